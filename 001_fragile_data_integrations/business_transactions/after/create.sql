@@ -14,7 +14,7 @@ CREATE TABLE "sagas" (
 );
 
 CREATE CHANGEFEED INTO 'kafka://redpanda:29092?topic_name=sagas'
-WITH kafka_sink_config='{"Flush": {"MaxMessages": 1, "Frequency": "100ms"}, "RequiredAcks": "ONE" }'
+WITH updated, resolved = '1s', min_checkpoint_frequency = '1s', kafka_sink_config='{"Flush": {"MaxMessages": 1, "Frequency": "100ms"}, "RequiredAcks": "ONE" }'
 AS
   SELECT
     "order_id",
@@ -26,6 +26,57 @@ AS
   FROM sagas
   WHERE NOT event_op() = 'delete';
 
+-- The status of each step of each saga. The saga row records the step
+-- that changed most recently, so the changefeed publishes every change.
+CREATE TABLE "saga_steps" (
+  "saga_key" STRING NOT NULL,
+  "step" STRING NOT NULL,
+  "status" STRING NOT NULL,
+  "error" STRING,
+
+  PRIMARY KEY ("saga_key", "step")
+);
+
+-- Every state change of every saga, written in the same transaction as
+-- the change itself.
+CREATE TABLE "saga_events" (
+  "saga_key" STRING NOT NULL,
+  "seq" INT NOT NULL DEFAULT unique_rowid(),
+  "step" STRING,
+  "step_status" STRING,
+  "from_status" STRING,
+  "status" STRING NOT NULL,
+  "error" STRING,
+  "ts" TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+  PRIMARY KEY ("saga_key", "seq")
+);
+
+-- Changefeed messages that have been processed, written in the same
+-- transaction as the step they triggered, so redeliveries are no-ops.
+-- Message IDs are the saga's key, the step and the MVCC timestamp of the
+-- saga row, which is why the changefeed above has the updated option.
+-- Messages are only redelivered until they're acknowledged, so entries
+-- expire long after the last redelivery could arrive.
+CREATE TABLE "saga_processed_messages" (
+  "message_id" STRING PRIMARY KEY,
+  "ts" TIMESTAMPTZ NOT NULL DEFAULT now()
+) WITH (
+  ttl_expiration_expression = '"ts" + INTERVAL ''7 days''',
+  ttl_job_cron = '@hourly'
+);
+
+-- Sagas with a step whose compensation ran out of retries, or whose
+-- changefeed message couldn't be handled.
+CREATE TABLE "saga_dead_letters" (
+  "saga_key" STRING PRIMARY KEY,
+  "step" STRING NOT NULL,
+  "status" STRING NOT NULL,
+  "error" STRING NOT NULL,
+  "attempts" INT NOT NULL,
+  "ts" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 -- Orders
 CREATE TYPE order_status AS ENUM ('in_progress', 'cancelled');
 
@@ -3,174 +3,94 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/saga"
 	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/segmentio/kafka-go"
 )
 
-func main() {
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
-	defer db.Close()
-
-	router := fiber.New()
-	router.Post("/sagas", createSaga(db))
-
-	go handleSagaMessages(db, newReader("localhost:9092", "sagas"))
-
-	log.Fatal(router.Listen(":3000"))
-}
-
-func handleSagaMessages(db *pgxpool.Pool, reader *kafka.Reader) {
-	defer reader.Close()
+var (
+	sagaTransitions = metrics.NewCounterVec("saga_step_transitions_total", "Saga state changes, by the step and status moved to.", "step", "status")
+)
 
-	for {
-		var s saga
-		commit, err := readAndParse(reader, &s)
-		if err != nil {
-			log.Printf("error fetching event: %v", err)
-			continue
-		}
+func main() {
+	replay := flag.Int("replay", 0, "replay each changefeed message of a new saga n times, check each step took effect once and exit")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
 
-		// Nothing to do.
-		if s.Status == sagaStatusCancelled || s.Status == sagaStatusFinished {
-			continue
-		}
+	db := connect.MustDatabase(cfg.Database.URL)
+	defer db.Close()
 
-		switch s.Step {
-		case sagaStepOrder:
-			if err := processOrder(db, s); err != nil {
-				log.Printf("error processing order: %v", err)
-				continue
-			}
-		case sagaStepPayment:
-			if err := processPayment(db, s); err != nil {
-				log.Printf("error processing payment: %v", err)
-				continue
-			}
-		case sagaStepReservation:
-			if err := processReservation(db, s); err != nil {
-				log.Printf("error processing reservations: %v", err)
-				continue
-			}
-		case sagaStepShipment:
-			if err := processShipment(db, s); err != nil {
-				log.Printf("error processing shipment: %v", err)
-				continue
-			}
-		default:
-			log.Printf("invalid saga step: %v", err)
-			continue
-		}
+	orchestrator := newOrchestrator(db)
 
-		if err := commit(); err != nil {
-			log.Printf("error committing event: %v", err)
-			continue
+	if *replay > 0 {
+		if err := replaySaga(context.Background(), db, orchestrator, *replay); err != nil {
+			log.Fatalf("replay failed: %v", err)
 		}
+		log.Println("replay passed")
+		return
 	}
-}
 
-func processOrder(db *pgxpool.Pool, s saga) error {
-	if s.failuresParsed.Orders {
-		return cancelSaga(db, s)
-	}
+	router := fiber.New()
+	router.Post("/sagas", createSaga(db, orchestrator))
+	router.Get("/sagas/:order_id", getSaga(orchestrator))
+	router.Get("/dead_letters", listDeadLetters(orchestrator))
+	router.Post("/dead_letters/:order_id/redrive", redriveDeadLetter(orchestrator))
 
-	switch s.Status {
-	case sagaStatusInProgress:
-		return createOrder(db, s)
-	case sagaStatusCancelling:
-		return cancelOrder(db, s)
-	default:
-		return fmt.Errorf("invalid status: %q", s.Status)
-	}
-}
+	source := changefeed.MustOpen(cfg.Changefeed.Source, cfg.Kafka.Brokers, "sagas")
+	defer source.Close()
 
-func processPayment(db *pgxpool.Pool, s saga) error {
-	if s.failuresParsed.Payments {
-		return cancelOrder(db, s)
-	}
-
-	switch s.Status {
-	case sagaStatusInProgress:
-		return createPayment(db, s)
-	case sagaStatusCancelling:
-		return cancelPayment(db, s)
-	default:
-		return fmt.Errorf("invalid status: %q", s.Status)
-	}
-}
+	metrics.GaugeFunc("saga_watermark_lag_seconds", "Time since the saga changefeed's resolved timestamp.", func() float64 {
+		return orchestrator.Watermark().Lag().Seconds()
+	})
 
-func processReservation(db *pgxpool.Pool, s saga) error {
-	if s.failuresParsed.Reservations {
-		return cancelPayment(db, s)
-	}
+	go func() {
+		if err := orchestrator.Run(context.Background(), source); err != nil {
+			log.Fatalf("error running saga orchestrator: %v", err)
+		}
+	}()
 
-	switch s.Status {
-	case sagaStatusInProgress:
-		return createReservation(db, s)
-	case sagaStatusCancelling:
-		return cancelReservation(db, s)
-	default:
-		return fmt.Errorf("invalid status: %q", s.Status)
-	}
+	log.Fatal(router.Listen(":3000"))
 }
 
-func processShipment(db *pgxpool.Pool, s saga) error {
-	if s.failuresParsed.Shipments {
-		return cancelReservation(db, s)
-	}
-
-	switch s.Status {
-	case sagaStatusInProgress:
-		return createShipment(db, s)
-	case sagaStatusCancelling:
-		return cancelShipment(db, s)
-	default:
-		return fmt.Errorf("invalid status: %q", s.Status)
-	}
+func newOrchestrator(db *pgxpool.Pool) *saga.Orchestrator[order] {
+	return saga.New[order](db, saga.OnTransition(func(t saga.Transition) {
+		sagaTransitions.WithLabelValues(t.Step, string(t.StepStatus)).Inc()
+	})).
+		AddStep("order", createOrder, cancelOrder).
+		AddStep("payment", createPayment, cancelPayment, saga.DependsOn("order")).
+		AddStep("reservation", createReservation, cancelReservation, saga.DependsOn("order")).
+		AddStep("shipment", createShipment, cancelShipment, saga.DependsOn("payment", "reservation"))
 }
 
 // **********
 // Structs **
 // **********
 
-type sagaStep string
-
-const (
-	sagaStepOrder       sagaStep = "order"
-	sagaStepPayment     sagaStep = "payment"
-	sagaStepReservation sagaStep = "reservation"
-	sagaStepShipment    sagaStep = "shipment"
-)
-
-type sagaStatus string
-
-const (
-	sagaStatusInProgress sagaStatus = "in_progress"
-	sagaStatusFinished   sagaStatus = "finished"
-	sagaStatusCancelling sagaStatus = "cancelling"
-	sagaStatusCancelled  sagaStatus = "cancelled"
-)
+type order struct {
+	OrderID  string    `json:"order_id"`
+	Payment  float64   `json:"payment"`
+	Products []product `json:"products"`
+	Failures failures  `json:"failures"`
+}
 
-type saga struct {
-	OrderID  string          `json:"order_id"`
-	Payment  float64         `json:"payment"`
-	Products json.RawMessage `json:"products"`
-	Step     sagaStep        `json:"step"`
-	Status   sagaStatus      `json:"status"`
-	Failures json.RawMessage `json:"failures"`
-
-	productsParsed []struct {
-		ID       string `json:"id"`
-		Quantity int    `json:"quantity"`
-	}
-	failuresParsed failures
+type product struct {
+	ID       string `json:"id"`
+	Quantity int    `json:"quantity"`
 }
 
 type failures struct {
@@ -184,19 +104,18 @@ type failures struct {
 // Database functions **
 // *********************
 
-func createSaga(db *pgxpool.Pool) fiber.Handler {
+func createSaga(db *pgxpool.Pool, orchestrator *saga.Orchestrator[order]) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		log.Println("[saga] create")
 
-		var s saga
-		if err := ctx.BodyParser(&s); err != nil {
+		var o order
+		if err := ctx.BodyParser(&o); err != nil {
 			log.Printf("invalid saga: %v", err)
 			return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid saga")
 		}
 
-		const stmt = `INSERT INTO sagas (order_id, payment, products, failures) VALUES ($1, $2, $3, $4)`
-		if _, err := db.Exec(ctx.Context(), stmt, s.OrderID, s.Payment, s.Products, s.Failures); err != nil {
-			log.Printf("inserting saga: %v", err)
+		if err := insertSaga(ctx.Context(), db, orchestrator, o); err != nil {
+			log.Printf("creating saga: %v", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "inserting saga")
 		}
 
@@ -204,241 +123,177 @@ func createSaga(db *pgxpool.Pool) fiber.Handler {
 	}
 }
 
-func cancelSaga(db *pgxpool.Pool, s saga) error {
-	log.Println("cancelling order")
+func insertSaga(ctx context.Context, db *pgxpool.Pool, orchestrator *saga.Orchestrator[order], o order) error {
+	products, err := json.Marshal(o.Products)
+	if err != nil {
+		return fmt.Errorf("marshalling products: %w", err)
+	}
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE sagas SET status = 'cancelled' WHERE order_id = $1`
+	failures, err := json.Marshal(o.Failures)
+	if err != nil {
+		return fmt.Errorf("marshalling failures: %w", err)
+	}
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepOrder, sagaStatusCancelled); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
+	return crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		const stmt = `INSERT INTO sagas (order_id, payment, products, failures) VALUES ($1, $2, $3, $4)`
+		if _, err := tx.Exec(ctx, stmt, o.OrderID, o.Payment, products, failures); err != nil {
+			return fmt.Errorf("inserting saga: %w", err)
 		}
 
-		return nil
+		return orchestrator.Started(ctx, tx, o.OrderID)
 	})
 }
 
-func createOrder(db *pgxpool.Pool, s saga) error {
-	log.Println("creating order")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO orders (id) VALUES ($1)`
-
-		// Insert order (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
+func getSaga(orchestrator *saga.Orchestrator[order]) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		state, err := orchestrator.Get(ctx.Context(), ctx.Params("order_id"))
+		if errors.Is(err, saga.ErrNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "saga not found")
 		}
-
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepPayment, sagaStatusInProgress); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
+		if err != nil {
+			log.Printf("getting saga: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "getting saga")
 		}
 
-		return nil
-	})
+		return ctx.JSON(state)
+	}
 }
 
-func cancelOrder(db *pgxpool.Pool, s saga) error {
-	log.Println("cancelling order")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE orders SET status = 'cancelled' WHERE id = $1`
-
-		// Insert order (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
-
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepOrder, sagaStatusCancelled); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
+func listDeadLetters(orchestrator *saga.Orchestrator[order]) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		letters, err := orchestrator.DeadLetters(ctx.Context())
+		if err != nil {
+			log.Printf("listing dead letters: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "listing dead letters")
 		}
 
-		return nil
-	})
+		return ctx.JSON(letters)
+	}
 }
 
-func createPayment(db *pgxpool.Pool, s saga) error {
-	log.Println("creating payment")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO payments (order_id, amount) VALUES ($1, $2)`
+func redriveDeadLetter(orchestrator *saga.Orchestrator[order]) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		orderID := ctx.Params("order_id")
+		log.Printf("[saga] redrive %s", orderID)
 
-		// Insert payment (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID, s.Payment); err != nil {
-			return fmt.Errorf("inserting payment: %w", err)
+		err := orchestrator.Redrive(ctx.Context(), orderID)
+		if errors.Is(err, saga.ErrNotDeadLettered) {
+			return fiber.NewError(fiber.StatusNotFound, "saga is not dead-lettered")
 		}
-
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepReservation, sagaStatusInProgress); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
+		if err != nil {
+			log.Printf("redriving saga: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "redriving saga")
 		}
 
 		return nil
-	})
+	}
 }
 
-func cancelPayment(db *pgxpool.Pool, s saga) error {
-	log.Println("cancelling payment")
+// Step functions run in the same transaction that moves the saga on, so if
+// one fails, the saga stays put and the orchestrator tries the step again,
+// with backoff, until it runs out of attempts.
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE payments SET status = 'cancelled' WHERE order_id = $1`
+func createOrder(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("creating order")
 
-		// Update payment (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if o.Failures.Orders {
+		return saga.Abort(errors.New("simulated order failure"))
+	}
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepOrder, sagaStatusCancelling); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
-		}
+	const stmt = `INSERT INTO orders (id) VALUES ($1)`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func createReservation(db *pgxpool.Pool, s saga) error {
-	log.Println("creating reservation")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO reservations (order_id, product_id, quantity) VALUES ($1, $2, $3)`
-
-		// Insert reservation (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		for _, r := range s.productsParsed {
-			if _, err := tx.Exec(context.Background(), stmt, s.OrderID, r.ID, r.Quantity); err != nil {
-				return fmt.Errorf("inserting reservation: %w", err)
-			}
-		}
+func cancelOrder(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("cancelling order")
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepShipment, sagaStatusInProgress); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
-		}
+	const stmt = `UPDATE orders SET status = 'cancelled' WHERE id = $1`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("cancelling order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelReservation(db *pgxpool.Pool, s saga) error {
-	log.Println("cancelling reservation")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `DELETE FROM reservations WHERE order_id = $1`
+func createPayment(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("creating payment")
 
-		// Delete reserved quantities (if it fails, don't update saga just yet, we might
-		// be able to try again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if o.Failures.Payments {
+		return saga.Abort(errors.New("simulated payment failure"))
+	}
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepPayment, sagaStatusCancelling); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
-		}
+	const stmt = `INSERT INTO payments (order_id, amount) VALUES ($1, $2)`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID, o.Payment); err != nil {
+		return fmt.Errorf("inserting payment: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func createShipment(db *pgxpool.Pool, s saga) error {
-	log.Println("creating shipment")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO shipments (order_id) VALUES ($1)`
-
-		// Insert shipment (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, s.OrderID); err != nil {
-			return fmt.Errorf("inserting payment: %w", err)
-		}
+func cancelPayment(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("cancelling payment")
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepShipment, sagaStatusFinished); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
-		}
+	const stmt = `UPDATE payments SET status = 'cancelled' WHERE order_id = $1`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("cancelling payment: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelShipment(db *pgxpool.Pool, s saga) error {
-	log.Println("cancelling shipment")
-
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE shipments SET status = 'cancelled' WHERE order_id = $1`
+func createReservation(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("creating reservation")
 
-		// Update payment (if it fails, don't update saga just yet, we might be able to try
-		// again when CockroachDB republishes the unacked message).
-		if _, err := tx.Exec(context.Background(), stmt, "cancelled", s.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if o.Failures.Reservations {
+		return saga.Abort(errors.New("simulated reservation failure"))
+	}
 
-		// Update saga.
-		if err := updateSaga(tx, s.OrderID, sagaStepReservation, sagaStatusCancelling); err != nil {
-			return fmt.Errorf("updating saga: %w", err)
+	const stmt = `INSERT INTO reservations (order_id, product_id, quantity) VALUES ($1, $2, $3)`
+	for _, p := range o.Products {
+		if _, err := tx.Exec(ctx, stmt, o.OrderID, p.ID, p.Quantity); err != nil {
+			return fmt.Errorf("inserting reservation: %w", err)
 		}
+	}
 
-		return nil
-	})
-}
-
-// **********
-// Helpers **
-// **********
-
-func newReader(url, topic string) *kafka.Reader {
-	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{url},
-		GroupID:     uuid.NewString(),
-		Topic:       topic,
-		StartOffset: kafka.LastOffset,
-	})
-
-	return kafkaReader
+	return nil
 }
 
-type commitFunc func() error
+func cancelReservation(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("cancelling reservation")
 
-func readAndParse(reader *kafka.Reader, s *saga) (commitFunc, error) {
-	msg, err := reader.FetchMessage(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("reading message: %w", err)
+	const stmt = `DELETE FROM reservations WHERE order_id = $1`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("deleting reservations: %w", err)
 	}
 
-	if err = json.Unmarshal(msg.Value, &s); err != nil {
-		return nil, fmt.Errorf("parsing message: %w", err)
-	}
+	return nil
+}
 
-	if err = json.Unmarshal(s.Products, &s.productsParsed); err != nil {
-		return nil, fmt.Errorf("parsing products: %w", err)
-	}
+func createShipment(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("creating shipment")
 
-	if err = json.Unmarshal(s.Failures, &s.failuresParsed); err != nil {
-		return nil, fmt.Errorf("parsing failures: %w", err)
+	if o.Failures.Shipments {
+		return saga.Abort(errors.New("simulated shipment failure"))
 	}
 
-	commit := func() error {
-		return reader.CommitMessages(context.Background(), msg)
+	const stmt = `INSERT INTO shipments (order_id) VALUES ($1)`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting shipment: %w", err)
 	}
 
-	return commit, nil
+	return nil
 }
 
-func updateSaga(tx pgx.Tx, orderID string, step sagaStep, status sagaStatus) error {
-	const stmt = `UPDATE sagas SET
-									step = $1,
-									status = $2
-								WHERE order_id = $3`
+func cancelShipment(ctx context.Context, tx pgx.Tx, o order) error {
+	log.Println("cancelling shipment")
 
-	if _, err := tx.Exec(context.Background(), stmt, step, status, orderID); err != nil {
-		return fmt.Errorf("updating saga: %w", err)
+	const stmt = `UPDATE shipments SET status = 'cancelled' WHERE order_id = $1`
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("cancelling shipment: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/saga"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// replaySaga creates a saga and walks it to completion by hand. At each
+// step it builds the message the changefeed would publish for the saga row
+// and handles it n times, simulating redeliveries, then checks that every
+// step took effect exactly once.
+//
+// Run it with the app stopped, so the changefeed consumer doesn't race it.
+func replaySaga(ctx context.Context, db *pgxpool.Pool, orchestrator *saga.Orchestrator[order], n int) error {
+	o := order{
+		OrderID: uuid.NewString(),
+		Payment: 26.97,
+		Products: []product{
+			{ID: uuid.NewString(), Quantity: 1},
+			{ID: uuid.NewString(), Quantity: 2},
+		},
+	}
+
+	log.Printf("replaying saga %s", o.OrderID)
+	if err := insertSaga(ctx, db, orchestrator, o); err != nil {
+		return fmt.Errorf("creating saga: %w", err)
+	}
+
+	// Independent steps run off the same message, so there's at most one
+	// message per step, plus the one for the finished saga. Each step and
+	// the saga's creation record one event.
+	const steps = 4
+	for i := 0; i <= steps; i++ {
+		msg, status, err := sagaMessage(ctx, db, o.OrderID)
+		if err != nil {
+			return err
+		}
+
+		if status == saga.StatusFinished {
+			break
+		}
+		if i == steps {
+			return fmt.Errorf("saga still %s after %d messages", status, steps)
+		}
+
+		for j := 0; j < n; j++ {
+			if err = orchestrator.Handle(ctx, msg); err != nil {
+				return fmt.Errorf("handling message %d of round %d: %w", j+1, i+1, err)
+			}
+		}
+	}
+
+	checks := []struct {
+		name string
+		stmt string
+		want int
+	}{
+		{name: "orders", stmt: `SELECT count(*) FROM orders WHERE id = $1`, want: 1},
+		{name: "payments", stmt: `SELECT count(*) FROM payments WHERE order_id = $1`, want: 1},
+		{name: "reservations", stmt: `SELECT count(*) FROM reservations WHERE order_id = $1`, want: len(o.Products)},
+		{name: "shipments", stmt: `SELECT count(*) FROM shipments WHERE order_id = $1`, want: 1},
+		{name: "saga events", stmt: `SELECT count(*) FROM saga_events WHERE saga_key = $1`, want: steps + 1},
+	}
+
+	var errs []error
+	for _, c := range checks {
+		var got int
+		if err := db.QueryRow(ctx, c.stmt, o.OrderID).Scan(&got); err != nil {
+			return fmt.Errorf("counting %s: %w", c.name, err)
+		}
+
+		log.Printf("%s: %d (want %d)", c.name, got, c.want)
+		if got != c.want {
+			errs = append(errs, fmt.Errorf("%s: got %d, want %d", c.name, got, c.want))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sagaMessage returns the changefeed message for the current state of a
+// saga row, shaped as the changefeed in create.sql publishes it, with the
+// row's MVCC timestamp as its updated timestamp.
+func sagaMessage(ctx context.Context, db *pgxpool.Pool, orderID string) ([]byte, saga.Status, error) {
+	const stmt = `SELECT
+									json_build_object(
+										'order_id', order_id,
+										'payment', payment,
+										'products', products,
+										'status', status,
+										'step', step,
+										'failures', failures,
+										'__crdb__', json_build_object('updated', crdb_internal_mvcc_timestamp::STRING)
+									)::STRING,
+									status::STRING
+								FROM sagas
+								WHERE order_id = $1`
+
+	var msg string
+	var status saga.Status
+	if err := db.QueryRow(ctx, stmt, orderID).Scan(&msg, &status); err != nil {
+		return nil, "", fmt.Errorf("building saga message: %w", err)
+	}
+
+	return []byte(msg), status, nil
+}
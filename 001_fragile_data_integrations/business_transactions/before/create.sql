@@ -1,3 +1,17 @@
+-- Workflow log, recording how far each order has got so a restarted
+-- service can resume or compensate it.
+CREATE TABLE "workflows" (
+  "order_id" UUID PRIMARY KEY,
+  "body" JSONB NOT NULL,
+  "step" INT NOT NULL DEFAULT 0,
+  "status" STRING NOT NULL DEFAULT 'in_progress',
+  "cancelled" INT NOT NULL DEFAULT 0,
+  "error" STRING,
+  "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+  INDEX ("status", "updated_at")
+);
+
 -- Orders
 CREATE TYPE order_status AS ENUM ('in_progress', 'cancelled');
 
@@ -3,20 +3,37 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
-	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ordersProcessed = metrics.NewCounterVec("orders_processed_total", "Orders processed, by outcome (created, cancelled or failed).", "outcome")
+)
+
 func main() {
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	flag.StringVar(&crashAfter, "crash-after", "", "exit once the named step (order, payment, reservation or shipment) has been created, to test recovery")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
+	if err := recoverWorkflows(context.Background(), db); err != nil {
+		log.Fatalf("error recovering workflows: %v", err)
+	}
+
 	router := fiber.New()
 	router.Post("/orders", handleCreateOrder(db))
 
@@ -33,49 +50,28 @@ func handleCreateOrder(db *pgxpool.Pool) fiber.Handler {
 			return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid order")
 		}
 
-		if err := json.Unmarshal(o.Products, &o.productsParsed); err != nil {
-			log.Printf("parsing products: %v", err)
-			return fiber.NewError(fiber.StatusUnprocessableEntity, "parsing products")
+		if err := o.parse(); err != nil {
+			log.Printf("%v", err)
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid order")
 		}
 
-		if err := json.Unmarshal(o.Failures, &o.failuresParsed); err != nil {
-			log.Printf("parsing failures: %v", err)
-			return fiber.NewError(fiber.StatusUnprocessableEntity, "parsing failures")
+		// Log the workflow before running any of it, so it can be resumed
+		// or compensated if the process dies part way through.
+		if err := startWorkflow(ctx.UserContext(), db, o); err != nil {
+			log.Printf("starting workflow: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "starting workflow")
 		}
 
-		// Build creation/cancellation workflows.
-		functions := []createCancel{
-			{
-				create: createOrder,
-			},
-			{
-				create:  createPayment,
-				cancels: []dbFunc{cancelOrder},
-			},
-			{
-				create:  createReservation,
-				cancels: []dbFunc{cancelPayment, cancelOrder},
-			},
-			{
-				create:  createShipment,
-				cancels: []dbFunc{cancelReservation, cancelPayment, cancelOrder},
-			},
+		status, err := runWorkflow(ctx.UserContext(), db, o.OrderID)
+		if err != nil {
+			log.Printf("running workflow: %v", err)
+			ordersProcessed.WithLabelValues("failed").Inc()
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "cancelling order")
 		}
 
-		for _, f := range functions {
-			// Attempt to create.
-			if err := f.create(db, o); err != nil {
-				log.Printf("creating order: %v", err)
-
-				// Attempt to unwind.
-				for _, cf := range f.cancels {
-					if err := cf(db, o); err != nil {
-						log.Printf("cancelling order: %v", err)
-						return fiber.NewError(fiber.StatusUnprocessableEntity, "cancelling order")
-					}
-				}
-				return fiber.NewError(fiber.StatusUnprocessableEntity, "creating order")
-			}
+		recordOutcome(status)
+		if status == workflowCancelled {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "creating order")
 		}
 
 		return nil
@@ -99,6 +95,18 @@ type order struct {
 	failuresParsed failures
 }
 
+func (o *order) parse() error {
+	if err := json.Unmarshal(o.Products, &o.productsParsed); err != nil {
+		return fmt.Errorf("parsing products: %w", err)
+	}
+
+	if err := json.Unmarshal(o.Failures, &o.failuresParsed); err != nil {
+		return fmt.Errorf("parsing failures: %w", err)
+	}
+
+	return nil
+}
+
 type failures struct {
 	Orders       bool `json:"orders"`
 	Payments     bool `json:"payments"`
@@ -111,138 +119,148 @@ type failures struct {
 // *********************
 
 type createCancel struct {
+	name    string
 	create  dbFunc
 	cancels []dbFunc
 }
 
-type dbFunc func(*pgxpool.Pool, order) error
+type dbFunc func(context.Context, pgx.Tx, order) error
+
+// workflowSteps returns the creation/cancellation workflow for an order.
+func workflowSteps() []createCancel {
+	return []createCancel{
+		{
+			name:   "order",
+			create: createOrder,
+		},
+		{
+			name:    "payment",
+			create:  createPayment,
+			cancels: []dbFunc{cancelOrder},
+		},
+		{
+			name:    "reservation",
+			create:  createReservation,
+			cancels: []dbFunc{cancelPayment, cancelOrder},
+		},
+		{
+			name:    "shipment",
+			create:  createShipment,
+			cancels: []dbFunc{cancelReservation, cancelPayment, cancelOrder},
+		},
+	}
+}
 
-func createOrder(db *pgxpool.Pool, o order) error {
+func createOrder(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("creating order")
 
 	if o.failuresParsed.Orders {
 		return fmt.Errorf("mocked error creating order")
 	}
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO orders (id) VALUES ($1)`
+	const stmt = `INSERT INTO orders (id) VALUES ($1)`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelOrder(db *pgxpool.Pool, o order) error {
+func cancelOrder(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("cancelling order")
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE orders SET status = 'cancelled' WHERE id = $1`
+	const stmt = `UPDATE orders SET status = 'cancelled' WHERE id = $1`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func createPayment(db *pgxpool.Pool, o order) error {
+func createPayment(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("creating payment")
 
 	if o.failuresParsed.Payments {
 		return fmt.Errorf("mocked error creating payment")
 	}
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO payments (order_id, amount) VALUES ($1, $2)`
+	const stmt = `INSERT INTO payments (order_id, amount) VALUES ($1, $2)`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID, o.Payment); err != nil {
-			return fmt.Errorf("inserting payment: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID, o.Payment); err != nil {
+		return fmt.Errorf("inserting payment: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelPayment(db *pgxpool.Pool, o order) error {
+func cancelPayment(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("cancelling payment")
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE payments SET status = 'cancelled' WHERE order_id = $1`
+	const stmt = `UPDATE payments SET status = 'cancelled' WHERE order_id = $1`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func createReservation(db *pgxpool.Pool, o order) error {
+func createReservation(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("creating reservation")
 
 	if o.failuresParsed.Reservations {
 		return fmt.Errorf("mocked error creating reservations")
 	}
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO reservations (order_id, product_id, quantity) VALUES ($1, $2, $3)`
+	const stmt = `INSERT INTO reservations (order_id, product_id, quantity) VALUES ($1, $2, $3)`
 
-		for _, r := range o.productsParsed {
-			if _, err := tx.Exec(context.Background(), stmt, o.OrderID, r.ID, r.Quantity); err != nil {
-				return fmt.Errorf("inserting reservation: %w", err)
-			}
+	for _, r := range o.productsParsed {
+		if _, err := tx.Exec(ctx, stmt, o.OrderID, r.ID, r.Quantity); err != nil {
+			return fmt.Errorf("inserting reservation: %w", err)
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelReservation(db *pgxpool.Pool, o order) error {
+func cancelReservation(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("cancelling reservation")
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `DELETE FROM reservations WHERE order_id = $1`
+	const stmt = `DELETE FROM reservations WHERE order_id = $1`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func createShipment(db *pgxpool.Pool, o order) error {
+func createShipment(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("creating shipment")
 
 	if o.failuresParsed.Shipments {
 		return fmt.Errorf("mocked error creating shipment")
 	}
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `INSERT INTO shipments (order_id) VALUES ($1)`
+	const stmt = `INSERT INTO shipments (order_id) VALUES ($1)`
 
-		if _, err := tx.Exec(context.Background(), stmt, o.OrderID); err != nil {
-			return fmt.Errorf("inserting payment: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting payment: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func cancelShipment(db *pgxpool.Pool, o order) error {
+func cancelShipment(ctx context.Context, tx pgx.Tx, o order) error {
 	log.Println("cancelling shipment")
 
-	return crdbpgx.ExecuteTx(context.Background(), db, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		const stmt = `UPDATE shipments SET status = 'cancelled' WHERE order_id = $1`
+	const stmt = `UPDATE shipments SET status = 'cancelled' WHERE order_id = $1`
 
-		if _, err := tx.Exec(context.Background(), stmt, "cancelled", o.OrderID); err != nil {
-			return fmt.Errorf("inserting order: %w", err)
-		}
+	if _, err := tx.Exec(ctx, stmt, o.OrderID); err != nil {
+		return fmt.Errorf("inserting order: %w", err)
+	}
 
-		return nil
-	})
+	return nil
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Workflow statuses, as stored in the workflows table.
+const (
+	workflowInProgress   = "in_progress"
+	workflowCompensating = "compensating"
+	workflowFinished     = "finished"
+	workflowCancelled    = "cancelled"
+)
+
+// workflow is an order's entry in the workflow log. Step is the index of
+// the next create to run, or of the create that failed once the workflow
+// is compensating, in which case Cancelled counts the cancels that have
+// run so far.
+type workflow struct {
+	Order     order
+	Step      int
+	Status    string
+	Cancelled int
+}
+
+// errWorkflowMoved rolls back a transaction whose workflow has been
+// advanced by another process since it was read.
+var errWorkflowMoved = errors.New("workflow has moved on")
+
+// Transient errors creating an order are retried with backoff before the
+// workflow gives up and compensates. Failed cancels are retried with the
+// same backoff, as an order can't be left half cancelled; if they keep
+// failing, the workflow is left compensating for recoverWorkflows.
+const (
+	maxCreateAttempts     = 5
+	maxCompensateAttempts = 10
+	initialBackoff        = time.Millisecond * 100
+	maxBackoff            = time.Second * 2
+)
+
+// crashAfter, if set, exits the process once the named step has been
+// created, leaving its workflow in flight for the next run to recover.
+var crashAfter string
+
+// startWorkflow records a new order in the workflow log.
+func startWorkflow(ctx context.Context, db *pgxpool.Pool, o order) error {
+	body, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("marshalling order: %w", err)
+	}
+
+	const stmt = `INSERT INTO workflows (order_id, body) VALUES ($1, $2)`
+	if _, err = db.Exec(ctx, stmt, o.OrderID, body); err != nil {
+		return fmt.Errorf("inserting workflow: %w", err)
+	}
+
+	return nil
+}
+
+// runWorkflow advances an order's workflow until it's finished or
+// cancelled. Each create or cancel commits in the same transaction as the
+// workflow's new position, so a process that dies part way leaves the log
+// pointing at exactly the work left to do.
+//
+// A create that fails with a transient error is retried, re-reading the
+// workflow first in case the failed attempt committed after all. Only
+// other errors, or transient ones that persist, cancel the order. A
+// failed cancel is retried whatever the error.
+func runWorkflow(ctx context.Context, db *pgxpool.Pool, orderID string) (string, error) {
+	attempt, backoff := 1, initialBackoff
+	retry := func(what string, err error) error {
+		log.Printf("%s (attempt %d, retrying in %s): %v", what, attempt, backoff, err)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		attempt, backoff = attempt+1, min(backoff*2, maxBackoff)
+		return nil
+	}
+
+	for {
+		w, err := getWorkflow(ctx, db, orderID)
+		if err != nil {
+			return "", err
+		}
+
+		switch w.Status {
+		case workflowFinished, workflowCancelled:
+			return w.Status, nil
+
+		case workflowInProgress:
+			err = advance(ctx, db, w)
+			if errors.Is(err, errWorkflowMoved) {
+				continue
+			}
+			if err == nil {
+				attempt, backoff = 1, initialBackoff
+				continue
+			}
+
+			if transient(err) && attempt < maxCreateAttempts {
+				if err = retry("creating order", err); err != nil {
+					return "", err
+				}
+				continue
+			}
+
+			log.Printf("creating order: %v", err)
+			if err = fail(ctx, db, w, err); err != nil && !errors.Is(err, errWorkflowMoved) {
+				return "", err
+			}
+			attempt, backoff = 1, initialBackoff
+
+		case workflowCompensating:
+			err = compensate(ctx, db, w)
+			if err == nil || errors.Is(err, errWorkflowMoved) {
+				continue
+			}
+
+			if attempt < maxCompensateAttempts {
+				if err = retry("cancelling order", err); err != nil {
+					return w.Status, err
+				}
+				continue
+			}
+
+			return w.Status, err
+
+		default:
+			return "", fmt.Errorf("unknown workflow status %q", w.Status)
+		}
+	}
+}
+
+// transient reports whether err is likely to succeed if retried: a
+// transaction that kept failing to serialize or whose commit is unknown,
+// or a connection that failed before the statement reached the database.
+func transient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40003":
+			return true
+		}
+		return false
+	}
+
+	return pgconn.SafeToRetry(err)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// advance runs the workflow's next create.
+func advance(ctx context.Context, db *pgxpool.Pool, w workflow) error {
+	steps := workflowSteps()
+	err := crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		if err := steps[w.Step].create(ctx, tx, w.Order); err != nil {
+			return err
+		}
+
+		status := workflowInProgress
+		if w.Step == len(steps)-1 {
+			status = workflowFinished
+		}
+
+		return moveWorkflow(ctx, tx, w, w.Step+1, status, 0, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	if crashAfter == steps[w.Step].name {
+		log.Printf("crashing after %s", crashAfter)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// fail switches the workflow to compensating the step that failed.
+func fail(ctx context.Context, db *pgxpool.Pool, w workflow, cause error) error {
+	return crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return moveWorkflow(ctx, tx, w, w.Step, workflowCompensating, 0, cause.Error())
+	})
+}
+
+// compensate runs the remaining cancels of the step that failed, one
+// transaction each.
+func compensate(ctx context.Context, db *pgxpool.Pool, w workflow) error {
+	cancels := workflowSteps()[w.Step].cancels
+
+	for i := w.Cancelled; i < len(cancels); i++ {
+		status := workflowCompensating
+		if i == len(cancels)-1 {
+			status = workflowCancelled
+		}
+
+		err := crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			if err := cancels[i](ctx, tx, w.Order); err != nil {
+				return err
+			}
+
+			return moveWorkflow(ctx, tx, w, w.Step, status, i+1, "")
+		})
+		if err != nil {
+			return fmt.Errorf("cancelling order: %w", err)
+		}
+		w.Status, w.Cancelled = status, i+1
+	}
+
+	// Nothing to undo if the first step failed.
+	if len(cancels) == 0 {
+		return crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			return moveWorkflow(ctx, tx, w, w.Step, workflowCancelled, 0, "")
+		})
+	}
+
+	return nil
+}
+
+// moveWorkflow updates a workflow's position, provided it hasn't moved
+// since w was read.
+func moveWorkflow(ctx context.Context, tx pgx.Tx, w workflow, step int, status string, cancelled int, cause string) error {
+	const stmt = `UPDATE workflows
+								SET step = $1, status = $2, cancelled = $3, error = COALESCE(NULLIF($4, ''), error), updated_at = now()
+								WHERE order_id = $5 AND step = $6 AND status = $7 AND cancelled = $8`
+
+	result, err := tx.Exec(ctx, stmt, step, status, cancelled, cause, w.Order.OrderID, w.Step, w.Status, w.Cancelled)
+	if err != nil {
+		return fmt.Errorf("updating workflow: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return errWorkflowMoved
+	}
+
+	return nil
+}
+
+func getWorkflow(ctx context.Context, db *pgxpool.Pool, orderID string) (workflow, error) {
+	const stmt = `SELECT body, step, status, cancelled FROM workflows WHERE order_id = $1`
+
+	var w workflow
+	var body []byte
+	if err := db.QueryRow(ctx, stmt, orderID).Scan(&body, &w.Step, &w.Status, &w.Cancelled); err != nil {
+		return workflow{}, fmt.Errorf("getting workflow: %w", err)
+	}
+
+	if err := json.Unmarshal(body, &w.Order); err != nil {
+		return workflow{}, fmt.Errorf("parsing workflow order: %w", err)
+	}
+
+	if err := w.Order.parse(); err != nil {
+		return workflow{}, err
+	}
+
+	return w, nil
+}
+
+// recoverWorkflows resumes every workflow left in flight by a previous
+// run: orders part way through being created carry on, and orders part
+// way through being cancelled finish cancelling.
+func recoverWorkflows(ctx context.Context, db *pgxpool.Pool) error {
+	const stmt = `SELECT order_id::STRING FROM workflows WHERE status IN ($1, $2) ORDER BY updated_at`
+
+	rows, err := db.Query(ctx, stmt, workflowInProgress, workflowCompensating)
+	if err != nil {
+		return fmt.Errorf("querying in-flight workflows: %w", err)
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("scanning in-flight workflows: %w", err)
+	}
+
+	for _, id := range ids {
+		log.Printf("[order] recovering %s", id)
+
+		status, err := runWorkflow(ctx, db, id)
+		if err != nil {
+			log.Printf("error recovering order %s: %v", id, err)
+			ordersProcessed.WithLabelValues("failed").Inc()
+			continue
+		}
+
+		recordOutcome(status)
+	}
+
+	return nil
+}
+
+func recordOutcome(status string) {
+	switch status {
+	case workflowFinished:
+		ordersProcessed.WithLabelValues("created").Inc()
+	case workflowCancelled:
+		ordersProcessed.WithLabelValues("cancelled").Inc()
+	}
+}
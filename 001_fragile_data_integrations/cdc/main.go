@@ -2,70 +2,124 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/segmentio/kafka-go"
 )
 
 var (
-	paymentsMu sync.Mutex
-	payments   = make(map[string]time.Time)
+	messagesPublished = stats.NewCounter()
+	delays            = metrics.NewLatency("cdc_delay_seconds", "Time between a payment being inserted and its event being consumed.", 1000)
+	freshness         = metrics.NewLatency("cdc_freshness_seconds", "Time between a point in time and every change before it being consumed.", 1000)
 
-	messagesPublished uint64
-	avgDelay          = rollingAverage(50)
+	watermark *changefeed.Watermark
+	verify    *verifier
+	decoder   *changefeed.Decoder
 )
 
 func main() {
-	url := flag.String("url", "", "connection string")
-	flag.Parse()
+	verifyMode := flag.Bool("verify", false, "also update payments and print a summary of missing, duplicate and out-of-order events")
+	deadline := flag.Duration("deadline", time.Second*30, "how long to wait for a payment's event before reporting it missing")
+	lostAfter := flag.Duration("lost-after", time.Minute*10, "how long to keep waiting for a missing payment's event before counting it as lost")
+	cfg := config.MustLoad(config.Config{
+		Kafka:   config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.CounterFunc("cdc_payments_published_total", "Payments inserted into the database.", func() float64 {
+		return float64(messagesPublished.Load())
+	})
 
-	db := connect.MustDatabase(*url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
-	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
-		GroupID:     uuid.NewString(),
-		Topic:       "events.public.payment",
-		StartOffset: kafka.LastOffset,
+	decoder = changefeed.MustDecoder(cfg.Changefeed.Format, cfg.Changefeed.Registry)
+
+	source := changefeed.MustOpen(cfg.Changefeed.Source, cfg.Kafka.Brokers, "events.public.payment")
+	defer source.Close()
+
+	var partitions int
+	if cfg.Changefeed.Source == "" {
+		var err error
+		if partitions, err = changefeed.KafkaPartitions(context.Background(), cfg.Kafka.Brokers, "events.public.payment"); err != nil {
+			log.Printf("error reading topic partitions: %v", err)
+		}
+	}
+	watermark = changefeed.NewWatermark(partitions)
+	metrics.GaugeFunc("cdc_watermark_lag_seconds", "Time since the changefeed's resolved timestamp.", func() float64 {
+		return watermark.Lag().Seconds()
 	})
 
-	go consumePayments(kafkaReader)
-	work(db)
+	if *verifyMode {
+		verify = newVerifier(*deadline, *lostAfter)
+		go func() {
+			for range time.NewTicker(time.Second).C {
+				verify.sweep(watermark.Resolved())
+			}
+		}()
+	}
+
+	go consumePayments(source, *verifyMode)
+	go measureFreshness()
+	work(db, *verifyMode)
 }
 
-func work(db *pgxpool.Pool) {
+func work(db *pgxpool.Pool, updates bool) {
 	for range time.NewTicker(time.Millisecond * 100).C {
 		if err := insertPayment(db); err != nil {
 			log.Printf("error inserting payment: %v", err)
 		}
+
+		// Give the verifier something to order.
+		if updates && rand.Intn(5) == 0 {
+			if err := updatePayment(db); err != nil {
+				log.Printf("error updating payment: %v", err)
+			}
+		}
 	}
 }
 
 func insertPayment(db *pgxpool.Pool) error {
-	paymentsMu.Lock()
-	defer paymentsMu.Unlock()
-
 	id := uuid.NewString()
 	now := time.Now()
-	payments[id] = now
+
+	// Track the payment before inserting it, so its event can't arrive
+	// first.
+	verify.insert(id, now)
 
 	const stmt = `INSERT INTO payment (id, amount, ts) VALUES ($1, $2, $3)`
 	if _, err := db.Exec(context.Background(), stmt, id, round(rand.Float64()*100, 2), now); err != nil {
+		verify.forget(id)
 		return fmt.Errorf("inserting payment: %w", err)
 	}
 
-	atomic.AddUint64(&messagesPublished, 1)
+	messagesPublished.Inc()
+	return nil
+}
+
+func updatePayment(db *pgxpool.Pool) error {
+	id, ok := verify.recent()
+	if !ok {
+		return nil
+	}
+
+	const stmt = `UPDATE payment SET amount = $1 WHERE id = $2`
+	if _, err := db.Exec(context.Background(), stmt, round(rand.Float64()*100, 2), id); err != nil {
+		return fmt.Errorf("updating payment: %w", err)
+	}
+
 	return nil
 }
 
@@ -73,60 +127,95 @@ func round(val float64, precision int) float64 {
 	return math.Round(val*(math.Pow10(precision))) / math.Pow10(precision)
 }
 
-type paymentEvent struct {
-	After struct {
-		ID     string    `json:"id"`
-		Amount float64   `json:"amount"`
-		TS     time.Time `json:"ts"`
-	} `json:"after"`
+type payment struct {
+	ID     string    `json:"id"`
+	Amount float64   `json:"amount"`
+	TS     time.Time `json:"ts"`
 }
 
-func consumePayments(reader *kafka.Reader) {
+func consumePayments(source changefeed.Source, summary bool) {
 	for {
-		msg, err := reader.ReadMessage(context.Background())
+		msg, err := source.Fetch(context.Background())
+		if errors.Is(err, changefeed.ErrClosed) {
+			log.Printf("no more messages")
+			return
+		}
 		if err != nil {
 			log.Printf("error reading message: %v", err)
 			continue
 		}
 
-		if err = compareAndPrint(msg); err != nil {
+		if err = compareAndPrint(msg, summary); err != nil {
 			log.Printf("error comparing message: %v", err)
+			msg.Nack(err)
 			continue
 		}
+
+		if err = msg.Ack(context.Background()); err != nil {
+			log.Printf("error acknowledging message: %v", err)
+		}
 	}
 }
 
-func compareAndPrint(msg kafka.Message) error {
-	var pe paymentEvent
-	if err := json.Unmarshal(msg.Value, &pe); err != nil {
+func compareAndPrint(msg changefeed.Message, summary bool) error {
+	_, value, err := decoder.JSON(context.Background(), msg)
+	if err != nil {
+		return fmt.Errorf("decoding event: %w", err)
+	}
+
+	// Debezium's keys aren't arrays, and the key's in the value anyway.
+	e, err := changefeed.Decode[payment](nil, value, changefeed.EnvelopeWrapped)
+	if err != nil {
 		return fmt.Errorf("parsing event: %w", err)
 	}
 
-	paymentsMu.Lock()
-	defer paymentsMu.Unlock()
+	if e.IsResolved() {
+		watermark.Observe(msg.Partition, e.Resolved)
+		return nil
+	}
 
-	delete(payments, pe.After.ID)
+	// Deletes carry the row's before image, if anything, which is checked
+	// like any other version of the payment.
+	row := e.After
+	if e.IsDelete() {
+		row = e.Before
+	}
+	if row == nil {
+		return nil
+	}
 
-	diff := time.Since(pe.After.TS)
-	fmt.Printf("average delay: %s (%d messages)\n", avgDelay(diff), atomic.LoadUint64(&messagesPublished))
+	// Updates carry the payment's original timestamp, so only inserts
+	// measure delay.
+	if verify.receive(row.ID, eventVersion(e, value)) && !e.IsDelete() {
+		delays.Record(time.Since(row.TS))
+	}
+
+	fmt.Printf("delay: %s freshness: %s (%d messages published)\n", delays.Snapshot(), freshness.Snapshot(), messagesPublished.Load())
+	if summary {
+		fmt.Println(verify.summary())
+	}
 	return nil
 }
 
-func rollingAverage(period int) func(time.Duration) time.Duration {
-	var i int
-	var sum time.Duration
-	var storage = make([]time.Duration, 0, period)
-
-	return func(input time.Duration) (avrg time.Duration) {
-		if len(storage) < period {
-			sum += input
-			storage = append(storage, input)
+// measureFreshness waits for the changefeed to resolve each second in
+// turn, measuring how long it takes for every change up to that point to
+// arrive, rather than just the latency of individual messages. It only
+// reports anything for changefeeds with the resolved option.
+func measureFreshness() {
+	for range time.NewTicker(time.Second).C {
+		if watermark.Resolved().IsZero() {
+			continue
 		}
 
-		sum += input - storage[i]
-		storage[i], i = input, (i+1)%period
-		avrg = sum / time.Duration(len(storage))
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := watermark.WaitFor(ctx, changefeed.FromTime(start))
+		cancel()
+		if err != nil {
+			log.Printf("error waiting for changefeed to resolve: %v", err)
+			continue
+		}
 
-		return
+		freshness.Record(time.Since(start))
 	}
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+)
+
+var verifyResults = metrics.NewCounterVec("cdc_verify_events_total", "Changefeed correctness checks, by result (received, duplicate, regression, missing, late or lost).", "result")
+
+// version orders the events of a payment: by MVCC timestamp (or updated
+// timestamp) for CockroachDB changefeeds, or by the log sequence number of
+// the change for Debezium.
+type version struct {
+	ts  changefeed.Timestamp
+	lsn int64
+}
+
+// eventVersion returns an event's version. value is the decoded message,
+// which for Debezium holds the change's position under "source".
+func eventVersion(e changefeed.Event[payment], value []byte) version {
+	ts := e.MVCCTimestamp
+	if ts.IsZero() {
+		ts = e.Updated
+	}
+	if !ts.IsZero() {
+		return version{ts: ts}
+	}
+
+	var debezium struct {
+		Source struct {
+			LSN int64 `json:"lsn"`
+		} `json:"source"`
+	}
+	if err := json.Unmarshal(value, &debezium); err != nil {
+		return version{}
+	}
+
+	return version{lsn: debezium.Source.LSN}
+}
+
+func (v version) isZero() bool {
+	return v.ts.IsZero() && v.lsn == 0
+}
+
+func (v version) less(o version) bool {
+	if !v.ts.IsZero() || !o.ts.IsZero() {
+		return v.ts.Less(o.ts)
+	}
+
+	return v.lsn < o.lsn
+}
+
+func (v version) String() string {
+	if !v.ts.IsZero() {
+		return v.ts.String()
+	}
+
+	return "lsn:" + strconv.FormatInt(v.lsn, 10)
+}
+
+// seen is a version and when its event arrived.
+type seen struct {
+	version version
+	at      time.Time
+}
+
+// verifier tracks every inserted payment until its event arrives, flagging
+// payments that don't arrive in time, events that arrive more than once
+// and updates that arrive out of order.
+//
+// A nil verifier verifies nothing, and treats every event as the first
+// for its payment, as only the verifier updates payments.
+type verifier struct {
+	mu        sync.Mutex
+	deadline  time.Duration
+	lostAfter time.Duration
+
+	// pending holds payments that have been inserted but not yet seen.
+	pending map[string]time.Time
+	// missing holds payments that weren't seen before the deadline, and
+	// when they were flagged. They're counted as lost and forgotten by
+	// sweep if they still haven't been seen after lostAfter.
+	missing map[string]time.Time
+	// latest holds the newest version seen of each payment, and versions
+	// every version seen of each payment, keyed by id@version. Both are
+	// pruned by sweep.
+	latest   map[string]seen
+	versions map[string]seen
+
+	inserted, received, duplicates, regressions, missed, late, lost int
+}
+
+func newVerifier(deadline, lostAfter time.Duration) *verifier {
+	return &verifier{
+		deadline:  deadline,
+		lostAfter: lostAfter,
+		pending:   map[string]time.Time{},
+		missing:   map[string]time.Time{},
+		latest:    map[string]seen{},
+		versions:  map[string]seen{},
+	}
+}
+
+// insert records a payment written to the database.
+func (v *verifier) insert(id string, ts time.Time) {
+	if v == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.pending[id] = ts
+	v.inserted++
+}
+
+// forget stops tracking a payment that failed to insert.
+func (v *verifier) forget(id string) {
+	if v == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.pending, id)
+	v.inserted--
+}
+
+// receive records an event for a payment, returning true if it's the
+// first event for a pending payment. Events without a version can't be
+// checked for duplicates or regressions.
+func (v *verifier) receive(id string, ver version) bool {
+	if v == nil {
+		return true
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.received++
+	verifyResults.WithLabelValues("received").Inc()
+
+	_, first := v.pending[id]
+	delete(v.pending, id)
+	if _, ok := v.missing[id]; ok {
+		delete(v.missing, id)
+		v.late++
+		verifyResults.WithLabelValues("late").Inc()
+	}
+
+	if ver.isZero() {
+		return first
+	}
+	now := time.Now()
+
+	key := id + "@" + ver.String()
+	if _, ok := v.versions[key]; ok {
+		v.duplicates++
+		verifyResults.WithLabelValues("duplicate").Inc()
+		return false
+	}
+	v.versions[key] = seen{version: ver, at: now}
+
+	if latest, ok := v.latest[id]; ok && ver.less(latest.version) {
+		v.regressions++
+		verifyResults.WithLabelValues("regression").Inc()
+		return first
+	}
+	v.latest[id] = seen{version: ver, at: now}
+
+	return first
+}
+
+// sweep flags payments that have been pending for longer than the
+// deadline as missing, counts those missing for longer than lostAfter as
+// lost, and forgets versions that can no longer be
+// redelivered: those older than the deadline that the changefeed has
+// since resolved. Without resolved timestamps, as with Debezium, versions
+// are forgotten once they're older than the deadline.
+func (v *verifier) sweep(resolved changefeed.Timestamp) {
+	if v == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for id, ts := range v.pending {
+		if time.Since(ts) < v.deadline {
+			continue
+		}
+
+		delete(v.pending, id)
+		v.missing[id] = time.Now()
+		v.missed++
+		verifyResults.WithLabelValues("missing").Inc()
+	}
+
+	for id, at := range v.missing {
+		if time.Since(at) < v.lostAfter {
+			continue
+		}
+
+		delete(v.missing, id)
+		v.lost++
+		verifyResults.WithLabelValues("lost").Inc()
+	}
+
+	expired := func(s seen) bool {
+		if time.Since(s.at) < v.deadline {
+			return false
+		}
+		if resolved.IsZero() || s.version.ts.IsZero() {
+			return true
+		}
+		return s.version.ts.Less(resolved)
+	}
+
+	for key, s := range v.versions {
+		if expired(s) {
+			delete(v.versions, key)
+		}
+	}
+	for id, s := range v.latest {
+		if expired(s) {
+			delete(v.latest, id)
+		}
+	}
+}
+
+// recent returns the id of a payment that has already been seen, for
+// updating.
+func (v *verifier) recent() (string, bool) {
+	if v == nil {
+		return "", false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for id := range v.latest {
+		return id, true
+	}
+
+	return "", false
+}
+
+func (v *verifier) summary() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return fmt.Sprintf(
+		"inserted: %d received: %d pending: %d missing: %d (late: %d, lost: %d) duplicates: %d regressions: %d tracked: %d",
+		v.inserted, v.received, len(v.pending), v.missed-v.late, v.late, v.lost, v.duplicates, v.regressions, len(v.versions),
+	)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+)
+
+func TestVerifierLate(t *testing.T) {
+	v := newVerifier(time.Second, time.Hour)
+
+	v.insert("a", time.Now().Add(-time.Minute))
+	v.insert("b", time.Now())
+	v.sweep(changefeed.Timestamp{})
+
+	if v.missed != 1 || len(v.missing) != 1 || len(v.pending) != 1 {
+		t.Fatalf("expected a missing and b pending, got %s", v.summary())
+	}
+
+	if first := v.receive("a", version{lsn: 1}); first {
+		t.Fatalf("expected a missing payment's event not to count as first")
+	}
+
+	if v.late != 1 || len(v.missing) != 0 {
+		t.Fatalf("expected a to be late, got %s", v.summary())
+	}
+}
+
+func TestVerifierLost(t *testing.T) {
+	v := newVerifier(time.Second, time.Minute)
+
+	v.insert("a", time.Now().Add(-time.Minute))
+	v.sweep(changefeed.Timestamp{})
+
+	// Still within lostAfter.
+	v.sweep(changefeed.Timestamp{})
+	if v.lost != 0 || len(v.missing) != 1 {
+		t.Fatalf("expected a to still be missing, got %s", v.summary())
+	}
+
+	v.missing["a"] = time.Now().Add(-2 * time.Minute)
+	v.sweep(changefeed.Timestamp{})
+	if v.lost != 1 || len(v.missing) != 0 {
+		t.Fatalf("expected a to be lost, got %s", v.summary())
+	}
+
+	// An event after that is no longer reported as late.
+	v.receive("a", version{lsn: 1})
+	if v.late != 0 {
+		t.Fatalf("expected a lost payment's event not to be late, got %s", v.summary())
+	}
+}
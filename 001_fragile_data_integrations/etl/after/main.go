@@ -8,20 +8,33 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
 )
 
+var (
+	transformDelay = metrics.NewLatency("etl_delay_seconds", "Time between an order being written and its transformed event being consumed.", 1000)
+)
+
 func main() {
 	log.SetFlags(0)
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2114"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	transformedReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
+		Brokers:     cfg.Kafka.Brokers,
 		GroupID:     uuid.NewString(),
 		Topic:       "transformed_2",
 		StartOffset: kafka.LastOffset,
@@ -67,6 +80,7 @@ func simulateConsumer(reader *kafka.Reader) error {
 		}
 
 		ts := time.Unix(a.Timestamp, 0)
+		transformDelay.Record(time.Since(ts))
 		log.Printf("\n[transformed %s] %s", time.Since(ts), string(m.Value))
 	}
 }
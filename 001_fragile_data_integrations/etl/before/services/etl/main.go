@@ -3,39 +3,69 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
-	"github.com/google/uuid"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/transform"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
 )
 
+var (
+	watermark = changefeed.NewWatermark(0)
+	decoder   *changefeed.Decoder
+
+	messagesTransformed = metrics.NewCounterVec("etl_messages_total", "Messages handled by the ETL service, by outcome.", "outcome")
+)
+
 func main() {
 	log.SetFlags(0)
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
-	defer db.Close()
+	specPath := flag.String("spec", "", "path to a transform spec to use instead of the built-in transformation")
 
-	rawReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
-		GroupID:     uuid.NewString(),
-		Topic:       "raw",
-		StartOffset: kafka.LastOffset,
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
 	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.GaugeFunc("etl_watermark_lag_seconds", "Time since the raw changefeed's resolved timestamp.", func() float64 {
+		return watermark.Lag().Seconds()
+	})
+
+	var spec *transform.Spec
+	if *specPath != "" {
+		var err error
+		if spec, err = transform.Load(*specPath); err != nil {
+			log.Fatalf("error loading transform spec: %v", err)
+		}
+	}
+
+	db := connect.MustDatabase(cfg.Database.URL)
+	defer db.Close()
+
+	decoder = changefeed.MustDecoder(cfg.Changefeed.Format, cfg.Changefeed.Registry)
+
+	rawSource := changefeed.MustOpen(cfg.Changefeed.Source, cfg.Kafka.Brokers, "raw")
+	defer rawSource.Close()
 
 	transformedWriter := &kafka.Writer{
-		Addr:                   kafka.TCP("localhost:9092"),
+		Addr:                   kafka.TCP(cfg.Kafka.Brokers...),
 		Topic:                  "transformed",
 		AllowAutoTopicCreation: true,
 	}
 	defer transformedWriter.Close()
 
 	go simulateProducer(db)
-	simulateETL(rawReader, transformedWriter)
+	simulateETL(rawSource, transformedWriter, spec)
 }
 
 func simulateProducer(db *pgxpool.Pool) error {
@@ -52,14 +82,12 @@ func simulateProducer(db *pgxpool.Pool) error {
 }
 
 type before struct {
-	After struct {
-		OrderID    string    `json:"order_id"`
-		ProductID  string    `json:"product_id"`
-		CustomerID string    `json:"customer_id"`
-		Quantity   int       `json:"quantity"`
-		Price      float64   `json:"price"`
-		Timestamp  time.Time `json:"ts"`
-	} `json:"after"`
+	OrderID    string    `json:"order_id"`
+	ProductID  string    `json:"product_id"`
+	CustomerID string    `json:"customer_id"`
+	Quantity   int       `json:"quantity"`
+	Price      float64   `json:"price"`
+	Timestamp  time.Time `json:"ts"`
 }
 
 type after struct {
@@ -69,46 +97,136 @@ type after struct {
 	Timestamp int64  `json:"ts"`    // Epoch
 }
 
-func simulateETL(reader *kafka.Reader, writer *kafka.Writer) error {
+func simulateETL(source changefeed.Source, writer *kafka.Writer, spec *transform.Spec) error {
 	for {
-		m, err := reader.ReadMessage(context.Background())
+		m, err := source.Fetch(context.Background())
+		if errors.Is(err, changefeed.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			log.Printf("error reading message: %v", err)
 			continue
 		}
 
-		a, err := transform(m)
-		if err != nil {
-			log.Printf("error transforming message: %v", err)
-			continue
+		if spec != nil {
+			err = etlSpec(m, writer, spec)
+		} else {
+			err = etl(m, writer)
 		}
-
-		abytes, err := json.Marshal(a)
 		if err != nil {
-			log.Printf("error marshalling transformed message: %v", err)
+			log.Printf("%v", err)
+			messagesTransformed.WithLabelValues("failed").Inc()
+			m.Nack(err)
 			continue
 		}
 
-		out := kafka.Message{
-			Key:   []byte(a.OrderID),
-			Value: abytes,
-		}
-		if err = writer.WriteMessages(context.Background(), out); err != nil {
-			log.Printf("writing transformed message: %v", err)
-			continue
+		if err = m.Ack(context.Background()); err != nil {
+			log.Printf("error acknowledging message: %v", err)
 		}
 	}
 }
 
-func transform(m kafka.Message) (after, error) {
-	var b before
-	if err := json.Unmarshal(m.Value, &b); err != nil {
-		return after{}, fmt.Errorf("parsing before")
+func etl(m changefeed.Message, writer *kafka.Writer) error {
+	key, value, err := decoder.JSON(context.Background(), m)
+	if err != nil {
+		return fmt.Errorf("error decoding message: %w", err)
+	}
+
+	e, err := changefeed.Decode[before](key, value, changefeed.EnvelopeWrapped)
+	if err != nil {
+		return fmt.Errorf("error parsing message: %w", err)
+	}
+
+	if e.IsResolved() {
+		watermark.Observe(m.Partition, e.Resolved)
+		return nil
+	}
+
+	a, err := transformOrder(e)
+	if err != nil {
+		return fmt.Errorf("error transforming message: %w", err)
+	}
+
+	abytes, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("error marshalling transformed message: %w", err)
+	}
+
+	out := kafka.Message{
+		Key:   []byte(a.OrderID),
+		Value: abytes,
+	}
+	if err = writer.WriteMessages(context.Background(), out); err != nil {
+		return fmt.Errorf("writing transformed message: %w", err)
+	}
+
+	messagesTransformed.WithLabelValues("transformed").Inc()
+	return nil
+}
+
+func transformOrder(e changefeed.Event[before]) (after, error) {
+	if e.After == nil {
+		return after{}, fmt.Errorf("message has no row")
 	}
 
 	return after{
-		Quantity:  b.After.Quantity,
-		Price:     int64(b.After.Price * 100),
-		Timestamp: b.After.Timestamp.Unix(),
+		OrderID:   e.After.OrderID,
+		Quantity:  e.After.Quantity,
+		Price:     int64(e.After.Price * 100),
+		Timestamp: e.After.Timestamp.Unix(),
 	}, nil
 }
+
+// etlSpec transforms a message using a declarative spec rather than
+// transformOrder. The spec's arithmetic is exact, so it can give a price
+// one higher than transformOrder's float arithmetic.
+func etlSpec(m changefeed.Message, writer *kafka.Writer, spec *transform.Spec) error {
+	key, value, err := decoder.JSON(context.Background(), m)
+	if err != nil {
+		return fmt.Errorf("error decoding message: %w", err)
+	}
+
+	e, err := changefeed.Decode[json.RawMessage](key, value, changefeed.EnvelopeWrapped)
+	if err != nil {
+		return fmt.Errorf("error parsing message: %w", err)
+	}
+
+	if e.IsResolved() {
+		watermark.Observe(m.Partition, e.Resolved)
+		return nil
+	}
+
+	if e.After == nil {
+		return fmt.Errorf("error transforming message: message has no row")
+	}
+
+	row, err := transform.DecodeRow(*e.After)
+	if err != nil {
+		return fmt.Errorf("error transforming message: %w", err)
+	}
+
+	a, ok, err := spec.Apply(row)
+	if err != nil {
+		return fmt.Errorf("error transforming message: %w", err)
+	}
+	if !ok {
+		messagesTransformed.WithLabelValues("filtered").Inc()
+		return nil
+	}
+
+	abytes, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("error marshalling transformed message: %w", err)
+	}
+
+	out := kafka.Message{
+		Key:   []byte(spec.KeyOf(row)),
+		Value: abytes,
+	}
+	if err = writer.WriteMessages(context.Background(), out); err != nil {
+		return fmt.Errorf("writing transformed message: %w", err)
+	}
+
+	messagesTransformed.WithLabelValues("transformed").Inc()
+	return nil
+}
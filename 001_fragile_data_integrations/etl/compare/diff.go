@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+)
+
+// fieldDiff is a field whose value differs between two messages.
+type fieldDiff struct {
+	field       string
+	kind        string
+	left, right any
+}
+
+func (d fieldDiff) String() string {
+	return fmt.Sprintf("%s: %v vs %v (%s)", d.field, show(d.left), show(d.right), d.kind)
+}
+
+// describe explains a kind of difference.
+func describe(kind string) string {
+	switch kind {
+	case "off_by_one":
+		return "integers one apart, typically truncation vs rounding"
+	case "numeric":
+		return "numbers differ"
+	case "type":
+		return "values have different JSON types"
+	case "missing_left":
+		return "field only on the right"
+	case "missing_right":
+		return "field only on the left"
+	default:
+		return "values differ"
+	}
+}
+
+// diff compares two JSON objects field by field, comparing numbers by
+// value so that 100 and 100.0 are the same.
+func diff(left, right []byte) ([]fieldDiff, error) {
+	l, err := decodeObject(left)
+	if err != nil {
+		return nil, fmt.Errorf("parsing left message: %w", err)
+	}
+	r, err := decodeObject(right)
+	if err != nil {
+		return nil, fmt.Errorf("parsing right message: %w", err)
+	}
+
+	fields := map[string]bool{}
+	for f := range l {
+		fields[f] = true
+	}
+	for f := range r {
+		fields[f] = true
+	}
+
+	var diffs []fieldDiff
+	for f := range fields {
+		lv, lok := l[f]
+		rv, rok := r[f]
+
+		d := fieldDiff{field: f, left: lv, right: rv}
+		switch {
+		case !lok:
+			d.kind = "missing_left"
+		case !rok:
+			d.kind = "missing_right"
+		default:
+			d.kind = compareValues(lv, rv)
+		}
+
+		if d.kind != "" {
+			diffs = append(diffs, d)
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].field < diffs[j].field
+	})
+
+	return diffs, nil
+}
+
+func decodeObject(b []byte) (map[string]any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var m map[string]any
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	// Changefeed metadata isn't part of the payload.
+	delete(m, "__crdb__")
+
+	return m, nil
+}
+
+// compareValues returns the kind of difference between two values, or ""
+// if they're equal.
+func compareValues(l, r any) string {
+	ln, lok := l.(json.Number)
+	rn, rok := r.(json.Number)
+
+	switch {
+	case lok && rok:
+		lr, _ := new(big.Rat).SetString(ln.String())
+		rr, _ := new(big.Rat).SetString(rn.String())
+		if lr == nil || rr == nil {
+			return "numeric"
+		}
+
+		delta := new(big.Rat).Sub(lr, rr)
+		switch {
+		case delta.Sign() == 0:
+			return ""
+		case lr.IsInt() && rr.IsInt() && delta.Abs(delta).Cmp(big.NewRat(1, 1)) == 0:
+			return "off_by_one"
+		default:
+			return "numeric"
+		}
+
+	case lok != rok || reflect.TypeOf(l) != reflect.TypeOf(r):
+		return "type"
+
+	case reflect.DeepEqual(l, r):
+		return ""
+
+	default:
+		return "value"
+	}
+}
+
+func show(v any) string {
+	if v == nil {
+		return "null"
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+)
+
+func TestMain(m *testing.M) {
+	pairs = metrics.NewCounterVec("etl_compare_messages_total", "", "result")
+	fieldMismatch = metrics.NewCounterVec("etl_compare_field_mismatches_total", "", "field", "kind")
+	leftBehind = metrics.NewLatency("etl_compare_left_behind_seconds", "", 10)
+	rightBehind = metrics.NewLatency("etl_compare_right_behind_seconds", "", 10)
+
+	os.Exit(m.Run())
+}
+
+func TestDiff(t *testing.T) {
+	cases := []struct {
+		name  string
+		left  string
+		right string
+		exp   map[string]string // Field to kind.
+	}{
+		{
+			name:  "equal numbers with different representations",
+			left:  `{"id": "a", "total": 100}`,
+			right: `{"id": "a", "total": 100.0}`,
+			exp:   map[string]string{},
+		},
+		{
+			name:  "changefeed metadata ignored",
+			left:  `{"id": "a", "__crdb__": {"updated": "1"}}`,
+			right: `{"id": "a"}`,
+			exp:   map[string]string{},
+		},
+		{
+			name:  "integers one apart",
+			left:  `{"total": 1234}`,
+			right: `{"total": 1235}`,
+			exp:   map[string]string{"total": "off_by_one"},
+		},
+		{
+			name:  "decimals one apart",
+			left:  `{"total": 1.5}`,
+			right: `{"total": 2.5}`,
+			exp:   map[string]string{"total": "numeric"},
+		},
+		{
+			name:  "numbers further apart",
+			left:  `{"total": 1234}`,
+			right: `{"total": 1240}`,
+			exp:   map[string]string{"total": "numeric"},
+		},
+		{
+			name:  "string vs number",
+			left:  `{"total": "1234"}`,
+			right: `{"total": 1234}`,
+			exp:   map[string]string{"total": "type"},
+		},
+		{
+			name:  "null vs string",
+			left:  `{"email": null}`,
+			right: `{"email": "a@example.com"}`,
+			exp:   map[string]string{"email": "type"},
+		},
+		{
+			name:  "different strings",
+			left:  `{"email": "a@example.com"}`,
+			right: `{"email": "b@example.com"}`,
+			exp:   map[string]string{"email": "value"},
+		},
+		{
+			name:  "field only on one side",
+			left:  `{"id": "a", "email": "a@example.com"}`,
+			right: `{"id": "a", "country": "uk"}`,
+			exp:   map[string]string{"country": "missing_left", "email": "missing_right"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diffs, err := diff([]byte(c.left), []byte(c.right))
+			if err != nil {
+				t.Fatalf("error diffing: %v", err)
+			}
+
+			got := map[string]string{}
+			for _, d := range diffs {
+				got[d.field] = d.kind
+			}
+
+			if len(got) != len(c.exp) {
+				t.Fatalf("expected %v, got %v", c.exp, got)
+			}
+			for f, kind := range c.exp {
+				if got[f] != kind {
+					t.Fatalf("expected %v, got %v", c.exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffSortsFields(t *testing.T) {
+	diffs, err := diff([]byte(`{"c": 1, "a": 1, "b": 1}`), []byte(`{}`))
+	if err != nil {
+		t.Fatalf("error diffing: %v", err)
+	}
+
+	if len(diffs) != 3 || diffs[0].field != "a" || diffs[1].field != "b" || diffs[2].field != "c" {
+		t.Fatalf("expected fields a, b, c, got %v", diffs)
+	}
+}
+
+func TestDiffInvalid(t *testing.T) {
+	if _, err := diff([]byte(`not json`), []byte(`{}`)); err == nil {
+		t.Fatalf("expected error for invalid left message")
+	}
+
+	if _, err := diff([]byte(`{}`), []byte(`[1]`)); err == nil {
+		t.Fatalf("expected error for non-object right message")
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	cases := []struct {
+		key string
+		exp string
+	}{
+		{key: `["a"]`, exp: "a"},
+		{key: `a`, exp: "a"},
+		{key: `"a"`, exp: `"a"`},
+		{key: `["a", "b"]`, exp: `["a", "b"]`},
+		{key: ``, exp: ""},
+	}
+
+	for _, c := range cases {
+		if got := joinKey([]byte(c.key)); got != c.exp {
+			t.Fatalf("joinKey(%s): expected %q, got %q", c.key, c.exp, got)
+		}
+	}
+}
+
+func TestJoinerPairsByKey(t *testing.T) {
+	j := newJoiner("left", "right", time.Minute)
+	now := time.Now()
+	at := func(v string) arrival {
+		return arrival{value: []byte(v), at: now, received: now}
+	}
+
+	// Messages wait for their counterpart, and a key's messages pair up in
+	// the order they arrived.
+	j.add(leftSide, "a", at(`{"v": 1}`))
+	j.add(leftSide, "a", at(`{"v": 2}`))
+	j.add(rightSide, "b", at(`{"v": 1}`))
+	if j.compared != 0 {
+		t.Fatalf("expected no comparisons before any pair, got %d", j.compared)
+	}
+
+	j.add(rightSide, "a", at(`{"v": 1}`))
+	j.add(rightSide, "a", at(`{"v": 5}`))
+	j.add(leftSide, "b", at(`{"v": 1.0}`))
+
+	if j.compared != 3 || j.matched != 2 {
+		t.Fatalf("expected 3 pairs with 2 matching, got %d with %d", j.compared, j.matched)
+	}
+
+	if n := j.mismatches["v"]["numeric"]; n != 1 {
+		t.Fatalf("expected 1 numeric mismatch on v, got %d", n)
+	}
+
+	if len(j.pending) != 0 {
+		t.Fatalf("expected no pending keys, got %d", len(j.pending))
+	}
+}
+
+func TestJoinerExpire(t *testing.T) {
+	j := newJoiner("left", "right", time.Minute)
+	old := time.Now().Add(-2 * time.Minute)
+
+	j.add(leftSide, "a", arrival{value: []byte(`{}`), at: old, received: old})
+	j.add(rightSide, "b", arrival{value: []byte(`{}`), at: time.Now(), received: time.Now()})
+	j.expire()
+
+	if j.unmatched[leftSide] != 1 || j.unmatched[rightSide] != 0 {
+		t.Fatalf("expected 1 unmatched on left only, got %v", j.unmatched)
+	}
+
+	if _, ok := j.pending["a"]; ok {
+		t.Fatalf("expected expired key to be removed")
+	}
+
+	if _, ok := j.pending["b"]; !ok {
+		t.Fatalf("expected recent key to still be pending")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	pairs         *prometheus.CounterVec
+	fieldMismatch *prometheus.CounterVec
+	leftBehind    *metrics.Latency
+	rightBehind   *metrics.Latency
+	verbose       bool
+)
+
+func main() {
+	log.SetFlags(0)
+
+	left := flag.String("left", "transformed", "topic written by the ETL service")
+	right := flag.String("right", "transformed_2", "topic written by the CDC query")
+	timeout := flag.Duration("timeout", time.Second*30, "how long to wait for a message's counterpart before reporting it unmatched")
+	fromStart := flag.Bool("from-start", false, "compare the topics' whole history rather than only new messages")
+	interval := flag.Duration("i", time.Second*5, "interval between reports")
+	flag.BoolVar(&verbose, "v", false, "print every pair, not just mismatches")
+	cfg := config.MustLoad(config.Config{
+		Kafka:   config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics: config.MetricsConfig{Addr: ":2115"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	pairs = metrics.NewCounterVec("etl_compare_messages_total", "Messages compared across the two topics, by result.", "result")
+	fieldMismatch = metrics.NewCounterVec("etl_compare_field_mismatches_total", "Fields whose values differ between the two topics, by field and kind of difference.", "field", "kind")
+	leftBehind = metrics.NewLatency("etl_compare_left_behind_seconds", "Time the left topic's message arrived after its counterpart.", 1000)
+	rightBehind = metrics.NewLatency("etl_compare_right_behind_seconds", "Time the right topic's message arrived after its counterpart.", 1000)
+
+	start := kafka.LastOffset
+	if *fromStart {
+		start = kafka.FirstOffset
+	}
+
+	j := newJoiner(*left, *right, *timeout)
+	for i, topic := range []string{*left, *right} {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     cfg.Kafka.Brokers,
+			GroupID:     uuid.NewString(),
+			Topic:       topic,
+			StartOffset: start,
+		})
+		defer reader.Close()
+
+		go j.consume(reader, side(i))
+	}
+
+	go func() {
+		for range time.NewTicker(time.Second).C {
+			j.expire()
+		}
+	}()
+
+	for range time.NewTicker(*interval).C {
+		j.printReport()
+	}
+}
+
+type side int
+
+const (
+	leftSide side = iota
+	rightSide
+)
+
+// arrival is a message waiting for its counterpart from the other topic.
+// at is when it was published, and received when it was read, which
+// differ when catching up on a topic's history.
+type arrival struct {
+	value    []byte
+	at       time.Time
+	received time.Time
+}
+
+// joiner pairs up the messages of two topics by key, in the order they
+// arrive, and compares each pair.
+type joiner struct {
+	names   [2]string
+	timeout time.Duration
+
+	mu         sync.Mutex
+	pending    map[string]*[2][]arrival
+	compared   uint64
+	matched    uint64
+	unmatched  [2]uint64
+	mismatches map[string]map[string]uint64 // Field to kind to count.
+	first      [2]uint64
+	unkeyed    [2]sync.Once
+}
+
+func newJoiner(left, right string, timeout time.Duration) *joiner {
+	return &joiner{
+		names:      [2]string{left, right},
+		timeout:    timeout,
+		pending:    map[string]*[2][]arrival{},
+		mismatches: map[string]map[string]uint64{},
+	}
+}
+
+func (j *joiner) consume(reader *kafka.Reader, s side) {
+	for {
+		m, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			log.Printf("error reading %s: %v", j.names[s], err)
+			continue
+		}
+
+		key := joinKey(m.Key)
+		if key == "" {
+			j.unkeyed[s].Do(func() {
+				log.Printf("messages on %s have no key, so can't be compared", j.names[s])
+			})
+			pairs.WithLabelValues("unkeyed").Inc()
+			continue
+		}
+
+		a := arrival{value: m.Value, at: m.Time, received: time.Now()}
+		if a.at.IsZero() {
+			a.at = a.received
+		}
+		j.add(s, key, a)
+	}
+}
+
+// joinKey returns a message key as a string. Changefeed keys are JSON
+// arrays of the primary key's columns, where the ETL service writes the
+// bare ID.
+func joinKey(b []byte) string {
+	if k, err := changefeed.DecodeKey(b); err == nil {
+		if s := k.String(); s != "" {
+			return s
+		}
+	}
+
+	return string(b)
+}
+
+func (j *joiner) add(s side, key string, a arrival) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	p, ok := j.pending[key]
+	if !ok {
+		p = &[2][]arrival{}
+		j.pending[key] = p
+	}
+
+	other := 1 - s
+	if len(p[other]) == 0 {
+		p[s] = append(p[s], a)
+		return
+	}
+
+	counterpart := p[other][0]
+	p[other] = p[other][1:]
+	if len(p[leftSide]) == 0 && len(p[rightSide]) == 0 {
+		delete(j.pending, key)
+	}
+
+	if s == leftSide {
+		j.compare(key, a, counterpart)
+	} else {
+		j.compare(key, counterpart, a)
+	}
+}
+
+func (j *joiner) compare(key string, l, r arrival) {
+	lag := r.at.Sub(l.at)
+	if lag >= 0 {
+		j.first[leftSide]++
+		rightBehind.Record(lag)
+	} else {
+		j.first[rightSide]++
+		leftBehind.Record(-lag)
+	}
+
+	diffs, err := diff(l.value, r.value)
+	if err != nil {
+		log.Printf("error comparing %s: %v", key, err)
+		pairs.WithLabelValues("invalid").Inc()
+		return
+	}
+	j.compared++
+
+	if len(diffs) == 0 {
+		j.matched++
+		pairs.WithLabelValues("match").Inc()
+		if verbose {
+			fmt.Printf("match     %s (%s lag %s)\n", key, j.names[rightSide], lag.Round(time.Millisecond))
+		}
+		return
+	}
+
+	pairs.WithLabelValues("mismatch").Inc()
+	var parts []string
+	for _, d := range diffs {
+		fieldMismatch.WithLabelValues(d.field, d.kind).Inc()
+		if j.mismatches[d.field] == nil {
+			j.mismatches[d.field] = map[string]uint64{}
+		}
+		j.mismatches[d.field][d.kind]++
+		parts = append(parts, d.String())
+	}
+	fmt.Printf("mismatch  %s (%s lag %s): %s\n", key, j.names[rightSide], lag.Round(time.Millisecond), strings.Join(parts, ", "))
+}
+
+// expire reports messages whose counterpart hasn't arrived in time.
+func (j *joiner) expire() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	deadline := time.Now().Add(-j.timeout)
+	for key, p := range j.pending {
+		for s := range p {
+			for len(p[s]) > 0 && p[s][0].received.Before(deadline) {
+				p[s] = p[s][1:]
+				j.unmatched[s]++
+				pairs.WithLabelValues("unmatched_" + j.names[s]).Inc()
+				fmt.Printf("unmatched %s: only on %s\n", key, j.names[s])
+			}
+		}
+		if len(p[leftSide]) == 0 && len(p[rightSide]) == 0 {
+			delete(j.pending, key)
+		}
+	}
+}
+
+func (j *joiner) printReport() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fmt.Printf("\ncompared %d pairs: %d identical, %d differing; unmatched: %d only on %s, %d only on %s\n",
+		j.compared, j.matched, j.compared-j.matched,
+		j.unmatched[leftSide], j.names[leftSide], j.unmatched[rightSide], j.names[rightSide])
+
+	fields := make([]string, 0, len(j.mismatches))
+	for f := range j.mismatches {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	for _, f := range fields {
+		for kind, n := range j.mismatches[f] {
+			fmt.Printf("  %-12s %-20s %d (%s)\n", f, kind, n, describe(kind))
+		}
+	}
+
+	fmt.Printf("  %s first: %d, %s behind: %s\n", j.names[leftSide], j.first[leftSide], j.names[rightSide], rightBehind.Snapshot())
+	fmt.Printf("  %s first: %d, %s behind: %s\n\n", j.names[rightSide], j.first[rightSide], j.names[leftSide], leftBehind.Snapshot())
+}
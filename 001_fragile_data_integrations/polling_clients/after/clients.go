@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// simulateSSEClient follows the SSE stream as a browser's EventSource
+// would, reconnecting from its last cursor whenever the stream ends.
+func simulateSSEClient(addr string) {
+	var cursor string
+	for {
+		if err := followSSE(addr, &cursor); err != nil {
+			log.Printf("error following sse stream: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func followSSE(addr string, cursor *string) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/events/sse", nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *cursor != "" {
+		req.Header.Set("Last-Event-ID", *cursor)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer resp.Body.Close()
+	requestsMade.Inc()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connecting: unexpected status %d", resp.StatusCode)
+	}
+
+	var id, name, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			name = value
+		case "data":
+			data = value
+		case "":
+			// A blank line dispatches the event; a comment is a heartbeat.
+			if name != "" {
+				receive(name, data)
+			}
+			if name == "reset" {
+				*cursor = ""
+			} else if id != "" {
+				*cursor = id
+			}
+			id, name, data = "", "", ""
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("reading stream: %w", err)
+	}
+
+	return nil
+}
+
+// simulateWebSocketClient follows the WebSocket stream, reconnecting from
+// its last cursor whenever the connection closes.
+func simulateWebSocketClient(addr string) {
+	var cursor string
+	for {
+		if err := followWebSocket(addr, &cursor); err != nil {
+			log.Printf("error following websocket stream: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func followWebSocket(addr string, cursor *string) error {
+	u := "ws://" + addr + "/events/ws"
+	if *cursor != "" {
+		u += "?cursor=" + *cursor
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close()
+	requestsMade.Inc()
+
+	for {
+		var m wsMessage
+		if err = conn.ReadJSON(&m); err != nil {
+			return fmt.Errorf("reading message: %w", err)
+		}
+
+		switch m.Type {
+		case "reset":
+			*cursor = ""
+		case "change":
+			*cursor = m.Cursor
+			if m.Event != nil {
+				applyPollLag(m.Event.ID)
+				rowsRead.Inc()
+			}
+		}
+	}
+}
+
+// receive handles a single event from a stream.
+func receive(name, data string) {
+	if name != "change" {
+		return
+	}
+
+	var e event
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		log.Printf("error parsing event: %v", err)
+		return
+	}
+
+	applyPollLag(e.ID)
+	rowsRead.Inc()
+}
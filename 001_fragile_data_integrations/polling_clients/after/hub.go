@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// event is a row of the events table, as published by the changefeed.
+type event struct {
+	ID    string  `json:"id"`
+	Value decimal `json:"value"`
+	TS    string  `json:"ts"`
+}
+
+// decimal is a DECIMAL column, which changefeeds may encode as either a
+// number or a string.
+type decimal float64
+
+func (d *decimal) UnmarshalJSON(b []byte) error {
+	f, err := strconv.ParseFloat(strings.Trim(string(b), `"`), 64)
+	if err != nil {
+		return fmt.Errorf("parsing decimal: %w", err)
+	}
+
+	*d = decimal(f)
+	return nil
+}
+
+// delivery is an event as sent to a client, with the cursor a client
+// resumes from to receive the events after it.
+type delivery struct {
+	cursor string
+	event  event
+	seq    uint64
+}
+
+// filter selects the events a subscription receives. The zero filter
+// matches everything.
+type filter struct {
+	ids      map[string]bool
+	minValue *float64
+	maxValue *float64
+}
+
+// parseFilter reads a filter from query parameters: any number of "id"
+// parameters, and "min_value" and "max_value" bounds.
+func parseFilter(q url.Values) (filter, error) {
+	var f filter
+
+	if ids := q["id"]; len(ids) > 0 {
+		f.ids = map[string]bool{}
+		for _, id := range ids {
+			f.ids[id] = true
+		}
+	}
+
+	for name, dest := range map[string]**float64{"min_value": &f.minValue, "max_value": &f.maxValue} {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return filter{}, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		*dest = &v
+	}
+
+	return f, nil
+}
+
+func (f filter) match(e event) bool {
+	if f.ids != nil && !f.ids[e.ID] {
+		return false
+	}
+	if f.minValue != nil && float64(e.Value) < *f.minValue {
+		return false
+	}
+	if f.maxValue != nil && float64(e.Value) > *f.maxValue {
+		return false
+	}
+
+	return true
+}
+
+// subscription receives the events matching its filter. Its channel is
+// closed if the client falls too far behind, and the client has to
+// reconnect from its last cursor.
+type subscription struct {
+	filter filter
+	events chan delivery
+}
+
+// hub fans changefeed events out to subscribed clients, keeping the most
+// recent ones so that reconnecting clients can resume from their cursor.
+//
+// Cursors are the hub's epoch and a sequence number. They only survive
+// as long as the process, and events older than the buffer are gone, so
+// a client resuming from a cursor the hub can't serve is told to reset:
+// to reload its state from the database and then follow the stream.
+type hub struct {
+	epoch string
+	size  int
+
+	mu     sync.Mutex
+	next   uint64
+	buffer []delivery
+	subs   map[*subscription]struct{}
+}
+
+func newHub(size int) *hub {
+	return &hub{
+		epoch: uuid.NewString()[:8],
+		size:  size,
+		subs:  map[*subscription]struct{}{},
+	}
+}
+
+// publish sends an event to every matching subscription.
+func (h *hub) publish(e event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.next++
+	d := delivery{
+		cursor: fmt.Sprintf("%s-%d", h.epoch, h.next),
+		event:  e,
+		seq:    h.next,
+	}
+
+	h.buffer = append(h.buffer, d)
+	if len(h.buffer) > h.size {
+		h.buffer = h.buffer[len(h.buffer)-h.size:]
+	}
+
+	for s := range h.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+
+		select {
+		case s.events <- d:
+		default:
+			// Don't hold up every other client for a slow one.
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+// subscribe registers a subscription, returning the buffered events after
+// cursor that match f. ok is false if cursor can't be resumed from.
+func (h *hub) subscribe(f filter, cursor string) (s *subscription, backlog []delivery, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s = &subscription{filter: f, events: make(chan delivery, 256)}
+	h.subs[s] = struct{}{}
+
+	if cursor == "" {
+		return s, nil, true
+	}
+
+	seq, ok := h.parseCursor(cursor)
+	if !ok {
+		return s, nil, false
+	}
+
+	// The event after the cursor must still be buffered, or the client
+	// has missed some.
+	if seq < h.next && (len(h.buffer) == 0 || h.buffer[0].seq > seq+1) {
+		return s, nil, false
+	}
+
+	for _, d := range h.buffer {
+		if d.seq > seq && f.match(d.event) {
+			backlog = append(backlog, d)
+		}
+	}
+
+	return s, backlog, true
+}
+
+func (h *hub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+func (h *hub) clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs)
+}
+
+func (h *hub) parseCursor(cursor string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(cursor, "-")
+	if !found || epoch != h.epoch {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n > h.next {
+		return 0, false
+	}
+
+	return n, true
+}
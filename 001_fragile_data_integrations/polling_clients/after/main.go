@@ -6,55 +6,86 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
+	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
-	requestsMade uint64
-	rowsRead     uint64
+	requestsMade = stats.NewCounter()
+	rowsRead     = stats.NewCounter()
+	queueLag     = metrics.NewLatency("polling_delay_seconds", "Time between an event being written and a consumer first reading it.", 1000)
 
-	rowsWrittenMu       sync.RWMutex
-	rowsWritten         = map[string]time.Time{}
-	queueDelayAvg       float64
-	queueDelayAvgWindow = rollingAverage(10)
+	rowsWrittenMu sync.Mutex
+	rowsWritten   = map[string]time.Time{}
 )
 
 func main() {
 	writeInterval := flag.Duration("w", time.Millisecond*10, "interval between writes")
 	concurrency := flag.Int("c", 1, "number of users to simulate")
-	flag.Parse()
+	transport := flag.String("transport", "sse", "how simulated users receive events (sse or ws)")
+	httpAddr := flag.String("http-addr", "localhost:3000", "address to serve event streams on")
+	bufferSize := flag.Int("buffer", 10000, "number of recent events kept for clients resuming from a cursor")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+
+	h := newHub(*bufferSize)
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.CounterFunc("polling_requests_total", "Connections made by clients to the event streams.", func() float64 {
+		return float64(requestsMade.Load())
+	})
+	metrics.CounterFunc("polling_rows_read_total", "Rows received by clients.", func() float64 {
+		return float64(rowsRead.Load())
+	})
+	metrics.GaugeFunc("polling_push_clients", "Clients subscribed to the event streams.", func() float64 {
+		return float64(h.clients())
+	})
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
+		Brokers:     cfg.Kafka.Brokers,
 		GroupID:     uuid.NewString(),
 		Topic:       "events",
 		StartOffset: kafka.LastOffset,
 	})
 
+	router := fiber.New(fiber.Config{DisableStartupMessage: true})
+	router.Get("/events/sse", handleSSE(h))
+	router.Get("/events/ws", handleWebSocket(h))
+	go func() {
+		log.Fatal(router.Listen(*httpAddr))
+	}()
+
+	go simulateQueueConsumer(kafkaReader, h)
 	go simulateProducer(db, *writeInterval)
-	go printLoop()
 
-	var eg errgroup.Group
 	for i := 0; i < *concurrency; i++ {
-		eg.Go(func() error {
-			return simulateQueueConsumer(kafkaReader)
-		})
-	}
-	if err := eg.Wait(); err != nil {
-		log.Fatalf("error in worker: %v", err)
+		switch *transport {
+		case "sse":
+			go simulateSSEClient(*httpAddr)
+		case "ws":
+			go simulateWebSocketClient(*httpAddr)
+		default:
+			log.Fatalf("unknown transport %q", *transport)
+		}
 	}
+
+	printLoop(h)
 }
 
 func simulateProducer(db *pgxpool.Pool, rate time.Duration) error {
@@ -76,17 +107,26 @@ func simulateProducer(db *pgxpool.Pool, rate time.Duration) error {
 	return fmt.Errorf("finished simulateProducer unexectedly")
 }
 
-func simulateQueueConsumer(reader *kafka.Reader) error {
+// simulateQueueConsumer is the service's single changefeed consumer,
+// fanning each event out to every subscribed client.
+func simulateQueueConsumer(reader *kafka.Reader, h *hub) error {
 	for {
 		m, err := reader.ReadMessage(context.Background())
 		if err != nil {
 			log.Printf("error reading message: %v", err)
 			continue
 		}
-		applyPollLag(strings.Trim(string(m.Key), `["]`))
 
-		atomic.AddUint64(&requestsMade, 1)
-		atomic.AddUint64(&rowsRead, 1)
+		e, err := changefeed.Decode[event](m.Key, m.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			log.Printf("error parsing message: %v", err)
+			continue
+		}
+		if e.IsResolved() || e.IsDelete() {
+			continue
+		}
+
+		h.publish(*e.After)
 	}
 }
 
@@ -101,38 +141,17 @@ func applyPollLag(id string) {
 		return
 	}
 
-	queueDelayAvg = queueDelayAvgWindow(time.Since(rwts).Seconds())
+	queueLag.Record(time.Since(rwts))
 
 	delete(rowsWritten, id)
 }
 
-func rollingAverage(period int) func(float64) float64 {
-	var i int
-	var sum float64
-	var storage = make([]float64, 0, period)
-
-	return func(input float64) (avrg float64) {
-		if len(storage) < period {
-			sum += input
-			storage = append(storage, input)
-		}
-
-		sum += input - storage[i]
-		storage[i], i = input, (i+1)%period
-		avrg = sum / float64(len(storage))
-
-		return
-	}
-}
-
-func printLoop() {
+func printLoop(h *hub) {
 	for range time.NewTicker(time.Second).C {
 		fmt.Println("\033[H\033[2J")
-		fmt.Printf("requests made: %d\n", atomic.LoadUint64(&requestsMade))
-		fmt.Printf("rows read:     %d\n", atomic.LoadUint64(&rowsRead))
-
-		rowsWrittenMu.RLock()
-		fmt.Printf("average delay: %0.2fs\n", queueDelayAvg)
-		rowsWrittenMu.RUnlock()
+		fmt.Printf("clients:       %d\n", h.clients())
+		fmt.Printf("requests made: %d (%.0f/s)\n", requestsMade.Load(), requestsMade.Rate())
+		fmt.Printf("rows read:     %d (%.0f/s)\n", rowsRead.Load(), rowsRead.Rate())
+		fmt.Printf("delay:         %s\n", queueLag.Snapshot())
 	}
 }
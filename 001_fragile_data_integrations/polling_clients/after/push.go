@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// heartbeat is how often idle streams are written to, so disconnected
+// clients are noticed.
+const heartbeat = time.Second * 15
+
+// wsMessage is a message sent to WebSocket clients.
+type wsMessage struct {
+	Type   string `json:"type"`
+	Cursor string `json:"cursor,omitempty"`
+	Event  *event `json:"event,omitempty"`
+}
+
+// subscribeRequest reads a subscription's filter and cursor from a
+// request. The cursor comes from the "cursor" query parameter or, for
+// reconnecting EventSource clients, the Last-Event-ID header.
+func subscribeRequest(ctx *fiber.Ctx) (filter, string, error) {
+	q, err := url.ParseQuery(string(ctx.Context().QueryArgs().QueryString()))
+	if err != nil {
+		return filter{}, "", fmt.Errorf("parsing query: %w", err)
+	}
+
+	f, err := parseFilter(q)
+	if err != nil {
+		return filter{}, "", err
+	}
+
+	cursor := q.Get("cursor")
+	if id := ctx.Get("Last-Event-ID"); id != "" {
+		cursor = id
+	}
+
+	return f, cursor, nil
+}
+
+// handleSSE streams events to a client as Server-Sent Events, each with
+// its cursor as the event id.
+func handleSSE(h *hub) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		f, cursor, err := subscribeRequest(ctx)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		ctx.Set(fiber.HeaderContentType, "text/event-stream")
+		ctx.Set(fiber.HeaderCacheControl, "no-cache")
+		ctx.Set(fiber.HeaderConnection, "keep-alive")
+
+		sub, backlog, ok := h.subscribe(f, cursor)
+		ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer h.unsubscribe(sub)
+
+			if !ok {
+				fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+			}
+			for _, d := range backlog {
+				writeSSE(w, d)
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case d, open := <-sub.events:
+					if !open {
+						return
+					}
+					writeSSE(w, d)
+				case <-ticker.C:
+					fmt.Fprint(w, ": ping\n\n")
+				}
+
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		})
+
+		return nil
+	}
+}
+
+func writeSSE(w *bufio.Writer, d delivery) {
+	b, err := json.Marshal(d.event)
+	if err != nil {
+		log.Printf("error marshalling event: %v", err)
+		return
+	}
+
+	fmt.Fprintf(w, "id: %s\nevent: change\ndata: %s\n\n", d.cursor, b)
+}
+
+// handleWebSocket streams events to a client over a WebSocket, as JSON
+// messages holding the event and its cursor.
+func handleWebSocket(h *hub) fiber.Handler {
+	upgrader := websocket.FastHTTPUpgrader{
+		CheckOrigin: func(*fasthttp.RequestCtx) bool { return true },
+	}
+
+	return func(ctx *fiber.Ctx) error {
+		f, cursor, err := subscribeRequest(ctx)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return upgrader.Upgrade(ctx.Context(), func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			sub, backlog, ok := h.subscribe(f, cursor)
+			defer h.unsubscribe(sub)
+
+			// Clients don't send anything, but reading is how a close is
+			// noticed.
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				for {
+					if _, _, err := conn.NextReader(); err != nil {
+						return
+					}
+				}
+			}()
+
+			if !ok {
+				if err := conn.WriteJSON(wsMessage{Type: "reset"}); err != nil {
+					return
+				}
+			}
+			for _, d := range backlog {
+				if err := writeWebSocket(conn, d); err != nil {
+					return
+				}
+			}
+
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case d, open := <-sub.events:
+					if !open {
+						return
+					}
+					if err := writeWebSocket(conn, d); err != nil {
+						return
+					}
+				case <-ticker.C:
+					if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		})
+	}
+}
+
+func writeWebSocket(conn *websocket.Conn, d delivery) error {
+	e := d.event
+	return conn.WriteJSON(wsMessage{Type: "change", Cursor: d.cursor, Event: &e})
+}
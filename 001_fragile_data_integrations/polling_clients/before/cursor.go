@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// cursorPoller reads events incrementally, remembering the (ts, id) of
+// the last event it read so that each query only returns newer rows.
+//
+// It reads AS OF SYSTEM TIME a little in the past, so every row with an
+// older ts has committed by the time it's read and the cursor never skips
+// over a row that was still being written. Rows whose transactions take
+// longer than the staleness to commit may still be missed.
+type cursorPoller struct {
+	db          *pgxpool.Pool
+	minInterval time.Duration
+	maxInterval time.Duration
+	staleness   time.Duration
+	batchSize   int
+	seen        *seenRows
+
+	ts time.Time
+	id string
+}
+
+// run polls until an unrecoverable error, backing off while there's
+// nothing new to read and polling again straight away while there's a
+// backlog.
+func (p *cursorPoller) run() error {
+	p.ts = time.Now().Add(-p.staleness)
+	p.id = "00000000-0000-0000-0000-000000000000"
+
+	interval := p.minInterval
+	for {
+		n, err := p.poll(context.Background())
+		requestsMade.Inc()
+
+		switch {
+		case err != nil:
+			log.Printf("error simulating read: %v", err)
+			interval = min(max(interval*2, p.minInterval), p.maxInterval)
+		case n == p.batchSize:
+			interval = 0
+		case n > 0:
+			interval = p.minInterval
+		default:
+			interval = min(max(interval*2, p.minInterval), p.maxInterval)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// poll reads the next batch of events after the cursor, returning how
+// many there were.
+func (p *cursorPoller) poll(ctx context.Context) (int, error) {
+	stmt := fmt.Sprintf(`SELECT id, ts FROM events
+								AS OF SYSTEM TIME '-%dms'
+								WHERE (ts, id) > ($1, $2::UUID)
+								ORDER BY ts, id
+								LIMIT $3`, p.staleness.Milliseconds())
+
+	rows, err := p.db.Query(ctx, stmt, p.ts, p.id, p.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("running query: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		var ts time.Time
+		if err = rows.Scan(&id, &ts); err != nil {
+			return 0, fmt.Errorf("scanning row: %w", err)
+		}
+
+		ids = append(ids, id)
+		p.ts, p.id = ts, id
+	}
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating rows: %w", err)
+	}
+
+	applyPollLag(ids)
+	rowsRead.Add(uint64(len(ids)))
+	p.seen.observe(ids)
+
+	return len(ids), nil
+}
+
+// seenRows remembers the rows a single poller has read, to tell new rows
+// apart from ones it's reading again.
+type seenRows struct {
+	ids       map[string]time.Time
+	lastPrune time.Time
+}
+
+func newSeenRows() *seenRows {
+	return &seenRows{
+		ids:       map[string]time.Time{},
+		lastPrune: time.Now(),
+	}
+}
+
+// observe counts each id as either new or re-read. Ids are forgotten a
+// minute after they were first read, long after any window poll would
+// return them again.
+func (s *seenRows) observe(ids []string) {
+	now := time.Now()
+
+	for _, id := range ids {
+		if _, ok := s.ids[id]; ok {
+			rowsReread.Inc()
+			continue
+		}
+
+		rowsNew.Inc()
+		s.ids[id] = now
+	}
+
+	if now.Sub(s.lastPrune) < time.Second*10 {
+		return
+	}
+	for id, ts := range s.ids {
+		if now.Sub(ts) > time.Minute {
+			delete(s.ids, id)
+		}
+	}
+	s.lastPrune = now
+}
@@ -7,31 +7,59 @@ import (
 	"log"
 	"math/rand"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
-	requestsMade uint64
-	rowsRead     uint64
-
-	rowsWrittenMu sync.RWMutex
+	requestsMade = stats.NewCounter()
+	rowsRead     = stats.NewCounter()
+	rowsNew      = stats.NewCounter()
+	rowsReread   = stats.NewCounter()
+	rowsMissed   = stats.NewCounter()
+	pollLag      = metrics.NewLatency("polling_delay_seconds", "Time between an event being written and a poller first reading it.", 1000)
+
+	rowsWrittenMu sync.Mutex
 	rowsWritten   = map[string]time.Time{}
-	averageLagMS  int64
 )
 
 func main() {
 	writeInterval := flag.Duration("w", time.Millisecond*10, "interval between writes")
-	readInterval := flag.Duration("r", time.Millisecond*100, "interval between reads")
+	readInterval := flag.Duration("r", time.Millisecond*100, "interval between reads (the shortest interval in cursor mode)")
 	concurrency := flag.Int("c", 1, "number of users to simulate")
-	flag.Parse()
-
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	mode := flag.String("mode", "window", "how pollers read events (window or cursor)")
+	maxInterval := flag.Duration("max-r", time.Second*5, "longest interval between reads in cursor mode")
+	staleness := flag.Duration("staleness", time.Second, "how far in the past cursor mode reads, via AS OF SYSTEM TIME")
+	batchSize := flag.Int("batch", 1000, "most rows read per query in cursor mode")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.CounterFunc("polling_requests_total", "Polling queries made.", func() float64 {
+		return float64(requestsMade.Load())
+	})
+	metrics.CounterFunc("polling_rows_read_total", "Rows returned by polling queries.", func() float64 {
+		return float64(rowsRead.Load())
+	})
+	metrics.CounterFunc("polling_rows_new_total", "Rows a poller read for the first time.", func() float64 {
+		return float64(rowsNew.Load())
+	})
+	metrics.CounterFunc("polling_rows_reread_total", "Rows a poller had already read before.", func() float64 {
+		return float64(rowsReread.Load())
+	})
+	metrics.CounterFunc("polling_rows_missed_total", "Rows no poller read within a minute of being written.", func() float64 {
+		return float64(rowsMissed.Load())
+	})
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	go simulateProducer(db, *writeInterval)
@@ -39,9 +67,24 @@ func main() {
 
 	var eg errgroup.Group
 	for i := 0; i < *concurrency; i++ {
-		eg.Go(func() error {
-			return simulatePollingConsumer(db, *readInterval)
-		})
+		switch *mode {
+		case "window":
+			eg.Go(func() error {
+				return simulatePollingConsumer(db, *readInterval)
+			})
+		case "cursor":
+			p := &cursorPoller{
+				db:          db,
+				minInterval: *readInterval,
+				maxInterval: *maxInterval,
+				staleness:   *staleness,
+				batchSize:   *batchSize,
+				seen:        newSeenRows(),
+			}
+			eg.Go(p.run)
+		default:
+			log.Fatalf("unknown mode %q", *mode)
+		}
 	}
 	if err := eg.Wait(); err != nil {
 		log.Fatalf("error in worker: %v", err)
@@ -68,43 +111,43 @@ func simulateProducer(db *pgxpool.Pool, rate time.Duration) error {
 }
 
 func simulatePollingConsumer(db *pgxpool.Pool, rate time.Duration) error {
+	seen := newSeenRows()
+
 	for range time.NewTicker(rate).C {
-		rowCount, err := readFromDB(db)
+		ids, err := readFromDB(db)
 		if err != nil {
 			log.Printf("error simulating read: %v", err)
 		}
 
-		atomic.AddUint64(&requestsMade, 1)
-		atomic.AddUint64(&rowsRead, rowCount)
+		requestsMade.Inc()
+		rowsRead.Add(uint64(len(ids)))
+		seen.observe(ids)
 	}
 
 	return fmt.Errorf("finished simulateReads unexectedly")
 }
 
-func readFromDB(db *pgxpool.Pool) (uint64, error) {
+func readFromDB(db *pgxpool.Pool) ([]string, error) {
 	const stmt = `SELECT id FROM events
 								WHERE ts > now() - INTERVAL '10s'`
 
 	rows, err := db.Query(context.Background(), stmt)
 	if err != nil {
-		return 0, fmt.Errorf("running query: %w", err)
+		return nil, fmt.Errorf("running query: %w", err)
 	}
 
-	count := 0
 	var ids []string
 	for rows.Next() {
-		count++
-
 		var id string
 		if err = rows.Scan(&id); err != nil {
-			return 0, fmt.Errorf("scanning row: %w", err)
+			return nil, fmt.Errorf("scanning row: %w", err)
 		}
 		ids = append(ids, id)
 	}
 
 	applyPollLag(ids)
 
-	return uint64(count), nil
+	return ids, nil
 }
 
 func applyPollLag(ids []string) {
@@ -113,34 +156,46 @@ func applyPollLag(ids []string) {
 	rowsWrittenMu.Lock()
 	defer rowsWrittenMu.Unlock()
 
-	var totalDelays time.Duration
-	var averagePool int
 	for _, id := range ids {
 		publishTS, ok := rowsWritten[id]
 		if !ok {
 			continue
 		}
 
-		totalDelays += time.Since(publishTS)
-		averagePool++
+		pollLag.Record(time.Since(publishTS))
 		delete(rowsWritten, id)
 	}
+}
 
-	if totalDelays == 0 {
-		return
-	}
+// countMissed gives up on rows that no poller has read within a minute
+// of being written.
+func countMissed() {
+	rowsWrittenMu.Lock()
+	defer rowsWrittenMu.Unlock()
 
-	averageLagMS = totalDelays.Milliseconds() / int64(averagePool)
+	for id, ts := range rowsWritten {
+		if time.Since(ts) > time.Minute {
+			rowsMissed.Inc()
+			delete(rowsWritten, id)
+		}
+	}
 }
 
 func printLoop() {
 	for range time.NewTicker(time.Second).C {
-		fmt.Println("\033[H\033[2J")
-		fmt.Printf("requests made: %d\n", atomic.LoadUint64(&requestsMade))
-		fmt.Printf("rows read:     %d\n", atomic.LoadUint64(&rowsRead))
+		countMissed()
 
-		rowsWrittenMu.RLock()
-		fmt.Printf("average delay: %dms\n", averageLagMS)
-		rowsWrittenMu.RUnlock()
+		var wasted float64
+		if n := rowsRead.Load(); n > 0 {
+			wasted = float64(rowsReread.Load()) / float64(n) * 100
+		}
+
+		fmt.Println("\033[H\033[2J")
+		fmt.Printf("requests made: %d (%.0f/s)\n", requestsMade.Load(), requestsMade.Rate())
+		fmt.Printf("rows read:     %d (%.0f/s)\n", rowsRead.Load(), rowsRead.Rate())
+		fmt.Printf("  new:         %d (%.0f/s)\n", rowsNew.Load(), rowsNew.Rate())
+		fmt.Printf("  re-read:     %d (%.0f/s, %.1f%% wasted)\n", rowsReread.Load(), rowsReread.Rate(), wasted)
+		fmt.Printf("rows missed:   %d\n", rowsMissed.Load())
+		fmt.Printf("delay:         %s\n", pollLag.Snapshot())
 	}
 }
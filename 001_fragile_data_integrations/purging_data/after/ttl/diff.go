@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// change is a storage parameter whose actual value differs from the
+// policy's. An empty Actual means it isn't set, and an empty Desired that
+// it should be reset.
+type change struct {
+	Param   string
+	Actual  string
+	Desired string
+}
+
+// plan is what applying a policy would do to its table.
+type plan struct {
+	Policy  policy
+	Missing bool
+	Changes []change
+}
+
+// actualParams returns the storage parameters set on a table, or false if
+// the table doesn't exist.
+func actualParams(ctx context.Context, db *pgxpool.Pool, p policy) (map[string]string, bool, error) {
+	const stmt = `SELECT coalesce(c.reloptions, ARRAY[]::STRING[])
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2 AND c.relkind = 'r'`
+
+	rows, err := db.Query(ctx, stmt, p.Schema, p.Table)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading storage parameters: %w", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+
+	var options []string
+	if err = rows.Scan(&options); err != nil {
+		return nil, false, fmt.Errorf("scanning storage parameters: %w", err)
+	}
+
+	params := map[string]string{}
+	for _, o := range options {
+		k, v, _ := strings.Cut(o, "=")
+		params[k] = unquote(v)
+	}
+
+	return params, true, rows.Err()
+}
+
+// diff compares a table's actual storage parameters with its policy's.
+func diff(p policy, actual map[string]string) []change {
+	desired := p.params()
+
+	var changes []change
+	for _, param := range managed {
+		a, set := actual[param]
+		if !set {
+			a = defaults[param]
+		}
+		d, want := desired[param]
+		if !want {
+			d = defaults[param]
+		}
+
+		if equal(param, a, d) {
+			continue
+		}
+
+		c := change{Param: param, Desired: d}
+		if set {
+			c.Actual = a
+		}
+		changes = append(changes, c)
+	}
+
+	return changes
+}
+
+var (
+	typeAnnotation = regexp.MustCompile(`:::?[a-z]+`)
+	typedLiteral   = regexp.MustCompile(`\binterval\s*'`)
+)
+
+// unquote returns the value of a storage parameter, which CockroachDB may
+// report as a string literal with a type annotation, such as
+// '@hourly':::STRING, or as an escape string if it contains quotes, such
+// as e'(ts AT TIME ZONE \'UTC\':::STRING)'. Annotations inside the
+// literal are part of the value; one after it is dropped.
+func unquote(v string) string {
+	escaped := strings.HasPrefix(v, "e'")
+	if escaped {
+		v = v[1:]
+	}
+	if !strings.HasPrefix(v, "'") {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped && c == '\\' && i+1 < len(v):
+			i++
+			switch v[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(v[i])
+			}
+		case c == '\'' && i+1 < len(v) && v[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == '\'':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// equal compares parameter values. Expressions are compared loosely, as
+// CockroachDB may reformat them, adding parentheses and type annotations
+// in place of typed literals.
+func equal(param, a, b string) bool {
+	if param != "ttl_expiration_expression" {
+		return a == b
+	}
+
+	return normalize(a) == normalize(b)
+}
+
+func normalize(expr string) string {
+	expr = strings.ToLower(expr)
+	expr = typeAnnotation.ReplaceAllString(expr, "")
+	expr = typedLiteral.ReplaceAllString(expr, "'")
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '(', ')':
+			return -1
+		}
+		return r
+	}, expr)
+}
+
+// statements returns the SQL that brings a table in line with its policy.
+func (p plan) statements() []string {
+	table := p.Policy.name()
+
+	if p.Policy.Disabled {
+		if len(p.Changes) == 0 {
+			return nil
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s RESET (ttl)", table)}
+	}
+
+	var set, reset []string
+	for _, c := range p.Changes {
+		if c.Desired == "" {
+			reset = append(reset, c.Param)
+			continue
+		}
+		set = append(set, fmt.Sprintf("%s = %s", c.Param, literal(c.Param, c.Desired)))
+	}
+	sort.Strings(set)
+	sort.Strings(reset)
+
+	var stmts []string
+	if len(set) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s SET (%s)", table, strings.Join(set, ", ")))
+	}
+	if len(reset) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s RESET (%s)", table, strings.Join(reset, ", ")))
+	}
+
+	return stmts
+}
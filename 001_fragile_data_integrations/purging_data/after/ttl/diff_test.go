@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnquote(t *testing.T) {
+	cases := []struct {
+		v   string
+		exp string
+	}{
+		{v: `500`, exp: `500`},
+		{v: `true`, exp: `true`},
+		{v: `'* * * * *'`, exp: `* * * * *`},
+		{v: `'@hourly':::STRING`, exp: `@hourly`},
+		{v: `'it''s'`, exp: `it's`},
+		{
+			v:   `e'((ts AT TIME ZONE \'UTC\':::STRING) + \'5 years\':::INTERVAL) AT TIME ZONE \'UTC\':::STRING'`,
+			exp: `((ts AT TIME ZONE 'UTC':::STRING) + '5 years':::INTERVAL) AT TIME ZONE 'UTC':::STRING`,
+		},
+		{
+			v:   `'((ts AT TIME ZONE ''UTC'':::STRING) + ''5 years'':::INTERVAL) AT TIME ZONE ''UTC'':::STRING'`,
+			exp: `((ts AT TIME ZONE 'UTC':::STRING) + '5 years':::INTERVAL) AT TIME ZONE 'UTC':::STRING`,
+		},
+	}
+
+	for _, c := range cases {
+		if act := unquote(c.v); act != c.exp {
+			t.Errorf("expected %s to unquote to %s, got %s", c.v, c.exp, act)
+		}
+	}
+}
+
+func TestNormalizeReformattedExpression(t *testing.T) {
+	p := policy{Schema: "public", Table: "orders", Column: "ts", Retention: "5 years"}
+
+	// How CockroachDB reports the expression it was given.
+	cases := []string{
+		`e'((ts AT TIME ZONE \'UTC\':::STRING) + \'5 years\':::INTERVAL) AT TIME ZONE \'UTC\':::STRING'`,
+		`e'((ts AT TIME ZONE \'UTC\') + INTERVAL \'5 years\') AT TIME ZONE \'UTC\''`,
+		`'(ts at time zone ''UTC'' + ''5 years''::INTERVAL) at time zone ''UTC'''`,
+	}
+
+	for _, reported := range cases {
+		if a := unquote(reported); !equal("ttl_expiration_expression", a, p.expression()) {
+			t.Errorf("expected %s to match %s, normalized %s and %s", reported, p.expression(), normalize(a), normalize(p.expression()))
+		}
+	}
+
+	other := policy{Schema: "public", Table: "orders", Column: "ts", Retention: "1 year"}
+	if equal("ttl_expiration_expression", unquote(cases[0]), other.expression()) {
+		t.Errorf("expected a different retention not to match")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	p := policy{Schema: "public", Table: "orders", Column: "ts", Retention: "5 years", Cron: "* * * * *", DeleteBatchSize: 100}
+
+	cases := []struct {
+		name   string
+		actual map[string]string
+		exp    []change
+	}{
+		{
+			name: "in line",
+			actual: map[string]string{
+				"ttl_expiration_expression": `((ts AT TIME ZONE 'UTC':::STRING) + '5 years':::INTERVAL) AT TIME ZONE 'UTC':::STRING`,
+				"ttl_job_cron":              "* * * * *",
+				"ttl_delete_batch_size":     "100",
+			},
+		},
+		{
+			name:   "no ttl",
+			actual: map[string]string{},
+			exp: []change{
+				{Param: "ttl_expiration_expression", Desired: p.expression()},
+				{Param: "ttl_job_cron", Desired: "* * * * *"},
+				{Param: "ttl_delete_batch_size", Desired: "100"},
+			},
+		},
+		{
+			name: "drifted",
+			actual: map[string]string{
+				"ttl_expiration_expression": `((ts AT TIME ZONE 'UTC':::STRING) + '1 year':::INTERVAL) AT TIME ZONE 'UTC':::STRING`,
+				"ttl_job_cron":              "@hourly",
+				"ttl_delete_batch_size":     "100",
+				"ttl_select_batch_size":     "50",
+				"ttl_pause":                 "true",
+			},
+			exp: []change{
+				{Param: "ttl_expiration_expression", Actual: `((ts AT TIME ZONE 'UTC':::STRING) + '1 year':::INTERVAL) AT TIME ZONE 'UTC':::STRING`, Desired: p.expression()},
+				{Param: "ttl_job_cron", Actual: "@hourly", Desired: "* * * * *"},
+				{Param: "ttl_select_batch_size", Actual: "50"},
+				{Param: "ttl_pause", Actual: "true", Desired: "false"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if act := diff(p, c.actual); !reflect.DeepEqual(act, c.exp) {
+				t.Errorf("expected %+v, got %+v", c.exp, act)
+			}
+		})
+	}
+}
+
+func TestStatements(t *testing.T) {
+	p := policy{Schema: "public", Table: "orders", Column: "ts", Retention: "5 years"}
+
+	cases := []struct {
+		name string
+		plan plan
+		exp  []string
+	}{
+		{
+			name: "nothing to do",
+			plan: plan{Policy: p},
+		},
+		{
+			name: "set and reset",
+			plan: plan{Policy: p, Changes: []change{
+				{Param: "ttl_job_cron", Actual: "@hourly", Desired: "@daily"},
+				{Param: "ttl_expiration_expression", Desired: p.expression()},
+				{Param: "ttl_select_batch_size", Actual: "50"},
+				{Param: "ttl_delete_batch_size", Desired: "100"},
+			}},
+			exp: []string{
+				`ALTER TABLE public.orders SET (ttl_delete_batch_size = 100, ttl_expiration_expression = '((ts AT TIME ZONE ''UTC'') + INTERVAL ''5 years'') AT TIME ZONE ''UTC''', ttl_job_cron = '@daily')`,
+				`ALTER TABLE public.orders RESET (ttl_select_batch_size)`,
+			},
+		},
+		{
+			name: "disabled",
+			plan: plan{Policy: policy{Schema: "public", Table: "orders", Disabled: true}, Changes: []change{
+				{Param: "ttl_job_cron", Actual: "@hourly"},
+			}},
+			exp: []string{`ALTER TABLE public.orders RESET (ttl)`},
+		},
+		{
+			name: "already disabled",
+			plan: plan{Policy: policy{Schema: "public", Table: "orders", Disabled: true}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if act := c.plan.statements(); !reflect.DeepEqual(act, c.exp) {
+				t.Errorf("expected %q, got %q", c.exp, act)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+	policiesPath := flag.String("policies", "policies.yaml", "path to the retention policies")
+	apply := flag.Bool("apply", false, "apply the plan, rather than only printing it")
+	check := flag.Bool("check", false, "exit with status 2 if any table differs from its policy")
+	status := flag.Bool("status", false, "report ttl job progress instead of planning")
+	limit := flag.Int("jobs", 5, "number of recent ttl jobs to report per table")
+	count := flag.Bool("count", false, "count expired rows that are yet to be deleted (scans each table)")
+	interval := flag.Duration("i", 0, "interval between status reports (0 to report once)")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+	})
+
+	policies, err := loadPolicies(*policiesPath)
+	if err != nil {
+		log.Fatalf("error loading policies: %v", err)
+	}
+
+	db := connect.MustDatabase(cfg.Database.URL)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	if *status {
+		for {
+			if err = report(ctx, db, policies, *limit, *count); err != nil {
+				log.Fatalf("error reporting ttl status: %v", err)
+			}
+			if *interval == 0 {
+				return
+			}
+			time.Sleep(*interval)
+		}
+	}
+
+	plans, err := planAll(ctx, db, policies)
+	if err != nil {
+		log.Fatalf("error planning: %v", err)
+	}
+	drift := printPlans(plans)
+
+	if *apply {
+		if err = applyAll(ctx, db, plans); err != nil {
+			log.Fatalf("error applying: %v", err)
+		}
+		return
+	}
+
+	if *check && drift {
+		os.Exit(2)
+	}
+}
+
+func planAll(ctx context.Context, db *pgxpool.Pool, policies []policy) ([]plan, error) {
+	var plans []plan
+	for _, p := range policies {
+		actual, exists, err := actualParams(ctx, db, p)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", p.name(), err)
+		}
+		if !exists {
+			plans = append(plans, plan{Policy: p, Missing: true})
+			continue
+		}
+
+		plans = append(plans, plan{Policy: p, Changes: diff(p, actual)})
+	}
+
+	return plans, nil
+}
+
+// printPlans prints what applying each policy would change, returning
+// whether anything would.
+func printPlans(plans []plan) bool {
+	var drift bool
+	for _, p := range plans {
+		switch {
+		case p.Missing:
+			fmt.Printf("%s: table not found\n", p.Policy.name())
+			drift = true
+			continue
+		case len(p.Changes) == 0:
+			fmt.Printf("%s: up to date\n", p.Policy.name())
+			continue
+		}
+
+		drift = true
+		fmt.Printf("%s:\n", p.Policy.name())
+		for _, c := range p.Changes {
+			fmt.Printf("  %-26s %s -> %s\n", c.Param, display(c.Actual), display(c.Desired))
+		}
+		for _, stmt := range p.statements() {
+			fmt.Printf("  %s;\n", stmt)
+		}
+	}
+
+	return drift
+}
+
+func display(v string) string {
+	if v == "" {
+		return "(unset)"
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+func applyAll(ctx context.Context, db *pgxpool.Pool, plans []plan) error {
+	for _, p := range plans {
+		if p.Missing {
+			continue
+		}
+
+		for _, stmt := range p.statements() {
+			if _, err := db.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("altering %s: %w", p.Policy.name(), err)
+			}
+			log.Printf("applied %s", stmt)
+		}
+	}
+
+	return nil
+}
+
+func report(ctx context.Context, db *pgxpool.Pool, policies []policy, limit int, count bool) error {
+	for _, p := range policies {
+		if p.Disabled {
+			continue
+		}
+
+		runs, err := jobs(ctx, db, p, limit)
+		if err != nil {
+			return err
+		}
+		printJobs(p, runs)
+
+		if !count {
+			continue
+		}
+
+		// Count by the expression the table actually has, which is what
+		// the TTL job deletes by, falling back to the policy's.
+		expression := p.expression()
+		actual, exists, err := actualParams(ctx, db, p)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if e, ok := actual["ttl_expiration_expression"]; ok {
+			expression = e
+		}
+
+		n, err := expired(ctx, db, p, expression)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  %d expired rows remaining\n", n)
+	}
+
+	return nil
+}
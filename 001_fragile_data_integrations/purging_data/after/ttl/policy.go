@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// policy declares how long a table's rows are kept, and how CockroachDB's
+// row-level TTL job should delete them once they expire.
+type policy struct {
+	Table  string `yaml:"table"`
+	Schema string `yaml:"schema"`
+
+	// Column is the TIMESTAMPTZ column rows expire relative to, and
+	// Retention the SQL interval they're kept for, such as "5 years".
+	Column    string `yaml:"column"`
+	Retention string `yaml:"retention"`
+
+	// Cron is when the TTL job runs, defaulting to CockroachDB's hourly.
+	Cron string `yaml:"cron"`
+
+	SelectBatchSize int  `yaml:"select_batch_size"`
+	DeleteBatchSize int  `yaml:"delete_batch_size"`
+	DeleteRateLimit int  `yaml:"delete_rate_limit"`
+	Pause           bool `yaml:"pause"`
+
+	// Disabled removes TTL from the table altogether.
+	Disabled bool `yaml:"disabled"`
+}
+
+type policyFile struct {
+	Policies []policy `yaml:"policies"`
+}
+
+func loadPolicies(path string) ([]policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading policies: %w", err)
+	}
+
+	var f policyFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing policies: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for i, p := range f.Policies {
+		if p.Schema == "" {
+			f.Policies[i].Schema = "public"
+		}
+		if err = p.validate(); err != nil {
+			return nil, fmt.Errorf("policy %d: %w", i+1, err)
+		}
+
+		name := f.Policies[i].name()
+		if seen[name] {
+			return nil, fmt.Errorf("table %s has more than one policy", name)
+		}
+		seen[name] = true
+	}
+
+	return f.Policies, nil
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (p policy) validate() error {
+	if !identifier.MatchString(p.Table) {
+		return fmt.Errorf("invalid table %q", p.Table)
+	}
+	if p.Schema != "" && !identifier.MatchString(p.Schema) {
+		return fmt.Errorf("invalid schema %q", p.Schema)
+	}
+	if p.Disabled {
+		return nil
+	}
+
+	if !identifier.MatchString(p.Column) {
+		return fmt.Errorf("%s: invalid column %q", p.Table, p.Column)
+	}
+	if p.Retention == "" || strings.Contains(p.Retention, "'") {
+		return fmt.Errorf("%s: invalid retention %q", p.Table, p.Retention)
+	}
+	if p.SelectBatchSize < 0 || p.DeleteBatchSize < 0 || p.DeleteRateLimit < 0 {
+		return fmt.Errorf("%s: batch settings must not be negative", p.Table)
+	}
+
+	return nil
+}
+
+func (p policy) name() string {
+	return p.Schema + "." + p.Table
+}
+
+// params returns the TTL storage parameters the policy wants set. Settings
+// left at zero are left at CockroachDB's defaults.
+func (p policy) params() map[string]string {
+	if p.Disabled {
+		return map[string]string{}
+	}
+
+	params := map[string]string{
+		"ttl_expiration_expression": p.expression(),
+		"ttl_pause":                 strconv.FormatBool(p.Pause),
+	}
+	if p.Cron != "" {
+		params["ttl_job_cron"] = p.Cron
+	}
+	if p.SelectBatchSize > 0 {
+		params["ttl_select_batch_size"] = strconv.Itoa(p.SelectBatchSize)
+	}
+	if p.DeleteBatchSize > 0 {
+		params["ttl_delete_batch_size"] = strconv.Itoa(p.DeleteBatchSize)
+	}
+	if p.DeleteRateLimit > 0 {
+		params["ttl_delete_rate_limit"] = strconv.Itoa(p.DeleteRateLimit)
+	}
+
+	return params
+}
+
+// expression returns the time at which a row expires.
+func (p policy) expression() string {
+	return fmt.Sprintf("((%s AT TIME ZONE 'UTC') + INTERVAL '%s') AT TIME ZONE 'UTC'", p.Column, p.Retention)
+}
+
+// managed are the storage parameters policies own. Any of them that are
+// set on a table but not in its policy are reset to their defaults.
+var managed = []string{
+	"ttl_expiration_expression",
+	"ttl_job_cron",
+	"ttl_select_batch_size",
+	"ttl_delete_batch_size",
+	"ttl_delete_rate_limit",
+	"ttl_pause",
+}
+
+// defaults are the values CockroachDB reports no parameter for.
+var defaults = map[string]string{
+	"ttl_pause": "false",
+}
+
+// literal renders a parameter's value as SQL.
+func literal(param, value string) string {
+	switch param {
+	case "ttl_expiration_expression", "ttl_job_cron":
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	default:
+		return value
+	}
+}
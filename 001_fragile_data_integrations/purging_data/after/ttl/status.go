@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// job is a run of a table's row-level TTL job.
+type job struct {
+	ID       int64
+	Status   string
+	Running  string
+	Created  time.Time
+	Finished *time.Time
+	Fraction *float64
+	Error    string
+}
+
+// jobs returns a table's most recent TTL job runs, newest first.
+func jobs(ctx context.Context, db *pgxpool.Pool, p policy, limit int) ([]job, error) {
+	const stmt = `SELECT
+			job_id,
+			status,
+			coalesce(running_status, ''),
+			created,
+			finished,
+			fraction_completed,
+			coalesce(error, '')
+		FROM crdb_internal.jobs
+		WHERE job_type = 'ROW LEVEL TTL'
+		AND description LIKE '%.' || $1
+		ORDER BY created DESC
+		LIMIT $2`
+
+	rows, err := db.Query(ctx, stmt, p.name(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying ttl jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []job
+	for rows.Next() {
+		var j job
+		if err = rows.Scan(&j.ID, &j.Status, &j.Running, &j.Created, &j.Finished, &j.Fraction, &j.Error); err != nil {
+			return nil, fmt.Errorf("scanning ttl job: %w", err)
+		}
+		runs = append(runs, j)
+	}
+
+	return runs, rows.Err()
+}
+
+// expired counts the rows that have expired but are yet to be deleted,
+// which is the same backlog the external purger reports as remaining. It
+// reads slightly in the past, so as not to contend with the TTL job.
+func expired(ctx context.Context, db *pgxpool.Pool, p policy, expression string) (int64, error) {
+	stmt := fmt.Sprintf(`SELECT count(*) FROM %s AS OF SYSTEM TIME '-10s' WHERE (%s) <= now()`, p.name(), expression)
+
+	var n int64
+	if err := db.QueryRow(ctx, stmt).Scan(&n); err != nil {
+		return 0, fmt.Errorf("counting expired rows: %w", err)
+	}
+
+	return n, nil
+}
+
+func printJobs(p policy, runs []job) {
+	if len(runs) == 0 {
+		fmt.Printf("%s: no ttl jobs have run\n", p.name())
+		return
+	}
+
+	fmt.Printf("%s: ttl jobs\n", p.name())
+	for _, j := range runs {
+		took := "-"
+		if j.Finished != nil {
+			took = j.Finished.Sub(j.Created).Round(time.Millisecond).String()
+		}
+		progress := "-"
+		if j.Fraction != nil {
+			progress = fmt.Sprintf("%.0f%%", *j.Fraction*100)
+		}
+
+		fmt.Printf("  %d  %-9s  %s  took %-10s  %s", j.ID, j.Status, j.Created.Format(time.RFC3339), took, progress)
+		if j.Running != "" {
+			fmt.Printf("  %s", j.Running)
+		}
+		if j.Error != "" {
+			fmt.Printf("  error: %s", j.Error)
+		}
+		fmt.Println()
+	}
+}
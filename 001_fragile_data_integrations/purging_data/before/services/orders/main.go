@@ -7,13 +7,25 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ordersInserted = metrics.NewCounter("orders_inserted_total", "Orders inserted by the generator.")
+)
+
 func main() {
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	if err := generateOrders(db); err != nil {
@@ -28,6 +40,7 @@ func generateOrders(db *pgxpool.Pool) error {
 		if _, err := db.Exec(context.Background(), stmt, uuid.NewString(), total, randomDate()); err != nil {
 			return fmt.Errorf("inserting order: %w", err)
 		}
+		ordersInserted.Inc()
 	}
 
 	return fmt.Errorf("finished generateOrders unexpectedly")
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// batchSizer adapts the batch size so each batch takes roughly the target
+// latency: growing it while batches are quick, and shrinking it as soon as
+// they're slow. Changes are limited to doubling or halving per batch so a
+// single outlier doesn't swing the size too far.
+type batchSizer struct {
+	target   time.Duration
+	min, max int
+	size     int
+}
+
+func newBatchSizer(target time.Duration, min, max int) *batchSizer {
+	return &batchSizer{target: target, min: min, max: max, size: min}
+}
+
+// observe records how long a batch of n rows took and returns the size of
+// the next batch. Partial batches say nothing about larger ones, so they
+// only ever shrink the size.
+func (b *batchSizer) observe(n int, elapsed time.Duration) int {
+	if n == 0 || elapsed <= 0 {
+		return b.size
+	}
+
+	factor := min(max(float64(b.target)/float64(elapsed), 0.5), 2)
+	if n < b.size && factor > 1 {
+		return b.size
+	}
+
+	b.size = min(max(int(float64(b.size)*factor), b.min), b.max)
+	return b.size
+}
+
+// probe measures the latency of a foreground query, so the purger can
+// back off while it's hurting the application. It pauses once p99 latency
+// rises above the threshold and resumes once it's back below 80% of it.
+type probe struct {
+	db        *pgxpool.Pool
+	query     string
+	threshold time.Duration
+	latency   *stats.Histogram
+
+	mu    sync.Mutex
+	pause bool
+}
+
+func newProbe(db *pgxpool.Pool, query string, threshold time.Duration) *probe {
+	return &probe{
+		db:        db,
+		query:     query,
+		threshold: threshold,
+		latency:   stats.NewHistogram(100),
+	}
+}
+
+// run issues the probe query every interval until ctx is done.
+func (p *probe) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		err := p.measure(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.observe(time.Since(start), err)
+	}
+}
+
+// timeout is how long the probe query may take before it's abandoned.
+func (p *probe) timeout() time.Duration {
+	return p.threshold * 2
+}
+
+// measure runs the probe query, giving up after the timeout.
+func (p *probe) measure(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, p.query)
+	if err != nil {
+		return fmt.Errorf("running probe query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+
+	return rows.Err()
+}
+
+// observe records how long a probe query took and re-evaluates the pause.
+// A failed query counts as taking at least the timeout, as the
+// application's queries are likely failing too, so a database that stops
+// answering pauses the purger rather than leaving it on a stale p99.
+func (p *probe) observe(elapsed time.Duration, err error) {
+	if err != nil {
+		log.Printf("error probing foreground latency: %v", err)
+		elapsed = max(elapsed, p.timeout())
+	}
+
+	p.latency.Record(elapsed)
+	p.update()
+}
+
+func (p *probe) update() {
+	p99 := p.latency.Snapshot().P99
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case !p.pause && p99 > p.threshold:
+		p.pause = true
+		log.Printf("pausing: foreground p99 %s is above %s", p99.Round(time.Millisecond), p.threshold)
+	case p.pause && p99 < p.threshold*8/10:
+		p.pause = false
+		log.Printf("resuming: foreground p99 %s has recovered", p99.Round(time.Millisecond))
+	}
+}
+
+// wait blocks while the purger is paused. A nil probe never pauses.
+func (p *probe) wait(ctx context.Context) {
+	for p.paused() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (p *probe) paused() bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pause
+}
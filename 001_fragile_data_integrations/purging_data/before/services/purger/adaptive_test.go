@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatchSizerObserve(t *testing.T) {
+	type batch struct {
+		n       int
+		elapsed time.Duration
+		exp     int
+	}
+
+	cases := []struct {
+		name    string
+		batches []batch
+	}{
+		{
+			name: "quick batches double the size",
+			batches: []batch{
+				{n: 10, elapsed: 50 * time.Millisecond, exp: 20},
+				{n: 20, elapsed: 10 * time.Millisecond, exp: 40},
+			},
+		},
+		{
+			name: "slow batches halve the size",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 20, elapsed: time.Millisecond, exp: 40},
+				{n: 40, elapsed: time.Second, exp: 20},
+			},
+		},
+		{
+			name: "near-target batches adjust in proportion",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 20, elapsed: 80 * time.Millisecond, exp: 25},
+				{n: 25, elapsed: 125 * time.Millisecond, exp: 20},
+			},
+		},
+		{
+			name: "clamped to min",
+			batches: []batch{
+				{n: 10, elapsed: time.Second, exp: 10},
+			},
+		},
+		{
+			name: "clamped to max",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 20, elapsed: time.Millisecond, exp: 40},
+				{n: 40, elapsed: time.Millisecond, exp: 50},
+				{n: 50, elapsed: time.Millisecond, exp: 50},
+			},
+		},
+		{
+			name: "partial batches never grow the size",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 5, elapsed: time.Millisecond, exp: 20},
+				{n: 19, elapsed: time.Millisecond, exp: 20},
+			},
+		},
+		{
+			name: "partial batches can shrink the size",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 15, elapsed: time.Second, exp: 10},
+			},
+		},
+		{
+			name: "empty batches are ignored",
+			batches: []batch{
+				{n: 10, elapsed: time.Millisecond, exp: 20},
+				{n: 0, elapsed: time.Second, exp: 20},
+				{n: 20, elapsed: 0, exp: 20},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := newBatchSizer(100*time.Millisecond, 10, 50)
+			for i, batch := range c.batches {
+				if got := b.observe(batch.n, batch.elapsed); got != batch.exp {
+					t.Fatalf("batch %d: expected %d, got %d", i, batch.exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeUpdate(t *testing.T) {
+	p := newProbe(nil, "", 100*time.Millisecond)
+	record := func(n int, d time.Duration) {
+		for i := 0; i < n; i++ {
+			p.observe(d, nil)
+		}
+	}
+
+	record(50, 10*time.Millisecond)
+	if p.paused() {
+		t.Fatalf("expected not paused while p99 is below the threshold")
+	}
+
+	// With 52 samples, the nearest-rank p99 is the largest.
+	record(2, 150*time.Millisecond)
+	if !p.paused() {
+		t.Fatalf("expected paused once p99 is above the threshold")
+	}
+
+	// Below the threshold, but not below 80% of it.
+	record(100, 90*time.Millisecond)
+	if !p.paused() {
+		t.Fatalf("expected still paused while p99 is above 80%% of the threshold")
+	}
+
+	record(100, 70*time.Millisecond)
+	if p.paused() {
+		t.Fatalf("expected resumed once p99 is below 80%% of the threshold")
+	}
+}
+
+func TestProbeObserveError(t *testing.T) {
+	p := newProbe(nil, "", 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		p.observe(10*time.Millisecond, nil)
+	}
+
+	// A probe that fails quickly still counts as slow.
+	p.observe(time.Millisecond, errors.New("connection refused"))
+	if !p.paused() {
+		t.Fatalf("expected paused after a failed probe")
+	}
+
+	if max := p.latency.Snapshot().Max; max != p.timeout() {
+		t.Fatalf("expected failed probe to be recorded as %s, got %s", p.timeout(), max)
+	}
+}
+
+func TestProbeNil(t *testing.T) {
+	var p *probe
+	if p.paused() {
+		t.Fatalf("expected a nil probe never to pause")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// cursor is the (ts, id) of the last order the purger deleted. Each batch
+// starts just after it, so batches walk the ts index in key order instead
+// of rescanning the tombstones of orders that were already deleted.
+type cursor struct {
+	TS time.Time
+	ID string
+}
+
+// start is the cursor at the beginning of a pass.
+var start = cursor{ID: "00000000-0000-0000-0000-000000000000"}
+
+func (c cursor) atStart() bool {
+	return c.TS.IsZero() && c.ID == start.ID
+}
+
+// loadCursor returns the purger's persisted cursor, or the start of a
+// pass if there isn't one.
+func loadCursor(ctx context.Context, db *pgxpool.Pool, name string) (cursor, error) {
+	const stmt = `SELECT ts, id::STRING FROM purger_cursor WHERE name = $1`
+
+	var c cursor
+	err := db.QueryRow(ctx, stmt, name).Scan(&c.TS, &c.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return start, nil
+	}
+	if err != nil {
+		return cursor{}, fmt.Errorf("loading cursor: %w", err)
+	}
+
+	return c, nil
+}
+
+// execer is satisfied by both pools and transactions.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// saveCursor persists the cursor. Saving it in the transaction that
+// deletes a batch means it moves if and only if the batch is deleted.
+func saveCursor(ctx context.Context, db execer, name string, c cursor) error {
+	const stmt = `UPSERT INTO purger_cursor (name, ts, id, updated_at) VALUES ($1, $2, $3, now())`
+
+	if _, err := db.Exec(ctx, stmt, name, c.TS, c.ID); err != nil {
+		return fmt.Errorf("saving cursor: %w", err)
+	}
+
+	return nil
+}
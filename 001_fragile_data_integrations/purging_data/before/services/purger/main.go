@@ -2,34 +2,343 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/archive"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/time/rate"
+)
+
+var (
+	rowsPurged      = metrics.NewCounter("purger_rows_deleted_total", "Order rows deleted by the purger.")
+	rowsArchived    = metrics.NewCounter("purger_rows_archived_total", "Order rows archived and verified before being deleted.")
+	archiveFailures = metrics.NewCounter("purger_archive_failures_total", "Batches that couldn't be archived or verified, and so weren't deleted.")
 )
 
 func main() {
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	archiveURI := flag.String("archive", "archive", "where to archive orders before deleting them: a directory or s3://bucket/prefix")
+	batchMin := flag.Int("batch-min", 100, "smallest batch of orders to archive and delete")
+	batchMax := flag.Int("batch", 10000, "largest batch of orders to archive and delete")
+	target := flag.Duration("target-latency", time.Millisecond*500, "time each batch's select and delete should take, which the batch size adapts to")
+	maxRate := flag.Int("max-rate", 0, "most orders to delete per second (0 for no limit)")
+	pauseP99 := flag.Duration("pause-p99", time.Millisecond*200, "pause while the probe query's p99 latency is above this (0 to never pause)")
+	probeQuery := flag.String("probe", "SELECT id, customer_id, total, ts FROM orders ORDER BY ts DESC LIMIT 10", "foreground query whose latency is watched")
+	interval := flag.Duration("i", time.Minute, "interval between passes once there's nothing left to delete")
+	progressInterval := flag.Duration("progress", time.Second*30, "interval between progress reports")
+	name := flag.String("name", "orders", "name the purger's cursor is saved under")
+	restoreFrom := flag.String("restore-from", "", "restore archived orders from this date (YYYY-MM-DD) instead of purging")
+	restoreTo := flag.String("restore-to", "", "restore archived orders before this date (YYYY-MM-DD)")
+	restoreTable := flag.String("restore-table", "orders_restored", "table to restore orders into (not orders itself, where they'd be purged again)")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		S3:       config.S3Config{Region: "us-east-1"},
+		Metrics:  config.MetricsConfig{Addr: ":2113"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
-	if err := purgeOrders(db); err != nil {
-		log.Fatalf("error generating orders: %v", err)
+	store, err := archive.Open(*archiveURI, cfg.S3.Endpoint, cfg.S3.Region)
+	if err != nil {
+		log.Fatalf("error opening archive: %v", err)
+	}
+	a := archive.New(store)
+
+	if *restoreFrom != "" || *restoreTo != "" {
+		if err = restoreOrders(db, a, *restoreTable, *restoreFrom, *restoreTo); err != nil {
+			log.Fatalf("error restoring orders: %v", err)
+		}
+		return
+	}
+
+	// A batch never holds more than a second's worth of rows, so the rate
+	// limiter's burst can always cover it.
+	limiter := rate.NewLimiter(rate.Inf, *batchMax)
+	if *maxRate > 0 {
+		*batchMax = min(*batchMax, *maxRate)
+		*batchMin = min(*batchMin, *batchMax)
+		limiter = rate.NewLimiter(rate.Limit(*maxRate), *batchMax)
+	}
+
+	p := &purger{
+		db:       db,
+		archive:  a,
+		name:     *name,
+		sizer:    newBatchSizer(*target, *batchMin, *batchMax),
+		limiter:  limiter,
+		progress: newProgress(db),
+		interval: *interval,
 	}
+
+	ctx := context.Background()
+	if *pauseP99 > 0 {
+		p.probe = newProbe(db, *probeQuery, *pauseP99)
+		go p.probe.run(ctx, time.Millisecond*250)
+
+		metrics.GaugeFunc("purger_foreground_p99_seconds", "p99 latency of the foreground probe query.", func() float64 {
+			return p.probe.latency.Snapshot().P99.Seconds()
+		})
+	}
+	go p.progress.run(ctx, *progressInterval)
+
+	metrics.GaugeFunc("purger_paused", "1 while the purger is paused for foreground latency.", func() float64 {
+		if p.probe.paused() {
+			return 1
+		}
+		return 0
+	})
+	metrics.GaugeFunc("purger_batch_size", "Size of the purger's next batch.", func() float64 {
+		return float64(batchSize.Load())
+	})
+	metrics.GaugeFunc("purger_rows_remaining", "Expired orders left to purge.", func() float64 {
+		return float64(p.progress.rowsRemaining())
+	})
+	metrics.GaugeFunc("purger_eta_seconds", "Estimated time to purge the remaining expired orders.", func() float64 {
+		eta, _ := p.progress.eta()
+		return eta.Seconds()
+	})
+
+	if err = p.run(ctx); err != nil {
+		log.Fatalf("error purging orders: %v", err)
+	}
+}
+
+// order is an archived order. Totals are kept as exact decimals.
+type order struct {
+	ID         string      `json:"id"`
+	CustomerID string      `json:"customer_id"`
+	Total      json.Number `json:"total"`
+	TS         time.Time   `json:"ts"`
+}
+
+// purger deletes expired orders in key-ordered batches, archiving each
+// batch first. It runs flat out while there's a backlog, limited by the
+// rate ceiling and paused while foreground latency is high, and rests
+// between passes once it's caught up.
+type purger struct {
+	db       *pgxpool.Pool
+	archive  *archive.Archive
+	name     string
+	sizer    *batchSizer
+	limiter  *rate.Limiter
+	probe    *probe
+	progress *progress
+	interval time.Duration
 }
 
-func purgeOrders(db *pgxpool.Pool) error {
-	// Delete orders 5 years and older.
-	const stmt = `DELETE FROM orders WHERE ts <= now() - INTERVAL '43800h' LIMIT 10000`
-	for range time.NewTicker(time.Minute).C {
-		affected, err := db.Exec(context.Background(), stmt)
+// batchSize is the size of the next batch, for reporting.
+var batchSize atomic.Int64
+
+func (p *purger) run(ctx context.Context) error {
+	cur, err := loadCursor(ctx, p.db, p.name)
+	if err != nil {
+		return err
+	}
+	if !cur.atStart() {
+		fmt.Printf("resuming after order %s (%s)\n", cur.ID, cur.TS.Format(time.RFC3339))
+	}
+
+	backoff := time.Second
+	for {
+		batchSize.Store(int64(p.sizer.size))
+		p.probe.wait(ctx)
+
+		n, next, elapsed, err := p.purgeBatch(ctx, cur, p.sizer.size)
 		if err != nil {
-			return fmt.Errorf("purging orders: %w", err)
+			log.Printf("error purging batch: %v", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		if n > 0 {
+			cur = next
+			size := p.sizer.observe(n, elapsed)
+			fmt.Printf("deleted %d rows in %s (next batch %d)\n", n, elapsed.Round(time.Millisecond), size)
+			continue
+		}
+
+		// Orders can expire behind the cursor, as their ts only has to
+		// pass the cutoff, so each pass ends by starting again from the
+		// beginning.
+		if !cur.atStart() {
+			cur = start
+			if err = saveCursor(ctx, p.db, p.name, cur); err != nil {
+				log.Printf("error resetting cursor: %v", err)
+			}
+			continue
+		}
+
+		time.Sleep(p.interval)
+	}
+}
+
+// purgeBatch archives the next batch of expired orders after the cursor
+// and, once the archive has been verified, deletes exactly those orders
+// and moves the cursor past them. It returns the number of orders deleted
+// and the time spent in the database, which the batch size adapts to.
+func (p *purger) purgeBatch(ctx context.Context, cur cursor, size int) (int, cursor, time.Duration, error) {
+	// Select orders 5 years and older.
+	const selectStmt = `SELECT id, customer_id, total::STRING, ts
+											FROM orders
+											WHERE (ts, id) > ($1, $2::UUID)
+											AND ts <= now() - INTERVAL '43800h'
+											ORDER BY ts, id
+											LIMIT $3`
+
+	selectStart := time.Now()
+	rows, err := p.db.Query(ctx, selectStmt, cur.TS, cur.ID, size)
+	if err != nil {
+		return 0, cur, 0, fmt.Errorf("selecting expired orders: %w", err)
+	}
+
+	var ids []string
+	var batch []archive.Row
+	var last cursor
+	for rows.Next() {
+		var o order
+		var total string
+		if err = rows.Scan(&o.ID, &o.CustomerID, &total, &o.TS); err != nil {
+			rows.Close()
+			return 0, cur, 0, fmt.Errorf("scanning order: %w", err)
+		}
+		o.Total = json.Number(total)
+
+		b, err := json.Marshal(o)
+		if err != nil {
+			rows.Close()
+			return 0, cur, 0, fmt.Errorf("marshalling order: %w", err)
+		}
+
+		ids = append(ids, o.ID)
+		batch = append(batch, archive.Row{TS: o.TS, Data: b})
+		last = cursor{TS: o.TS, ID: o.ID}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, cur, 0, fmt.Errorf("iterating orders: %w", err)
+	}
+	elapsed := time.Since(selectStart)
+
+	if len(batch) == 0 {
+		return 0, cur, elapsed, nil
+	}
+
+	m, err := p.archive.Write(ctx, "orders", batch)
+	if err != nil {
+		archiveFailures.Inc()
+		return 0, cur, 0, fmt.Errorf("archiving orders: %w", err)
+	}
+	if err = p.archive.Verify(ctx, m); err != nil {
+		archiveFailures.Inc()
+		return 0, cur, 0, fmt.Errorf("verifying archive: %w", err)
+	}
+	rowsArchived.Add(float64(m.Rows))
+
+	if err = p.limiter.WaitN(ctx, len(ids)); err != nil {
+		return 0, cur, 0, fmt.Errorf("waiting for rate limit: %w", err)
+	}
+
+	const deleteStmt = `DELETE FROM orders WHERE id = ANY($1::UUID[])`
+
+	deleteStart := time.Now()
+	var deleted int64
+	err = crdbpgx.ExecuteTx(ctx, p.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		affected, err := tx.Exec(ctx, deleteStmt, ids)
+		if err != nil {
+			return fmt.Errorf("deleting orders: %w", err)
+		}
+		deleted = affected.RowsAffected()
+
+		return saveCursor(ctx, tx, p.name, last)
+	})
+	if err != nil {
+		return 0, cur, 0, fmt.Errorf("purging orders: %w", err)
+	}
+	elapsed += time.Since(deleteStart)
+
+	rowsPurged.Add(float64(deleted))
+	p.progress.deleted.Add(uint64(deleted))
+
+	return len(ids), last, elapsed, nil
+}
+
+// restoreOrders upserts the archived orders with a ts in [from, to) into
+// table. Either end of the range may be empty to leave it open.
+func restoreOrders(db *pgxpool.Pool, a *archive.Archive, table, from, to string) error {
+	var start, end time.Time
+	var err error
+	if from != "" {
+		if start, err = time.Parse(time.DateOnly, from); err != nil {
+			return fmt.Errorf("parsing -restore-from: %w", err)
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse(time.DateOnly, to); err != nil {
+			return fmt.Errorf("parsing -restore-to: %w", err)
+		}
+	}
+
+	ctx := context.Background()
+	manifests, err := a.Manifests(ctx, "orders", start, end)
+	if err != nil {
+		return fmt.Errorf("listing archive: %w", err)
+	}
+
+	stmt := fmt.Sprintf(`UPSERT INTO %s (id, customer_id, total, ts)
+											 SELECT * FROM unnest($1::UUID[], $2::UUID[], $3::DECIMAL[], $4::TIMESTAMPTZ[])`,
+		pgx.Identifier{table}.Sanitize(),
+	)
+
+	var restored int
+	for _, m := range manifests {
+		rows, err := a.Read(ctx, m)
+		if err != nil {
+			return err
+		}
+
+		var ids, customerIDs, totals []string
+		var timestamps []time.Time
+		for _, r := range rows {
+			var o order
+			if err = json.Unmarshal(r, &o); err != nil {
+				return fmt.Errorf("parsing order in batch %s: %w", m.Batch, err)
+			}
+
+			if (!start.IsZero() && o.TS.Before(start)) || (!end.IsZero() && !o.TS.Before(end)) {
+				continue
+			}
+
+			ids = append(ids, o.ID)
+			customerIDs = append(customerIDs, o.CustomerID)
+			totals = append(totals, o.Total.String())
+			timestamps = append(timestamps, o.TS)
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		if _, err = db.Exec(ctx, stmt, ids, customerIDs, totals, timestamps); err != nil {
+			return fmt.Errorf("restoring batch %s: %w", m.Batch, err)
 		}
 
-		fmt.Printf("deleted %d rows\n", affected.RowsAffected())
+		restored += len(ids)
+		fmt.Printf("restored %d rows from %s\n", len(ids), m.File)
 	}
 
-	return fmt.Errorf("finished purgeOrders unexpectedly")
+	fmt.Printf("restored %d rows from %d batches\n", restored, len(manifests))
+	return nil
 }
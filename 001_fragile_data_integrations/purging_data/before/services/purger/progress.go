@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// progress tracks how many expired orders are left and, from the recent
+// deletion rate, how long they'll take to purge.
+type progress struct {
+	db      *pgxpool.Pool
+	deleted *stats.Counter
+
+	mu        sync.Mutex
+	remaining int64
+	rate      float64 // Rows per second, smoothed.
+	last      uint64
+	lastAt    time.Time
+}
+
+func newProgress(db *pgxpool.Pool) *progress {
+	return &progress{
+		db:      db,
+		deleted: stats.NewCounter(),
+		lastAt:  time.Now(),
+	}
+}
+
+// run reports progress every interval until ctx is done.
+func (p *progress) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.update(ctx); err != nil {
+			log.Printf("error counting expired orders: %v", err)
+		} else {
+			p.print()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *progress) update(ctx context.Context) error {
+	// Read slightly in the past so counting doesn't contend with the
+	// purger's deletes.
+	const stmt = `SELECT count(*) FROM orders
+								AS OF SYSTEM TIME '-10s'
+								WHERE ts <= now() - INTERVAL '43800h'`
+
+	var remaining int64
+	if err := p.db.QueryRow(ctx, stmt).Scan(&remaining); err != nil {
+		return fmt.Errorf("counting orders: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	deleted := p.deleted.Load()
+	rate := float64(deleted-p.last) / now.Sub(p.lastAt).Seconds()
+	if p.rate == 0 {
+		p.rate = rate
+	} else {
+		p.rate = 0.3*rate + 0.7*p.rate
+	}
+
+	p.remaining, p.last, p.lastAt = remaining, deleted, now
+	return nil
+}
+
+// eta returns how long the remaining orders will take to purge at the
+// current rate, or false if nothing is being purged.
+func (p *progress) eta() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.remaining == 0 {
+		return 0, true
+	}
+	if p.rate < 1 {
+		return 0, false
+	}
+
+	return time.Duration(float64(p.remaining) / p.rate * float64(time.Second)), true
+}
+
+func (p *progress) rowsRemaining() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.remaining
+}
+
+func (p *progress) print() {
+	eta, ok := p.eta()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	etaText := "unknown"
+	if ok {
+		etaText = eta.Round(time.Second).String()
+	}
+
+	fmt.Printf("remaining: %d expired orders, purging %.0f rows/s, eta %s\n", p.remaining, p.rate, etaText)
+}
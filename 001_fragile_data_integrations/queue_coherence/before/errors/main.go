@@ -10,7 +10,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
@@ -25,10 +27,17 @@ var (
 
 func main() {
 	writeInterval := flag.Duration("w", time.Millisecond*1000, "interval between writes")
-	flag.Parse()
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.AtomicCounter("queue_coherence_db_writes_total", "Stock updates written to the database.", &exptectedCount)
+	metrics.AtomicCounter("queue_coherence_queue_reads_total", "Stock updates read from the queue.", &actualCount)
 
 	kafkaWriter := &kafka.Writer{
-		Addr:                   kafka.TCP("localhost:9092"),
+		Addr:                   kafka.TCP(cfg.Kafka.Brokers...),
 		Topic:                  "stock",
 		AllowAutoTopicCreation: true,
 		BatchSize:              1,
@@ -36,13 +45,13 @@ func main() {
 	defer kafkaWriter.Close()
 
 	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
+		Brokers:     cfg.Kafka.Brokers,
 		GroupID:     uuid.NewString(),
 		Topic:       "stock",
 		StartOffset: kafka.LastOffset,
 	})
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	go simulateQueueConsumer(kafkaReader)
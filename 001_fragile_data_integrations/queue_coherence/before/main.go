@@ -5,44 +5,74 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/workload"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
 )
 
 var (
-	productID = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+	productIDs []string
 
 	dbQuantities    *quantities
 	queueQuantities *quantities
+
+	mismatches int64
+
+	// version is the quantity written next, so every write is distinct.
+	version atomic.Int64
 )
 
 func main() {
 	readInterval := flag.Duration("r", time.Millisecond*100, "interval between reads")
-	writeInterval := flag.Duration("w", time.Millisecond*1000, "interval between writes")
-	flag.Parse()
+	writeInterval := flag.Duration("w", time.Millisecond*1000, "interval between each writer's writes")
+	wl := workload.Flags(flag.CommandLine)
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	wl.Interval = *writeInterval
+	if err := wl.Validate(); err != nil {
+		log.Fatalf("invalid workload: %v", err)
+	}
+
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.GaugeFunc("queue_coherence_mismatched_products", "Products whose queue quantity disagrees with the database.", func() float64 {
+		return float64(atomic.LoadInt64(&mismatches))
+	})
 
 	kafkaWriter := &kafka.Writer{
-		Addr:                   kafka.TCP("localhost:9092"),
+		Addr:                   kafka.TCP(cfg.Kafka.Brokers...),
 		Topic:                  "stock",
+		Balancer:               &kafka.Hash{},
 		AllowAutoTopicCreation: true,
 	}
 	defer kafkaWriter.Close()
 
 	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{"localhost:9092"},
+		Brokers: cfg.Kafka.Brokers,
 		GroupID: "cg-a",
 		Topic:   "stock",
 	})
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
+	productIDs = workload.ProductIDs(wl.Products)
+	if err := seedProducts(db); err != nil {
+		log.Fatalf("error seeding products: %v", err)
+	}
+
 	dbQuantities = &quantities{
 		name:     "db quantities",
 		products: map[string]int{},
@@ -54,8 +84,21 @@ func main() {
 
 	go simulatePollingConsumer(db, *readInterval)
 	go simulateQueueConsumer(kafkaReader)
-	go simulateProducer(db, kafkaWriter, *writeInterval)
-	printLoop()
+
+	if wl.Duration == 0 {
+		go simulateProducer(db, kafkaWriter, *wl)
+		printLoop()
+	}
+
+	go printLoop()
+	result := simulateProducer(db, kafkaWriter, *wl)
+
+	// Let both consumers catch up before deciding whether they agree.
+	time.Sleep(wl.Settle)
+	report := workload.NewReport("queue_coherence/before", *wl, result, len(mismatched()))
+	if err := report.Write(wl.Report); err != nil {
+		log.Fatalf("error writing report: %v", err)
+	}
 }
 
 type quantities struct {
@@ -77,6 +120,18 @@ func (q *quantities) set(product string, stock int) {
 	q.products[product] = stock
 }
 
+func seedProducts(db *pgxpool.Pool) error {
+	const stmt = `INSERT INTO stock (product_id, quantity)
+								SELECT unnest($1::STRING[]), 0
+								ON CONFLICT DO NOTHING`
+
+	if _, err := db.Exec(context.Background(), stmt, productIDs); err != nil {
+		return fmt.Errorf("inserting products: %w", err)
+	}
+
+	return nil
+}
+
 func simulatePollingConsumer(db *pgxpool.Pool, rate time.Duration) error {
 	for range time.NewTicker(rate).C {
 		if err := simulateRead(db); err != nil {
@@ -88,12 +143,14 @@ func simulatePollingConsumer(db *pgxpool.Pool, rate time.Duration) error {
 }
 
 func simulateRead(db *pgxpool.Pool) error {
-	dbQuantity, err := readFromDB(db, productID)
+	dbQuantity, err := readFromDB(db, productIDs)
 	if err != nil {
 		return fmt.Errorf("reading from db: %w", err)
 	}
 
-	dbQuantities.set(productID, dbQuantity)
+	for id, quantity := range dbQuantity {
+		dbQuantities.set(id, quantity)
+	}
 	return nil
 }
 
@@ -113,28 +170,26 @@ func simulateQueueConsumer(reader *kafka.Reader) error {
 	}
 }
 
-func simulateProducer(db *pgxpool.Pool, kafka *kafka.Writer, rate time.Duration) error {
-	i := 0
-	for range time.NewTicker(rate).C {
-		i++
-		if err := simulateWrite(db, kafka, i); err != nil {
-			log.Printf("error simulating write: %v", err)
-		}
+func simulateProducer(db *pgxpool.Pool, writer *kafka.Writer, wl workload.Config) workload.Result {
+	write := func(ctx context.Context, productID string) error {
+		return simulateWrite(ctx, db, writer, productID, int(version.Add(1)))
 	}
 
-	return fmt.Errorf("finished simulateWrites unexectedly")
+	return workload.Run(context.Background(), wl, write, func(err error) {
+		log.Printf("error simulating write: %v", err)
+	})
 }
 
-func simulateWrite(db *pgxpool.Pool, writer *kafka.Writer, stock int) error {
+func simulateWrite(ctx context.Context, db *pgxpool.Pool, writer *kafka.Writer, productID string, stock int) error {
 	// Update stock in database.
 	const stmt = `UPDATE stock SET quantity = $1 WHERE product_id = $2`
-	if _, err := db.Exec(context.Background(), stmt, stock, productID); err != nil {
+	if _, err := db.Exec(ctx, stmt, stock, productID); err != nil {
 		return fmt.Errorf("updating database stock: %w", err)
 	}
 
 	// Publish message.
 	err := writer.WriteMessages(
-		context.Background(),
+		ctx,
 		kafka.Message{
 			Key:   []byte(productID),
 			Value: []byte(strconv.Itoa(stock)),
@@ -148,42 +203,60 @@ func simulateWrite(db *pgxpool.Pool, writer *kafka.Writer, stock int) error {
 	return nil
 }
 
-func printLoop() {
-	for range time.NewTicker(time.Second).C {
-		dbQuantities.productsMu.RLock()
-		queueQuantities.productsMu.RLock()
+// mismatched describes each product whose queue quantity disagrees with
+// the database.
+func mismatched() []string {
+	dbQuantities.productsMu.RLock()
+	defer dbQuantities.productsMu.RUnlock()
+	queueQuantities.productsMu.RLock()
+	defer queueQuantities.productsMu.RUnlock()
 
-		lines := []string{}
+	lines := []string{}
+	for dbk, dbv := range dbQuantities.products {
+		cv := queueQuantities.products[dbk]
 
-		for dbk, dbv := range dbQuantities.products {
-			cv := queueQuantities.products[dbk]
-
-			if cv != dbv {
-				lines = append(lines, fmt.Sprintf("%s (db: %d vs queue: %d)\n", dbk, dbv, cv))
-			}
+		if cv != dbv {
+			lines = append(lines, fmt.Sprintf("%s (db: %d vs queue: %d)", dbk, dbv, cv))
 		}
+	}
+	sort.Strings(lines)
 
-		dbQuantities.productsMu.RUnlock()
-		queueQuantities.productsMu.RUnlock()
+	return lines
+}
+
+func printLoop() {
+	for range time.NewTicker(time.Second).C {
+		lines := mismatched()
+		atomic.StoreInt64(&mismatches, int64(len(lines)))
 
 		fmt.Println("\033[H\033[2J")
 		if len(lines) > 0 {
-			fmt.Println(strings.Join(lines, "\n"))
+			fmt.Printf("%d of %d products mismatched\n\n", len(lines), len(productIDs))
+			fmt.Println(strings.Join(lines[:min(len(lines), 20)], "\n"))
 		} else {
 			fmt.Println("queue and database match")
 		}
 	}
 }
 
-func readFromDB(db *pgxpool.Pool, productID string) (int, error) {
-	const stmt = `SELECT quantity FROM stock WHERE product_id = $1`
+func readFromDB(db *pgxpool.Pool, productIDs []string) (map[string]int, error) {
+	const stmt = `SELECT product_id, quantity FROM stock WHERE product_id = ANY($1)`
 
-	row := db.QueryRow(context.Background(), stmt, productID)
-
-	var quantity int
-	if err := row.Scan(&quantity); err != nil {
-		return 0, fmt.Errorf("getting stock from database: %w", err)
+	rows, err := db.Query(context.Background(), stmt, productIDs)
+	if err != nil {
+		return nil, fmt.Errorf("getting stock from database: %w", err)
+	}
+	defer rows.Close()
+
+	quantities := map[string]int{}
+	for rows.Next() {
+		var id string
+		var quantity int
+		if err = rows.Scan(&id, &quantity); err != nil {
+			return nil, fmt.Errorf("scanning stock: %w", err)
+		}
+		quantities[id] = quantity
 	}
 
-	return quantity, nil
+	return quantities, rows.Err()
 }
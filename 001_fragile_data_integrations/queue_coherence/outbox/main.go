@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/outbox"
+	"github.com/cockroachdb/architectural-simplification/pkg/workload"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	productIDs []string
+
+	dbQuantities    *quantities
+	queueQuantities *quantities
+
+	mismatches int64
+	duplicates uint64
+
+	// version is the quantity written next, so every write is distinct.
+	version atomic.Int64
+)
+
+func main() {
+	readInterval := flag.Duration("r", time.Millisecond*100, "interval between reads")
+	writeInterval := flag.Duration("w", time.Millisecond*1000, "interval between each writer's writes")
+	mode := flag.String("relay", "poll", "how the relay reads the outbox (poll or changefeed)")
+	wl := workload.Flags(flag.CommandLine)
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	wl.Interval = *writeInterval
+	if err := wl.Validate(); err != nil {
+		log.Fatalf("invalid workload: %v", err)
+	}
+
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.GaugeFunc("queue_coherence_mismatched_products", "Products whose queue quantity disagrees with the database.", func() float64 {
+		return float64(atomic.LoadInt64(&mismatches))
+	})
+	metrics.AtomicCounter("queue_coherence_duplicate_events_total", "Outbox events the consumer had already seen.", &duplicates)
+
+	db := connect.MustDatabase(cfg.Database.URL)
+	defer db.Close()
+
+	productIDs = workload.ProductIDs(wl.Products)
+	if err := seedProducts(db); err != nil {
+		log.Fatalf("error seeding products: %v", err)
+	}
+
+	publisher := outbox.NewKafkaPublisher(cfg.Kafka.Brokers, "stock_events")
+	defer publisher.Close()
+
+	var relay *outbox.Relay
+	switch *mode {
+	case "poll":
+		relay = outbox.NewRelay(db, publisher)
+		go relay.Poll(context.Background())
+
+	case "changefeed":
+		partitions, err := changefeed.KafkaPartitions(context.Background(), cfg.Kafka.Brokers, "outbox")
+		if err != nil {
+			log.Printf("error reading topic partitions: %v", err)
+		}
+
+		relay = outbox.NewRelay(db, publisher, outbox.WithPartitions(partitions))
+		source := changefeed.MustOpen(cfg.Changefeed.Source, cfg.Kafka.Brokers, "outbox")
+		defer source.Close()
+		go func() {
+			if err := relay.Run(context.Background(), source); err != nil {
+				log.Fatalf("error relaying outbox events: %v", err)
+			}
+		}()
+
+	default:
+		log.Fatalf("unknown relay %q", *mode)
+	}
+
+	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Kafka.Brokers,
+		GroupID: uuid.NewString(),
+		Topic:   "stock_events",
+	})
+
+	dbQuantities = &quantities{
+		products: map[string]int{},
+	}
+	queueQuantities = &quantities{
+		products: map[string]int{},
+	}
+
+	go simulatePollingConsumer(db, *readInterval)
+	go simulateQueueConsumer(kafkaReader)
+
+	box := outbox.New()
+	if wl.Duration == 0 {
+		go simulateProducer(db, box, *wl)
+		printLoop(relay)
+	}
+
+	go printLoop(relay)
+	result := simulateProducer(db, box, *wl)
+
+	// Let both consumers catch up before deciding whether they agree.
+	time.Sleep(wl.Settle)
+	report := workload.NewReport("queue_coherence/outbox", *wl, result, len(mismatched()))
+	report.Extra = map[string]any{
+		"relay":      *mode,
+		"duplicates": atomic.LoadUint64(&duplicates),
+	}
+	if err := report.Write(wl.Report); err != nil {
+		log.Fatalf("error writing report: %v", err)
+	}
+}
+
+type quantities struct {
+	productsMu sync.RWMutex
+	products   map[string]int
+}
+
+func (q *quantities) set(product string, stock int) {
+	q.productsMu.Lock()
+	defer q.productsMu.Unlock()
+
+	q.products[product] = stock
+}
+
+func seedProducts(db *pgxpool.Pool) error {
+	const stmt = `INSERT INTO stock (product_id, quantity)
+								SELECT unnest($1::STRING[]), 0
+								ON CONFLICT DO NOTHING`
+
+	if _, err := db.Exec(context.Background(), stmt, productIDs); err != nil {
+		return fmt.Errorf("inserting products: %w", err)
+	}
+
+	return nil
+}
+
+func simulatePollingConsumer(db *pgxpool.Pool, rate time.Duration) error {
+	for range time.NewTicker(rate).C {
+		if err := simulateRead(db); err != nil {
+			log.Printf("error simulating read: %v", err)
+		}
+	}
+
+	return fmt.Errorf("finished simulateReads unexectedly")
+}
+
+func simulateRead(db *pgxpool.Pool) error {
+	dbQuantity, err := readFromDB(db, productIDs)
+	if err != nil {
+		return fmt.Errorf("reading from db: %w", err)
+	}
+
+	for id, quantity := range dbQuantity {
+		dbQuantities.set(id, quantity)
+	}
+	return nil
+}
+
+type stockChanged struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+func simulateQueueConsumer(reader *kafka.Reader) error {
+	// Events are delivered at least once, so remember the last one seen
+	// for each product and drop any that aren't newer.
+	seen := map[string]int64{}
+
+	for {
+		m, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			log.Printf("error reading message: %v", err)
+			continue
+		}
+
+		seq := outbox.Seq(m)
+		if seq <= seen[string(m.Key)] {
+			atomic.AddUint64(&duplicates, 1)
+			continue
+		}
+		seen[string(m.Key)] = seq
+
+		var e stockChanged
+		if err = json.Unmarshal(m.Value, &e); err != nil {
+			log.Printf("error parsing message: %v", err)
+			continue
+		}
+
+		queueQuantities.set(e.ProductID, e.Quantity)
+	}
+}
+
+func simulateProducer(db *pgxpool.Pool, box *outbox.Outbox, wl workload.Config) workload.Result {
+	write := func(ctx context.Context, productID string) error {
+		return simulateWrite(ctx, db, box, productID, int(version.Add(1)))
+	}
+
+	return workload.Run(context.Background(), wl, write, func(err error) {
+		log.Printf("error simulating write: %v", err)
+	})
+}
+
+func simulateWrite(ctx context.Context, db *pgxpool.Pool, box *outbox.Outbox, productID string, stock int) error {
+	// Update stock and record the event in the same transaction.
+	return crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		const stmt = `UPDATE stock SET quantity = $1 WHERE product_id = $2`
+		if _, err := tx.Exec(ctx, stmt, stock, productID); err != nil {
+			return fmt.Errorf("updating database stock: %w", err)
+		}
+
+		return box.Write(ctx, tx, outbox.Event{
+			AggregateKey: productID,
+			Type:         "stock_changed",
+			Payload:      stockChanged{ProductID: productID, Quantity: stock},
+		})
+	})
+}
+
+// mismatched describes each product whose queue quantity disagrees with
+// the database.
+func mismatched() []string {
+	dbQuantities.productsMu.RLock()
+	defer dbQuantities.productsMu.RUnlock()
+	queueQuantities.productsMu.RLock()
+	defer queueQuantities.productsMu.RUnlock()
+
+	lines := []string{}
+	for dbk, dbv := range dbQuantities.products {
+		cv := queueQuantities.products[dbk]
+
+		if cv != dbv {
+			lines = append(lines, fmt.Sprintf("%s (db: %d vs queue: %d)", dbk, dbv, cv))
+		}
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+func printLoop(relay *outbox.Relay) {
+	for range time.NewTicker(time.Second).C {
+		lines := mismatched()
+		atomic.StoreInt64(&mismatches, int64(len(lines)))
+
+		fmt.Println("\033[H\033[2J")
+		if ts := relay.Watermark().Resolved(); !ts.IsZero() {
+			fmt.Printf("relay has every event up to %s\n", ts.Time().Format(time.TimeOnly))
+		}
+		fmt.Printf("duplicates dropped: %d\n", atomic.LoadUint64(&duplicates))
+		if len(lines) > 0 {
+			fmt.Printf("%d of %d products mismatched\n\n", len(lines), len(productIDs))
+			fmt.Println(strings.Join(lines[:min(len(lines), 20)], "\n"))
+		} else {
+			fmt.Println("queue and database match")
+		}
+	}
+}
+
+func readFromDB(db *pgxpool.Pool, productIDs []string) (map[string]int, error) {
+	const stmt = `SELECT product_id, quantity FROM stock WHERE product_id = ANY($1)`
+
+	rows, err := db.Query(context.Background(), stmt, productIDs)
+	if err != nil {
+		return nil, fmt.Errorf("getting stock from database: %w", err)
+	}
+	defer rows.Close()
+
+	quantities := map[string]int{}
+	for rows.Next() {
+		var id string
+		var quantity int
+		if err = rows.Scan(&id, &quantity); err != nil {
+			return nil, fmt.Errorf("scanning stock: %w", err)
+		}
+		quantities[id] = quantity
+	}
+
+	return quantities, rows.Err()
+}
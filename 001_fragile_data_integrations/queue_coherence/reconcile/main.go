@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
+	"github.com/cockroachdb/architectural-simplification/pkg/outbox"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	driftGauge   *prometheus.GaugeVec
+	repairs      prometheus.Counter
+	passDuration *metrics.Latency
+)
+
+func main() {
+	topic := flag.String("topic", "stock", "topic holding stock updates")
+	format := flag.String("format", "changefeed", "format of the topic's messages (plain, changefeed or outbox)")
+	interval := flag.Duration("i", time.Second*5, "interval between reconciliations")
+	grace := flag.Duration("grace", time.Second*2, "time a database change has to reach the topic before it counts as drift")
+	repair := flag.Bool("repair", false, "re-publish the database value of drifted products")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Kafka:    config.KafkaConfig{Brokers: []string{"localhost:9092"}},
+		Metrics:  config.MetricsConfig{Addr: ":2113"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	driftGauge = metrics.NewGaugeVec("queue_coherence_drifted_products", "Products whose topic state disagrees with the database, by kind of drift.", "kind")
+	repairs = metrics.NewCounter("queue_coherence_repairs_total", "Repair messages emitted for drifted products.")
+	passDuration = metrics.NewLatency("queue_coherence_reconcile_seconds", "Time taken to reconcile the stock table against the topic.", 100)
+
+	if *format != "plain" && *format != "changefeed" && *format != "outbox" {
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	db := connect.MustDatabase(cfg.Database.URL)
+	defer db.Close()
+
+	// Read the topic from the start in a group of our own, so the topic's
+	// whole history is folded into the latest state of each key.
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Kafka.Brokers,
+		GroupID:     uuid.NewString(),
+		Topic:       *topic,
+		StartOffset: kafka.FirstOffset,
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.Kafka.Brokers...),
+		Topic:    *topic,
+		Balancer: &kafka.Hash{},
+	}
+	defer writer.Close()
+
+	r := &reconciler{
+		db:     db,
+		writer: writer,
+		format: *format,
+		grace:  *grace,
+		repair: *repair,
+		state:  map[string]topicValue{},
+	}
+
+	go r.consume(reader)
+	r.loop(*interval)
+}
+
+// topicValue is the latest value of a key in the topic.
+type topicValue struct {
+	quantity int
+	seq      int64
+	at       time.Time
+}
+
+// dbValue is a row of the stock table.
+type dbValue struct {
+	quantity int
+	updated  time.Time
+}
+
+// drift is a product whose topic state disagrees with the database.
+type drift struct {
+	productID string
+	db        *dbValue
+	topic     *topicValue
+	age       time.Duration
+}
+
+func (d drift) kind() string {
+	switch {
+	case d.topic == nil:
+		return "missing_from_topic"
+	case d.db == nil:
+		return "missing_from_db"
+	default:
+		return "mismatch"
+	}
+}
+
+type reconciler struct {
+	db     *pgxpool.Pool
+	writer *kafka.Writer
+	format string
+	grace  time.Duration
+	repair bool
+
+	stateMu sync.RWMutex
+	state   map[string]topicValue
+}
+
+type stockMessage struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+func (r *reconciler) consume(reader *kafka.Reader) {
+	for {
+		m, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			log.Printf("error reading message: %v", err)
+			continue
+		}
+
+		if err = r.apply(m); err != nil {
+			log.Printf("error applying message: %v", err)
+		}
+	}
+}
+
+// apply folds a message into the latest state of its key. Tombstones
+// remove the key, as they would from a compacted topic.
+func (r *reconciler) apply(m kafka.Message) error {
+	var key string
+	var msg *stockMessage
+	var seq int64
+
+	switch r.format {
+	case "plain":
+		key = string(m.Key)
+		if len(m.Value) > 0 {
+			quantity, err := strconv.Atoi(string(m.Value))
+			if err != nil {
+				return fmt.Errorf("parsing quantity: %w", err)
+			}
+			msg = &stockMessage{ProductID: key, Quantity: quantity}
+		}
+
+	case "changefeed":
+		e, err := changefeed.Decode[stockMessage](m.Key, m.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			return fmt.Errorf("parsing changefeed message: %w", err)
+		}
+		if e.IsResolved() {
+			return nil
+		}
+		key, msg = e.Key.String(), e.After
+
+	case "outbox":
+		key, seq = string(m.Key), outbox.Seq(m)
+		if len(m.Value) > 0 {
+			msg = &stockMessage{}
+			if err := json.Unmarshal(m.Value, msg); err != nil {
+				return fmt.Errorf("parsing outbox event: %w", err)
+			}
+		}
+	}
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	// Outbox events may be redelivered out of order after a relay restart.
+	if seq > 0 && seq <= r.state[key].seq {
+		return nil
+	}
+
+	if msg == nil {
+		delete(r.state, key)
+		return nil
+	}
+
+	r.state[key] = topicValue{quantity: msg.Quantity, seq: seq, at: m.Time}
+	return nil
+}
+
+func (r *reconciler) loop(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		start := time.Now()
+		drifts, total, err := r.reconcile(context.Background())
+		if err != nil {
+			log.Printf("error reconciling: %v", err)
+			continue
+		}
+		passDuration.Record(time.Since(start))
+
+		if r.repair && len(drifts) > 0 {
+			if err = r.repairDrift(context.Background(), drifts); err != nil {
+				log.Printf("error repairing drift: %v", err)
+			}
+		}
+
+		printReport(drifts, total)
+	}
+}
+
+// reconcile compares every row of the stock table with the topic's state,
+// returning the drifted products and the number compared.
+func (r *reconciler) reconcile(ctx context.Context) ([]drift, int, error) {
+	rows, err := r.readDB(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading stock: %w", err)
+	}
+
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+
+	now := time.Now()
+	var drifts []drift
+
+	for id, row := range rows {
+		// Give recent changes time to reach the topic.
+		if now.Sub(row.updated) < r.grace {
+			continue
+		}
+
+		tv, ok := r.state[id]
+		if ok && tv.quantity == row.quantity {
+			continue
+		}
+
+		d := drift{productID: id, db: &row, age: now.Sub(row.updated)}
+		if ok {
+			d.topic = &tv
+		}
+		drifts = append(drifts, d)
+	}
+
+	for id, tv := range r.state {
+		if _, ok := rows[id]; ok || now.Sub(tv.at) < r.grace {
+			continue
+		}
+
+		drifts = append(drifts, drift{productID: id, topic: &tv, age: now.Sub(tv.at)})
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].age > drifts[j].age
+	})
+
+	counts := map[string]float64{"mismatch": 0, "missing_from_topic": 0, "missing_from_db": 0}
+	for _, d := range drifts {
+		counts[d.kind()]++
+	}
+	for kind, n := range counts {
+		driftGauge.WithLabelValues(kind).Set(n)
+	}
+
+	total := len(rows)
+	for id := range r.state {
+		if _, ok := rows[id]; !ok {
+			total++
+		}
+	}
+
+	return drifts, total, nil
+}
+
+func (r *reconciler) readDB(ctx context.Context) (map[string]dbValue, error) {
+	const stmt = `SELECT product_id, quantity, crdb_internal_mvcc_timestamp::STRING FROM stock`
+
+	rows, err := r.db.Query(ctx, stmt)
+	if err != nil {
+		return nil, fmt.Errorf("querying stock: %w", err)
+	}
+	defer rows.Close()
+
+	values := map[string]dbValue{}
+	for rows.Next() {
+		var id, mvcc string
+		var v dbValue
+		if err = rows.Scan(&id, &v.quantity, &mvcc); err != nil {
+			return nil, fmt.Errorf("scanning stock: %w", err)
+		}
+
+		ts, err := changefeed.ParseTimestamp(mvcc)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mvcc timestamp: %w", err)
+		}
+		v.updated = ts.Time()
+
+		values[id] = v
+	}
+
+	return values, rows.Err()
+}
+
+// repairDrift re-publishes the database's value of each drifted product
+// the way the topic's producer would: plain messages are written to the
+// topic directly, changefeed rows are rewritten so the changefeed emits
+// them again, and outbox events are written to the outbox.
+func (r *reconciler) repairDrift(ctx context.Context, drifts []drift) error {
+	var ids []string
+	var messages []kafka.Message
+	var events []outbox.Event
+
+	for _, d := range drifts {
+		id := d.productID
+
+		switch r.format {
+		case "plain":
+			m := kafka.Message{Key: []byte(id)}
+			if d.db != nil {
+				m.Value = []byte(strconv.Itoa(d.db.quantity))
+			}
+			messages = append(messages, m)
+
+		case "changefeed":
+			if d.db != nil {
+				ids = append(ids, id)
+			}
+
+		case "outbox":
+			if d.db != nil {
+				events = append(events, outbox.Event{
+					AggregateKey: id,
+					Type:         "stock_reconciled",
+					Payload:      stockMessage{ProductID: id, Quantity: d.db.quantity},
+				})
+			}
+		}
+	}
+
+	var n int
+	switch {
+	case len(messages) > 0:
+		if err := r.writer.WriteMessages(ctx, messages...); err != nil {
+			return fmt.Errorf("writing repair messages: %w", err)
+		}
+		n = len(messages)
+
+	case len(ids) > 0:
+		const stmt = `UPDATE stock SET quantity = quantity WHERE product_id = ANY($1)`
+		if _, err := r.db.Exec(ctx, stmt, ids); err != nil {
+			return fmt.Errorf("touching drifted rows: %w", err)
+		}
+		n = len(ids)
+
+	case len(events) > 0:
+		box := outbox.New()
+		err := crdbpgx.ExecuteTx(ctx, r.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			return box.Write(ctx, tx, events...)
+		})
+		if err != nil {
+			return fmt.Errorf("writing repair events: %w", err)
+		}
+		n = len(events)
+	}
+
+	repairs.Add(float64(n))
+	return nil
+}
+
+func printReport(drifts []drift, total int) {
+	fmt.Println("\033[H\033[2J")
+	fmt.Printf("%s: %d of %d products drifted\n\n", time.Now().Format(time.TimeOnly), len(drifts), total)
+	if len(drifts) == 0 {
+		return
+	}
+
+	lines := []string{fmt.Sprintf("%-36s  %-10s  %-10s  %s", "product", "db", "topic", "age")}
+	for _, d := range drifts {
+		dbv, tv := "missing", "missing"
+		if d.db != nil {
+			dbv = strconv.Itoa(d.db.quantity)
+		}
+		if d.topic != nil {
+			tv = strconv.Itoa(d.topic.quantity)
+		}
+
+		lines = append(lines, fmt.Sprintf("%-36s  %-10s  %-10s  %s", d.productID, dbv, tv, d.age.Round(time.Millisecond)))
+	}
+
+	fmt.Println(strings.Join(lines, "\n"))
+}
@@ -3,39 +3,34 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/segmentio/kafka-go"
 )
 
 func main() {
-	kafkaURL, ok := os.LookupEnv("KAFKA_URL")
-	if !ok {
-		log.Fatal("missing KAFKA_URL env var")
-	}
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database, config.Kafka)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	indexURL, ok := os.LookupEnv("INDEX_URL")
-	if !ok {
-		log.Fatalf("missing INDEX_URL env var")
-	}
+	decoder := changefeed.MustDecoder(cfg.Changefeed.Format, cfg.Changefeed.Registry)
 
-	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{kafkaURL},
-		GroupID:     uuid.NewString(),
-		Topic:       "products.store.product",
-		StartOffset: kafka.LastOffset,
-	})
+	source := changefeed.MustOpen(cfg.Changefeed.Source, cfg.Kafka.Brokers, "products.store.product")
+	defer source.Close()
 
-	db := connect.MustDatabase(indexURL)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
-	consume(kafkaReader, db)
+	consume(source, decoder, db)
 }
 
 type cdcEvent struct {
@@ -66,30 +61,59 @@ type cdcEvent struct {
 	} `json:"payload"`
 }
 
-func consume(reader *kafka.Reader, db *pgxpool.Pool) {
-	avgDelay := rollingAverage(50)
+func consume(source changefeed.Source, decoder *changefeed.Decoder, db *pgxpool.Pool) {
+	delays := metrics.NewLatency("indexer_delay_seconds", "Time between a product being written and it being indexed.", 1000)
 
 	for {
-		msg, err := reader.ReadMessage(context.Background())
+		msg, err := source.Fetch(context.Background())
+		if errors.Is(err, changefeed.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("error reading event: %v", err)
 			continue
 		}
 
-		var event cdcEvent
-		if err = json.Unmarshal(msg.Value, &event); err != nil {
+		event, err := parseEvent(decoder, msg)
+		if err != nil {
 			log.Printf("error parsing event: %v", err)
+			msg.Nack(err)
 			continue
 		}
 
 		ts, err := updateIndex(db, event)
 		if err != nil {
 			log.Printf("error updating index: %v", err)
+			msg.Nack(err)
 			continue
 		}
 
-		fmt.Printf("average delay: %s\r", avgDelay(time.Since(ts)))
+		if err = msg.Ack(context.Background()); err != nil {
+			log.Printf("error acknowledging event: %v", err)
+		}
+
+		delays.Record(time.Since(ts))
+		fmt.Printf("delay: %s\r", delays.Snapshot())
+	}
+}
+
+// parseEvent reads a connector event. The JSON converter wraps events in
+// a schema and payload, whereas with the Avro converter the event is the
+// payload itself.
+func parseEvent(decoder *changefeed.Decoder, msg changefeed.Message) (cdcEvent, error) {
+	_, value, err := decoder.JSON(context.Background(), msg)
+	if err != nil {
+		return cdcEvent{}, err
+	}
+
+	var event cdcEvent
+	if decoder != nil {
+		err = json.Unmarshal(value, &event.Payload)
+	} else {
+		err = json.Unmarshal(value, &event)
 	}
+
+	return event, err
 }
 
 func updateIndex(db *pgxpool.Pool, e cdcEvent) (time.Time, error) {
@@ -115,22 +139,3 @@ func updateIndex(db *pgxpool.Pool, e cdcEvent) (time.Time, error) {
 
 	return ts, nil
 }
-
-func rollingAverage(period int) func(time.Duration) time.Duration {
-	var i int
-	var sum time.Duration
-	var storage = make([]time.Duration, 0, period)
-
-	return func(input time.Duration) (avrg time.Duration) {
-		if len(storage) < period {
-			sum += input
-			storage = append(storage, input)
-		}
-
-		sum += input - storage[i]
-		storage[i], i = input, (i+1)%period
-		avrg = sum / time.Duration(len(storage))
-
-		return
-	}
-}
@@ -8,20 +8,35 @@ import (
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"google.golang.org/api/option"
 )
 
+var (
+	writes = metrics.NewCounterVec("dual_write_writes_total", "Order writes, by store and outcome.", "store", "outcome")
+)
+
 func main() {
 	log.SetFlags(0)
 
-	cockroach := connect.MustDatabase("postgres://root@localhost:26257/defaultdb?sslmode=disable")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/defaultdb?sslmode=disable"},
+		BigQuery: config.BigQueryConfig{Endpoint: "http://localhost:9050", Project: "local"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	cockroach := connect.MustDatabase(cfg.Database.URL)
 	defer cockroach.Close()
 
-	bigquery := mustConnectBigQuery("http://localhost:9050")
+	bigquery := mustConnectBigQuery(cfg.BigQuery)
 	defer bigquery.Close()
 
 	go bigQueryAdapter(bigquery)
@@ -50,8 +65,10 @@ func simulateWriter(pg *pgxpool.Pool, bq *bigquery.Client) error {
 
 		if err := writeCockroach(pg, o); err != nil {
 			log.Printf("writing to cockroach: %v", err)
+			writes.WithLabelValues("cockroach", "failed").Inc()
 			continue
 		}
+		writes.WithLabelValues("cockroach", "saved").Inc()
 
 		i++
 		fmt.Printf("saved %d orders\r", i)
@@ -86,34 +103,57 @@ func (o order) Save() (map[string]bigquery.Value, string, error) {
 	return m, o.ID, nil
 }
 
-type bigQueryCDCMessage struct {
-	Payload []order `json:"payload"`
-}
-
+// bigQueryAdapter receives the changefeed's webhook requests and writes
+// their rows to BigQuery. A request fails, and the changefeed retries it,
+// if any of its rows can't be written.
 func bigQueryAdapter(bq *bigquery.Client) {
+	source := changefeed.NewWebhookSource("", "", "")
+	go consumeChangefeed(source, bq)
+
 	router := fiber.New()
-	router.Post("/bigquery", func(c *fiber.Ctx) error {
-		var msg bigQueryCDCMessage
-		if err := c.BodyParser(&msg); err != nil {
-			return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	router.Post("/bigquery", adaptor.HTTPHandler(source))
+
+	log.Fatal(router.ListenTLS(":3000", "./cert.pem", "./key.pem"))
+}
+
+func consumeChangefeed(source changefeed.Source, bq *bigquery.Client) {
+	for {
+		msg, err := source.Fetch(context.Background())
+		if err != nil {
+			log.Printf("error reading message: %v", err)
+			return
+		}
+
+		e, err := changefeed.Decode[order](msg.Key, msg.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			log.Printf("error parsing message: %v", err)
+			msg.Nack(err)
+			continue
+		}
+
+		if e.IsResolved() || e.IsDelete() {
+			msg.Ack(context.Background())
+			continue
 		}
 
 		// Insert row into BigQuery but "fail" 0.1% of the time.
 		if rand.Intn(1000) == 42 {
 			log.Println("simulated error in bigquery")
-			return fiber.NewError(fiber.StatusInternalServerError, "simulated error in bigquery")
+			writes.WithLabelValues("bigquery", "failed").Inc()
+			msg.Nack(fmt.Errorf("simulated error in bigquery"))
+			continue
 		}
 
-		for _, o := range msg.Payload {
-			if err := writeBigQuery(bq, o); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
+		if err = writeBigQuery(bq, *e.After); err != nil {
+			log.Printf("error writing to bigquery: %v", err)
+			writes.WithLabelValues("bigquery", "failed").Inc()
+			msg.Nack(err)
+			continue
 		}
+		writes.WithLabelValues("bigquery", "saved").Inc()
 
-		return nil
-	})
-
-	log.Fatal(router.ListenTLS(":3000", "./cert.pem", "./key.pem"))
+		msg.Ack(context.Background())
+	}
 }
 
 func writeBigQuery(bq *bigquery.Client, o order) error {
@@ -126,11 +166,11 @@ func writeBigQuery(bq *bigquery.Client, o order) error {
 	return nil
 }
 
-func mustConnectBigQuery(url string) *bigquery.Client {
+func mustConnectBigQuery(cfg config.BigQueryConfig) *bigquery.Client {
 	client, err := bigquery.NewClient(
 		context.Background(),
-		"local",
-		option.WithEndpoint(url),
+		cfg.Project,
+		option.WithEndpoint(cfg.Endpoint),
 	)
 	if err != nil {
 		log.Fatalf("error connecting to big query: %v", err)
@@ -8,21 +8,29 @@ import (
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gocql/gocql"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"google.golang.org/api/option"
 )
 
+var (
+	eodTotals = metrics.NewGaugeVec("eod_total", "End of day order total as reported by each store.", "store")
+)
+
 func main() {
 	log.SetFlags(0)
 
-	postgresURL := flag.String("postgres", "", "postgres connection string")
 	cassandraURL := flag.String("cassandra", "", "cassandra connection string")
-	bigQueryURL := flag.String("bigquery", "", "bigquery connection string")
-	flag.Parse()
+	cfg := config.MustLoad(config.Config{
+		BigQuery: config.BigQueryConfig{Project: "local"},
+		Metrics:  config.MetricsConfig{Addr: ":2113"},
+	}, config.Database, config.BigQuery)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	postgres := connect.MustDatabase(*postgresURL)
+	postgres := connect.MustDatabase(cfg.Database.URL)
 	defer postgres.Close()
 
 	var cassandra *gocql.Session
@@ -31,7 +39,7 @@ func main() {
 		defer cassandra.Close()
 	}
 
-	bigquery := mustConnectBigQuery(*bigQueryURL)
+	bigquery := mustConnectBigQuery(cfg.BigQuery)
 	defer bigquery.Close()
 
 	if err := simulateWriter(postgres, cassandra, bigquery); err != nil {
@@ -62,6 +70,12 @@ func simulateWriter(pg *pgxpool.Pool, cs *gocql.Session, bq *bigquery.Client) er
 			continue
 		}
 
+		eodTotals.WithLabelValues("postgres").Set(postgresEOD)
+		if cs != nil {
+			eodTotals.WithLabelValues("cassandra").Set(cassandraEOD)
+		}
+		eodTotals.WithLabelValues("bigquery").Set(bigQueryEOD)
+
 		fmt.Println("\033[H\033[2J")
 		fmt.Printf("postgres eod:  %2.f\n", postgresEOD)
 		if cs != nil {
@@ -149,11 +163,11 @@ func mustConnectCassandra(url string) *gocql.Session {
 	return nil
 }
 
-func mustConnectBigQuery(url string) *bigquery.Client {
+func mustConnectBigQuery(cfg config.BigQueryConfig) *bigquery.Client {
 	client, err := bigquery.NewClient(
 		context.Background(),
-		"local",
-		option.WithEndpoint(url),
+		cfg.Project,
+		option.WithEndpoint(cfg.Endpoint),
 	)
 	if err != nil {
 		log.Fatalf("error connecting to big query: %v", err)
@@ -12,7 +12,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 )
 
 var (
@@ -45,6 +47,16 @@ func main() {
 		servers:         sf,
 	}
 
+	metrics.GaugeFunc("lb_connections", "Client connections currently proxied.", func() float64 {
+		return float64(atomic.LoadInt64(&svr.connections))
+	})
+	metrics.GaugeFunc("lb_servers", "Servers currently in the rotation.", func() float64 {
+		svr.serversMu.RLock()
+		defer svr.serversMu.RUnlock()
+
+		return float64(len(svr.servers))
+	})
+
 	go svr.httpServer(*httpPort)
 
 	if *debug {
@@ -144,6 +156,7 @@ func (svr *server) httpServer(port int) {
 	router := fiber.New()
 	router.Post("/servers", addServer(svr))
 	router.Delete("/servers", removeServer(svr))
+	router.Get("/metrics", adaptor.HTTPHandler(metrics.Handler()))
 
 	log.Fatal(router.Listen(fmt.Sprintf(":%d", port)))
 }
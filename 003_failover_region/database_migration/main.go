@@ -5,23 +5,29 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"os"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
+
 func main() {
-	url, ok := os.LookupEnv("CONNECTION_STRING")
-	if !ok {
-		log.Fatalf("missing CONNECTION_STRING env var")
-	}
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	db := connect.MustDatabase(url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	work(db)
@@ -30,6 +36,7 @@ func main() {
 func work(db *pgxpool.Pool) {
 	for range time.NewTicker(time.Second).C {
 		id := uuid.NewString()
+		start := time.Now()
 
 		// Insert purchase.
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
@@ -57,7 +64,12 @@ func work(db *pgxpool.Pool) {
 
 		if err != nil {
 			log.Printf("error: %v", err)
+			operations.WithLabelValues("error").Inc()
+			operationLatency.Record(time.Since(start))
 			continue
 		}
+
+		operations.WithLabelValues("ok").Inc()
+		operationLatency.Record(time.Since(start))
 	}
 }
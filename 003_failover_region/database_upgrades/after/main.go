@@ -8,15 +8,28 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
+
 func main() {
-	db := connect.MustDatabase("postgres://root@cockroachdb-public.crdb.svc.cluster.local:26257/defaultdb?sslmode=disable")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@cockroachdb-public.crdb.svc.cluster.local:26257/defaultdb?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	work(db)
@@ -25,8 +38,9 @@ func main() {
 func work(db *pgxpool.Pool) {
 	for range time.NewTicker(time.Second).C {
 		id := uuid.NewString()
+		start := time.Now()
 
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*3)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 
 		err := crdbpgx.ExecuteTx(ctx, db, pgx.TxOptions{}, func(tx pgx.Tx) error {
 			// Insert purchase.
@@ -59,8 +73,14 @@ func work(db *pgxpool.Pool) {
 			return nil
 		})
 
+		cancel()
+		operationLatency.Record(time.Since(start))
+
 		if err != nil {
 			log.Println(err)
+			operations.WithLabelValues("error").Inc()
+			continue
 		}
+		operations.WithLabelValues("ok").Inc()
 	}
 }
@@ -2,17 +2,31 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"math/rand"
 	"strings"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 )
 
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
+
 func main() {
-	db, err := sql.Open("mysql", "root:password@tcp(mysql:3306)/defaultdb")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "root:password@tcp(mysql:3306)/defaultdb"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	db, err := sql.Open("mysql", cfg.Database.URL)
 	if err != nil {
 		log.Fatalf("error connecting to mysql: %v", err)
 	}
@@ -23,38 +37,50 @@ func main() {
 
 func work(db *sql.DB) {
 	for range time.NewTicker(time.Second).C {
-		id := uuid.NewString()
+		start := time.Now()
+		err := operation(db)
+		operationLatency.Record(time.Since(start))
 
-		// Insert purchase.
-		stmt := `INSERT INTO purchase (id, basket_id, member_id, amount) VALUES (?, ?, ?, ?)`
-		if _, err := db.Exec(stmt, id, uuid.NewString(), uuid.NewString(), rand.Float64()*100); err != nil {
-			log.Printf("inserting purchase: %v", err)
+		if err != nil {
+			log.Println(err)
+			operations.WithLabelValues("error").Inc()
 			continue
 		}
+		operations.WithLabelValues("ok").Inc()
+	}
 
-		// Select purchase.
-		stmt = `SELECT amount FROM purchase WHERE id = ?`
-		row := db.QueryRow(stmt, id)
+	log.Fatal("application unexpectedly exited")
+}
 
-		var value float64
-		if err := row.Scan(&value); err != nil {
-			log.Printf("selecting purchase: %v", err)
-			continue
-		}
+func operation(db *sql.DB) error {
+	id := uuid.NewString()
 
-		// Select database version.
-		stmt = `SELECT version()`
-		row = db.QueryRow(stmt)
+	// Insert purchase.
+	stmt := `INSERT INTO purchase (id, basket_id, member_id, amount) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(stmt, id, uuid.NewString(), uuid.NewString(), rand.Float64()*100); err != nil {
+		return fmt.Errorf("inserting purchase: %w", err)
+	}
 
-		var version string
-		if err := row.Scan(&version); err != nil {
-			log.Printf("selecting version: %v", err)
-			continue
-		}
+	// Select purchase.
+	stmt = `SELECT amount FROM purchase WHERE id = ?`
+	row := db.QueryRow(stmt, id)
 
-		// Feedback.
-		log.Printf("ok (%s)", strings.Split(version, "(")[0])
+	var value float64
+	if err := row.Scan(&value); err != nil {
+		return fmt.Errorf("selecting purchase: %w", err)
 	}
 
-	log.Fatal("application unexpectedly exited")
+	// Select database version.
+	stmt = `SELECT version()`
+	row = db.QueryRow(stmt)
+
+	var version string
+	if err := row.Scan(&version); err != nil {
+		return fmt.Errorf("selecting version: %w", err)
+	}
+
+	// Feedback.
+	log.Printf("ok (%s)", strings.Split(version, "(")[0])
+
+	return nil
 }
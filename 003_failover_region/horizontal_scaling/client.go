@@ -2,25 +2,27 @@ package main
 
 import (
 	"context"
-	"flag"
 	"log"
-	"os"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func main() {
-	url := flag.String("url", "", "database connection string")
-	flag.Parse()
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
 
-	if *url == "" {
-		flag.Usage()
-		os.Exit(2)
-	}
+func main() {
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	db := connect.MustDatabase(*url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	work(db)
@@ -36,7 +38,11 @@ func work(db *pgxpool.Pool) {
 		var count int
 		if err := row.Scan(&count); err != nil {
 			log.Printf("error getting row count: %v", err)
+			operations.WithLabelValues("error").Inc()
+		} else {
+			operations.WithLabelValues("ok").Inc()
 		}
+		operationLatency.Record(time.Since(start))
 
 		log.Printf("customers: %d (took %s)", count, time.Since(start))
 	}
@@ -6,10 +6,11 @@ import (
 	"log"
 	"math"
 	"math/rand"
-	"os"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -17,13 +18,18 @@ import (
 
 const letters = "abcdefghijklmnopqrstuvwxyz"
 
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
+
 func main() {
-	url, ok := os.LookupEnv("CONNECTION_STRING")
-	if !ok {
-		log.Fatalf("missing CONNECTION_STRING env var")
-	}
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	db := connect.MustDatabase(url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	readWrites(db)
@@ -31,9 +37,14 @@ func main() {
 
 func readWrites(db *pgxpool.Pool) {
 	for range time.NewTicker(time.Millisecond * 50).C {
+		start := time.Now()
 		if err := readWrite(db); err != nil {
 			log.Printf("error: %v", err)
+			operations.WithLabelValues("error").Inc()
+		} else {
+			operations.WithLabelValues("ok").Inc()
 		}
+		operationLatency.Record(time.Since(start))
 	}
 }
 
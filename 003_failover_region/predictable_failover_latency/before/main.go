@@ -6,22 +6,28 @@ import (
 	"log"
 	"math"
 	"math/rand"
-	"os"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyz"
 
+var (
+	operations       = metrics.NewCounterVec("client_operations_total", "Client operations attempted, by outcome.", "outcome")
+	operationLatency = metrics.NewLatency("client_operation_seconds", "Latency of client operations, including failures.", 1000)
+)
+
 func main() {
-	url, ok := os.LookupEnv("CONNECTION_STRING")
-	if !ok {
-		log.Fatalf("missing CONNECTION_STRING env var")
-	}
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	db := connect.MustDatabase(url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	readWrite(db)
@@ -29,6 +35,8 @@ func main() {
 
 func readWrite(db *pgxpool.Pool) {
 	for range time.NewTicker(time.Millisecond * 50).C {
+		start := time.Now()
+
 		// Write.
 		const writeStmt = `INSERT INTO product (name, price) VALUES ($1, $2)
 											 RETURNING id`
@@ -44,6 +52,8 @@ func readWrite(db *pgxpool.Pool) {
 		var id string
 		if err := row.Scan(&id); err != nil {
 			log.Printf("error inserting product: %v", err)
+			operations.WithLabelValues("error").Inc()
+			operationLatency.Record(time.Since(start))
 			continue
 		}
 
@@ -59,9 +69,14 @@ func readWrite(db *pgxpool.Pool) {
 		var dbPrice float64
 		if err := row.Scan(&dbName, &dbPrice); err != nil {
 			log.Printf("error reading product: %v", err)
+			operations.WithLabelValues("error").Inc()
+			operationLatency.Record(time.Since(start))
 			continue
 		}
 
+		operations.WithLabelValues("ok").Inc()
+		operationLatency.Record(time.Since(start))
+
 		// Print
 		fmt.Printf("inserted %s\n", id)
 	}
@@ -9,7 +9,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -30,9 +32,15 @@ var (
 func main() {
 	readInterval := flag.Duration("r", time.Millisecond*100, "interval between reads")
 	writeInterval := flag.Duration("w", time.Millisecond*1000, "interval between writes")
-	flag.Parse()
-
-	db := connect.MustDatabase("postgres://root@localhost:26257/?sslmode=disable")
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.AtomicCounter("cache_reads_total", "Product stock reads.", &reads)
+	metrics.AtomicCounter("cache_writes_total", "Product stock writes.", &writes)
+
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	go simulateReads(db, *readInterval)
@@ -8,23 +8,34 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
 	products = mustLoadIDs("004_unecessary_caching_tier/read_performance/ids.json")
+
+	writes            uint64
+	getProductLatency = metrics.NewLatency("read_performance_get_product_seconds", "Latency of the get product endpoint.", 1000)
 )
 
 func main() {
 	writeInterval := flag.Duration("w", time.Millisecond*100, "interval between writes")
-	flag.Parse()
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/defaultdb?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.AtomicCounter("read_performance_writes_total", "Product stock writes.", &writes)
 
 	db := connect.MustDatatabaseWithConfig(
-		"postgres://root@localhost:26257/defaultdb?sslmode=disable",
+		cfg.Database.URL,
 		func(cfg *pgxpool.Config) {
 			cfg.MaxConns = 50
 		})
@@ -54,6 +65,10 @@ func mustLoadIDs(path string) []string {
 
 func handleGetProduct(db *pgxpool.Pool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		defer func(start time.Time) {
+			getProductLatency.Record(time.Since(start))
+		}(time.Now())
+
 		productID := c.Params("id")
 		if productID == "" {
 			return fiber.NewError(fiber.StatusUnprocessableEntity, "missing product id")
@@ -71,14 +86,12 @@ func handleGetProduct(db *pgxpool.Pool) fiber.Handler {
 }
 
 func simulateWrites(db *pgxpool.Pool, rate time.Duration) error {
-	writesMade := 0
 	for range time.NewTicker(rate).C {
 		if err := simulateWrite(db); err != nil {
 			log.Printf("error simulating write: %v", err)
 		}
 
-		writesMade++
-		fmt.Printf("Writes made: %d\r", writesMade)
+		fmt.Printf("Writes made: %d\r", atomic.AddUint64(&writes, 1))
 
 	}
 
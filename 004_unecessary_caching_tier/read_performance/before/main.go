@@ -8,9 +8,12 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
@@ -18,16 +21,25 @@ import (
 
 var (
 	products = mustLoadIDs("004_unecessary_caching_tier/read_performance/ids.json")
+
+	writes            uint64
+	getProductLatency = metrics.NewLatency("read_performance_get_product_seconds", "Latency of the get product endpoint.", 1000)
 )
 
 func main() {
 	writeInterval := flag.Duration("w", time.Millisecond*100, "interval between writes")
-	flag.Parse()
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/defaultdb?sslmode=disable"},
+		Redis:    config.RedisConfig{Addr: "localhost:6379"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+	metrics.AtomicCounter("read_performance_writes_total", "Product stock writes.", &writes)
 
 	cache := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
 	})
 	defer cache.Close()
 
@@ -35,7 +47,7 @@ func main() {
 		log.Fatalf("error pinging redis: %v", err)
 	}
 
-	db := connect.MustDatabase("postgres://root@localhost:26257/defaultdb?sslmode=disable")
+	db := connect.MustDatabase(cfg.Database.URL)
 
 	router := fiber.New()
 	router.Get("/products/:id/stock", handleGetProduct(db, cache))
@@ -62,6 +74,10 @@ func mustLoadIDs(path string) []string {
 
 func handleGetProduct(db *pgxpool.Pool, cache *redis.Client) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		defer func(start time.Time) {
+			getProductLatency.Record(time.Since(start))
+		}(time.Now())
+
 		productID := c.Params("id")
 		if productID == "" {
 			return fiber.NewError(fiber.StatusUnprocessableEntity, "missing product id")
@@ -102,14 +118,12 @@ func handleGetProduct(db *pgxpool.Pool, cache *redis.Client) fiber.Handler {
 }
 
 func simulateWrites(db *pgxpool.Pool, cache *redis.Client, rate time.Duration) error {
-	writesMade := 0
 	for range time.NewTicker(rate).C {
 		if err := simulateWrite(db, cache); err != nil {
 			log.Printf("error simulating write: %v", err)
 		}
 
-		writesMade++
-		fmt.Printf("Writes made: %d\r", writesMade)
+		fmt.Printf("Writes made: %d\r", atomic.AddUint64(&writes, 1))
 	}
 
 	return fmt.Errorf("finished simulateWrites unexectedly")
@@ -3,10 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
-	"sync"
 	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
@@ -14,18 +15,19 @@ import (
 )
 
 var (
-	browseProductsLatencyWindow = rollingAverage(1000)
-	browseProductsLatencyMu     sync.RWMutex
-	browseProductsLatency       time.Duration
-
-	createOrderLatencyWindow = rollingAverage(1000)
-	createOrderLatencyMu     sync.RWMutex
-	createOrderLatency       time.Duration
+	browseProductsLatency = metrics.NewLatency("analytics_browse_products_seconds", "Latency of the browse products endpoint.", 1000)
+	createOrderLatency    = metrics.NewLatency("analytics_create_order_seconds", "Latency of the create order endpoint.", 1000)
 )
 
 func main() {
+	cfg := config.MustLoad(config.Config{
+		Database: config.DatabaseConfig{URL: "postgres://root@localhost:26257/defaultdb?sslmode=disable"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
 	db := connect.MustDatatabaseWithConfig(
-		"postgres://root@localhost:26257/defaultdb?sslmode=disable",
+		cfg.Database.URL,
 		func(cfg *pgxpool.Config) {
 			cfg.MaxConns = 50
 		})
@@ -94,9 +96,7 @@ func getProducts(db *pgxpool.Pool) fiber.Handler {
 			products = append(products, p)
 		}
 
-		browseProductsLatencyMu.Lock()
-		browseProductsLatency = browseProductsLatencyWindow(time.Since(start))
-		browseProductsLatencyMu.Unlock()
+		browseProductsLatency.Record(time.Since(start))
 		return c.JSON(products)
 	}
 }
@@ -148,43 +148,16 @@ func createOrder(db *pgxpool.Pool) fiber.Handler {
 			return fiber.NewError(fiber.StatusInternalServerError, "error creating order")
 		}
 
-		createOrderLatencyMu.Lock()
-		createOrderLatency = createOrderLatencyWindow(time.Since(start))
-		createOrderLatencyMu.Unlock()
+		createOrderLatency.Record(time.Since(start))
 		return nil
 	}
 }
 
-func rollingAverage(period int) func(time.Duration) time.Duration {
-	var i int
-	var sum time.Duration
-	var storage = make([]time.Duration, 0, period)
-
-	return func(input time.Duration) (avrg time.Duration) {
-		if len(storage) < period {
-			sum += input
-			storage = append(storage, input)
-		}
-
-		sum += input - storage[i]
-		storage[i], i = input, (i+1)%period
-		avrg = sum / time.Duration(len(storage))
-
-		return
-	}
-}
-
 func printLoop() {
 	for range time.NewTicker(time.Second).C {
 		fmt.Println("\033[H\033[2J")
 
-		browseProductsLatencyMu.RLock()
-		createOrderLatencyMu.RLock()
-
-		fmt.Printf("avg browse latency: %dms\n", browseProductsLatency.Milliseconds())
-		fmt.Printf("avg order latency:  %dms\n", createOrderLatency.Milliseconds())
-
-		browseProductsLatencyMu.RUnlock()
-		createOrderLatencyMu.RUnlock()
+		fmt.Printf("browse latency: %s\n", browseProductsLatency.Snapshot())
+		fmt.Printf("order latency:  %s\n", createOrderLatency.Snapshot())
 	}
 }
@@ -7,14 +7,28 @@ import (
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"google.golang.org/api/option"
 )
 
+var (
+	rowsInserted = metrics.NewCounter("bigquery_rows_inserted_total", "Changefeed rows inserted into BigQuery.")
+)
+
 func main() {
 	log.SetFlags(0)
 
-	bigquery := mustConnectBigQuery("http://localhost:9050")
+	cfg := config.MustLoad(config.Config{
+		BigQuery: config.BigQueryConfig{Endpoint: "http://localhost:9050", Project: "local"},
+		Metrics:  config.MetricsConfig{Addr: ":2112"},
+	})
+	metrics.Serve(cfg.Metrics.Addr)
+
+	bigquery := mustConnectBigQuery(cfg.BigQuery)
 	defer bigquery.Close()
 
 	bigQueryAdapter(bigquery)
@@ -48,35 +62,55 @@ func writeBigQuery(bq *bigquery.Client, o order) error {
 	return nil
 }
 
-type bigQueryCDCMessage struct {
-	Payload []order `json:"payload"`
-}
-
+// bigQueryAdapter receives the changefeed's webhook requests and writes
+// their rows to BigQuery. A request fails, and the changefeed retries it,
+// if any of its rows can't be written.
 func bigQueryAdapter(bq *bigquery.Client) {
+	source := changefeed.NewWebhookSource("", "", "")
+	go consumeChangefeed(source, bq)
+
 	router := fiber.New()
-	router.Post("/bigquery", func(c *fiber.Ctx) error {
-		var msg bigQueryCDCMessage
-		if err := c.BodyParser(&msg); err != nil {
-			return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	router.Post("/bigquery", adaptor.HTTPHandler(source))
+
+	log.Fatal(router.ListenTLS(":3000", "./cert.pem", "./key.pem"))
+}
+
+func consumeChangefeed(source changefeed.Source, bq *bigquery.Client) {
+	for {
+		msg, err := source.Fetch(context.Background())
+		if err != nil {
+			log.Printf("error reading message: %v", err)
+			return
 		}
 
-		for _, o := range msg.Payload {
-			if err := writeBigQuery(bq, o); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
+		e, err := changefeed.Decode[order](msg.Key, msg.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			log.Printf("error parsing message: %v", err)
+			msg.Nack(err)
+			continue
 		}
 
-		return nil
-	})
+		if e.IsResolved() || e.IsDelete() {
+			msg.Ack(context.Background())
+			continue
+		}
 
-	log.Fatal(router.ListenTLS(":3000", "./cert.pem", "./key.pem"))
+		if err = writeBigQuery(bq, *e.After); err != nil {
+			log.Printf("error writing to bigquery: %v", err)
+			msg.Nack(err)
+			continue
+		}
+		rowsInserted.Inc()
+
+		msg.Ack(context.Background())
+	}
 }
 
-func mustConnectBigQuery(url string) *bigquery.Client {
+func mustConnectBigQuery(cfg config.BigQueryConfig) *bigquery.Client {
 	client, err := bigquery.NewClient(
 		context.Background(),
-		"local",
-		option.WithEndpoint(url),
+		cfg.Project,
+		option.WithEndpoint(cfg.Endpoint),
 	)
 	if err != nil {
 		log.Fatalf("error connecting to big query: %v", err)
@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
 	"cloud.google.com/go/bigquery"
@@ -15,23 +14,32 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"google.golang.org/api/option"
 )
 
+var cfg config.Config
+
 func main() {
+	cfg = config.MustLoad(config.Config{
+		BigQuery: config.BigQueryConfig{Endpoint: "http://host.docker.internal:9050", Project: "local"},
+		S3:       config.S3Config{Region: "us-east-1"},
+	}, config.S3)
+
 	lambda.Start(handle)
 }
 
 func handle(ctx context.Context, e event) error {
-	bigquery, err := connectBigQuery("http://host.docker.internal:9050")
+	bigquery, err := connectBigQuery(cfg.BigQuery)
 	if err != nil {
 		return fmt.Errorf("error connecting to bigquery: %w", err)
 	}
 	defer bigquery.Close()
 
 	sess, err := session.NewSession(&aws.Config{
-		Endpoint:         aws.String(os.Getenv("AWS_ENDPOINT_URL")),
-		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(cfg.S3.Endpoint),
+		Region:           aws.String(cfg.S3.Region),
 		Credentials:      credentials.NewStaticCredentials("fake", "fake", ""),
 		S3ForcePathStyle: aws.Bool(true),
 	})
@@ -73,25 +81,22 @@ func (run *runner) sendObjectsToBigQuery(e event) error {
 	return nil
 }
 
-type cdcMessage struct {
-	After struct {
-		ID     string  `json:"id"`
-		Total  float64 `json:"total"`
-		TS     string  `json:"ts"`
-		UserID string  `json:"user_id"`
-	} `json:"after"`
-	Key []string `json:"key"`
+type order struct {
+	ID     string  `json:"id"`
+	Total  float64 `json:"total"`
+	TS     string  `json:"ts"`
+	UserID string  `json:"user_id"`
 }
 
-func (m cdcMessage) Save() (map[string]bigquery.Value, string, error) {
+func (o order) Save() (map[string]bigquery.Value, string, error) {
 	v := map[string]bigquery.Value{
-		"id":      m.After.ID,
-		"user_id": m.After.UserID,
-		"total":   m.After.Total,
-		"ts":      m.After.TS,
+		"id":      o.ID,
+		"user_id": o.UserID,
+		"total":   o.Total,
+		"ts":      o.TS,
 	}
 
-	return v, m.After.ID, nil
+	return v, o.ID, nil
 }
 
 func (run *runner) sendObjectToBigQuery(bucket, key string) error {
@@ -111,7 +116,7 @@ func (run *runner) sendObjectToBigQuery(bucket, key string) error {
 	return nil
 }
 
-func getCDCMessage(downloader *s3manager.Downloader, bucket, key string) ([]cdcMessage, error) {
+func getCDCMessage(downloader *s3manager.Downloader, bucket, key string) ([]order, error) {
 	buf := aws.NewWriteAtBuffer([]byte{})
 
 	_, err := downloader.Download(
@@ -127,27 +132,32 @@ func getCDCMessage(downloader *s3manager.Downloader, bucket, key string) ([]cdcM
 
 	lines := bytes.Split(buf.Bytes(), []byte("\n"))
 
-	var msgs []cdcMessage
+	var msgs []order
 	for _, line := range lines {
 		if bytes.Equal(line, []byte("")) {
 			continue
 		}
 
-		var msg cdcMessage
-		if err = json.Unmarshal(line, &msg); err != nil {
+		e, err := changefeed.Decode[order](nil, line, changefeed.EnvelopeWrapped)
+		if err != nil {
 			return nil, fmt.Errorf("parsing cdc message: %w", err)
 		}
-		msgs = append(msgs, msg)
+
+		// Deleted rows aren't removed from BigQuery.
+		if e.After == nil {
+			continue
+		}
+		msgs = append(msgs, *e.After)
 	}
 
 	return msgs, nil
 }
 
-func connectBigQuery(url string) (*bigquery.Client, error) {
+func connectBigQuery(cfg config.BigQueryConfig) (*bigquery.Client, error) {
 	client, err := bigquery.NewClient(
 		context.Background(),
-		"local",
-		option.WithEndpoint(url),
+		cfg.Project,
+		option.WithEndpoint(cfg.Endpoint),
 		option.WithoutAuthentication(),
 	)
 	if err != nil {
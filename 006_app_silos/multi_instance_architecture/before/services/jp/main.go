@@ -2,21 +2,25 @@ package main
 
 import (
 	"log"
-	"os"
+	"time"
 
+	"github.com/cockroachdb/architectural-simplification/pkg/config"
 	"github.com/cockroachdb/architectural-simplification/pkg/connect"
+	"github.com/cockroachdb/architectural-simplification/pkg/metrics"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var getProductsLatency = metrics.NewLatency("multi_instance_get_products_seconds", "Latency of the get products endpoint.", 1000)
+
 func main() {
-	url, ok := os.LookupEnv("CONNECTION_STRING")
-	if !ok {
-		log.Fatalf("missing CONNECTION_STRING env var")
-	}
+	cfg := config.MustLoad(config.Config{
+		Metrics: config.MetricsConfig{Addr: ":2112"},
+	}, config.Database)
+	metrics.Serve(cfg.Metrics.Addr)
 
-	db := connect.MustDatabase(url)
+	db := connect.MustDatabase(cfg.Database.URL)
 	defer db.Close()
 
 	router := fiber.New()
@@ -33,6 +37,8 @@ type product struct {
 
 func handleGetProducts(db *pgxpool.Pool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
 		const stmt = `SELECT
 										p.id,
 										i.translation AS name,
@@ -58,6 +64,7 @@ func handleGetProducts(db *pgxpool.Pool) fiber.Handler {
 			products = append(products, p)
 		}
 
+		getProductsLatency.Record(time.Since(start))
 		return c.JSON(products)
 	}
 }
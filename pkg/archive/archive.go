@@ -0,0 +1,233 @@
+// Package archive keeps rows that are about to be purged from a database,
+// as gzipped NDJSON batches with a manifest recording each batch's
+// checksum, row count and time range. Batches are verified by reading them
+// back from the store, so rows are only deleted once they're known to be
+// recoverable, and can be restored by time range.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FormatNDJSONGzip is the format of batch files: one JSON row per line,
+// gzipped.
+const FormatNDJSONGzip = "ndjson+gzip"
+
+// Row is a single archived row, with the timestamp batches are ranged by.
+type Row struct {
+	TS   time.Time
+	Data json.RawMessage
+}
+
+// Manifest describes a batch file.
+type Manifest struct {
+	Batch     string    `json:"batch"`
+	Table     string    `json:"table"`
+	File      string    `json:"file"`
+	Format    string    `json:"format"`
+	Rows      int       `json:"rows"`
+	Bytes     int       `json:"bytes"`
+	SHA256    string    `json:"sha256"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Archive writes, verifies and reads batches in a Store.
+type Archive struct {
+	store Store
+}
+
+// New returns an Archive backed by store.
+func New(store Store) *Archive {
+	return &Archive{store: store}
+}
+
+// Write archives a batch of a table's rows. Batch files are laid out by
+// the date of their oldest row, and manifests are written last, so a
+// batch without a manifest was never completely written.
+func (a *Archive) Write(ctx context.Context, table string, rows []Row) (Manifest, error) {
+	if len(rows) == 0 {
+		return Manifest{}, fmt.Errorf("archiving empty batch")
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+
+	m := Manifest{
+		Table:     table,
+		Format:    FormatNDJSONGzip,
+		Rows:      len(rows),
+		From:      rows[0].TS,
+		To:        rows[0].TS,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	for _, r := range rows {
+		if _, err := gz.Write(append(compact(r.Data), '\n')); err != nil {
+			return Manifest{}, fmt.Errorf("compressing batch: %w", err)
+		}
+
+		if r.TS.Before(m.From) {
+			m.From = r.TS
+		}
+		if r.TS.After(m.To) {
+			m.To = r.TS
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return Manifest{}, fmt.Errorf("compressing batch: %w", err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	m.SHA256 = hex.EncodeToString(sum[:])
+	m.Bytes = buf.Len()
+	m.Batch = m.CreatedAt.Format("20060102T150405Z") + "-" + uuid.NewString()[:8]
+	m.File = path.Join(table, m.From.UTC().Format("2006/01/02"), m.Batch+".ndjson.gz")
+
+	if err := a.store.Put(ctx, m.File, buf.Bytes()); err != nil {
+		return Manifest{}, fmt.Errorf("writing batch: %w", err)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Manifest{}, fmt.Errorf("marshalling manifest: %w", err)
+	}
+	if err = a.store.Put(ctx, manifestKey(table, m.Batch), b); err != nil {
+		return Manifest{}, fmt.Errorf("writing manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// Verify reads a batch and its manifest back from the store, checking
+// that both are intact.
+func (a *Archive) Verify(ctx context.Context, m Manifest) error {
+	b, err := a.store.Get(ctx, manifestKey(m.Table, m.Batch))
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+
+	var stored Manifest
+	if err = json.Unmarshal(b, &stored); err != nil {
+		return fmt.Errorf("parsing manifest: %w", err)
+	}
+	if stored.SHA256 != m.SHA256 || stored.Rows != m.Rows {
+		return fmt.Errorf("manifest for batch %s doesn't match what was written", m.Batch)
+	}
+
+	if _, err = a.Read(ctx, stored); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read returns a batch's rows, checking them against its manifest.
+func (a *Archive) Read(ctx context.Context, m Manifest) ([]json.RawMessage, error) {
+	b, err := a.store.Get(ctx, m.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading batch: %w", err)
+	}
+
+	if len(b) != m.Bytes {
+		return nil, fmt.Errorf("batch %s is %d bytes, expected %d", m.Batch, len(b), m.Bytes)
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != m.SHA256 {
+		return nil, fmt.Errorf("batch %s fails its checksum", m.Batch)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing batch %s: %w", m.Batch, err)
+	}
+	defer gz.Close()
+
+	var rows []json.RawMessage
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := append(json.RawMessage(nil), scanner.Bytes()...)
+		if !json.Valid(line) {
+			return nil, fmt.Errorf("batch %s has an invalid row on line %d", m.Batch, len(rows)+1)
+		}
+		rows = append(rows, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("decompressing batch %s: %w", m.Batch, err)
+	}
+
+	if len(rows) != m.Rows {
+		return nil, fmt.Errorf("batch %s has %d rows, expected %d", m.Batch, len(rows), m.Rows)
+	}
+
+	return rows, nil
+}
+
+// Manifests returns the manifests of a table's batches holding rows in
+// [from, to), oldest first. Zero times leave the range open.
+func (a *Archive) Manifests(ctx context.Context, table string, from, to time.Time) ([]Manifest, error) {
+	keys, err := a.store.List(ctx, path.Join(table, "manifests")+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []Manifest
+	for _, k := range keys {
+		if !strings.HasSuffix(k, ".json") {
+			continue
+		}
+
+		b, err := a.store.Get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+
+		var m Manifest
+		if err = json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("parsing manifest %s: %w", k, err)
+		}
+
+		if !to.IsZero() && !m.From.Before(to) {
+			continue
+		}
+		if !from.IsZero() && m.To.Before(from) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].From.Before(manifests[j].From)
+	})
+
+	return manifests, nil
+}
+
+func manifestKey(table, batch string) string {
+	return path.Join(table, "manifests", batch+".json")
+}
+
+// compact strips insignificant whitespace, as a row must fit on one line.
+func compact(b json.RawMessage) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return b
+	}
+
+	return buf.Bytes()
+}
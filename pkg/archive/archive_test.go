@@ -0,0 +1,196 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteVerifyRead(t *testing.T) {
+	a := New(NewDirStore(t.TempDir()))
+	ctx := context.Background()
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	rows := []Row{
+		{TS: day.Add(2 * time.Hour), Data: json.RawMessage(`{"id": 2,
+			"total": 20}`)},
+		{TS: day.Add(time.Hour), Data: json.RawMessage(`{"id": 1, "total": 10}`)},
+		{TS: day.Add(3 * time.Hour), Data: json.RawMessage(`{"id": 3, "total": 30}`)},
+	}
+
+	m, err := a.Write(ctx, "orders", rows)
+	if err != nil {
+		t.Fatalf("writing batch: %v", err)
+	}
+
+	if m.Rows != 3 || m.Table != "orders" || m.Format != FormatNDJSONGzip {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if !m.From.Equal(day.Add(time.Hour)) || !m.To.Equal(day.Add(3*time.Hour)) {
+		t.Errorf("expected batch to range from 01:00 to 03:00, got %v to %v", m.From, m.To)
+	}
+	if !strings.HasPrefix(m.File, "orders/2024/01/02/") {
+		t.Errorf("expected batch to be filed under its oldest row's date, got %s", m.File)
+	}
+
+	if err = a.Verify(ctx, m); err != nil {
+		t.Fatalf("verifying batch: %v", err)
+	}
+
+	read, err := a.Read(ctx, m)
+	if err != nil {
+		t.Fatalf("reading batch: %v", err)
+	}
+	exp := []string{`{"id":2,"total":20}`, `{"id":1,"total":10}`, `{"id":3,"total":30}`}
+	if len(read) != len(exp) {
+		t.Fatalf("expected %d rows, got %d", len(exp), len(read))
+	}
+	for i := range exp {
+		if string(read[i]) != exp[i] {
+			t.Errorf("expected row %d to be %s, got %s", i, exp[i], read[i])
+		}
+	}
+}
+
+func TestWriteRejectsEmptyBatch(t *testing.T) {
+	a := New(NewDirStore(t.TempDir()))
+	if _, err := a.Write(context.Background(), "orders", nil); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestVerifyRejectsCorruption(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string, m *Manifest)
+		expErr  string
+	}{
+		{
+			name: "batch altered",
+			corrupt: func(t *testing.T, dir string, m *Manifest) {
+				p := filepath.Join(dir, filepath.FromSlash(m.File))
+				b, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b[len(b)/2] ^= 0xff
+				if err = os.WriteFile(p, b, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expErr: "fails its checksum",
+		},
+		{
+			name: "batch truncated",
+			corrupt: func(t *testing.T, dir string, m *Manifest) {
+				p := filepath.Join(dir, filepath.FromSlash(m.File))
+				if err := os.Truncate(p, int64(m.Bytes-1)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expErr: "expected",
+		},
+		{
+			name: "batch missing",
+			corrupt: func(t *testing.T, dir string, m *Manifest) {
+				if err := os.Remove(filepath.Join(dir, filepath.FromSlash(m.File))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expErr: "reading batch",
+		},
+		{
+			name: "manifest doesn't match",
+			corrupt: func(t *testing.T, dir string, m *Manifest) {
+				m.SHA256 = strings.Repeat("0", 64)
+			},
+			expErr: "doesn't match what was written",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := New(NewDirStore(dir))
+
+			m, err := a.Write(context.Background(), "orders", []Row{
+				{TS: time.Now(), Data: json.RawMessage(`{"id": 1}`)},
+				{TS: time.Now(), Data: json.RawMessage(`{"id": 2}`)},
+			})
+			if err != nil {
+				t.Fatalf("writing batch: %v", err)
+			}
+
+			c.corrupt(t, dir, &m)
+
+			err = a.Verify(context.Background(), m)
+			if err == nil {
+				t.Fatal("expected verification to fail")
+			}
+			if !strings.Contains(err.Error(), c.expErr) {
+				t.Errorf("expected error containing %q, got %v", c.expErr, err)
+			}
+		})
+	}
+}
+
+func TestManifests(t *testing.T) {
+	a := New(NewDirStore(t.TempDir()))
+	ctx := context.Background()
+
+	if ms, err := a.Manifests(ctx, "orders", time.Time{}, time.Time{}); err != nil || len(ms) != 0 {
+		t.Fatalf("expected an empty archive to have no manifests, got %v (%v)", ms, err)
+	}
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	batch := func(table string, from, to int) Manifest {
+		m, err := a.Write(ctx, table, []Row{
+			{TS: day.Add(time.Duration(from) * time.Hour), Data: json.RawMessage(`{}`)},
+			{TS: day.Add(time.Duration(to) * time.Hour), Data: json.RawMessage(`{}`)},
+		})
+		if err != nil {
+			t.Fatalf("writing batch: %v", err)
+		}
+		return m
+	}
+
+	// Written out of order.
+	late := batch("orders", 20, 30)
+	early := batch("orders", 0, 5)
+	middle := batch("orders", 10, 15)
+	batch("customers", 0, 30)
+
+	cases := []struct {
+		name     string
+		from, to time.Time
+		exp      []Manifest
+	}{
+		{name: "all", exp: []Manifest{early, middle, late}},
+		{name: "from", from: day.Add(12 * time.Hour), exp: []Manifest{middle, late}},
+		{name: "to", to: day.Add(10 * time.Hour), exp: []Manifest{early}},
+		{name: "overlapping", from: day.Add(4 * time.Hour), to: day.Add(11 * time.Hour), exp: []Manifest{early, middle}},
+		{name: "between batches", from: day.Add(6 * time.Hour), to: day.Add(9 * time.Hour)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			act, err := a.Manifests(ctx, "orders", c.from, c.to)
+			if err != nil {
+				t.Fatalf("listing manifests: %v", err)
+			}
+
+			if len(act) != len(c.exp) {
+				t.Fatalf("expected %d manifests, got %d", len(c.exp), len(act))
+			}
+			for i := range c.exp {
+				if act[i].Batch != c.exp[i].Batch {
+					t.Errorf("expected manifest %d to be %s, got %s", i, c.exp[i].Batch, act[i].Batch)
+				}
+			}
+		})
+	}
+}
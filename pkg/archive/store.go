@@ -0,0 +1,200 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Store holds archive objects by key.
+type Store interface {
+	Put(ctx context.Context, key string, b []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Open returns the Store described by uri: a local directory, as a path
+// or file:// URI, or s3://bucket/prefix. S3 stores use the given endpoint
+// (empty for AWS) and region, with credentials from the environment.
+func Open(uri, endpoint, region string) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing archive %q: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		return NewDirStore(u.Host + u.Path), nil
+
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("s3 archive %q needs a bucket", uri)
+		}
+
+		cfg := &aws.Config{Region: aws.String(region)}
+		if endpoint != "" {
+			cfg.Endpoint = aws.String(endpoint)
+			cfg.S3ForcePathStyle = aws.Bool(true)
+		}
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating s3 session: %w", err)
+		}
+
+		return NewS3Store(s3.New(sess), u.Host, strings.TrimPrefix(u.Path, "/")), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported archive %q: expected a directory or s3://bucket/prefix", uri)
+	}
+}
+
+// DirStore keeps objects as files under a local directory.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns a Store writing to dir, which is created as needed.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+// Put writes the object to a temporary file and renames it into place, so
+// a crash never leaves a partial object behind.
+func (s *DirStore) Put(_ context.Context, key string, b []byte) error {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *DirStore) Get(_ context.Context, key string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+func (s *DirStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(p string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", prefix, err)
+	}
+
+	return keys, nil
+}
+
+// S3Store keeps objects in an S3-compatible bucket.
+type S3Store struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns a Store writing to bucket, under prefix.
+func NewS3Store(client s3iface.S3API, bucket, prefix string) *S3Store {
+	return &S3Store{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, b []byte) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(b),
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}
+
+	var keys []string
+	err := s.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(o.Key), s.key("")))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", prefix, err)
+	}
+
+	return keys, nil
+}
+
+// key returns the object key of k under the store's prefix. Unlike
+// path.Join, it keeps a trailing slash, so listing "orders/manifests/"
+// doesn't also match "orders/manifests_old/".
+func (s *S3Store) key(k string) string {
+	if s.prefix == "" {
+		return k
+	}
+
+	return strings.TrimSuffix(s.prefix, "/") + "/" + k
+}
@@ -0,0 +1,205 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 is an in-memory bucket implementing the parts of s3iface.S3API
+// that S3Store uses. Listings are returned two objects per page.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+}
+
+func (f *fakeS3) checkBucket(bucket *string) error {
+	if aws.StringValue(bucket) != f.bucket {
+		return fmt.Errorf("no such bucket: %s", aws.StringValue(bucket))
+	}
+	return nil
+}
+
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := f.checkBucket(in.Bucket); err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[aws.StringValue(in.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := f.checkBucket(in.Bucket); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", aws.StringValue(in.Key))
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	if err := f.checkBucket(in.Bucket); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.StringValue(in.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	for len(keys) > 0 {
+		n := min(2, len(keys))
+		page := &s3.ListObjectsV2Output{}
+		for _, k := range keys[:n] {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(k)})
+		}
+		keys = keys[n:]
+
+		if !fn(page, len(keys) == 0) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestS3StoreList(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+	}{
+		{name: "no prefix"},
+		{name: "prefix", prefix: "archive"},
+		{name: "prefix with trailing slash", prefix: "archive/"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := newFakeS3("bucket")
+			s := NewS3Store(client, "bucket", c.prefix)
+			ctx := context.Background()
+
+			for _, k := range []string{
+				"orders/manifests/1.json",
+				"orders/manifests/2.json",
+				"orders/manifests/3.json",
+				"orders/manifests_old/1.json",
+				"orders/2024/01/02/1.ndjson.gz",
+			} {
+				if err := s.Put(ctx, k, []byte(k)); err != nil {
+					t.Fatalf("writing %s: %v", k, err)
+				}
+			}
+
+			// A key from outside the store's prefix.
+			client.objects["archived/orders/manifests/4.json"] = nil
+
+			keys, err := s.List(ctx, "orders/manifests/")
+			if err != nil {
+				t.Fatalf("listing: %v", err)
+			}
+
+			exp := []string{"orders/manifests/1.json", "orders/manifests/2.json", "orders/manifests/3.json"}
+			if !reflect.DeepEqual(keys, exp) {
+				t.Fatalf("expected %v, got %v", exp, keys)
+			}
+
+			b, err := s.Get(ctx, keys[0])
+			if err != nil {
+				t.Fatalf("reading %s: %v", keys[0], err)
+			}
+			if string(b) != keys[0] {
+				t.Fatalf("expected %q, got %q", keys[0], b)
+			}
+		})
+	}
+}
+
+func TestS3StorePrefix(t *testing.T) {
+	client := newFakeS3("bucket")
+	a := New(NewS3Store(client, "bucket", "archive"))
+	ctx := context.Background()
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	m, err := a.Write(ctx, "orders", []Row{
+		{TS: day, Data: json.RawMessage(`{"id": 1}`)},
+	})
+	if err != nil {
+		t.Fatalf("writing batch: %v", err)
+	}
+
+	exp := []string{
+		"archive/" + m.File,
+		"archive/" + manifestKey("orders", m.Batch),
+	}
+	sort.Strings(exp)
+	if keys := client.keys(); !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected objects %v, got %v", exp, keys)
+	}
+
+	if err = a.Verify(ctx, m); err != nil {
+		t.Fatalf("verifying batch: %v", err)
+	}
+
+	ms, err := a.Manifests(ctx, "orders", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("listing manifests: %v", err)
+	}
+	if len(ms) != 1 || ms[0].Batch != m.Batch {
+		t.Fatalf("expected manifest %s, got %v", m.Batch, ms)
+	}
+}
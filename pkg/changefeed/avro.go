@@ -0,0 +1,121 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/schemaregistry"
+)
+
+// Format is the encoding of a changefeed's messages, matching the
+// changefeed's format option.
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	// FormatAvro messages are framed with the ID of their schema in a
+	// Confluent schema registry, as published with the
+	// confluent_schema_registry option.
+	FormatAvro Format = "avro"
+)
+
+// Decoder turns messages in a changefeed's format into the JSON that
+// Decode expects. A nil Decoder expects messages that are already JSON.
+//
+// Avro messages are read with the schema they were written with, looked
+// up by ID, so columns being added to or dropped from a table don't break
+// consumers: new fields are ignored, and missing ones are left at their
+// zero value.
+type Decoder struct {
+	registry *schemaregistry.Client
+}
+
+// NewDecoder returns a Decoder for format, fetching Avro schemas from the
+// registry at registryURL.
+func NewDecoder(format Format, registryURL string) (*Decoder, error) {
+	switch format {
+	case "", FormatJSON:
+		return nil, nil
+	case FormatAvro:
+		if registryURL == "" {
+			return nil, fmt.Errorf("avro changefeeds need a schema registry")
+		}
+		return &Decoder{registry: schemaregistry.NewClient(registryURL)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// MustDecoder calls NewDecoder, exiting if format isn't supported.
+func MustDecoder(format, registryURL string) *Decoder {
+	d, err := NewDecoder(Format(format), registryURL)
+	if err != nil {
+		log.Fatalf("error creating changefeed decoder: %v", err)
+	}
+
+	return d
+}
+
+// JSON returns a message's key and value as JSON. Keys become an array of
+// the row's primary key values, as with format = json.
+func (d *Decoder) JSON(ctx context.Context, m Message) (key, value []byte, err error) {
+	if d == nil {
+		return m.Key, m.Value, nil
+	}
+
+	if len(m.Key) > 0 {
+		if key, err = d.keyJSON(ctx, m.Key); err != nil {
+			return nil, nil, fmt.Errorf("decoding key: %w", err)
+		}
+	}
+
+	// A tombstone has no value to decode.
+	if len(m.Value) > 0 {
+		if value, err = d.valueJSON(ctx, m.Value); err != nil {
+			return nil, nil, fmt.Errorf("decoding value: %w", err)
+		}
+	}
+
+	return key, value, nil
+}
+
+func (d *Decoder) valueJSON(ctx context.Context, b []byte) ([]byte, error) {
+	native, s, err := d.registry.Decode(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.JSON(native)
+}
+
+func (d *Decoder) keyJSON(ctx context.Context, b []byte) ([]byte, error) {
+	native, s, err := d.registry.Decode(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := s.JSON(native)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := s.Fields()
+	if fields == nil {
+		// Not a record, so the key has a single column.
+		return json.Marshal([]json.RawMessage{record})
+	}
+
+	var columns map[string]json.RawMessage
+	if err = json.Unmarshal(record, &columns); err != nil {
+		return nil, fmt.Errorf("parsing key: %w", err)
+	}
+
+	k := make(Key, len(fields))
+	for i, f := range fields {
+		k[i] = columns[f]
+	}
+
+	return json.Marshal(k)
+}
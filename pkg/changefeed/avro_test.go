@@ -0,0 +1,225 @@
+package changefeed
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/schemaregistry"
+	"github.com/linkedin/goavro/v2"
+)
+
+// rowSchema is a row of order_line_item as a changefeed with format = avro
+// describes it, plus any extra fields.
+func rowSchema(extra string) string {
+	return fmt.Sprintf(`{
+		"type": "record",
+		"name": "order_line_item",
+		"fields": [
+			{"name": "order_id", "type": ["null", "string"]},
+			{"name": "line", "type": ["null", "long"]},
+			{"name": "price", "type": ["null", {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}]}%s
+		]
+	}`, extra)
+}
+
+// envelopeSchema wraps a row schema in the wrapped envelope.
+func envelopeSchema(row string) string {
+	return fmt.Sprintf(`{
+		"type": "record",
+		"name": "order_line_item_envelope",
+		"fields": [
+			{"name": "before", "type": ["null", %s], "default": null},
+			{"name": "after", "type": ["null", "order_line_item"], "default": null},
+			{"name": "updated", "type": ["null", "string"], "default": null}
+		]
+	}`, row)
+}
+
+const keySchema = `{
+	"type": "record",
+	"name": "order_line_item_key",
+	"fields": [
+		{"name": "order_id", "type": "string"},
+		{"name": "line", "type": "long"}
+	]
+}`
+
+type testLineItem struct {
+	OrderID string  `json:"order_id"`
+	Line    int     `json:"line"`
+	Price   float64 `json:"price"`
+}
+
+func newTestDecoder(t *testing.T) (*Decoder, *schemaregistry.Server) {
+	registry := schemaregistry.NewServer()
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	d, err := NewDecoder(FormatAvro, server.URL)
+	if err != nil {
+		t.Fatalf("creating decoder: %v", err)
+	}
+
+	return d, registry
+}
+
+// encode registers schema under subject and encodes native with it.
+func encode(t *testing.T, registry *schemaregistry.Server, subject, schema string, native any) []byte {
+	id, err := registry.Register(subject, schema)
+	if err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+
+	s, err := schemaregistry.NewSchema(id, schema)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+
+	b, err := s.Encode(native)
+	if err != nil {
+		t.Fatalf("encoding datum: %v", err)
+	}
+
+	return b
+}
+
+func TestDecoderJSON(t *testing.T) {
+	d, registry := newTestDecoder(t)
+
+	key := encode(t, registry, "order_line_item-key", keySchema, map[string]any{
+		"order_id": "a",
+		"line":     int64(2),
+	})
+	value := encode(t, registry, "order_line_item-value", envelopeSchema(rowSchema("")), map[string]any{
+		"before": nil,
+		"after": goavro.Union("order_line_item", map[string]any{
+			"order_id": goavro.Union("string", "a"),
+			"line":     goavro.Union("long", int64(2)),
+			"price":    goavro.Union("bytes.decimal", big.NewRat(1999, 100)),
+		}),
+		"updated": goavro.Union("string", "1700000000000000000.0000000001"),
+	})
+
+	k, v, err := d.JSON(context.Background(), Message{Key: key, Value: value})
+	if err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+
+	if exp := `["a",2]`; string(k) != exp {
+		t.Errorf("expected key %s, got %s", exp, k)
+	}
+	if exp := `{"after":{"line":2,"order_id":"a","price":19.99},"before":null,"updated":"1700000000000000000.0000000001"}`; string(v) != exp {
+		t.Errorf("expected value %s, got %s", exp, v)
+	}
+
+	e, err := Decode[testLineItem](k, v, EnvelopeWrapped)
+	if err != nil {
+		t.Fatalf("decoding event: %v", err)
+	}
+	if e.After == nil || *e.After != (testLineItem{OrderID: "a", Line: 2, Price: 19.99}) {
+		t.Errorf("unexpected row %+v", e.After)
+	}
+	if exp := (Timestamp{WallTime: 1700000000000000000, Logical: 1}); e.Updated != exp {
+		t.Errorf("expected updated %v, got %v", exp, e.Updated)
+	}
+	var orderID string
+	var line int
+	if err = e.Key.Scan(&orderID, &line); err != nil || orderID != "a" || line != 2 {
+		t.Errorf("expected key a/2, got %s/%d (%v)", orderID, line, err)
+	}
+}
+
+// A column added to the table registers a new version of the schema,
+// which a consumer that doesn't know about the column can still read.
+func TestDecoderSchemaEvolution(t *testing.T) {
+	d, registry := newTestDecoder(t)
+
+	row := map[string]any{
+		"order_id": goavro.Union("string", "a"),
+		"line":     goavro.Union("long", int64(1)),
+		"price":    goavro.Union("bytes.decimal", big.NewRat(5, 1)),
+	}
+	v1 := encode(t, registry, "order_line_item-value", envelopeSchema(rowSchema("")), map[string]any{
+		"after": goavro.Union("order_line_item", row),
+	})
+
+	// ALTER TABLE order_line_item ADD COLUMN note STRING
+	row["note"] = goavro.Union("string", "gift")
+	v2 := encode(t, registry, "order_line_item-value", envelopeSchema(rowSchema(`,
+			{"name": "note", "type": ["null", "string"], "default": null}`)), map[string]any{
+		"after": goavro.Union("order_line_item", row),
+	})
+
+	for i, value := range [][]byte{v1, v2} {
+		_, v, err := d.JSON(context.Background(), Message{Value: value})
+		if err != nil {
+			t.Fatalf("decoding version %d: %v", i+1, err)
+		}
+
+		e, err := Decode[testLineItem](nil, v, EnvelopeWrapped)
+		if err != nil {
+			t.Fatalf("decoding version %d event: %v", i+1, err)
+		}
+		if e.After == nil || *e.After != (testLineItem{OrderID: "a", Line: 1, Price: 5}) {
+			t.Errorf("unexpected version %d row %+v", i+1, e.After)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	d, _ := newTestDecoder(t)
+
+	cases := []struct {
+		name string
+		msg  Message
+	}{
+		{name: "json value", msg: Message{Value: []byte(`{"after": null}`)}},
+		{name: "unknown schema", msg: Message{Value: schemaregistry.Frame(42, []byte{0})}},
+		{name: "json key", msg: Message{Key: []byte(`["a"]`)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, err := d.JSON(context.Background(), c.msg); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecoderTombstone(t *testing.T) {
+	d, registry := newTestDecoder(t)
+
+	key := encode(t, registry, "order_line_item-key", keySchema, map[string]any{
+		"order_id": "a",
+		"line":     int64(1),
+	})
+
+	k, v, err := d.JSON(context.Background(), Message{Key: key})
+	if err != nil {
+		t.Fatalf("decoding tombstone: %v", err)
+	}
+	if string(k) != `["a",1]` || v != nil {
+		t.Errorf("expected key only, got key %s value %s", k, v)
+	}
+}
+
+func TestNilDecoderPassesJSONThrough(t *testing.T) {
+	d, err := NewDecoder(FormatJSON, "")
+	if err != nil {
+		t.Fatalf("creating decoder: %v", err)
+	}
+
+	msg := Message{Key: []byte(`["a"]`), Value: []byte(`{"after": null}`)}
+	k, v, err := d.JSON(context.Background(), msg)
+	if err != nil || string(k) != string(msg.Key) || string(v) != string(msg.Value) {
+		t.Errorf("expected message unchanged, got %s %s (%v)", k, v, err)
+	}
+
+	if _, err = NewDecoder(FormatAvro, ""); err == nil {
+		t.Error("expected avro without a registry to be an error")
+	}
+}
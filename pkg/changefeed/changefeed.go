@@ -0,0 +1,236 @@
+// Package changefeed decodes the messages published by CockroachDB
+// changefeeds into typed events. Messages are JSON, or Avro turned into
+// JSON by a Decoder.
+package changefeed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Envelope is the shape of a changefeed's messages, matching the
+// changefeed's envelope option.
+type Envelope string
+
+const (
+	// EnvelopeWrapped messages hold the row under "after" and, with the
+	// diff option, its previous value under "before". This is the default
+	// for changefeeds on tables.
+	EnvelopeWrapped Envelope = "wrapped"
+	// EnvelopeBare messages are the row itself, with metadata under
+	// "__crdb__". This is the default for changefeeds with a CDC query.
+	EnvelopeBare Envelope = "bare"
+	// EnvelopeKeyOnly messages only have a key.
+	EnvelopeKeyOnly Envelope = "key_only"
+)
+
+// Event is a single changefeed message whose rows decode into T.
+//
+// A resolved message carries only Resolved, promising that every change
+// at or before it has already been published.
+type Event[T any] struct {
+	Key           Key
+	Before        *T
+	After         *T
+	Updated       Timestamp
+	MVCCTimestamp Timestamp
+	Resolved      Timestamp
+
+	deleted bool
+}
+
+// IsResolved reports whether the event is a resolved timestamp rather
+// than a row change.
+func (e Event[T]) IsResolved() bool {
+	return !e.Resolved.IsZero()
+}
+
+// IsDelete reports whether the event records a row being deleted. Deletes
+// can't be told apart from other changes in key_only changefeeds.
+func (e Event[T]) IsDelete() bool {
+	return e.deleted
+}
+
+// Key is the primary key of a changed row, one element per key column.
+type Key []json.RawMessage
+
+// DecodeKey parses a changefeed message key, a JSON array of the row's
+// primary key values.
+func DecodeKey(b []byte) (Key, error) {
+	var k Key
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("parsing key: %w", err)
+	}
+
+	return k, nil
+}
+
+// Scan decodes the key's columns into dest, in order.
+func (k Key) Scan(dest ...any) error {
+	if len(dest) != len(k) {
+		return fmt.Errorf("key has %d columns, scanning into %d", len(k), len(dest))
+	}
+
+	for i, d := range dest {
+		if err := json.Unmarshal(k[i], d); err != nil {
+			return fmt.Errorf("parsing key column %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// String returns the key's only column as a string, or "" if the key
+// doesn't have exactly one string column.
+func (k Key) String() string {
+	var s string
+	if len(k) != 1 || json.Unmarshal(k[0], &s) != nil {
+		return ""
+	}
+
+	return s
+}
+
+// Decode parses a changefeed message's key and value. The key may be nil
+// for sinks that only carry a value, in which case it's read from the
+// value's "key" field (or "__crdb__" field for bare messages) if present.
+func Decode[T any](key, value []byte, envelope Envelope) (Event[T], error) {
+	var e Event[T]
+
+	if len(key) > 0 {
+		k, err := DecodeKey(key)
+		if err != nil {
+			return Event[T]{}, err
+		}
+		e.Key = k
+	}
+
+	var err error
+	switch envelope {
+	case EnvelopeWrapped:
+		err = decodeWrapped(value, &e)
+	case EnvelopeBare:
+		err = decodeBare(value, &e)
+	case EnvelopeKeyOnly:
+		err = decodeKeyOnly(value, &e)
+	default:
+		err = fmt.Errorf("unknown envelope %q", envelope)
+	}
+	if err != nil {
+		return Event[T]{}, err
+	}
+
+	return e, nil
+}
+
+type wrapped[T any] struct {
+	Key           Key       `json:"key"`
+	Before        *T        `json:"before"`
+	After         *T        `json:"after"`
+	Updated       Timestamp `json:"updated"`
+	MVCCTimestamp Timestamp `json:"mvcc_timestamp"`
+	Resolved      Timestamp `json:"resolved"`
+}
+
+func decodeWrapped[T any](value []byte, e *Event[T]) error {
+	// A deleted row's message has an "after" of null, which can't be told
+	// apart from a missing field once decoded, so look for it first.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+
+	var w wrapped[T]
+	if err := json.Unmarshal(value, &w); err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+
+	e.Before, e.After = w.Before, w.After
+	e.Updated, e.MVCCTimestamp, e.Resolved = w.Updated, w.MVCCTimestamp, w.Resolved
+	if e.Key == nil {
+		e.Key = w.Key
+	}
+
+	after, ok := fields["after"]
+	e.deleted = ok && isNull(after)
+
+	return nil
+}
+
+type metadata struct {
+	Key           Key       `json:"key"`
+	Updated       Timestamp `json:"updated"`
+	MVCCTimestamp Timestamp `json:"mvcc_timestamp"`
+	Resolved      Timestamp `json:"resolved"`
+}
+
+func decodeBare[T any](value []byte, e *Event[T]) error {
+	// A deleted row's message is either empty or only has metadata.
+	if isNull(value) {
+		e.deleted = true
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+
+	if raw, ok := fields["__crdb__"]; ok {
+		var m metadata
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return fmt.Errorf("parsing message metadata: %w", err)
+		}
+
+		e.Updated, e.MVCCTimestamp, e.Resolved = m.Updated, m.MVCCTimestamp, m.Resolved
+		if e.Key == nil {
+			e.Key = m.Key
+		}
+
+		delete(fields, "__crdb__")
+	} else if raw, ok := fields["resolved"]; ok && len(fields) == 1 {
+		// Sinks other than Kafka send resolved timestamps in their own
+		// format, whatever the envelope.
+		if err := json.Unmarshal(raw, &e.Resolved); err != nil {
+			return fmt.Errorf("parsing resolved timestamp: %w", err)
+		}
+	}
+
+	if e.IsResolved() {
+		return nil
+	}
+
+	if len(fields) == 0 {
+		e.deleted = true
+		return nil
+	}
+
+	var row T
+	if err := json.Unmarshal(value, &row); err != nil {
+		return fmt.Errorf("parsing row: %w", err)
+	}
+	e.After = &row
+
+	return nil
+}
+
+func decodeKeyOnly[T any](value []byte, e *Event[T]) error {
+	// Resolved messages still have a value.
+	if isNull(value) {
+		return nil
+	}
+
+	var m metadata
+	if err := json.Unmarshal(value, &m); err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+	e.Resolved = m.Resolved
+
+	return nil
+}
+
+func isNull(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) == 0 || bytes.Equal(b, []byte("null"))
+}
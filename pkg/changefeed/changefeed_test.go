@@ -0,0 +1,197 @@
+package changefeed
+
+import (
+	"testing"
+)
+
+type testRow struct {
+	ID    string `json:"id"`
+	Price int    `json:"price"`
+}
+
+func TestDecodeWrapped(t *testing.T) {
+	cases := []struct {
+		name      string
+		key       string
+		value     string
+		expKey    string
+		expBefore *testRow
+		expAfter  *testRow
+		expDelete bool
+		expUpdate Timestamp
+	}{
+		{
+			name:      "insert",
+			key:       `["a"]`,
+			value:     `{"after": {"id": "a", "price": 1}, "updated": "1700000000000000000.0000000001"}`,
+			expKey:    "a",
+			expAfter:  &testRow{ID: "a", Price: 1},
+			expUpdate: Timestamp{WallTime: 1700000000000000000, Logical: 1},
+		},
+		{
+			name:      "update with diff",
+			key:       `["a"]`,
+			value:     `{"after": {"id": "a", "price": 2}, "before": {"id": "a", "price": 1}}`,
+			expKey:    "a",
+			expBefore: &testRow{ID: "a", Price: 1},
+			expAfter:  &testRow{ID: "a", Price: 2},
+		},
+		{
+			name:      "delete",
+			key:       `["a"]`,
+			value:     `{"after": null}`,
+			expKey:    "a",
+			expDelete: true,
+		},
+		{
+			name:     "key in value",
+			value:    `{"after": {"id": "a", "price": 1}, "key": ["a"]}`,
+			expKey:   "a",
+			expAfter: &testRow{ID: "a", Price: 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var key []byte
+			if c.key != "" {
+				key = []byte(c.key)
+			}
+
+			e, err := Decode[testRow](key, []byte(c.value), EnvelopeWrapped)
+			if err != nil {
+				t.Fatalf("decoding message: %v", err)
+			}
+
+			if act := e.Key.String(); act != c.expKey {
+				t.Errorf("expected key %q, got %q", c.expKey, act)
+			}
+			if !equalRows(e.Before, c.expBefore) {
+				t.Errorf("expected before %+v, got %+v", c.expBefore, e.Before)
+			}
+			if !equalRows(e.After, c.expAfter) {
+				t.Errorf("expected after %+v, got %+v", c.expAfter, e.After)
+			}
+			if e.IsDelete() != c.expDelete {
+				t.Errorf("expected delete %v, got %v", c.expDelete, e.IsDelete())
+			}
+			if e.Updated != c.expUpdate {
+				t.Errorf("expected updated %v, got %v", c.expUpdate, e.Updated)
+			}
+			if e.IsResolved() {
+				t.Error("expected a row change, got a resolved timestamp")
+			}
+		})
+	}
+}
+
+func TestDecodeBare(t *testing.T) {
+	e, err := Decode[testRow](nil, []byte(`{"id": "a", "price": 1, "__crdb__": {"key": ["a"], "updated": "1700000000000000000.0000000000"}}`), EnvelopeBare)
+	if err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+	if !equalRows(e.After, &testRow{ID: "a", Price: 1}) {
+		t.Errorf("unexpected row %+v", e.After)
+	}
+	if e.Key.String() != "a" {
+		t.Errorf("expected key a, got %v", e.Key)
+	}
+	if e.Updated.WallTime != 1700000000000000000 {
+		t.Errorf("unexpected updated %v", e.Updated)
+	}
+
+	for _, value := range []string{``, `null`, `{"__crdb__": {"updated": "1.0000000000"}}`} {
+		e, err = Decode[testRow](nil, []byte(value), EnvelopeBare)
+		if err != nil {
+			t.Fatalf("decoding %q: %v", value, err)
+		}
+		if !e.IsDelete() || e.After != nil {
+			t.Errorf("expected %q to be a delete, got %+v", value, e)
+		}
+	}
+}
+
+func TestDecodeResolved(t *testing.T) {
+	exp := Timestamp{WallTime: 1700000000000000000, Logical: 2}
+
+	cases := []struct {
+		envelope Envelope
+		value    string
+	}{
+		{envelope: EnvelopeWrapped, value: `{"resolved": "1700000000000000000.0000000002"}`},
+		{envelope: EnvelopeBare, value: `{"__crdb__": {"resolved": "1700000000000000000.0000000002"}}`},
+		// Webhook and cloudstorage sinks use their own format.
+		{envelope: EnvelopeBare, value: `{"resolved": "1700000000000000000.0000000002"}`},
+		{envelope: EnvelopeKeyOnly, value: `{"resolved": "1700000000000000000.0000000002"}`},
+	}
+
+	for _, c := range cases {
+		e, err := Decode[testRow](nil, []byte(c.value), c.envelope)
+		if err != nil {
+			t.Fatalf("decoding %s %s: %v", c.envelope, c.value, err)
+		}
+		if !e.IsResolved() || e.Resolved != exp {
+			t.Errorf("expected %s %s to resolve %v, got %v", c.envelope, c.value, exp, e.Resolved)
+		}
+		if e.After != nil || e.IsDelete() {
+			t.Errorf("expected %s %s to have no row, got %+v", c.envelope, c.value, e)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		key      string
+		value    string
+		envelope Envelope
+	}{
+		{name: "bad key", key: `"a"`, value: `{"after": null}`, envelope: EnvelopeWrapped},
+		{name: "bad value", value: `{`, envelope: EnvelopeWrapped},
+		{name: "bad row", value: `{"after": {"price": "x"}}`, envelope: EnvelopeWrapped},
+		{name: "bad timestamp", value: `{"after": null, "updated": "x"}`, envelope: EnvelopeWrapped},
+		{name: "unknown envelope", value: `{}`, envelope: "row"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var key []byte
+			if c.key != "" {
+				key = []byte(c.key)
+			}
+			if _, err := Decode[testRow](key, []byte(c.value), c.envelope); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestKeyScan(t *testing.T) {
+	k, err := DecodeKey([]byte(`["a", 2]`))
+	if err != nil {
+		t.Fatalf("decoding key: %v", err)
+	}
+
+	var id string
+	var line int
+	if err = k.Scan(&id, &line); err != nil {
+		t.Fatalf("scanning key: %v", err)
+	}
+	if id != "a" || line != 2 {
+		t.Errorf("expected a/2, got %s/%d", id, line)
+	}
+
+	if err = k.Scan(&id); err == nil {
+		t.Error("expected scanning too few columns to fail")
+	}
+	if act := k.String(); act != "" {
+		t.Errorf("expected a multi-column key to have no string, got %q", act)
+	}
+}
+
+func equalRows(a, b *testRow) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
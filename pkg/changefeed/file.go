@@ -0,0 +1,138 @@
+package changefeed
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSource reads the newline-delimited JSON files a cloudstorage sink
+// writes, from a local directory. Files are read in name order, which for
+// the cloudstorage sink is the order they were written, with each line
+// of a .ndjson file being a message and each .RESOLVED file a resolved
+// timestamp.
+//
+// Files are only tracked in memory, so a restarted FileSource reads the
+// directory from the start.
+type FileSource struct {
+	dir    string
+	follow bool
+	poll   time.Duration
+
+	mu      sync.Mutex
+	seen    map[string]bool
+	pending []Message
+	closed  bool
+}
+
+// NewFileSource returns a Source reading the files in dir. With follow,
+// Fetch waits for new files once it's read the existing ones; without it,
+// Fetch returns ErrClosed.
+func NewFileSource(dir string, follow bool) *FileSource {
+	return &FileSource{
+		dir:    dir,
+		follow: follow,
+		poll:   time.Second,
+		seen:   map[string]bool{},
+	}
+}
+
+func (s *FileSource) Fetch(ctx context.Context) (Message, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return Message{}, ErrClosed
+		}
+
+		if len(s.pending) == 0 {
+			if err := s.scan(); err != nil {
+				s.mu.Unlock()
+				return Message{}, err
+			}
+		}
+
+		if len(s.pending) > 0 {
+			m := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return m, nil
+		}
+		s.mu.Unlock()
+
+		if !s.follow {
+			return Message{}, ErrClosed
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-time.After(s.poll):
+		}
+	}
+}
+
+func (s *FileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// scan queues the messages in files that haven't been read yet.
+func (s *FileSource) scan() error {
+	var paths []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || s.seen[path] || !isSinkFile(path) {
+			return nil
+		}
+
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", s.dir, err)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		s.seen[path] = true
+
+		for _, line := range bytes.Split(b, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			s.pending = append(s.pending, Message{Value: line})
+		}
+	}
+
+	return nil
+}
+
+func isSinkFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".json", ".resolved":
+		return true
+	}
+
+	return false
+}
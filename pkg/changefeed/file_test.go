@@ -0,0 +1,140 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSinkFile writes a file under dir the way the cloudstorage sink
+// does, via a temporary name that isn't read.
+func writeSinkFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+
+	if err := os.WriteFile(p+".tmp", []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+
+	if err := os.Rename(p+".tmp", p); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+}
+
+func fetchValues(t *testing.T, s Source, n int) []string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var values []string
+	for i := 0; i < n; i++ {
+		m, err := s.Fetch(ctx)
+		if err != nil {
+			t.Fatalf("fetching message %d: %v", i, err)
+		}
+		values = append(values, string(m.Value))
+	}
+
+	return values
+}
+
+func TestFileSourceOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	// The sink's files sort by the timestamp that starts their name, and
+	// are spread across date directories.
+	writeSinkFile(t, dir, "2024-01-02/202401020000000000000000000-a-1-0-0-orders-1.ndjson", `{"id": 3}`+"\n")
+	writeSinkFile(t, dir, "2024-01-01/202401012300000000000000000.RESOLVED", `{"resolved": "1704150000000000000.0000000000"}`)
+	writeSinkFile(t, dir, "2024-01-01/202401010000000000000000000-a-1-0-0-orders-1.ndjson", `{"id": 1}`+"\n\n"+`{"id": 2}`+"\n")
+	writeSinkFile(t, dir, "2024-01-01/notes.txt", "not a sink file")
+
+	s := NewFileSource(dir, false)
+	defer s.Close()
+
+	exp := []string{
+		`{"id": 1}`,
+		`{"id": 2}`,
+		`{"resolved": "1704150000000000000.0000000000"}`,
+		`{"id": 3}`,
+	}
+	act := fetchValues(t, s, len(exp))
+	for i := range exp {
+		if act[i] != exp[i] {
+			t.Fatalf("expected %v, got %v", exp, act)
+		}
+	}
+
+	// Once read, a directory without follow is exhausted.
+	if _, err := s.Fetch(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFileSourceResolved(t *testing.T) {
+	dir := t.TempDir()
+	writeSinkFile(t, dir, "2024-01-01/202401010000000000000000000.RESOLVED", `{"resolved": "1704067200000000000.0000000000"}`)
+
+	s := NewFileSource(dir, false)
+	defer s.Close()
+
+	m := fetchValues(t, s, 1)[0]
+	e, err := Decode[map[string]any](nil, []byte(m), EnvelopeWrapped)
+	if err != nil {
+		t.Fatalf("decoding resolved message: %v", err)
+	}
+
+	if !e.IsResolved() {
+		t.Fatalf("expected a resolved message, got %+v", e)
+	}
+}
+
+func TestFileSourceFollow(t *testing.T) {
+	dir := t.TempDir()
+	writeSinkFile(t, dir, "2024-01-01/202401010000000000000000000-a-1-0-0-orders-1.ndjson", `{"id": 1}`+"\n")
+
+	s := NewFileSource(dir, true)
+	s.poll = 10 * time.Millisecond
+	defer s.Close()
+
+	if act := fetchValues(t, s, 1); act[0] != `{"id": 1}` {
+		t.Fatalf("expected first file's message, got %v", act)
+	}
+
+	// With nothing new, Fetch waits rather than returning ErrClosed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := s.Fetch(ctx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Fetch to wait for new files, got %v", err)
+	}
+
+	writeSinkFile(t, dir, "2024-01-02/202401020000000000000000000-a-1-0-0-orders-1.ndjson", `{"id": 2}`+"\n")
+
+	if act := fetchValues(t, s, 1); act[0] != `{"id": 2}` {
+		t.Fatalf("expected new file's message, got %v", act)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("closing source: %v", err)
+	}
+	if _, err = s.Fetch(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestFileSourceMissingDir(t *testing.T) {
+	s := NewFileSource(filepath.Join(t.TempDir(), "missing"), false)
+	defer s.Close()
+
+	if _, err := s.Fetch(context.Background()); err == nil || errors.Is(err, ErrClosed) {
+		t.Fatalf("expected a listing error, got %v", err)
+	}
+}
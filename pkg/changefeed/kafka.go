@@ -0,0 +1,85 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaSource reads messages from a Kafka topic. Acknowledging a message
+// commits its offset. Nack does nothing: a later Ack commits past the
+// failed message, and as NewKafkaSource joins a consumer group of its own
+// starting from the latest offset, a restarted consumer doesn't see it
+// again either.
+type KafkaSource struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaSource returns a Source reading the latest messages on topic, in
+// a consumer group of its own.
+func NewKafkaSource(brokers []string, topic string) *KafkaSource {
+	return NewKafkaSourceFromReader(kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     uuid.NewString(),
+		Topic:       topic,
+		StartOffset: kafka.LastOffset,
+	}))
+}
+
+// NewKafkaSourceFromReader returns a Source reading from an existing
+// reader, which it takes ownership of.
+func NewKafkaSourceFromReader(reader *kafka.Reader) *KafkaSource {
+	return &KafkaSource{reader: reader}
+}
+
+func (s *KafkaSource) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.reader.FetchMessage(ctx)
+	if errors.Is(err, io.EOF) {
+		return Message{}, ErrClosed
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("fetching kafka message: %w", err)
+	}
+
+	return Message{
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		ack: func(ctx context.Context) error {
+			return s.reader.CommitMessages(ctx, msg)
+		},
+	}, nil
+}
+
+func (s *KafkaSource) Close() error {
+	return s.reader.Close()
+}
+
+// KafkaPartitions returns the number of partitions in a Kafka topic, for
+// sizing a Watermark.
+func KafkaPartitions(ctx context.Context, brokers []string, topic string) (int, error) {
+	var lastErr error
+	for _, broker := range brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		partitions, err := conn.ReadPartitions(topic)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return len(partitions), nil
+	}
+
+	return 0, fmt.Errorf("reading partitions of %q: %w", topic, lastErr)
+}
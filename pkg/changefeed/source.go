@@ -0,0 +1,110 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// ErrClosed is returned by a Source's Fetch once it's been closed, or has
+// run out of messages.
+var ErrClosed = errors.New("changefeed source closed")
+
+// Message is a single raw message from a changefeed sink. Key is nil for
+// sinks that carry the key in the value.
+type Message struct {
+	Key       []byte
+	Value     []byte
+	Topic     string
+	Partition int
+
+	ack  func(context.Context) error
+	nack func(error)
+}
+
+// Ack marks the message as processed, so the sink doesn't redeliver it.
+func (m Message) Ack(ctx context.Context) error {
+	if m.ack == nil {
+		return nil
+	}
+
+	return m.ack(ctx)
+}
+
+// Nack marks the message as failed. A WebhookSource has the changefeed
+// redeliver it. Kafka and file sources can't: the next Fetch moves past
+// the message, so a consumer that mustn't lose it has to retry it before
+// moving on.
+func (m Message) Nack(err error) {
+	if m.nack != nil {
+		m.nack(err)
+	}
+}
+
+// Source yields the messages a changefeed publishes to a sink, so a
+// consumer can run unchanged against Kafka, webhook or cloud storage
+// sinks.
+type Source interface {
+	// Fetch blocks until the next message arrives or ctx is done.
+	Fetch(ctx context.Context) (Message, error)
+	Close() error
+}
+
+// Open returns the Source described by uri:
+//
+//	kafka://broker[,broker...]/topic
+//	webhook://[host]:port[?cert=cert.pem&key=key.pem]
+//	file:///path/to/dir[?follow=false]
+//
+// Webhook sources serve HTTPS if given a certificate and key, which
+// CockroachDB's webhook sink requires. File sources read the files a
+// cloudstorage sink writes to a directory, watching for new ones unless
+// follow is false.
+func Open(uri string) (Source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing source %q: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "kafka":
+		topic := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || topic == "" {
+			return nil, fmt.Errorf("kafka source %q needs brokers and a topic", uri)
+		}
+		return NewKafkaSource(strings.Split(u.Host, ","), topic), nil
+
+	case "webhook":
+		q := u.Query()
+		return NewWebhookSource(u.Host, q.Get("cert"), q.Get("key")), nil
+
+	case "file":
+		dir := u.Host + u.Path
+		if dir == "" {
+			return nil, fmt.Errorf("file source %q needs a directory", uri)
+		}
+		return NewFileSource(dir, u.Query().Get("follow") != "false"), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported source %q", uri)
+	}
+}
+
+// MustOpen calls Open, exiting if uri isn't a valid source. An empty uri
+// opens a KafkaSource for the given brokers and topic, which is what the
+// scenario binaries consume by default.
+func MustOpen(uri string, brokers []string, topic string) Source {
+	if uri == "" {
+		return NewKafkaSource(brokers, topic)
+	}
+
+	s, err := Open(uri)
+	if err != nil {
+		log.Fatalf("error opening changefeed source: %v", err)
+	}
+
+	return s
+}
@@ -0,0 +1,92 @@
+package changefeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp is a CockroachDB HLC timestamp, as found in a changefeed's
+// updated, mvcc_timestamp and resolved fields: wall-clock nanoseconds and
+// a logical counter, formatted as "<wall>.<logical>".
+type Timestamp struct {
+	WallTime int64
+	Logical  int32
+}
+
+// ParseTimestamp parses an HLC timestamp string.
+func ParseTimestamp(s string) (Timestamp, error) {
+	wall, logical, _ := strings.Cut(s, ".")
+
+	var t Timestamp
+	var err error
+	if t.WallTime, err = strconv.ParseInt(wall, 10, 64); err != nil {
+		return Timestamp{}, fmt.Errorf("parsing timestamp %q: %w", s, err)
+	}
+
+	if logical != "" {
+		l, err := strconv.ParseInt(logical, 10, 32)
+		if err != nil {
+			return Timestamp{}, fmt.Errorf("parsing timestamp %q: %w", s, err)
+		}
+		t.Logical = int32(l)
+	}
+
+	return t, nil
+}
+
+// FromTime returns the timestamp for a wall-clock time.
+func FromTime(t time.Time) Timestamp {
+	return Timestamp{WallTime: t.UnixNano()}
+}
+
+// Time returns the timestamp's wall-clock time.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.WallTime)
+}
+
+// IsZero reports whether the timestamp is unset.
+func (t Timestamp) IsZero() bool {
+	return t.WallTime == 0 && t.Logical == 0
+}
+
+// Less reports whether t is before o.
+func (t Timestamp) Less(o Timestamp) bool {
+	if t.WallTime != o.WallTime {
+		return t.WallTime < o.WallTime
+	}
+
+	return t.Logical < o.Logical
+}
+
+// String formats the timestamp as CockroachDB does, which is also what
+// AS OF SYSTEM TIME and a changefeed's cursor option accept.
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%010d", t.WallTime, t.Logical)
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("parsing timestamp: %w", err)
+	}
+
+	if s == "" {
+		*t = Timestamp{}
+		return nil
+	}
+
+	parsed, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+
+	*t = parsed
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
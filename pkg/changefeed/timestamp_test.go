@@ -0,0 +1,75 @@
+package changefeed
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		s   string
+		exp Timestamp
+		err bool
+	}{
+		{s: "1700000000000000000.0000000001", exp: Timestamp{WallTime: 1700000000000000000, Logical: 1}},
+		{s: "1700000000000000000", exp: Timestamp{WallTime: 1700000000000000000}},
+		{s: "x.1", err: true},
+		{s: "1.x", err: true},
+	}
+
+	for _, c := range cases {
+		act, err := ParseTimestamp(c.s)
+		if c.err {
+			if err == nil {
+				t.Errorf("expected %q to fail", c.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parsing %q: %v", c.s, err)
+		}
+		if act != c.exp {
+			t.Errorf("expected %q to parse as %+v, got %+v", c.s, c.exp, act)
+		}
+	}
+}
+
+func TestTimestampString(t *testing.T) {
+	ts := Timestamp{WallTime: 1700000000000000000, Logical: 12}
+	if act, exp := ts.String(), "1700000000000000000.0000000012"; act != exp {
+		t.Errorf("expected %s, got %s", exp, act)
+	}
+
+	b, err := json.Marshal(ts)
+	if err != nil {
+		t.Fatalf("marshalling timestamp: %v", err)
+	}
+
+	var act Timestamp
+	if err = json.Unmarshal(b, &act); err != nil {
+		t.Fatalf("unmarshalling timestamp: %v", err)
+	}
+	if act != ts {
+		t.Errorf("expected %+v to round-trip, got %+v", ts, act)
+	}
+
+	if err = json.Unmarshal([]byte(`""`), &act); err != nil || !act.IsZero() {
+		t.Errorf("expected an empty string to be zero, got %+v (%v)", act, err)
+	}
+}
+
+func TestTimestampLess(t *testing.T) {
+	a := Timestamp{WallTime: 1, Logical: 5}
+	b := Timestamp{WallTime: 2}
+	c := Timestamp{WallTime: 2, Logical: 1}
+
+	if !a.Less(b) || !b.Less(c) || c.Less(b) || b.Less(b) {
+		t.Errorf("unexpected ordering of %v, %v and %v", a, b, c)
+	}
+
+	now := time.Unix(1700000000, 0)
+	if act := FromTime(now).Time(); !act.Equal(now) {
+		t.Errorf("expected %v, got %v", now, act)
+	}
+}
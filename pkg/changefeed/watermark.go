@@ -0,0 +1,105 @@
+package changefeed
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Watermark tracks the resolved timestamps a changefeed publishes to each
+// partition of its topic. A changefeed resolves a partition once every
+// change at or before the timestamp has been published to it, so the
+// watermark across all partitions is the point up to which a consumer has
+// seen every change.
+type Watermark struct {
+	mu         sync.Mutex
+	partitions int
+	resolved   map[int]Timestamp
+	advanced   chan struct{}
+}
+
+// NewWatermark returns a Watermark for a topic with the given number of
+// partitions. With 0, the watermark only covers the partitions that have
+// reported a resolved timestamp so far.
+func NewWatermark(partitions int) *Watermark {
+	return &Watermark{
+		partitions: partitions,
+		resolved:   map[int]Timestamp{},
+		advanced:   make(chan struct{}),
+	}
+}
+
+// Observe records a resolved timestamp for a partition. Timestamps older
+// than the partition's current one are ignored, as a changefeed may
+// resend them after a restart.
+func (w *Watermark) Observe(partition int, ts Timestamp) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.resolved[partition].Less(ts) {
+		return
+	}
+
+	before := w.current()
+	w.resolved[partition] = ts
+
+	if before.Less(w.current()) {
+		close(w.advanced)
+		w.advanced = make(chan struct{})
+	}
+}
+
+// Resolved returns the watermark: the lowest resolved timestamp across all
+// partitions, or zero if any partition hasn't reported one yet.
+func (w *Watermark) Resolved() Timestamp {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current()
+}
+
+// Lag returns how far the watermark is behind the current time, or 0 if
+// there's no watermark yet.
+func (w *Watermark) Lag() time.Duration {
+	ts := w.Resolved()
+	if ts.IsZero() {
+		return 0
+	}
+
+	return time.Since(ts.Time())
+}
+
+// WaitFor blocks until the watermark reaches ts, meaning every change
+// committed at or before ts has been consumed, or until ctx is done.
+func (w *Watermark) WaitFor(ctx context.Context, ts Timestamp) error {
+	for {
+		w.mu.Lock()
+		current, advanced := w.current(), w.advanced
+		w.mu.Unlock()
+
+		if !current.IsZero() && !current.Less(ts) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-advanced:
+		}
+	}
+}
+
+func (w *Watermark) current() Timestamp {
+	if len(w.resolved) == 0 || len(w.resolved) < w.partitions {
+		return Timestamp{}
+	}
+
+	var lowest Timestamp
+	for _, ts := range w.resolved {
+		if lowest.IsZero() || ts.Less(lowest) {
+			lowest = ts
+		}
+	}
+
+	return lowest
+}
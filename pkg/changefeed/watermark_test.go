@@ -0,0 +1,103 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatermarkIsLowestAcrossPartitions(t *testing.T) {
+	w := NewWatermark(3)
+
+	w.Observe(0, Timestamp{WallTime: 30})
+	w.Observe(1, Timestamp{WallTime: 10})
+	if act := w.Resolved(); !act.IsZero() {
+		t.Errorf("expected no watermark until every partition resolves, got %v", act)
+	}
+
+	w.Observe(2, Timestamp{WallTime: 20})
+	if act, exp := w.Resolved(), (Timestamp{WallTime: 10}); act != exp {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+
+	// Resent older timestamps are ignored.
+	w.Observe(1, Timestamp{WallTime: 5})
+	if act, exp := w.Resolved(), (Timestamp{WallTime: 10}); act != exp {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+
+	w.Observe(1, Timestamp{WallTime: 40})
+	if act, exp := w.Resolved(), (Timestamp{WallTime: 20}); act != exp {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestWatermarkWithUnknownPartitions(t *testing.T) {
+	w := NewWatermark(0)
+	if act := w.Resolved(); !act.IsZero() {
+		t.Errorf("expected no watermark, got %v", act)
+	}
+	if act := w.Lag(); act != 0 {
+		t.Errorf("expected no lag without a watermark, got %v", act)
+	}
+
+	w.Observe(4, Timestamp{WallTime: 20})
+	w.Observe(7, Timestamp{WallTime: 10, Logical: 1})
+	if act, exp := w.Resolved(), (Timestamp{WallTime: 10, Logical: 1}); act != exp {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestWatermarkWaitFor(t *testing.T) {
+	w := NewWatermark(2)
+	target := Timestamp{WallTime: 20}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.WaitFor(context.Background(), target)
+	}()
+
+	for _, o := range []struct {
+		partition int
+		ts        Timestamp
+	}{
+		{partition: 0, ts: Timestamp{WallTime: 25}},
+		{partition: 1, ts: Timestamp{WallTime: 15}},
+		{partition: 1, ts: Timestamp{WallTime: 19, Logical: 9}},
+	} {
+		w.Observe(o.partition, o.ts)
+
+		select {
+		case err := <-done:
+			t.Fatalf("expected WaitFor to block at %v, returned %v", w.Resolved(), err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	w.Observe(1, target)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error waiting: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected WaitFor to return once the watermark reached its timestamp")
+	}
+
+	// Already reached.
+	if err := w.WaitFor(context.Background(), Timestamp{WallTime: 1}); err != nil {
+		t.Errorf("unexpected error waiting: %v", err)
+	}
+}
+
+func TestWatermarkWaitForCancelled(t *testing.T) {
+	w := NewWatermark(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := w.WaitFor(ctx, Timestamp{WallTime: 1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,150 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// WebhookSource receives the batches a changefeed's webhook sink POSTs.
+// A request is only answered once every message in it has been
+// acknowledged, so a Nack or a consumer that's too slow makes the
+// changefeed retry the batch.
+type WebhookSource struct {
+	server   *http.Server
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewWebhookSource returns a Source that listens on addr, serving HTTPS
+// if certFile and keyFile are set. With an empty addr it doesn't listen,
+// and its ServeHTTP method must be mounted on an existing server.
+func NewWebhookSource(addr, certFile, keyFile string) *WebhookSource {
+	s := &WebhookSource{
+		messages: make(chan Message),
+		closed:   make(chan struct{}),
+	}
+
+	if addr != "" {
+		s.server = &http.Server{Addr: addr, Handler: s}
+		go func() {
+			var err error
+			if certFile != "" {
+				err = s.server.ListenAndServeTLS(certFile, keyFile)
+			} else {
+				err = s.server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("error serving webhook source: %v", err)
+			}
+		}()
+	}
+
+	return s
+}
+
+func (s *WebhookSource) Fetch(ctx context.Context) (Message, error) {
+	select {
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-s.closed:
+		return Message{}, ErrClosed
+	case m := <-s.messages:
+		return m, nil
+	}
+}
+
+func (s *WebhookSource) Close() error {
+	s.once.Do(func() { close(s.closed) })
+
+	if s.server != nil {
+		return s.server.Close()
+	}
+
+	return nil
+}
+
+// webhookBatch is the body of a webhook sink request: either a batch of
+// messages or a resolved timestamp.
+type webhookBatch struct {
+	Payload  []json.RawMessage `json:"payload"`
+	Length   int               `json:"length"`
+	Resolved json.RawMessage   `json:"resolved"`
+}
+
+func (s *WebhookSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var batch webhookBatch
+	if err = json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, fmt.Sprintf("parsing body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	values := batch.Payload
+	if batch.Resolved != nil {
+		values = []json.RawMessage{body}
+	}
+
+	done := make(chan error, len(values))
+	for _, v := range values {
+		var meta struct {
+			Topic string `json:"topic"`
+		}
+		_ = json.Unmarshal(v, &meta)
+
+		var once sync.Once
+		m := Message{
+			Value: v,
+			Topic: meta.Topic,
+			ack: func(context.Context) error {
+				once.Do(func() { done <- nil })
+				return nil
+			},
+			nack: func(err error) {
+				once.Do(func() { done <- err })
+			},
+		}
+
+		select {
+		case s.messages <- m:
+		case <-r.Context().Done():
+			http.Error(w, "consumer not ready", http.StatusServiceUnavailable)
+			return
+		case <-s.closed:
+			http.Error(w, "source closed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	for range values {
+		select {
+		case err = <-done:
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case <-r.Context().Done():
+			http.Error(w, "consumer not ready", http.StatusServiceUnavailable)
+			return
+		case <-s.closed:
+			http.Error(w, "source closed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// post sends body to the webhook source's server in the background and
+// returns a channel that receives the response's status code.
+func post(t *testing.T, url, body string) <-chan int {
+	t.Helper()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	return status
+}
+
+func expectPending(t *testing.T, status <-chan int) {
+	t.Helper()
+
+	select {
+	case code := <-status:
+		t.Fatalf("expected response to wait for acks, got %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectStatus(t *testing.T, status <-chan int, exp int) {
+	t.Helper()
+
+	select {
+	case code := <-status:
+		if code != exp {
+			t.Fatalf("expected status %d, got %d", exp, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for response")
+	}
+}
+
+func TestWebhookSourceAck(t *testing.T) {
+	s := NewWebhookSource("", "", "")
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	status := post(t, srv.URL, `{"payload": [
+		{"after": {"id": 1}, "key": [1], "topic": "orders"},
+		{"after": {"id": 2}, "key": [2], "topic": "orders"}
+	], "length": 2}`)
+
+	ctx := context.Background()
+	first, err := s.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("fetching first message: %v", err)
+	}
+	if first.Topic != "orders" {
+		t.Fatalf("expected topic orders, got %q", first.Topic)
+	}
+
+	second, err := s.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("fetching second message: %v", err)
+	}
+
+	expectPending(t, status)
+
+	if err = first.Ack(ctx); err != nil {
+		t.Fatalf("acking first message: %v", err)
+	}
+	expectPending(t, status)
+
+	if err = second.Ack(ctx); err != nil {
+		t.Fatalf("acking second message: %v", err)
+	}
+	expectStatus(t, status, http.StatusOK)
+}
+
+func TestWebhookSourceNack(t *testing.T) {
+	s := NewWebhookSource("", "", "")
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	status := post(t, srv.URL, `{"payload": [{"after": {"id": 1}, "key": [1]}], "length": 1}`)
+
+	m, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetching message: %v", err)
+	}
+
+	// Only the first of an ack and a nack counts.
+	m.Nack(errors.New("failed"))
+	_ = m.Ack(context.Background())
+
+	expectStatus(t, status, http.StatusInternalServerError)
+}
+
+func TestWebhookSourceResolved(t *testing.T) {
+	s := NewWebhookSource("", "", "")
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	body := `{"resolved": "1704067200000000000.0000000000"}`
+	status := post(t, srv.URL, body)
+
+	m, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetching message: %v", err)
+	}
+
+	e, err := Decode[map[string]any](nil, m.Value, EnvelopeWrapped)
+	if err != nil {
+		t.Fatalf("decoding resolved message: %v", err)
+	}
+	if !e.IsResolved() {
+		t.Fatalf("expected a resolved message, got %s", m.Value)
+	}
+
+	expectPending(t, status)
+
+	if err = m.Ack(context.Background()); err != nil {
+		t.Fatalf("acking message: %v", err)
+	}
+	expectStatus(t, status, http.StatusOK)
+}
+
+func TestWebhookSourceRejects(t *testing.T) {
+	s := NewWebhookSource("", "", "")
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+
+	expectStatus(t, post(t, srv.URL, `not json`), http.StatusBadRequest)
+}
+
+func TestWebhookSourceClose(t *testing.T) {
+	s := NewWebhookSource("", "", "")
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// A batch waiting for a consumer is refused once the source closes,
+	// so the changefeed retries it.
+	status := post(t, srv.URL, `{"payload": [{"after": {"id": 1}, "key": [1]}], "length": 1}`)
+	expectPending(t, status)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing source: %v", err)
+	}
+	expectStatus(t, status, http.StatusServiceUnavailable)
+
+	if _, err := s.Fetch(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,355 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the endpoints a scenario binary talks to.
+//
+// Values are resolved in the following order, with later sources taking
+// precedence over earlier ones:
+//
+//  1. The defaults passed to Load.
+//  2. An optional YAML file (-config flag or CONFIG_FILE env var).
+//  3. Environment variables.
+//  4. Command line flags.
+type Config struct {
+	Database   DatabaseConfig   `yaml:"database"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	Redis      RedisConfig      `yaml:"redis"`
+	BigQuery   BigQueryConfig   `yaml:"bigquery"`
+	S3         S3Config         `yaml:"s3"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Changefeed ChangefeedConfig `yaml:"changefeed"`
+}
+
+// DatabaseConfig holds the connection string of a Postgres-compatible
+// database.
+type DatabaseConfig struct {
+	URL string `yaml:"url"`
+}
+
+// KafkaConfig holds the addresses of the Kafka (or Redpanda) brokers.
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+}
+
+// RedisConfig holds the address and credentials of a Redis server.
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// BigQueryConfig holds the endpoint and project of a BigQuery (or BigQuery
+// emulator) instance.
+type BigQueryConfig struct {
+	Endpoint string `yaml:"endpoint"`
+	Project  string `yaml:"project"`
+}
+
+// S3Config holds the endpoint, region and bucket of an S3-compatible store.
+type S3Config struct {
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+}
+
+// MetricsConfig holds the address the /metrics endpoint listens on. An
+// empty address disables the endpoint.
+type MetricsConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+// ChangefeedConfig holds the sink a changefeed consumer reads from, as a
+// kafka://, webhook:// or file:// URI. An empty source means the
+// consumer's default Kafka topic.
+//
+// Format is the changefeed's format option, json (the default) or avro.
+// Avro messages are decoded with schemas from the Registry URL.
+type ChangefeedConfig struct {
+	Source   string `yaml:"source"`
+	Format   string `yaml:"format"`
+	Registry string `yaml:"registry"`
+}
+
+// Endpoint identifies a group of settings that a binary can mark as
+// required when calling Load.
+type Endpoint string
+
+const (
+	Database Endpoint = "database"
+	Kafka    Endpoint = "kafka"
+	Redis    Endpoint = "redis"
+	BigQuery Endpoint = "bigquery"
+	S3       Endpoint = "s3"
+)
+
+// setting maps a single configuration value to its flag and env vars.
+type setting struct {
+	key      string
+	endpoint Endpoint
+	flag     string
+	env      []string
+	usage    string
+	get      func(*Config) string
+	set      func(*Config, string) error
+}
+
+var settings = []setting{
+	{
+		key:      "database.url",
+		endpoint: Database,
+		flag:     "database-url",
+		env:      []string{"DATABASE_URL", "CONNECTION_STRING"},
+		usage:    "database connection string",
+		get:      func(c *Config) string { return c.Database.URL },
+		set:      func(c *Config, v string) error { c.Database.URL = v; return nil },
+	},
+	{
+		key:      "kafka.brokers",
+		endpoint: Kafka,
+		flag:     "kafka-brokers",
+		env:      []string{"KAFKA_BROKERS", "KAFKA_URL"},
+		usage:    "comma-separated list of kafka brokers",
+		get:      func(c *Config) string { return strings.Join(c.Kafka.Brokers, ",") },
+		set:      func(c *Config, v string) error { c.Kafka.Brokers = splitList(v); return nil },
+	},
+	{
+		key:      "redis.addr",
+		endpoint: Redis,
+		flag:     "redis-addr",
+		env:      []string{"REDIS_ADDR"},
+		usage:    "redis address",
+		get:      func(c *Config) string { return c.Redis.Addr },
+		set:      func(c *Config, v string) error { c.Redis.Addr = v; return nil },
+	},
+	{
+		key:   "redis.password",
+		flag:  "redis-password",
+		env:   []string{"REDIS_PASSWORD"},
+		usage: "redis password",
+		get:   func(c *Config) string { return c.Redis.Password },
+		set:   func(c *Config, v string) error { c.Redis.Password = v; return nil },
+	},
+	{
+		key:   "redis.db",
+		flag:  "redis-db",
+		env:   []string{"REDIS_DB"},
+		usage: "redis database number",
+		get:   func(c *Config) string { return strconv.Itoa(c.Redis.DB) },
+		set: func(c *Config, v string) error {
+			db, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("not an integer: %q", v)
+			}
+			c.Redis.DB = db
+			return nil
+		},
+	},
+	{
+		key:      "bigquery.endpoint",
+		endpoint: BigQuery,
+		flag:     "bigquery-endpoint",
+		env:      []string{"BIGQUERY_ENDPOINT"},
+		usage:    "bigquery endpoint",
+		get:      func(c *Config) string { return c.BigQuery.Endpoint },
+		set:      func(c *Config, v string) error { c.BigQuery.Endpoint = v; return nil },
+	},
+	{
+		key:   "bigquery.project",
+		flag:  "bigquery-project",
+		env:   []string{"BIGQUERY_PROJECT"},
+		usage: "bigquery project id",
+		get:   func(c *Config) string { return c.BigQuery.Project },
+		set:   func(c *Config, v string) error { c.BigQuery.Project = v; return nil },
+	},
+	{
+		key:      "s3.endpoint",
+		endpoint: S3,
+		flag:     "s3-endpoint",
+		env:      []string{"S3_ENDPOINT", "AWS_ENDPOINT_URL"},
+		usage:    "s3 endpoint",
+		get:      func(c *Config) string { return c.S3.Endpoint },
+		set:      func(c *Config, v string) error { c.S3.Endpoint = v; return nil },
+	},
+	{
+		key:   "s3.region",
+		flag:  "s3-region",
+		env:   []string{"S3_REGION", "AWS_REGION"},
+		usage: "s3 region",
+		get:   func(c *Config) string { return c.S3.Region },
+		set:   func(c *Config, v string) error { c.S3.Region = v; return nil },
+	},
+	{
+		key:   "s3.bucket",
+		flag:  "s3-bucket",
+		env:   []string{"S3_BUCKET"},
+		usage: "s3 bucket",
+		get:   func(c *Config) string { return c.S3.Bucket },
+		set:   func(c *Config, v string) error { c.S3.Bucket = v; return nil },
+	},
+	{
+		key:   "metrics.addr",
+		flag:  "metrics-addr",
+		env:   []string{"METRICS_ADDR"},
+		usage: "address to serve /metrics on (empty to disable)",
+		get:   func(c *Config) string { return c.Metrics.Addr },
+		set:   func(c *Config, v string) error { c.Metrics.Addr = v; return nil },
+	},
+	{
+		key:   "changefeed.source",
+		flag:  "changefeed-source",
+		env:   []string{"CHANGEFEED_SOURCE"},
+		usage: "changefeed sink to consume: kafka://brokers/topic, webhook://:port or file:///dir (empty for the default kafka topic)",
+		get:   func(c *Config) string { return c.Changefeed.Source },
+		set:   func(c *Config, v string) error { c.Changefeed.Source = v; return nil },
+	},
+	{
+		key:   "changefeed.format",
+		flag:  "changefeed-format",
+		env:   []string{"CHANGEFEED_FORMAT"},
+		usage: "changefeed message format: json or avro",
+		get:   func(c *Config) string { return c.Changefeed.Format },
+		set:   func(c *Config, v string) error { c.Changefeed.Format = v; return nil },
+	},
+	{
+		key:   "changefeed.registry",
+		flag:  "changefeed-registry",
+		env:   []string{"CHANGEFEED_REGISTRY", "SCHEMA_REGISTRY_URL"},
+		usage: "schema registry url for avro changefeeds",
+		get:   func(c *Config) string { return c.Changefeed.Registry },
+		set:   func(c *Config, v string) error { c.Changefeed.Registry = v; return nil },
+	},
+}
+
+// MustLoad calls Load and exits if the configuration is invalid.
+func MustLoad(defaults Config, required ...Endpoint) Config {
+	cfg, err := Load(defaults, required...)
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
+	return cfg
+}
+
+// Load registers the configuration flags on flag.CommandLine, parses the
+// command line and resolves the configuration against the environment.
+// It replaces a call to flag.Parse, so any binary-specific flags must be
+// defined before it's called.
+func Load(defaults Config, required ...Endpoint) (Config, error) {
+	return LoadFlagSet(flag.CommandLine, os.Args[1:], os.LookupEnv, defaults, required...)
+}
+
+// LoadFlagSet is Load with an explicit flag set, argument list and env
+// var lookup function.
+func LoadFlagSet(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool), defaults Config, required ...Endpoint) (Config, error) {
+	configFile := fs.String("config", "", "path to a yaml config file (env CONFIG_FILE)")
+
+	flagValues := map[string]*string{}
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, strings.Join(s.env, ", "))
+		flagValues[s.flag] = fs.String(s.flag, s.get(&defaults), usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, fmt.Errorf("parsing flags: %w", err)
+	}
+
+	cfg := defaults
+	origins := map[string]string{}
+
+	// File.
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return Config{}, err
+		}
+		for _, s := range settings {
+			if s.get(&cfg) != s.get(&defaults) {
+				origins[s.key] = "file " + path
+			}
+		}
+	}
+
+	var errs []error
+
+	// Environment.
+	for _, s := range settings {
+		for _, name := range s.env {
+			v, ok := lookupEnv(name)
+			if !ok {
+				continue
+			}
+
+			if err := s.set(&cfg, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s (from env %s): %w", s.key, name, err))
+			}
+			origins[s.key] = "env " + name
+			break
+		}
+	}
+
+	// Flags.
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag != f.Name {
+				continue
+			}
+
+			if err := s.set(&cfg, *flagValues[s.flag]); err != nil {
+				errs = append(errs, fmt.Errorf("%s (from flag -%s): %w", s.key, s.flag, err))
+			}
+			origins[s.key] = "flag -" + s.flag
+		}
+	})
+
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+
+	if err := cfg.validate(origins, required); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	if err = dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,283 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// load calls LoadFlagSet with a fresh flag set and env taken from the
+// given map.
+func load(t *testing.T, args []string, env map[string]string, defaults Config, required ...Endpoint) (Config, error) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	return LoadFlagSet(fs, args, lookupEnv, defaults, required...)
+}
+
+func writeFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	defaults := Config{Redis: RedisConfig{Addr: "default:6379"}}
+	path := writeFile(t, "redis:\n  addr: file:6379\n")
+
+	cases := []struct {
+		name string
+		args []string
+		env  map[string]string
+		exp  string
+	}{
+		{
+			name: "defaults",
+			exp:  "default:6379",
+		},
+		{
+			name: "file flag overrides defaults",
+			args: []string{"-config", path},
+			exp:  "file:6379",
+		},
+		{
+			name: "file env var overrides defaults",
+			env:  map[string]string{"CONFIG_FILE": path},
+			exp:  "file:6379",
+		},
+		{
+			name: "env overrides file",
+			args: []string{"-config", path},
+			env:  map[string]string{"REDIS_ADDR": "env:6379"},
+			exp:  "env:6379",
+		},
+		{
+			name: "flag overrides env",
+			args: []string{"-config", path, "-redis-addr", "flag:6379"},
+			env:  map[string]string{"REDIS_ADDR": "env:6379"},
+			exp:  "flag:6379",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := load(t, c.args, c.env, defaults)
+			if err != nil {
+				t.Fatalf("error loading config: %v", err)
+			}
+
+			if cfg.Redis.Addr != c.exp {
+				t.Fatalf("expected %q, got %q", c.exp, cfg.Redis.Addr)
+			}
+		})
+	}
+}
+
+func TestLoadEnvAliases(t *testing.T) {
+	cfg, err := load(t, nil, map[string]string{"CONNECTION_STRING": "postgres://root@localhost:26257/defaultdb"}, Config{})
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	if exp := "postgres://root@localhost:26257/defaultdb"; cfg.Database.URL != exp {
+		t.Fatalf("expected %q, got %q", exp, cfg.Database.URL)
+	}
+
+	cfg, err = load(t, nil, map[string]string{"KAFKA_URL": "a:9092, b:9092"}, Config{})
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	if got := strings.Join(cfg.Kafka.Brokers, ","); got != "a:9092,b:9092" {
+		t.Fatalf("expected %q, got %q", "a:9092,b:9092", got)
+	}
+}
+
+func TestLoadOrigins(t *testing.T) {
+	path := writeFile(t, "redis:\n  addr: from-file\n")
+
+	cases := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		origin string
+	}{
+		{
+			name:   "file",
+			args:   []string{"-config", path},
+			origin: "file " + path,
+		},
+		{
+			name:   "env",
+			env:    map[string]string{"REDIS_ADDR": "from-env"},
+			origin: "env REDIS_ADDR",
+		},
+		{
+			name:   "flag",
+			args:   []string{"-redis-addr", "from-flag"},
+			origin: "flag -redis-addr",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := load(t, c.args, c.env, Config{})
+
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+
+			if verr.Key != "redis.addr" {
+				t.Fatalf("expected key %q, got %q", "redis.addr", verr.Key)
+			}
+
+			if verr.Origin != c.origin {
+				t.Fatalf("expected origin %q, got %q", c.origin, verr.Origin)
+			}
+		})
+	}
+}
+
+func TestLoadRequired(t *testing.T) {
+	_, err := load(t, nil, nil, Config{}, Database)
+
+	var verr ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+
+	if verr.Key != "database.url" || verr.Origin != "" {
+		t.Fatalf("expected database.url with no origin, got %v", verr)
+	}
+
+	if _, err = load(t, nil, map[string]string{"DATABASE_URL": "postgres://localhost:26257"}, Config{}, Database); err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	path := writeFile(t, "redis:\n  address: localhost:6379\n")
+
+	if _, err := load(t, []string{"-config", path}, nil, Config{}); err == nil {
+		t.Fatalf("expected error for unknown file setting")
+	}
+
+	if _, err := load(t, []string{"-redis-address", "localhost:6379"}, nil, Config{}); err == nil {
+		t.Fatalf("expected error for unknown flag")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		key  string
+	}{
+		{
+			name: "url without host",
+			env:  map[string]string{"S3_ENDPOINT": "localhost"},
+			key:  "s3.endpoint",
+		},
+		{
+			name: "database url without host",
+			env:  map[string]string{"DATABASE_URL": "postgres://"},
+			key:  "database.url",
+		},
+		{
+			name: "broker without port",
+			env:  map[string]string{"KAFKA_BROKERS": "localhost"},
+			key:  "kafka.brokers",
+		},
+		{
+			name: "negative redis db",
+			env:  map[string]string{"REDIS_DB": "-1"},
+			key:  "redis.db",
+		},
+		{
+			name: "unknown changefeed source scheme",
+			env:  map[string]string{"CHANGEFEED_SOURCE": "http://localhost:9707"},
+			key:  "changefeed.source",
+		},
+		{
+			name: "unknown changefeed format",
+			env:  map[string]string{"CHANGEFEED_FORMAT": "protobuf"},
+			key:  "changefeed.format",
+		},
+		{
+			name: "avro without registry",
+			env:  map[string]string{"CHANGEFEED_FORMAT": "avro"},
+			key:  "changefeed.registry",
+		},
+		{
+			name: "bad registry url",
+			env:  map[string]string{"CHANGEFEED_REGISTRY": "registry:8081"},
+			key:  "changefeed.registry",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := load(t, nil, c.env, Config{})
+
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+
+			if verr.Key != c.key {
+				t.Fatalf("expected key %q, got %q (%v)", c.key, verr.Key, verr)
+			}
+		})
+	}
+}
+
+func TestLoadNotAnInteger(t *testing.T) {
+	_, err := load(t, []string{"-redis-db", "one"}, nil, Config{})
+	if err == nil || !strings.Contains(err.Error(), "flag -redis-db") {
+		t.Fatalf("expected error naming flag -redis-db, got %v", err)
+	}
+}
+
+func TestLoadChangefeed(t *testing.T) {
+	path := writeFile(t, "changefeed:\n  source: file:///tmp/feed\n  format: avro\n  registry: http://file:8081\n")
+
+	cfg, err := load(t,
+		[]string{"-config", path, "-changefeed-registry", "http://flag:8081"},
+		map[string]string{"CHANGEFEED_SOURCE": "webhook://:9707"},
+		Config{Changefeed: ChangefeedConfig{Format: "json"}},
+	)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	exp := ChangefeedConfig{Source: "webhook://:9707", Format: "avro", Registry: "http://flag:8081"}
+	if cfg.Changefeed != exp {
+		t.Fatalf("expected %+v, got %+v", exp, cfg.Changefeed)
+	}
+
+	cfg, err = load(t, nil, map[string]string{"CHANGEFEED_FORMAT": "avro", "SCHEMA_REGISTRY_URL": "http://registry:8081"}, Config{})
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	if cfg.Changefeed.Registry != "http://registry:8081" {
+		t.Fatalf("expected %q, got %q", "http://registry:8081", cfg.Changefeed.Registry)
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ValidationError describes a configuration value that's missing or
+// malformed, along with where the value came from.
+type ValidationError struct {
+	Key    string
+	Origin string
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	if e.Origin == "" {
+		return fmt.Sprintf("%s: %s", e.Key, e.Reason)
+	}
+
+	return fmt.Sprintf("%s (from %s): %s", e.Key, e.Origin, e.Reason)
+}
+
+func (c Config) validate(origins map[string]string, required []Endpoint) error {
+	var errs []error
+	fail := func(key, reason string) {
+		errs = append(errs, ValidationError{Key: key, Origin: origins[key], Reason: reason})
+	}
+
+	// Required settings.
+	for _, r := range required {
+		for _, s := range settings {
+			if s.endpoint == r && s.get(&c) == "" {
+				fail(s.key, fmt.Sprintf("required (set -%s or %s)", s.flag, s.env[0]))
+			}
+		}
+	}
+
+	// Well-formed settings.
+	if v := c.Database.URL; v != "" {
+		// Only URL-style connection strings are checked, as some
+		// drivers accept keyword/value or DSN formats.
+		if strings.Contains(v, "://") {
+			if err := checkURL(v); err != nil {
+				fail("database.url", err.Error())
+			}
+		}
+	}
+
+	for _, b := range c.Kafka.Brokers {
+		if err := checkHostPort(b); err != nil {
+			fail("kafka.brokers", err.Error())
+		}
+	}
+
+	if v := c.Redis.Addr; v != "" {
+		if err := checkHostPort(v); err != nil {
+			fail("redis.addr", err.Error())
+		}
+	}
+
+	if c.Redis.DB < 0 {
+		fail("redis.db", "must not be negative")
+	}
+
+	if v := c.BigQuery.Endpoint; v != "" {
+		if err := checkURL(v); err != nil {
+			fail("bigquery.endpoint", err.Error())
+		}
+	}
+
+	if v := c.S3.Endpoint; v != "" {
+		if err := checkURL(v); err != nil {
+			fail("s3.endpoint", err.Error())
+		}
+	}
+
+	if v := c.Metrics.Addr; v != "" {
+		if err := checkHostPort(v); err != nil {
+			fail("metrics.addr", err.Error())
+		}
+	}
+
+	if v := c.Changefeed.Source; v != "" {
+		if err := checkSource(v); err != nil {
+			fail("changefeed.source", err.Error())
+		}
+	}
+
+	switch c.Changefeed.Format {
+	case "", "json":
+	case "avro":
+		if c.Changefeed.Registry == "" {
+			fail("changefeed.registry", "required for avro changefeeds (set -changefeed-registry or CHANGEFEED_REGISTRY)")
+		}
+	default:
+		fail("changefeed.format", fmt.Sprintf("invalid format %q: expected json or avro", c.Changefeed.Format))
+	}
+
+	if v := c.Changefeed.Registry; v != "" {
+		if err := checkURL(v); err != nil {
+			fail("changefeed.registry", err.Error())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid url %q: missing scheme or host", v)
+	}
+
+	return nil
+}
+
+func checkSource(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+
+	switch u.Scheme {
+	case "kafka", "webhook", "file":
+		return nil
+	}
+
+	return fmt.Errorf("invalid source %q: expected kafka://, webhook:// or file://", v)
+}
+
+func checkHostPort(v string) error {
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		return fmt.Errorf("invalid address %q: expected host:port", v)
+	}
+
+	return nil
+}
@@ -2,23 +2,148 @@ package connect
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const (
+	defaultTimeout        = time.Minute
+	defaultInitialBackoff = time.Millisecond * 250
+	defaultMaxBackoff     = time.Second * 5
+)
+
+// Logger receives a line for each failed connection attempt. *log.Logger
+// satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures the behaviour of Database.
+type Option func(*options)
+
+type options struct {
+	poolOpts       []DatabaseOption
+	timeout        time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	logger         Logger
+}
+
+// WithPoolConfig applies the given DatabaseOptions to the *pgxpool.Config
+// before the pool is created.
+func WithPoolConfig(opts ...DatabaseOption) Option {
+	return func(o *options) {
+		o.poolOpts = append(o.poolOpts, opts...)
+	}
+}
+
+// WithTimeout sets how long Database will keep retrying before giving up.
+// If the context passed to Database has an earlier deadline, that wins.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithBackoff sets the delay before the first retry and the ceiling the
+// delay doubles up to between subsequent retries.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(o *options) {
+		o.initialBackoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithLogger reports each failed connection attempt to the given logger.
+// Pass nil to silence reporting.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// Database connects to a database, retrying with exponential backoff until
+// a ping succeeds or the deadline is reached.
+func Database(ctx context.Context, url string, opts ...Option) (*pgxpool.Pool, error) {
+	o := newOptions(opts...)
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing db config: %w", err)
+	}
+
+	for _, opt := range o.poolOpts {
+		opt(cfg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	backoff := o.initialBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := dial(ctx, cfg)
+		if err == nil {
+			return db, nil
+		}
+
+		if o.logger != nil {
+			o.logger.Printf("database connection attempt %d failed (retrying in %s): %v", attempt, backoff, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("connecting to database after %d attempts: %w", attempt, err)
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, o.maxBackoff)
+	}
+}
+
+func newOptions(opts ...Option) options {
+	o := options{
+		timeout:        defaultTimeout,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		logger:         log.Default(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+func dial(ctx context.Context, cfg *pgxpool.Config) (*pgxpool.Pool, error) {
+	// Each attempt gets its own copy, as a pool takes ownership of the
+	// config it's created with. The pool fills MinConns in the background
+	// with the context it's given, so it must outlive the retry deadline.
+	db, err := pgxpool.NewWithConfig(context.WithoutCancel(ctx), cfg.Copy())
+	if err != nil {
+		return nil, fmt.Errorf("creating pool: %w", err)
+	}
+
+	if err = db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("pinging database: %w", err)
+	}
+
+	return db, nil
+}
+
 // MustDatabase connects to a database and fails if a connection can't
 // be established.
 func MustDatabase(url string) *pgxpool.Pool {
-	db, err := pgxpool.New(context.Background(), url)
+	db, err := Database(context.Background(), url)
 	if err != nil {
 		log.Fatalf("error connecting to database: %v", err)
 	}
 
-	if err = db.Ping(context.Background()); err != nil {
-		log.Fatalf("error pinging database: %v", err)
-	}
-
 	return db
 }
 
@@ -29,24 +154,10 @@ type DatabaseOption func(*pgxpool.Config)
 // MustDatatabaseWithConfig connects to a database and fails if a connection can't
 // be established.
 func MustDatatabaseWithConfig(url string, opts ...DatabaseOption) *pgxpool.Pool {
-	cfg, err := pgxpool.ParseConfig(url)
-	if err != nil {
-		log.Fatalf("error parsing db config: %v", err)
-	}
-
-	for _, opt := range opts {
-		opt(cfg)
-	}
-
-	db, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	db, err := Database(context.Background(), url, WithPoolConfig(opts...))
 	if err != nil {
 		log.Fatalf("error connecting to database: %v", err)
 	}
-	defer db.Close()
-
-	if err = db.Ping(context.Background()); err != nil {
-		log.Fatalf("error pinging database: %v", err)
-	}
 
 	return db
 }
@@ -0,0 +1,435 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestNewOptions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	cases := []struct {
+		name string
+		opts []Option
+		exp  options
+	}{
+		{
+			name: "defaults",
+			exp: options{
+				timeout:        defaultTimeout,
+				initialBackoff: defaultInitialBackoff,
+				maxBackoff:     defaultMaxBackoff,
+				logger:         log.Default(),
+			},
+		},
+		{
+			name: "timeout",
+			opts: []Option{WithTimeout(time.Second)},
+			exp: options{
+				timeout:        time.Second,
+				initialBackoff: defaultInitialBackoff,
+				maxBackoff:     defaultMaxBackoff,
+				logger:         log.Default(),
+			},
+		},
+		{
+			name: "backoff",
+			opts: []Option{WithBackoff(time.Millisecond, time.Millisecond*10)},
+			exp: options{
+				timeout:        defaultTimeout,
+				initialBackoff: time.Millisecond,
+				maxBackoff:     time.Millisecond * 10,
+				logger:         log.Default(),
+			},
+		},
+		{
+			name: "logger",
+			opts: []Option{WithLogger(logger)},
+			exp: options{
+				timeout:        defaultTimeout,
+				initialBackoff: defaultInitialBackoff,
+				maxBackoff:     defaultMaxBackoff,
+				logger:         logger,
+			},
+		},
+		{
+			name: "silenced logger",
+			opts: []Option{WithLogger(nil)},
+			exp: options{
+				timeout:        defaultTimeout,
+				initialBackoff: defaultInitialBackoff,
+				maxBackoff:     defaultMaxBackoff,
+			},
+		},
+		{
+			name: "last option wins",
+			opts: []Option{WithTimeout(time.Second), WithTimeout(time.Second * 2)},
+			exp: options{
+				timeout:        time.Second * 2,
+				initialBackoff: defaultInitialBackoff,
+				maxBackoff:     defaultMaxBackoff,
+				logger:         log.Default(),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			act := newOptions(c.opts...)
+
+			if act.timeout != c.exp.timeout {
+				t.Errorf("timeout: expected %s, got %s", c.exp.timeout, act.timeout)
+			}
+			if act.initialBackoff != c.exp.initialBackoff || act.maxBackoff != c.exp.maxBackoff {
+				t.Errorf("backoff: expected %s/%s, got %s/%s", c.exp.initialBackoff, c.exp.maxBackoff, act.initialBackoff, act.maxBackoff)
+			}
+			if act.logger != c.exp.logger {
+				t.Errorf("logger: expected %v, got %v", c.exp.logger, act.logger)
+			}
+		})
+	}
+}
+
+func TestWithPoolConfigAccumulates(t *testing.T) {
+	var applied []string
+	o := newOptions(
+		WithPoolConfig(func(*pgxpool.Config) { applied = append(applied, "a") }),
+		WithPoolConfig(
+			func(*pgxpool.Config) { applied = append(applied, "b") },
+			func(*pgxpool.Config) { applied = append(applied, "c") },
+		),
+	)
+
+	for _, opt := range o.poolOpts {
+		opt(nil)
+	}
+
+	if act := strings.Join(applied, ""); act != "abc" {
+		t.Fatalf("expected pool options to be applied in order, got %q", act)
+	}
+}
+
+func TestDatabaseInvalidURL(t *testing.T) {
+	cases := []struct {
+		name string
+		url  string
+	}{
+		{name: "unknown sslmode", url: "postgres://root@localhost:26257/?sslmode=sometimes"},
+		{name: "bad port", url: "postgres://root@localhost:notaport/"},
+		{name: "bad pool setting", url: "postgres://root@localhost:26257/?pool_max_conns=lots"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := &recorder{}
+
+			_, err := Database(context.Background(), c.url, WithLogger(logger))
+			if err == nil || !strings.Contains(err.Error(), "parsing db config") {
+				t.Fatalf("expected a config error, got %v", err)
+			}
+			if len(logger.lines()) != 0 {
+				t.Fatalf("expected no connection attempts, got %v", logger.lines())
+			}
+		})
+	}
+}
+
+func TestDatabaseBacksOff(t *testing.T) {
+	cases := []struct {
+		name     string
+		initial  time.Duration
+		max      time.Duration
+		timeout  time.Duration
+		expDelay []string
+	}{
+		{
+			name:     "doubles",
+			initial:  time.Millisecond * 20,
+			max:      time.Second,
+			timeout:  time.Millisecond * 200,
+			expDelay: []string{"20ms", "40ms", "80ms"},
+		},
+		{
+			name:     "capped",
+			initial:  time.Millisecond * 20,
+			max:      time.Millisecond * 30,
+			timeout:  time.Millisecond * 200,
+			expDelay: []string{"20ms", "30ms", "30ms", "30ms"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := &recorder{}
+
+			_, err := Database(context.Background(), unreachableURL(t),
+				WithTimeout(c.timeout),
+				WithBackoff(c.initial, c.max),
+				WithLogger(logger))
+			if err == nil {
+				t.Fatal("expected an error connecting to an unreachable database")
+			}
+
+			lines := logger.lines()
+			if len(lines) < len(c.expDelay) {
+				t.Fatalf("expected at least %d attempts, got %v", len(c.expDelay), lines)
+			}
+			for i, delay := range c.expDelay {
+				exp := fmt.Sprintf("attempt %d failed (retrying in %s)", i+1, delay)
+				if !strings.Contains(lines[i], exp) {
+					t.Errorf("attempt %d: expected %q in %q", i+1, exp, lines[i])
+				}
+			}
+
+			exp := fmt.Sprintf("after %d attempts", len(lines))
+			if !strings.Contains(err.Error(), exp) {
+				t.Errorf("expected %q in %q", exp, err)
+			}
+		})
+	}
+}
+
+func TestDatabaseGivesUp(t *testing.T) {
+	cases := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		timeout time.Duration
+	}{
+		{
+			name:    "timeout option",
+			ctx:     func() (context.Context, context.CancelFunc) { return context.Background(), func() {} },
+			timeout: time.Millisecond * 100,
+		},
+		{
+			name: "earlier context deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*100)
+			},
+			timeout: time.Minute,
+		},
+		{
+			name: "cancelled context",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			timeout: time.Minute,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := c.ctx()
+			defer cancel()
+			start := time.Now()
+
+			db, err := Database(ctx, unreachableURL(t),
+				WithTimeout(c.timeout),
+				WithBackoff(time.Millisecond*10, time.Millisecond*10),
+				WithLogger(nil))
+			if err == nil {
+				db.Close()
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), "connecting to database") {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second*5 {
+				t.Errorf("expected to give up promptly, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestDatabaseReturnsUsablePool(t *testing.T) {
+	srv := newFakeServer(t)
+
+	db, err := Database(context.Background(), srv.url(),
+		WithTimeout(time.Second*5),
+		WithLogger(nil),
+		WithPoolConfig(func(c *pgxpool.Config) { c.MaxConns = 3 }))
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer db.Close()
+
+	if db.Config().MaxConns != 3 {
+		t.Errorf("expected pool options to be applied, got max conns %d", db.Config().MaxConns)
+	}
+
+	if err = db.Ping(context.Background()); err != nil {
+		t.Fatalf("error pinging returned pool: %v", err)
+	}
+	if _, err = db.Exec(context.Background(), "SELECT 1"); err != nil {
+		t.Fatalf("error querying returned pool: %v", err)
+	}
+}
+
+func TestDatabaseRetriesUntilAvailable(t *testing.T) {
+	url := unreachableURL(t)
+	addr := strings.TrimPrefix(strings.Split(url, "/?")[0], "postgres://root@")
+
+	// Start listening on the address only after a few attempts have failed.
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		serve(t, addr)
+	}()
+
+	logger := &recorder{}
+	db, err := Database(context.Background(), url,
+		WithTimeout(time.Second*10),
+		WithBackoff(time.Millisecond*20, time.Millisecond*50),
+		WithLogger(logger))
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer db.Close()
+
+	if len(logger.lines()) == 0 {
+		t.Error("expected failed attempts before the server was available")
+	}
+	if err = db.Ping(context.Background()); err != nil {
+		t.Fatalf("error pinging returned pool: %v", err)
+	}
+}
+
+func TestMustDatatabaseWithConfigReturnsOpenPool(t *testing.T) {
+	srv := newFakeServer(t)
+
+	db := MustDatatabaseWithConfig(srv.url(), func(c *pgxpool.Config) { c.MaxConns = 2 })
+	defer db.Close()
+
+	if err := db.Ping(context.Background()); err != nil {
+		t.Fatalf("expected an open pool, got %v", err)
+	}
+}
+
+// recorder is a Logger that keeps what it's given.
+type recorder struct {
+	mu sync.Mutex
+	l  []string
+}
+
+func (r *recorder) Printf(format string, v ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.l = append(r.l, fmt.Sprintf(format, v...))
+}
+
+func (r *recorder) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.l...)
+}
+
+// unreachableURL returns the URL of an address nothing is listening on.
+func unreachableURL(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error reserving address: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return "postgres://root@" + addr + "/?sslmode=disable&connect_timeout=1"
+}
+
+type fakeServer struct {
+	addr string
+}
+
+func (s fakeServer) url() string {
+	return "postgres://root@" + s.addr + "/?sslmode=disable&connect_timeout=1"
+}
+
+func newFakeServer(t *testing.T) fakeServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go accept(l)
+
+	return fakeServer{addr: l.Addr().String()}
+}
+
+func serve(t *testing.T, addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Errorf("error listening: %v", err)
+		return
+	}
+	t.Cleanup(func() { l.Close() })
+	accept(l)
+}
+
+func accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// handle speaks just enough of the Postgres wire protocol for a client to
+// connect, ping and run simple queries.
+func handle(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.0"})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			if strings.HasPrefix(msg.String, "--") {
+				backend.Send(&pgproto3.EmptyQueryResponse{})
+			} else {
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 0")})
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			if err = backend.Flush(); err != nil {
+				return
+			}
+		case *pgproto3.Terminate:
+			return
+		default:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: "unsupported"})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			if err = backend.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Serve exposes the default Prometheus registry at /metrics on addr in the
+// background. An empty addr disables the endpoint.
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving metrics: %v", err)
+		}
+	}()
+}
+
+// Handler returns an http.Handler serving the default Prometheus registry,
+// for binaries that already run an HTTP server.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(
+		prometheus.DefaultGatherer,
+		promhttp.HandlerOpts{EnableOpenMetrics: true},
+	)
+}
+
+// Latency records durations into a windowed stats.Histogram, for terminal
+// readouts, and a Prometheus histogram, for scraping.
+type Latency struct {
+	window *stats.Histogram
+	prom   prometheus.Histogram
+}
+
+// NewLatency registers a histogram called name (in seconds) with the
+// default Prometheus registry and keeps the last window samples for
+// Snapshot.
+func NewLatency(name, help string, window int) *Latency {
+	return &Latency{
+		window: stats.NewHistogram(window),
+		prom: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		}),
+	}
+}
+
+// Record adds a sample to both histograms.
+func (l *Latency) Record(d time.Duration) {
+	l.window.Record(d)
+	l.prom.Observe(d.Seconds())
+}
+
+// Snapshot summarises the samples in the window.
+func (l *Latency) Snapshot() stats.Snapshot {
+	return l.window.Snapshot()
+}
+
+// CounterFunc exposes a monotonically increasing value the caller already
+// tracks as a Prometheus counter.
+func CounterFunc(name, help string, f func() float64) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, f)
+}
+
+// AtomicCounter exposes a uint64 that the caller updates with the
+// sync/atomic functions as a Prometheus counter.
+func AtomicCounter(name, help string, v *uint64) {
+	CounterFunc(name, help, func() float64 {
+		return float64(atomic.LoadUint64(v))
+	})
+}
+
+// GaugeFunc exposes a value the caller already tracks as a Prometheus
+// gauge.
+func GaugeFunc(name, help string, f func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+}
+
+// NewCounter registers a counter for values that are only tracked in
+// Prometheus.
+func NewCounter(name, help string) prometheus.Counter {
+	return promauto.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+}
+
+// NewCounterVec registers a counter partitioned by the given labels.
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return promauto.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+// NewGaugeVec registers a gauge partitioned by the given labels.
+func NewGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	return promauto.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+}
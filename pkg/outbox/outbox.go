@@ -0,0 +1,177 @@
+// Package outbox implements the transactional outbox pattern on
+// CockroachDB.
+//
+// Domain events are written to an outbox table in the same transaction
+// as the business change they describe, so either both are committed or
+// neither is. A Relay then publishes the events, either by polling the
+// outbox table or by following a changefeed on it, and cleans up the rows
+// it's delivered. This keeps the business tables out of the changefeed
+// while still giving consumers every event, in order for each aggregate.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Event is a domain event to publish. AggregateKey identifies the entity
+// the event is about; events with the same key are published in the
+// order they were written. Payload is marshalled to JSON.
+type Event struct {
+	AggregateKey string
+	Type         string
+	Payload      any
+}
+
+// Record is an event as stored in the outbox table. Seq numbers a key's
+// events from 1 without gaps, so consumers can drop redelivered events
+// by ignoring any Seq they've already seen for a key.
+type Record struct {
+	AggregateKey string          `json:"aggregate_key"`
+	Seq          int64           `json:"seq"`
+	Type         string          `json:"type"`
+	Payload      json.RawMessage `json:"payload"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// Logger receives a line for each failed attempt to publish or clean up
+// events. *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures an Outbox or Relay.
+type Option func(*options)
+
+type options struct {
+	table         string
+	sequenceTable string
+	logger        Logger
+	batchSize     int
+	interval      time.Duration
+	retention     time.Duration
+	partitions    int
+}
+
+// WithTable sets the table holding events. Defaults to "outbox".
+func WithTable(name string) Option {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+// WithSequenceTable sets the table holding each aggregate's last Seq.
+// Defaults to "outbox_sequences".
+func WithSequenceTable(name string) Option {
+	return func(o *options) {
+		o.sequenceTable = name
+	}
+}
+
+// WithLogger reports failures to the given logger. Pass nil to silence
+// reporting.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithBatchSize sets the most events a polling Relay publishes at once.
+// Defaults to 100.
+func WithBatchSize(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// WithInterval sets how often a Relay polls for events and cleans up
+// delivered ones. Defaults to 100ms.
+func WithInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.interval = d
+	}
+}
+
+// WithRetention keeps delivered events for d before deleting them, which
+// helps when debugging consumers. Defaults to 0, deleting events as soon
+// as they're delivered.
+func WithRetention(d time.Duration) Option {
+	return func(o *options) {
+		o.retention = d
+	}
+}
+
+// WithPartitions sets the number of partitions in the changefeed's topic,
+// so a following Relay only publishes events once all of them are
+// resolved. Defaults to the partitions that have been resolved so far.
+func WithPartitions(n int) Option {
+	return func(o *options) {
+		o.partitions = n
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		table:         "outbox",
+		sequenceTable: "outbox_sequences",
+		logger:        log.Default(),
+		batchSize:     100,
+		interval:      time.Millisecond * 100,
+	}
+}
+
+// Outbox writes events to the outbox table.
+type Outbox struct {
+	opts options
+}
+
+// New returns an Outbox for the outbox table.
+func New(opts ...Option) *Outbox {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Outbox{opts: o}
+}
+
+// Write adds events to the outbox as part of tx, so they're only
+// published if tx commits. Writes for the same aggregate key are
+// serialized on its sequence row, so concurrent transactions can't
+// publish a key's events out of order.
+func (o *Outbox) Write(ctx context.Context, tx pgx.Tx, events ...Event) error {
+	nextStmt := fmt.Sprintf(
+		`INSERT INTO %s (aggregate_key, seq) VALUES ($1, 1)
+		 ON CONFLICT (aggregate_key) DO UPDATE SET seq = %s.seq + 1
+		 RETURNING seq`,
+		pgx.Identifier{o.opts.sequenceTable}.Sanitize(), pgx.Identifier{o.opts.sequenceTable}.Sanitize(),
+	)
+
+	insertStmt := fmt.Sprintf(
+		`INSERT INTO %s (aggregate_key, seq, type, payload) VALUES ($1, $2, $3, $4)`,
+		pgx.Identifier{o.opts.table}.Sanitize(),
+	)
+
+	for _, e := range events {
+		payload, err := json.Marshal(e.Payload)
+		if err != nil {
+			return fmt.Errorf("marshalling %s event payload: %w", e.Type, err)
+		}
+
+		var seq int64
+		if err = tx.QueryRow(ctx, nextStmt, e.AggregateKey).Scan(&seq); err != nil {
+			return fmt.Errorf("sequencing %s event: %w", e.Type, err)
+		}
+
+		if _, err = tx.Exec(ctx, insertStmt, e.AggregateKey, seq, e.Type, payload); err != nil {
+			return fmt.Errorf("writing %s event: %w", e.Type, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher sends records to wherever consumers read them from. Records
+// for the same aggregate key arrive in Seq order and must be published in
+// that order.
+type Publisher interface {
+	Publish(ctx context.Context, records ...Record) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, records ...Record) error
+
+func (f PublisherFunc) Publish(ctx context.Context, records ...Record) error {
+	return f(ctx, records...)
+}
+
+// KafkaPublisher publishes records to a Kafka topic, keyed by aggregate
+// key so each key's records land on the same partition, in order. The
+// record's type and Seq are sent as headers.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher returns a Publisher writing to topic.
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, records ...Record) error {
+	messages := make([]kafka.Message, len(records))
+	for i, r := range records {
+		messages[i] = kafka.Message{
+			Key:   []byte(r.AggregateKey),
+			Value: r.Payload,
+			Headers: []kafka.Header{
+				{Key: "type", Value: []byte(r.Type)},
+				{Key: "seq", Value: []byte(strconv.FormatInt(r.Seq, 10))},
+			},
+		}
+	}
+
+	if err := p.writer.WriteMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("writing %d messages: %w", len(messages), err)
+	}
+
+	return nil
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// Seq returns the Seq header of a message published by a KafkaPublisher,
+// or 0 if it doesn't have one.
+func Seq(m kafka.Message) int64 {
+	for _, h := range m.Headers {
+		if h.Key == "seq" {
+			seq, _ := strconv.ParseInt(string(h.Value), 10, 64)
+			return seq
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,387 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrNoUpdated is returned by Run for an event without an updated
+// timestamp, as it can't be held until the changefeed resolves it. Create
+// the changefeed with the updated option.
+var ErrNoUpdated = errors.New("outbox event has no updated timestamp, create the changefeed with the updated option")
+
+// Relay publishes the events in the outbox table and cleans up the ones
+// it's delivered. Events are published at least once: a Relay that fails
+// after publishing but before recording delivery publishes them again.
+//
+// Only one Relay should run per outbox table, or events for the same key
+// may be published out of order.
+type Relay struct {
+	db        database
+	publisher Publisher
+	opts      options
+	watermark *changefeed.Watermark
+	pending   []pendingRecord
+}
+
+// database is satisfied by *pgxpool.Pool.
+type database interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// pendingRecord is an event a following Relay has received but can't
+// publish until the changefeed resolves its timestamp.
+type pendingRecord struct {
+	record  Record
+	updated changefeed.Timestamp
+}
+
+// NewRelay returns a Relay publishing the events in db's outbox table.
+func NewRelay(db *pgxpool.Pool, publisher Publisher, opts ...Option) *Relay {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Relay{
+		db:        db,
+		publisher: publisher,
+		opts:      o,
+		watermark: changefeed.NewWatermark(o.partitions),
+	}
+}
+
+// Watermark returns the resolved timestamps seen by Run.
+func (r *Relay) Watermark() *changefeed.Watermark {
+	return r.watermark
+}
+
+// Poll publishes events by querying the outbox table until ctx is
+// cancelled. Batches take undelivered events from every key in turn,
+// oldest first, so a key with a backlog can't hold up the others, and are
+// published sorted by key and Seq, so a key's events are never published
+// ahead of one another.
+func (r *Relay) Poll(ctx context.Context) error {
+	for {
+		n, err := r.publishBatch(ctx)
+		if err != nil {
+			r.logf("error publishing outbox events: %v", err)
+		}
+		if n == r.opts.batchSize {
+			continue
+		}
+
+		r.cleanup(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.opts.interval):
+		}
+	}
+}
+
+// Run publishes events from a changefeed on the outbox table until ctx is
+// cancelled. Events are held until the changefeed's resolved timestamp
+// passes them, then published sorted by key and Seq, as the changefeed
+// itself only orders changes to the same row.
+//
+// Run returns ErrNoUpdated if the changefeed wasn't created with the
+// updated option.
+//
+// Messages are acknowledged as soon as they're held, so events that were
+// held when a Relay stopped are published by the Poll that Run starts
+// with rather than being redelivered.
+func (r *Relay) Run(ctx context.Context, source changefeed.Source) error {
+	if err := r.drain(ctx); err != nil {
+		r.logf("error publishing outstanding outbox events: %v", err)
+	}
+
+	for {
+		msg, err := source.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, changefeed.ErrClosed) {
+				return err
+			}
+			r.logf("error fetching outbox message: %v", err)
+			continue
+		}
+
+		e, err := changefeed.Decode[Record](msg.Key, msg.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			r.logf("error parsing outbox message: %v", err)
+			msg.Nack(err)
+			continue
+		}
+
+		switch {
+		case e.IsResolved():
+			r.watermark.Observe(msg.Partition, e.Resolved)
+			if err = r.flush(ctx); err != nil {
+				r.logf("error publishing outbox events: %v", err)
+				msg.Nack(err)
+				continue
+			}
+			r.cleanup(ctx)
+
+		case e.After != nil:
+			if e.Updated.IsZero() {
+				msg.Nack(ErrNoUpdated)
+				return ErrNoUpdated
+			}
+			r.pending = append(r.pending, pendingRecord{record: *e.After, updated: e.Updated})
+		}
+
+		if err = msg.Ack(ctx); err != nil {
+			r.logf("error acknowledging outbox message: %v", err)
+		}
+	}
+}
+
+// drain publishes batches until there are no undelivered events left.
+func (r *Relay) drain(ctx context.Context) error {
+	for {
+		n, err := r.publishBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if n < r.opts.batchSize {
+			return nil
+		}
+	}
+}
+
+// publishBatch publishes the next batch of undelivered events, returning
+// how many there were. Events are numbered within their key, and the
+// batch is filled with every key's first event, then every key's second,
+// and so on, so it always holds the oldest events of each key it covers.
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	stmt := fmt.Sprintf(
+		`SELECT aggregate_key, seq, type, payload, created_at
+		 FROM (
+			 SELECT *, row_number() OVER (PARTITION BY aggregate_key ORDER BY seq) AS n
+			 FROM %s
+			 WHERE delivered_at IS NULL
+		 )
+		 ORDER BY n, aggregate_key
+		 LIMIT $1`,
+		pgx.Identifier{r.opts.table}.Sanitize(),
+	)
+
+	rows, err := r.db.Query(ctx, stmt, r.opts.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("querying outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var rec Record
+		if err = rows.Scan(&rec.AggregateKey, &rec.Seq, &rec.Type, &rec.Payload, &rec.CreatedAt); err != nil {
+			return 0, fmt.Errorf("scanning outbox row: %w", err)
+		}
+		records = append(records, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating outbox rows: %w", err)
+	}
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	sortRecords(records)
+	if err = r.publish(ctx, records); err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+// flush publishes the held events the watermark has passed.
+func (r *Relay) flush(ctx context.Context) error {
+	resolved := r.watermark.Resolved()
+	if resolved.IsZero() {
+		return nil
+	}
+
+	var ready []Record
+	var held []pendingRecord
+	for _, p := range r.pending {
+		if resolved.Less(p.updated) {
+			held = append(held, p)
+			continue
+		}
+		ready = append(ready, p.record)
+	}
+
+	if len(ready) == 0 {
+		return nil
+	}
+
+	sortRecords(ready)
+
+	// Skip events a poll has already delivered.
+	ready, err := r.undelivered(ctx, ready)
+	if err != nil {
+		return err
+	}
+
+	if len(ready) > 0 {
+		if err = r.publish(ctx, ready); err != nil {
+			return err
+		}
+	}
+
+	r.pending = held
+	return nil
+}
+
+// publish sends records and records their delivery.
+func (r *Relay) publish(ctx context.Context, records []Record) error {
+	if err := r.publisher.Publish(ctx, records...); err != nil {
+		return fmt.Errorf("publishing %d events: %w", len(records), err)
+	}
+
+	if err := r.deliver(ctx, records); err != nil {
+		return fmt.Errorf("recording delivery of %d events: %w", len(records), err)
+	}
+
+	return nil
+}
+
+// deliver deletes delivered events, or marks them as delivered if they're
+// being retained.
+func (r *Relay) deliver(ctx context.Context, records []Record) error {
+	keys, seqs := recordKeys(records)
+
+	stmt := fmt.Sprintf(
+		`DELETE FROM %s
+		 WHERE (aggregate_key, seq) IN (SELECT * FROM unnest($1::STRING[], $2::INT8[]))`,
+		pgx.Identifier{r.opts.table}.Sanitize(),
+	)
+	if r.opts.retention > 0 {
+		stmt = fmt.Sprintf(
+			`UPDATE %s SET delivered_at = now()
+			 WHERE (aggregate_key, seq) IN (SELECT * FROM unnest($1::STRING[], $2::INT8[]))
+			 AND delivered_at IS NULL`,
+			pgx.Identifier{r.opts.table}.Sanitize(),
+		)
+	}
+
+	if _, err := r.db.Exec(ctx, stmt, keys, seqs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// undelivered returns the records that are still waiting to be published.
+func (r *Relay) undelivered(ctx context.Context, records []Record) ([]Record, error) {
+	keys, seqs := recordKeys(records)
+
+	stmt := fmt.Sprintf(
+		`SELECT aggregate_key, seq
+		 FROM %s
+		 WHERE (aggregate_key, seq) IN (SELECT * FROM unnest($1::STRING[], $2::INT8[]))
+		 AND delivered_at IS NULL`,
+		pgx.Identifier{r.opts.table}.Sanitize(),
+	)
+
+	rows, err := r.db.Query(ctx, stmt, keys, seqs)
+	if err != nil {
+		return nil, fmt.Errorf("querying undelivered events: %w", err)
+	}
+	defer rows.Close()
+
+	type id struct {
+		key string
+		seq int64
+	}
+	waiting := map[id]bool{}
+	for rows.Next() {
+		var i id
+		if err = rows.Scan(&i.key, &i.seq); err != nil {
+			return nil, fmt.Errorf("scanning undelivered event: %w", err)
+		}
+		waiting[i] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating undelivered events: %w", err)
+	}
+
+	var out []Record
+	for _, rec := range records {
+		if waiting[id{key: rec.AggregateKey, seq: rec.Seq}] {
+			out = append(out, rec)
+		}
+	}
+
+	return out, nil
+}
+
+// Cleanup deletes up to a batch of events that were delivered longer ago
+// than the retention period, returning how many it deleted.
+func (r *Relay) Cleanup(ctx context.Context) (int64, error) {
+	stmt := fmt.Sprintf(
+		`DELETE FROM %s
+		 WHERE delivered_at < $1
+		 LIMIT $2`,
+		pgx.Identifier{r.opts.table}.Sanitize(),
+	)
+
+	res, err := r.db.Exec(ctx, stmt, time.Now().Add(-r.opts.retention), r.opts.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("deleting delivered events: %w", err)
+	}
+
+	return res.RowsAffected(), nil
+}
+
+func (r *Relay) cleanup(ctx context.Context) {
+	if r.opts.retention == 0 {
+		return
+	}
+
+	if _, err := r.Cleanup(ctx); err != nil {
+		r.logf("error cleaning up outbox: %v", err)
+	}
+}
+
+func (r *Relay) logf(format string, v ...any) {
+	if r.opts.logger != nil {
+		r.opts.logger.Printf(format, v...)
+	}
+}
+
+// sortRecords sorts records by key and Seq.
+func sortRecords(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].AggregateKey != records[j].AggregateKey {
+			return records[i].AggregateKey < records[j].AggregateKey
+		}
+		return records[i].Seq < records[j].Seq
+	})
+}
+
+func recordKeys(records []Record) ([]string, []int64) {
+	keys := make([]string, len(records))
+	seqs := make([]int64, len(records))
+	for i, rec := range records {
+		keys[i], seqs[i] = rec.AggregateKey, rec.Seq
+	}
+
+	return keys, seqs
+}
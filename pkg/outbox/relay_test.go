@@ -0,0 +1,317 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestFlushHoldsUnresolvedEvents(t *testing.T) {
+	db := newFakeDB()
+	var published []string
+	r := newTestRelay(db, &published)
+
+	// Events arrive out of order across keys, as they would from several
+	// partitions.
+	for _, e := range []struct {
+		key     string
+		seq     int64
+		updated int64
+	}{
+		{key: "b", seq: 2, updated: 40},
+		{key: "a", seq: 2, updated: 20},
+		{key: "b", seq: 1, updated: 10},
+		{key: "a", seq: 1, updated: 15},
+		{key: "a", seq: 3, updated: 50},
+		{key: "c", seq: 1, updated: 30},
+	} {
+		hold(r, db, e.key, e.seq, e.updated)
+	}
+
+	// Nothing is published until every partition has resolved.
+	r.watermark.Observe(0, changefeed.Timestamp{WallTime: 35})
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+	if len(published) != 0 {
+		t.Fatalf("expected nothing to be published, got %v", published)
+	}
+
+	r.watermark.Observe(1, changefeed.Timestamp{WallTime: 30})
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+	if exp := []string{"a/1", "a/2", "b/1", "c/1"}; !reflect.DeepEqual(published, exp) {
+		t.Errorf("expected %v to be published, got %v", exp, published)
+	}
+	if act := db.undeliveredKeys(); !reflect.DeepEqual(act, []string{"a/3", "b/2"}) {
+		t.Errorf("expected a/3 and b/2 to be left, got %v", act)
+	}
+
+	published = nil
+	r.watermark.Observe(0, changefeed.Timestamp{WallTime: 60})
+	r.watermark.Observe(1, changefeed.Timestamp{WallTime: 60})
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+	if exp := []string{"a/3", "b/2"}; !reflect.DeepEqual(published, exp) {
+		t.Errorf("expected %v to be published, got %v", exp, published)
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("expected nothing to be held, got %v", r.pending)
+	}
+}
+
+func TestFlushSkipsPolledEvents(t *testing.T) {
+	db := newFakeDB()
+	var published []string
+	r := newTestRelay(db, &published)
+
+	hold(r, db, "a", 1, 10)
+	hold(r, db, "a", 2, 20)
+
+	// A poll published a/1 while it was held.
+	db.mu.Lock()
+	delete(db.undelivered, "a/1")
+	db.mu.Unlock()
+
+	r.watermark.Observe(0, changefeed.Timestamp{WallTime: 20})
+	r.watermark.Observe(1, changefeed.Timestamp{WallTime: 20})
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+	if exp := []string{"a/2"}; !reflect.DeepEqual(published, exp) {
+		t.Errorf("expected %v to be published, got %v", exp, published)
+	}
+}
+
+func TestFlushKeepsEventsThatFailToPublish(t *testing.T) {
+	db := newFakeDB()
+	r := newTestRelay(db, nil)
+	r.publisher = PublisherFunc(func(context.Context, ...Record) error {
+		return fmt.Errorf("broker unavailable")
+	})
+
+	hold(r, db, "a", 1, 10)
+	r.watermark.Observe(0, changefeed.Timestamp{WallTime: 20})
+	r.watermark.Observe(1, changefeed.Timestamp{WallTime: 20})
+
+	if err := r.flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(r.pending) != 1 {
+		t.Errorf("expected the event to still be held, got %v", r.pending)
+	}
+	if act := db.undeliveredKeys(); !reflect.DeepEqual(act, []string{"a/1"}) {
+		t.Errorf("expected a/1 to still be undelivered, got %v", act)
+	}
+}
+
+func TestPublishBatchDoesNotStarveKeys(t *testing.T) {
+	db := newFakeDB()
+	var published []string
+	r := newTestRelay(db, &published)
+	r.opts.batchSize = 3
+
+	// A hot key with a backlog that sorts ahead of a cold one.
+	for seq := 1; seq <= 10; seq++ {
+		db.undelivered[fmt.Sprintf("a/%d", seq)] = true
+	}
+	db.undelivered["b/1"] = true
+
+	n, err := r.publishBatch(context.Background())
+	if err != nil {
+		t.Fatalf("publishing batch: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected a full batch, got %d", n)
+	}
+	if exp := []string{"a/1", "a/2", "b/1"}; !reflect.DeepEqual(published, exp) {
+		t.Errorf("expected %v to be published, got %v", exp, published)
+	}
+
+	if err = r.drain(context.Background()); err != nil {
+		t.Fatalf("draining: %v", err)
+	}
+	if act := db.undeliveredKeys(); len(act) != 0 {
+		t.Errorf("expected every event to be delivered, got %v left", act)
+	}
+
+	var hot []string
+	for _, p := range published {
+		if strings.HasPrefix(p, "a/") {
+			hot = append(hot, p)
+		}
+	}
+	for i, p := range hot {
+		if exp := fmt.Sprintf("a/%d", i+1); p != exp {
+			t.Fatalf("expected the hot key's events in order, got %v", hot)
+		}
+	}
+}
+
+// newTestRelay returns a Relay for a two-partition changefeed, recording
+// the events it publishes as key/seq.
+func newTestRelay(db *fakeDB, published *[]string) *Relay {
+	r := NewRelay(nil, PublisherFunc(func(_ context.Context, records ...Record) error {
+		for _, rec := range records {
+			*published = append(*published, fmt.Sprintf("%s/%d", rec.AggregateKey, rec.Seq))
+		}
+		return nil
+	}), WithPartitions(2), WithLogger(nil))
+	r.db = db
+
+	return r
+}
+
+// hold adds an event to the outbox table and has r receive it
+// from the changefeed.
+func hold(r *Relay, db *fakeDB, key string, seq, updated int64) {
+	db.mu.Lock()
+	db.undelivered[fmt.Sprintf("%s/%d", key, seq)] = true
+	db.mu.Unlock()
+
+	r.pending = append(r.pending, pendingRecord{
+		record:  Record{AggregateKey: key, Seq: seq},
+		updated: changefeed.Timestamp{WallTime: updated},
+	})
+}
+
+// fakeDB is an in-memory stand-in for the outbox table, tracking which
+// events are undelivered. Statements are recognised by their prefix.
+type fakeDB struct {
+	mu          sync.Mutex
+	undelivered map[string]bool
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{undelivered: map[string]bool{}}
+}
+
+func (db *fakeDB) undeliveredKeys() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var keys []string
+	for k := range db.undelivered {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if strings.HasPrefix(sql, "SELECT aggregate_key, seq, type") {
+		return db.batch(args[0].(int)), nil
+	}
+	if !strings.HasPrefix(sql, "SELECT aggregate_key, seq\n") {
+		return nil, fmt.Errorf("fakeDB: unsupported query %q", sql)
+	}
+
+	keys, seqs := args[0].([]string), args[1].([]int64)
+	rows := &fakeRows{}
+	for i := range keys {
+		if db.undelivered[fmt.Sprintf("%s/%d", keys[i], seqs[i])] {
+			rows.rows = append(rows.rows, []any{keys[i], seqs[i]})
+		}
+	}
+
+	return rows, nil
+}
+
+// batch returns up to limit undelivered events, numbered within their
+// key and ordered by that number and then key, as publishBatch's window
+// query does.
+func (db *fakeDB) batch(limit int) *fakeRows {
+	type event struct {
+		key    string
+		seq, n int64
+	}
+
+	var events []event
+	for id := range db.undelivered {
+		key, seq, _ := strings.Cut(id, "/")
+		s, _ := strconv.ParseInt(seq, 10, 64)
+		events = append(events, event{key: key, seq: s})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].key != events[j].key {
+			return events[i].key < events[j].key
+		}
+		return events[i].seq < events[j].seq
+	})
+	for i := range events {
+		events[i].n = 1
+		if i > 0 && events[i-1].key == events[i].key {
+			events[i].n = events[i-1].n + 1
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].n != events[j].n {
+			return events[i].n < events[j].n
+		}
+		return events[i].key < events[j].key
+	})
+
+	rows := &fakeRows{}
+	for i := 0; i < len(events) && i < limit; i++ {
+		rows.rows = append(rows.rows, []any{events[i].key, events[i].seq})
+	}
+
+	return rows
+}
+
+func (db *fakeDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !strings.HasPrefix(sql, "DELETE FROM") {
+		return pgconn.CommandTag{}, fmt.Errorf("fakeDB: unsupported statement %q", sql)
+	}
+
+	keys, seqs := args[0].([]string), args[1].([]int64)
+	for i := range keys {
+		delete(db.undelivered, fmt.Sprintf("%s/%d", keys[i], seqs[i]))
+	}
+
+	return pgconn.NewCommandTag(fmt.Sprintf("DELETE %d", len(keys))), nil
+}
+
+type fakeRows struct {
+	pgx.Rows
+	rows [][]any
+	cur  []any
+}
+
+func (r *fakeRows) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	r.cur, r.rows = r.rows[0], r.rows[1:]
+	return true
+}
+
+// Scan fills in the key and Seq, leaving any other columns empty.
+func (r *fakeRows) Scan(dest ...any) error {
+	*dest[0].(*string) = r.cur[0].(string)
+	*dest[1].(*int64) = r.cur[1].(int64)
+	return nil
+}
+
+func (r *fakeRows) Close()     {}
+func (r *fakeRows) Err() error { return nil }
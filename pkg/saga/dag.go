@@ -0,0 +1,155 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type actionKind string
+
+const (
+	actionDo         actionKind = "do"
+	actionCompensate actionKind = "compensate"
+)
+
+// action is a step to run or compensate.
+type action struct {
+	step string
+	kind actionKind
+}
+
+// state is a saga's status and the status of each of its steps.
+type state struct {
+	status Status
+	steps  map[string]StepStatus
+}
+
+// step returns the status of the named step. Steps without a row haven't
+// run yet.
+func (s state) step(name string) StepStatus {
+	if status, ok := s.steps[name]; ok {
+		return status
+	}
+
+	return StepPending
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func (o *Orchestrator[T]) loadState(ctx context.Context, q querier, key string) (state, error) {
+	sagaStmt := fmt.Sprintf(`SELECT status::STRING FROM %s WHERE %s = $1`,
+		pgx.Identifier{o.opts.table}.Sanitize(),
+		pgx.Identifier{o.opts.keyColumn}.Sanitize(),
+	)
+
+	s := state{steps: map[string]StepStatus{}}
+	err := q.QueryRow(ctx, sagaStmt, key).Scan(&s.status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return state{}, ErrNotFound
+	}
+	if err != nil {
+		return state{}, fmt.Errorf("getting saga: %w", err)
+	}
+
+	stepStmt := fmt.Sprintf(`SELECT step, status FROM %s WHERE saga_key = $1`,
+		pgx.Identifier{o.opts.stepTable}.Sanitize(),
+	)
+
+	rows, err := q.Query(ctx, stepStmt, key)
+	if err != nil {
+		return state{}, fmt.Errorf("querying saga steps: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var status StepStatus
+		if err = rows.Scan(&name, &status); err != nil {
+			return state{}, fmt.Errorf("scanning saga step: %w", err)
+		}
+		s.steps[name] = status
+	}
+
+	if err = rows.Err(); err != nil {
+		return state{}, fmt.Errorf("reading saga steps: %w", err)
+	}
+
+	return s, nil
+}
+
+// actions returns every step that can be run or compensated in state s.
+func (o *Orchestrator[T]) actions(s state) []action {
+	var out []action
+	for _, step := range o.steps {
+		for _, kind := range []actionKind{actionDo, actionCompensate} {
+			a := action{step: step.Name, kind: kind}
+			if o.ready(s, a) {
+				out = append(out, a)
+			}
+		}
+	}
+
+	return out
+}
+
+// ready reports whether action a can be taken in state s. A step can run
+// once every step it depends on is done, and can be compensated once none
+// of the steps that depend on it are done.
+func (o *Orchestrator[T]) ready(s state, a action) bool {
+	switch a.kind {
+	case actionDo:
+		if s.status != StatusInProgress || s.step(a.step) != StepPending {
+			return false
+		}
+		for _, d := range o.steps[o.stepIndex(a.step)].DependsOn {
+			if s.step(d) != StepDone {
+				return false
+			}
+		}
+		return true
+
+	case actionCompensate:
+		if s.status != StatusCancelling || s.step(a.step) != StepDone {
+			return false
+		}
+		for _, d := range o.dependents[a.step] {
+			if s.step(d) == StepDone {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// settle returns the saga's status once its steps are in state s. A saga
+// in progress finishes when every step is done, and a cancelling saga is
+// cancelled when no steps are left to compensate.
+func (o *Orchestrator[T]) settle(s state) Status {
+	switch s.status {
+	case StatusInProgress:
+		for _, step := range o.steps {
+			if s.step(step.Name) != StepDone {
+				return StatusInProgress
+			}
+		}
+		return StatusFinished
+
+	case StatusCancelling:
+		for _, step := range o.steps {
+			if s.step(step.Name) == StepDone {
+				return StatusCancelling
+			}
+		}
+		return StatusCancelled
+	}
+
+	return s.status
+}
@@ -0,0 +1,172 @@
+package saga
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddStepRejectsInvalidDAGs(t *testing.T) {
+	cases := []struct {
+		name   string
+		add    func(o *Orchestrator[testOrder])
+		expErr string
+	}{
+		{
+			name: "unknown dependency",
+			add: func(o *Orchestrator[testOrder]) {
+				o.AddStep("order", nil, nil)
+				o.AddStep("payment", nil, nil, DependsOn("invoice"))
+			},
+			expErr: `step "payment" depends on unknown step "invoice"`,
+		},
+		{
+			name: "depends on itself",
+			add: func(o *Orchestrator[testOrder]) {
+				o.AddStep("order", nil, nil, DependsOn("order"))
+			},
+			expErr: `step "order" depends on unknown step "order"`,
+		},
+		{
+			// A step can't depend on one added after it, so payment can't
+			// close the cycle order -> payment -> order.
+			name: "cycle",
+			add: func(o *Orchestrator[testOrder]) {
+				o.AddStep("order", nil, nil, DependsOn("payment"))
+				o.AddStep("payment", nil, nil, DependsOn("order"))
+			},
+			expErr: `step "order" depends on unknown step "payment"`,
+		},
+		{
+			// Re-adding a step would otherwise let it depend on a later one.
+			name: "cycle through a re-added step",
+			add: func(o *Orchestrator[testOrder]) {
+				o.AddStep("order", nil, nil)
+				o.AddStep("payment", nil, nil, DependsOn("order"))
+				o.AddStep("order", nil, nil, DependsOn("payment"))
+			},
+			expErr: `step "order" is already added`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Fatal("expected AddStep to panic")
+				}
+				if msg := r.(string); !strings.Contains(msg, c.expErr) {
+					t.Errorf("expected panic containing %q, got %q", c.expErr, msg)
+				}
+			}()
+
+			c.add(New[testOrder](nil))
+		})
+	}
+}
+
+func TestAddStepDependencies(t *testing.T) {
+	o := New[testOrder](nil).
+		AddStep("order", nil, nil).
+		AddStep("payment", nil, nil).
+		AddStep("reservation", nil, nil, DependsOn("order")).
+		AddStep("audit", nil, nil, DependsOn()).
+		AddStep("shipment", nil, nil, DependsOn("payment", "reservation"))
+
+	exp := map[string][]string{
+		"order":       nil,
+		"payment":     {"order"},
+		"reservation": {"order"},
+		"audit":       nil,
+		"shipment":    {"payment", "reservation"},
+	}
+	for _, s := range o.steps {
+		if !reflect.DeepEqual(s.DependsOn, exp[s.Name]) {
+			t.Errorf("expected %s to depend on %v, got %v", s.Name, exp[s.Name], s.DependsOn)
+		}
+	}
+
+	if act := o.dependents["order"]; !reflect.DeepEqual(act, []string{"payment", "reservation"}) {
+		t.Errorf("expected payment and reservation to depend on order, got %v", act)
+	}
+}
+
+func TestActions(t *testing.T) {
+	o := newTestOrchestrator(newFakeDB(), "")
+
+	cases := []struct {
+		name  string
+		state state
+		exp   []action
+	}{
+		{
+			name:  "started",
+			state: state{status: StatusInProgress},
+			exp:   []action{{step: "order", kind: actionDo}},
+		},
+		{
+			name:  "parallel steps",
+			state: state{status: StatusInProgress, steps: map[string]StepStatus{"order": StepDone}},
+			exp:   []action{{step: "payment", kind: actionDo}, {step: "reservation", kind: actionDo}},
+		},
+		{
+			name:  "waiting on one branch",
+			state: state{status: StatusInProgress, steps: map[string]StepStatus{"order": StepDone, "payment": StepDone}},
+			exp:   []action{{step: "reservation", kind: actionDo}},
+		},
+		{
+			name: "join",
+			state: state{status: StatusInProgress, steps: map[string]StepStatus{
+				"order": StepDone, "payment": StepDone, "reservation": StepDone,
+			}},
+			exp: []action{{step: "shipment", kind: actionDo}},
+		},
+		{
+			// Only the branch that completed is compensated, and order
+			// waits for it.
+			name: "cancelled mid-branch",
+			state: state{status: StatusCancelling, steps: map[string]StepStatus{
+				"order": StepDone, "payment": StepDone, "reservation": StepFailed,
+			}},
+			exp: []action{{step: "payment", kind: actionCompensate}},
+		},
+		{
+			name: "compensating back to the start",
+			state: state{status: StatusCancelling, steps: map[string]StepStatus{
+				"order": StepDone, "payment": StepCompensated, "reservation": StepFailed,
+			}},
+			exp: []action{{step: "order", kind: actionCompensate}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if act := o.actions(c.state); !reflect.DeepEqual(act, c.exp) {
+				t.Errorf("expected %v, got %v", c.exp, act)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	o := newTestOrchestrator(newFakeDB(), "")
+
+	done := map[string]StepStatus{"order": StepDone, "payment": StepDone, "reservation": StepDone, "shipment": StepDone}
+	if act := o.settle(state{status: StatusInProgress, steps: done}); act != StatusFinished {
+		t.Errorf("expected a saga with every step done to finish, got %s", act)
+	}
+
+	partial := map[string]StepStatus{"order": StepDone}
+	if act := o.settle(state{status: StatusInProgress, steps: partial}); act != StatusInProgress {
+		t.Errorf("expected a saga with steps left to stay in progress, got %s", act)
+	}
+	if act := o.settle(state{status: StatusCancelling, steps: partial}); act != StatusCancelling {
+		t.Errorf("expected a saga with steps to compensate to stay cancelling, got %s", act)
+	}
+
+	compensated := map[string]StepStatus{"order": StepCompensated, "payment": StepFailed}
+	if act := o.settle(state{status: StatusCancelling, steps: compensated}); act != StatusCancelled {
+		t.Errorf("expected a saga with nothing left to compensate to be cancelled, got %s", act)
+	}
+}
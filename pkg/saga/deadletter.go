@@ -0,0 +1,111 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNotDeadLettered is returned by Redrive for a saga that isn't in the
+// dead-letter table.
+var ErrNotDeadLettered = errors.New("saga is not dead-lettered")
+
+// DeadLetter is a saga with a step whose compensation ran out of attempts,
+// or whose changefeed message couldn't be handled. The saga is left where
+// it was until it's redriven.
+type DeadLetter struct {
+	Key      string    `json:"key"`
+	Step     string    `json:"step"`
+	Status   Status    `json:"status"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	TS       time.Time `json:"ts"`
+}
+
+func (o *Orchestrator[T]) deadLetter(ctx context.Context, key, step string, attempts int, cause error) error {
+	// The step stays done, but the saga's history shows why it stopped.
+	return o.recordDeadLetter(ctx, Transition{
+		Key:        key,
+		Step:       step,
+		StepStatus: StepDone,
+		FromStatus: StatusCancelling,
+		Status:     StatusCancelling,
+	}, attempts, cause)
+}
+
+// recordDeadLetter adds a saga to the dead-letter table along with an
+// entry in its history recording why.
+func (o *Orchestrator[T]) recordDeadLetter(ctx context.Context, t Transition, attempts int, cause error) error {
+	stmt := fmt.Sprintf(`UPSERT INTO %s (saga_key, step, status, error, attempts, ts)
+												VALUES ($1, $2, $3, $4, $5, now())`,
+		pgx.Identifier{o.opts.deadLetterTable}.Sanitize(),
+	)
+
+	t.Error = fmt.Sprintf("dead-lettered after %d attempts: %v", attempts, cause)
+
+	return crdbpgx.ExecuteTx(ctx, o.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, stmt, t.Key, t.Step, t.Status, cause.Error(), attempts); err != nil {
+			return fmt.Errorf("dead-lettering saga: %w", err)
+		}
+
+		return o.recordEvent(ctx, tx, t)
+	})
+}
+
+// DeadLetters returns the sagas in the dead-letter table, oldest first.
+func (o *Orchestrator[T]) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	stmt := fmt.Sprintf(`SELECT saga_key, step, status, error, attempts, ts
+											 FROM %s
+											 ORDER BY ts`,
+		pgx.Identifier{o.opts.deadLetterTable}.Sanitize(),
+	)
+
+	rows, err := o.db.Query(ctx, stmt)
+	if err != nil {
+		return nil, fmt.Errorf("querying dead letters: %w", err)
+	}
+
+	letters, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeadLetter, error) {
+		var dl DeadLetter
+		err := row.Scan(&dl.Key, &dl.Step, &dl.Status, &dl.Error, &dl.Attempts, &dl.TS)
+		return dl, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning dead letters: %w", err)
+	}
+
+	return letters, nil
+}
+
+// Redrive removes a saga from the dead-letter table and rewrites its row,
+// so the changefeed publishes it again and it gets a fresh set of
+// attempts.
+func (o *Orchestrator[T]) Redrive(ctx context.Context, key string) error {
+	deleteStmt := fmt.Sprintf(`DELETE FROM %s WHERE saga_key = $1`,
+		pgx.Identifier{o.opts.deadLetterTable}.Sanitize(),
+	)
+	touchStmt := fmt.Sprintf(`UPDATE %s SET status = status WHERE %s = $1`,
+		pgx.Identifier{o.opts.table}.Sanitize(),
+		pgx.Identifier{o.opts.keyColumn}.Sanitize(),
+	)
+
+	return crdbpgx.ExecuteTx(ctx, o.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		deleted, err := tx.Exec(ctx, deleteStmt, key)
+		if err != nil {
+			return fmt.Errorf("deleting dead letter: %w", err)
+		}
+		if deleted.RowsAffected() == 0 {
+			return ErrNotDeadLettered
+		}
+
+		if _, err = tx.Exec(ctx, touchStmt, key); err != nil {
+			return fmt.Errorf("republishing saga: %w", err)
+		}
+
+		return nil
+	})
+}
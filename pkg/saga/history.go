@@ -0,0 +1,163 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNotFound is returned by Get for a saga that doesn't exist.
+var ErrNotFound = errors.New("saga not found")
+
+// Event is an entry in a saga's history. Step, StepStatus and FromStatus
+// are empty for the event recording the saga's creation.
+type Event struct {
+	Step       string     `json:"step,omitempty"`
+	StepStatus StepStatus `json:"step_status,omitempty"`
+	FromStatus Status     `json:"from_status,omitempty"`
+	Status     Status     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	TS         time.Time  `json:"ts"`
+}
+
+// StepState is the current status of one step of a saga.
+type StepState struct {
+	Step   string     `json:"step"`
+	Status StepStatus `json:"status"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// State is a saga's current status and that of each of its steps, along
+// with how it got there. Step is the step that changed most recently.
+type State struct {
+	Key     string      `json:"key"`
+	Step    string      `json:"step"`
+	Status  Status      `json:"status"`
+	Steps   []StepState `json:"steps"`
+	History []Event     `json:"history"`
+}
+
+// Started records the creation of a saga, adding a pending row for each of
+// its steps. Call it in the transaction that inserts the saga row.
+func (o *Orchestrator[T]) Started(ctx context.Context, tx pgx.Tx, key string) error {
+	if len(o.steps) == 0 {
+		return errors.New("saga has no steps")
+	}
+
+	stmt := fmt.Sprintf(`INSERT INTO %s (saga_key, step, status) VALUES ($1, $2, $3)`,
+		pgx.Identifier{o.opts.stepTable}.Sanitize(),
+	)
+
+	for _, s := range o.steps {
+		if _, err := tx.Exec(ctx, stmt, key, s.Name, StepPending); err != nil {
+			return fmt.Errorf("inserting saga step %q: %w", s.Name, err)
+		}
+	}
+
+	return o.recordEvent(ctx, tx, Transition{
+		Key:    key,
+		Status: StatusInProgress,
+	})
+}
+
+func (o *Orchestrator[T]) recordEvent(ctx context.Context, tx pgx.Tx, t Transition) error {
+	stmt := fmt.Sprintf(`INSERT INTO %s (saga_key, step, step_status, from_status, status, error)
+												VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5, NULLIF($6, ''))`,
+		pgx.Identifier{o.opts.eventTable}.Sanitize(),
+	)
+
+	if _, err := tx.Exec(ctx, stmt, t.Key, t.Step, t.StepStatus, t.FromStatus, t.Status, t.Error); err != nil {
+		return fmt.Errorf("recording saga event: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns a saga's current status, the status of each of its steps in
+// the order they were added, and its history in the order it happened.
+func (o *Orchestrator[T]) Get(ctx context.Context, key string) (State, error) {
+	sagaStmt := fmt.Sprintf(`SELECT step::STRING, status::STRING FROM %s WHERE %s = $1`,
+		pgx.Identifier{o.opts.table}.Sanitize(),
+		pgx.Identifier{o.opts.keyColumn}.Sanitize(),
+	)
+
+	s := State{Key: key}
+	err := o.db.QueryRow(ctx, sagaStmt, key).Scan(&s.Step, &s.Status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return State{}, ErrNotFound
+	}
+	if err != nil {
+		return State{}, fmt.Errorf("getting saga: %w", err)
+	}
+
+	if s.Steps, err = o.getSteps(ctx, key); err != nil {
+		return State{}, err
+	}
+
+	eventStmt := fmt.Sprintf(`SELECT
+														COALESCE(step, ''),
+														COALESCE(step_status, ''),
+														COALESCE(from_status, ''),
+														status,
+														COALESCE(error, ''),
+														ts
+													FROM %s
+													WHERE saga_key = $1
+													ORDER BY ts, seq`,
+		pgx.Identifier{o.opts.eventTable}.Sanitize(),
+	)
+
+	rows, err := o.db.Query(ctx, eventStmt, key)
+	if err != nil {
+		return State{}, fmt.Errorf("querying saga events: %w", err)
+	}
+
+	s.History, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Event, error) {
+		var e Event
+		err := row.Scan(&e.Step, &e.StepStatus, &e.FromStatus, &e.Status, &e.Error, &e.TS)
+		return e, err
+	})
+	if err != nil {
+		return State{}, fmt.Errorf("scanning saga events: %w", err)
+	}
+
+	return s, nil
+}
+
+func (o *Orchestrator[T]) getSteps(ctx context.Context, key string) ([]StepState, error) {
+	stmt := fmt.Sprintf(`SELECT step, status, COALESCE(error, '') FROM %s WHERE saga_key = $1`,
+		pgx.Identifier{o.opts.stepTable}.Sanitize(),
+	)
+
+	rows, err := o.db.Query(ctx, stmt, key)
+	if err != nil {
+		return nil, fmt.Errorf("querying saga steps: %w", err)
+	}
+
+	found, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StepState, error) {
+		var s StepState
+		err := row.Scan(&s.Step, &s.Status, &s.Error)
+		return s, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning saga steps: %w", err)
+	}
+
+	byName := map[string]StepState{}
+	for _, s := range found {
+		byName[s.Step] = s
+	}
+
+	steps := make([]StepState, len(o.steps))
+	for i, s := range o.steps {
+		steps[i] = StepState{Step: s.Name, Status: StepPending}
+		if found, ok := byName[s.Name]; ok {
+			steps[i] = found
+		}
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,522 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Orchestrator runs the steps of sagas whose data decodes into T.
+//
+// By default each step depends on the one added before it, giving a
+// linear saga; DependsOn turns it into a DAG. An aborted step cancels the
+// saga, after which every done step is compensated once the steps that
+// depend on it have been, so only the branches that completed are undone.
+//
+// Each step's Do or Compensate runs in a transaction that also records
+// the step's new status, the saga's new status and a processed-message
+// key, so a redelivered message is skipped rather than run twice. The key
+// is made of the saga's key, the step and the MVCC timestamp of the saga
+// row the message was published for, so the changefeed must be created
+// with the updated option.
+//
+// Failing steps are retried with exponential backoff. A step that runs
+// out of attempts is aborted; a compensation that runs out of attempts, or
+// a message that can't be handled, is recorded in the dead-letter table
+// for an operator to Redrive.
+type Orchestrator[T any] struct {
+	db         database
+	opts       options
+	steps      []Step[T]
+	dependents map[string][]string
+	watermark  *changefeed.Watermark
+}
+
+// database is satisfied by *pgxpool.Pool.
+type database interface {
+	crdbpgx.Conn
+	querier
+}
+
+// New returns an Orchestrator for the saga table in db.
+func New[T any](db *pgxpool.Pool, opts ...Option) *Orchestrator[T] {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Orchestrator[T]{
+		db:         db,
+		opts:       o,
+		dependents: map[string][]string{},
+		watermark:  changefeed.NewWatermark(o.partitions),
+	}
+}
+
+// AddStep registers a step of the saga. Its name must be a value of the
+// saga table's step column, and it may only depend on steps that have
+// already been added, which keeps the saga free of cycles. AddStep panics
+// if the step is already added or depends on an unknown step.
+func (o *Orchestrator[T]) AddStep(name string, do, compensate StepFunc[T], opts ...StepOption) *Orchestrator[T] {
+	var so stepOptions
+	for _, opt := range opts {
+		opt(&so)
+	}
+
+	if o.stepIndex(name) >= 0 {
+		panic(fmt.Sprintf("saga: step %q is already added", name))
+	}
+
+	deps := so.dependsOn
+	if !so.explicit && len(o.steps) > 0 {
+		deps = []string{o.steps[len(o.steps)-1].Name}
+	}
+
+	for _, d := range deps {
+		if o.stepIndex(d) < 0 {
+			panic(fmt.Sprintf("saga: step %q depends on unknown step %q", name, d))
+		}
+		o.dependents[d] = append(o.dependents[d], name)
+	}
+
+	o.steps = append(o.steps, Step[T]{
+		Name:       name,
+		Do:         do,
+		Compensate: compensate,
+		DependsOn:  deps,
+		Timeout:    so.timeout,
+	})
+
+	return o
+}
+
+// Watermark returns the resolved timestamps Run has seen, for changefeeds
+// created with the resolved option.
+func (o *Orchestrator[T]) Watermark() *changefeed.Watermark {
+	return o.watermark
+}
+
+// Run handles messages from a changefeed on the saga table until ctx is
+// cancelled. Not every Source redelivers a message that fails, Kafka's
+// among them, so Run retries it with the same backoff as steps. A message
+// that still fails once its attempts are used up is dead-lettered against
+// its saga, which stays where it is until it's redriven; one that doesn't
+// name a saga is logged and skipped.
+func (o *Orchestrator[T]) Run(ctx context.Context, source changefeed.Source) error {
+	for {
+		msg, err := source.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, changefeed.ErrClosed) {
+				return err
+			}
+			o.logf("error fetching saga message: %v", err)
+			continue
+		}
+
+		e, err := changefeed.Decode[json.RawMessage](msg.Key, msg.Value, changefeed.EnvelopeBare)
+		if err != nil {
+			o.logf("error parsing saga message: %v", err)
+			msg.Nack(err)
+			continue
+		}
+
+		if e.IsResolved() {
+			o.watermark.Observe(msg.Partition, e.Resolved)
+		} else if err = o.handleMessage(ctx, msg.Value); err != nil {
+			o.logf("error handling saga message: %v", err)
+			msg.Nack(err)
+			continue
+		}
+
+		if err = msg.Ack(ctx); err != nil {
+			o.logf("error acknowledging saga message: %v", err)
+		}
+	}
+}
+
+// message is the part of a changefeed row the Orchestrator needs.
+type message struct {
+	key     string
+	status  Status
+	updated changefeed.Timestamp
+}
+
+// errNoUpdated is returned for messages without the MVCC timestamp that
+// processed-message keys are made from.
+var errNoUpdated = errors.New("saga message has no updated timestamp, create the changefeed with the updated option")
+
+// errDuplicate rolls back a transaction for work that's already been
+// done, or is no longer needed.
+var errDuplicate = errors.New("duplicate saga message")
+
+// Handle processes a single changefeed message containing a saga row,
+// concurrently running every step that's ready to run or be compensated.
+func (o *Orchestrator[T]) Handle(ctx context.Context, value []byte) error {
+	if len(o.steps) == 0 {
+		return errors.New("saga has no steps")
+	}
+
+	m, err := o.parse(value)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do.
+	if m.status == StatusFinished || m.status == StatusCancelled {
+		return nil
+	}
+
+	var data T
+	if err = json.Unmarshal(value, &data); err != nil {
+		return fmt.Errorf("parsing saga data: %w", err)
+	}
+
+	s, err := o.loadState(ctx, o.db, m.key)
+	if err != nil {
+		return err
+	}
+
+	work := o.actions(s)
+	errs := make([]error, len(work))
+
+	var wg sync.WaitGroup
+	for i, a := range work {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = o.process(ctx, m, a, data)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// handleMessage runs Handle until it succeeds or runs out of attempts,
+// then dead-letters the message's saga. Messages missing the fields Handle
+// needs can't succeed however often they're retried, so they're
+// dead-lettered straight away.
+func (o *Orchestrator[T]) handleMessage(ctx context.Context, value []byte) error {
+	_, parseErr := o.parse(value)
+
+	backoff := o.opts.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := parseErr
+		if err == nil {
+			if err = o.Handle(ctx, value); err == nil {
+				return nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if parseErr != nil || attempt >= o.opts.maxAttempts {
+			key, step, status, ok := o.describe(value)
+			if !ok {
+				o.logf("skipping saga message that names no saga: %v", err)
+				return nil
+			}
+
+			o.logf("%s %s: giving up on message after %d attempts: %v", o.opts.keyColumn, key, attempt, err)
+			return o.recordDeadLetter(ctx, Transition{Key: key, Step: step, FromStatus: status, Status: status}, attempt, err)
+		}
+
+		o.logf("handling saga message, attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+		if err = sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, o.opts.maxBackoff)
+	}
+}
+
+// process runs a single action, retrying it until it succeeds or runs out
+// of attempts.
+func (o *Orchestrator[T]) process(ctx context.Context, m message, a action, data T) error {
+	key := m.key
+
+	backoff := o.opts.initialBackoff
+	for attempt := 1; ; attempt++ {
+		t, err := o.attempt(ctx, m, a, data)
+		if err == nil {
+			o.notify(t)
+			return nil
+		}
+
+		if errors.Is(err, errDuplicate) {
+			o.logf("%s %s: skipping %s %q, already processed", o.opts.keyColumn, key, a.kind, a.step)
+			return nil
+		}
+
+		// Compensations can't be aborted, only retried.
+		if a.kind == actionDo && IsAbort(err) {
+			o.logf("%s %s: %v", o.opts.keyColumn, key, err)
+			return o.abort(ctx, key, a.step, err)
+		}
+
+		if attempt >= o.opts.maxAttempts {
+			o.logf("%s %s: giving up after %d attempts: %v", o.opts.keyColumn, key, attempt, err)
+			if a.kind == actionCompensate {
+				return o.deadLetter(ctx, key, a.step, attempt, err)
+			}
+			return o.abort(ctx, key, a.step, err)
+		}
+
+		o.logf("%s %s: attempt %d failed, retrying in %s: %v", o.opts.keyColumn, key, attempt, backoff, err)
+		if err = sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, o.opts.maxBackoff)
+	}
+}
+
+// attempt runs a step's Do or Compensate and records the outcome in a
+// single transaction.
+func (o *Orchestrator[T]) attempt(ctx context.Context, m message, a action, data T) (Transition, error) {
+	key := m.key
+	step := o.steps[o.stepIndex(a.step)]
+
+	timeout := step.Timeout
+	if timeout == 0 {
+		timeout = o.opts.stepTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var t Transition
+	err := crdbpgx.ExecuteTx(ctx, o.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		if err := o.claim(ctx, tx, m, a); err != nil {
+			return err
+		}
+
+		s, err := o.loadState(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !o.ready(s, a) {
+			// A step that was about to run when another branch cancelled
+			// the saga has nothing to undo.
+			if a.kind == actionDo && s.step(a.step) == StepPending && s.status != StatusInProgress {
+				t = Transition{Key: key, Step: a.step, StepStatus: StepSkipped, FromStatus: s.status, Status: s.status}
+				return o.save(ctx, tx, t)
+			}
+
+			return errDuplicate
+		}
+
+		t = Transition{Key: key, Step: a.step, FromStatus: s.status}
+		switch a.kind {
+		case actionDo:
+			if err := o.run(ctx, tx, step.Do, data); err != nil {
+				return fmt.Errorf("running step %q: %w", a.step, err)
+			}
+			t.StepStatus = StepDone
+
+		case actionCompensate:
+			if err := o.run(ctx, tx, step.Compensate, data); err != nil {
+				return fmt.Errorf("compensating step %q: %w", a.step, err)
+			}
+			t.StepStatus = StepCompensated
+		}
+
+		s.steps[a.step] = t.StepStatus
+		t.Status = o.settle(s)
+
+		return o.save(ctx, tx, t)
+	})
+
+	return t, err
+}
+
+// abort marks a step as failed and cancels its saga.
+func (o *Orchestrator[T]) abort(ctx context.Context, key, step string, cause error) error {
+	var t Transition
+	err := crdbpgx.ExecuteTx(ctx, o.db, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		s, err := o.loadState(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if s.step(step) != StepPending {
+			return errDuplicate
+		}
+
+		t = Transition{
+			Key:        key,
+			Step:       step,
+			StepStatus: StepFailed,
+			FromStatus: s.status,
+			Error:      cause.Error(),
+		}
+
+		s.steps[step] = StepFailed
+		if s.status == StatusInProgress {
+			s.status = StatusCancelling
+		}
+		t.Status = o.settle(s)
+
+		return o.save(ctx, tx, t)
+	})
+
+	if errors.Is(err, errDuplicate) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	o.notify(t)
+	return nil
+}
+
+// claim records that a message's action has been processed, returning
+// errDuplicate if it already has been. As it runs in the same transaction
+// as the step, the record only sticks if the step's effects do too.
+//
+// A later message for the same step, such as one published when a step is
+// retried after compensation, has a different MVCC timestamp and so isn't
+// mistaken for a redelivery; whether it still has work to do is up to the
+// saga's state.
+func (o *Orchestrator[T]) claim(ctx context.Context, tx pgx.Tx, m message, a action) error {
+	stmt := fmt.Sprintf(`INSERT INTO %s (message_id) VALUES ($1) ON CONFLICT DO NOTHING`,
+		pgx.Identifier{o.opts.processedTable}.Sanitize(),
+	)
+
+	id := fmt.Sprintf("%s/%s/%s/%s", m.key, a.step, a.kind, m.updated)
+	result, err := tx.Exec(ctx, stmt, id)
+	if err != nil {
+		return fmt.Errorf("recording processed message: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return errDuplicate
+	}
+
+	return nil
+}
+
+// save records a transition: the step's new status, the saga's new status
+// (rewriting the saga row, which publishes the next message) and an entry
+// in the saga's history.
+func (o *Orchestrator[T]) save(ctx context.Context, tx pgx.Tx, t Transition) error {
+	stepStmt := fmt.Sprintf(`UPSERT INTO %s (saga_key, step, status, error) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		pgx.Identifier{o.opts.stepTable}.Sanitize(),
+	)
+	if _, err := tx.Exec(ctx, stepStmt, t.Key, t.Step, t.StepStatus, t.Error); err != nil {
+		return fmt.Errorf("updating saga step: %w", err)
+	}
+
+	sagaStmt := fmt.Sprintf(`UPDATE %s SET step = $1, status = $2 WHERE %s = $3`,
+		pgx.Identifier{o.opts.table}.Sanitize(),
+		pgx.Identifier{o.opts.keyColumn}.Sanitize(),
+	)
+	if _, err := tx.Exec(ctx, sagaStmt, t.Step, t.Status, t.Key); err != nil {
+		return fmt.Errorf("updating saga: %w", err)
+	}
+
+	return o.recordEvent(ctx, tx, t)
+}
+
+func (o *Orchestrator[T]) parse(value []byte) (message, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return message{}, fmt.Errorf("parsing saga message: %w", err)
+	}
+
+	var m message
+	if err := json.Unmarshal(fields[o.opts.keyColumn], &m.key); err != nil {
+		return message{}, fmt.Errorf("parsing saga key %q: %w", o.opts.keyColumn, err)
+	}
+	if err := json.Unmarshal(fields["status"], &m.status); err != nil {
+		return message{}, fmt.Errorf("parsing saga status: %w", err)
+	}
+
+	var meta struct {
+		Updated changefeed.Timestamp `json:"updated"`
+	}
+	if raw, ok := fields["__crdb__"]; ok {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return message{}, fmt.Errorf("parsing saga message metadata: %w", err)
+		}
+	}
+	if meta.Updated.IsZero() {
+		return message{}, errNoUpdated
+	}
+	m.updated = meta.Updated
+
+	return m, nil
+}
+
+// describe returns as much of a saga message as a dead letter needs,
+// reporting false if it doesn't have a key and status.
+func (o *Orchestrator[T]) describe(value []byte) (key, step string, status Status, ok bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return "", "", "", false
+	}
+
+	if json.Unmarshal(fields[o.opts.keyColumn], &key) != nil || key == "" {
+		return "", "", "", false
+	}
+	if json.Unmarshal(fields["status"], &status) != nil || status == "" {
+		return "", "", "", false
+	}
+	_ = json.Unmarshal(fields["step"], &step)
+
+	return key, step, status, true
+}
+
+func (o *Orchestrator[T]) run(ctx context.Context, tx pgx.Tx, f StepFunc[T], data T) error {
+	if f == nil {
+		return nil
+	}
+
+	return f(ctx, tx, data)
+}
+
+func (o *Orchestrator[T]) notify(t Transition) {
+	if o.opts.onTransition != nil {
+		o.opts.onTransition(t)
+	}
+}
+
+func (o *Orchestrator[T]) stepIndex(name string) int {
+	for i, s := range o.steps {
+		if s.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (o *Orchestrator[T]) logf(format string, v ...any) {
+	if o.opts.logger != nil {
+		o.opts.logger.Printf(format, v...)
+	}
+}
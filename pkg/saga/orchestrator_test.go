@@ -0,0 +1,645 @@
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/changefeed"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type testOrder struct {
+	OrderID string `json:"order_id"`
+}
+
+func TestRedeliveriesAreIdempotent(t *testing.T) {
+	cases := []struct {
+		name       string
+		deliveries int
+		abort      string
+		expStatus  Status
+		expEffects map[string]int
+	}{
+		{
+			name:       "delivered once",
+			deliveries: 1,
+			expStatus:  StatusFinished,
+			expEffects: map[string]int{
+				"order/do": 1, "payment/do": 1, "reservation/do": 1, "shipment/do": 1,
+			},
+		},
+		{
+			name:       "delivered five times",
+			deliveries: 5,
+			expStatus:  StatusFinished,
+			expEffects: map[string]int{
+				"order/do": 1, "payment/do": 1, "reservation/do": 1, "shipment/do": 1,
+			},
+		},
+		{
+			name:       "cancelled and delivered five times",
+			deliveries: 5,
+			abort:      "shipment",
+			expStatus:  StatusCancelled,
+			expEffects: map[string]int{
+				"order/do": 1, "payment/do": 1, "reservation/do": 1,
+				"order/compensate": 1, "payment/compensate": 1, "reservation/compensate": 1,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newFakeDB()
+			o := newTestOrchestrator(db, c.abort)
+			db.seed("o1", o)
+
+			source := &replaySource{db: db, key: "o1", deliveries: c.deliveries}
+			if err := o.Run(context.Background(), source); !errors.Is(err, changefeed.ErrClosed) {
+				t.Fatalf("unexpected error running saga: %v", err)
+			}
+
+			if act := db.status("o1"); act != c.expStatus {
+				t.Errorf("expected saga to be %s, got %s", c.expStatus, act)
+			}
+			if act := db.effects("o1"); !reflect.DeepEqual(act, c.expEffects) {
+				t.Errorf("expected effects %v, got %v", c.expEffects, act)
+			}
+			if source.handled < c.deliveries*2 {
+				t.Errorf("expected every message to be delivered %d times, only %d deliveries", c.deliveries, source.handled)
+			}
+		})
+	}
+}
+
+func TestConcurrentRedeliveriesAreIdempotent(t *testing.T) {
+	db := newFakeDB()
+	o := newTestOrchestrator(db, "")
+	db.seed("o1", o)
+
+	var history [][]byte
+	for round := 0; db.status("o1") == StatusInProgress; round++ {
+		if round > 10 {
+			t.Fatalf("saga still %s after %d rounds", db.status("o1"), round)
+		}
+
+		msg := db.message("o1")
+		history = append(history, msg)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 5)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = o.Handle(context.Background(), msg)
+			}()
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+
+	// Stale messages for steps that have since run change nothing.
+	for _, msg := range history {
+		if err := o.Handle(context.Background(), msg); err != nil {
+			t.Fatalf("error handling stale message: %v", err)
+		}
+	}
+
+	exp := map[string]int{"order/do": 1, "payment/do": 1, "reservation/do": 1, "shipment/do": 1}
+	if act := db.effects("o1"); !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected effects %v, got %v", exp, act)
+	}
+	if act := db.status("o1"); act != StatusFinished {
+		t.Errorf("expected saga to be finished, got %s", act)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	ts1 := changefeed.Timestamp{WallTime: 1}
+	ts2 := changefeed.Timestamp{WallTime: 2}
+
+	cases := []struct {
+		name   string
+		claims []message
+		exp    []error
+	}{
+		{
+			name:   "redelivered message",
+			claims: []message{{key: "o1", updated: ts1}, {key: "o1", updated: ts1}},
+			exp:    []error{nil, errDuplicate},
+		},
+		{
+			name:   "later message for the same step",
+			claims: []message{{key: "o1", updated: ts1}, {key: "o1", updated: ts2}},
+			exp:    []error{nil, nil},
+		},
+		{
+			name:   "same message for another saga",
+			claims: []message{{key: "o1", updated: ts1}, {key: "o2", updated: ts1}},
+			exp:    []error{nil, nil},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newFakeDB()
+			o := newTestOrchestrator(db, "")
+			a := action{step: "payment", kind: actionDo}
+
+			for i, m := range c.claims {
+				tx, _ := db.BeginTx(context.Background(), pgx.TxOptions{})
+				err := o.claim(context.Background(), tx, m, a)
+				if !errors.Is(err, c.exp[i]) {
+					t.Errorf("claim %d: expected %v, got %v", i+1, c.exp[i], err)
+				}
+				if err := tx.Commit(context.Background()); err != nil {
+					t.Fatalf("error committing claim: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAttemptRechecksState(t *testing.T) {
+	db := newFakeDB()
+	o := newTestOrchestrator(db, "")
+	db.seed("o1", o)
+
+	// Two messages published before the step ran both schedule it, and
+	// have different timestamps, so only the saga's state stops the second
+	// running it again.
+	a := action{step: "order", kind: actionDo}
+	first := message{key: "o1", status: StatusInProgress, updated: changefeed.Timestamp{WallTime: 100}}
+	second := message{key: "o1", status: StatusInProgress, updated: changefeed.Timestamp{WallTime: 101}}
+
+	if _, err := o.attempt(context.Background(), first, a, testOrder{OrderID: "o1"}); err != nil {
+		t.Fatalf("error running step: %v", err)
+	}
+	if _, err := o.attempt(context.Background(), second, a, testOrder{OrderID: "o1"}); !errors.Is(err, errDuplicate) {
+		t.Fatalf("expected %v, got %v", errDuplicate, err)
+	}
+
+	exp := map[string]int{"order/do": 1}
+	if act := db.effects("o1"); !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected effects %v, got %v", exp, act)
+	}
+}
+
+func TestHandleNeedsUpdatedTimestamp(t *testing.T) {
+	db := newFakeDB()
+	o := newTestOrchestrator(db, "")
+	db.seed("o1", o)
+
+	err := o.Handle(context.Background(), []byte(`{"order_id": "o1", "status": "in_progress"}`))
+	if !errors.Is(err, errNoUpdated) {
+		t.Fatalf("expected %v, got %v", errNoUpdated, err)
+	}
+	if act := db.effects("o1"); len(act) != 0 {
+		t.Errorf("expected no effects, got %v", act)
+	}
+}
+
+func TestRunDeadLettersUnhandledMessages(t *testing.T) {
+	db := newFakeDB()
+	o := newTestOrchestrator(db, "")
+	db.seed("o1", o)
+
+	source := &sliceSource{messages: [][]byte{
+		// Missing the updated timestamp.
+		[]byte(`{"order_id": "o1", "status": "in_progress"}`),
+		// Names no saga.
+		[]byte(`{"status": "in_progress"}`),
+		// For a saga that doesn't exist, so Handle fails every attempt.
+		[]byte(`{"order_id": "o2", "status": "in_progress", "__crdb__": {"updated": "1.0000000000"}}`),
+	}}
+	if err := o.Run(context.Background(), source); !errors.Is(err, changefeed.ErrClosed) {
+		t.Fatalf("unexpected error running saga: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, key := range []string{"o1", "o2"} {
+		if _, ok := db.data.dead[key]; !ok {
+			t.Errorf("expected saga %s to be dead-lettered", key)
+		}
+		if db.data.events[key] == 0 {
+			t.Errorf("expected saga %s to have a history entry for its dead letter", key)
+		}
+	}
+	if len(db.data.dead) != 2 {
+		t.Errorf("expected 2 dead letters, got %v", db.data.dead)
+	}
+}
+
+// newTestOrchestrator returns a diamond-shaped saga: order, then payment
+// and reservation in parallel, then shipment, which aborts if abort names
+// it. Each step records its effect in the same transaction.
+func newTestOrchestrator(db *fakeDB, abort string) *Orchestrator[testOrder] {
+	o := New[testOrder](nil, WithLogger(nil), WithRetries(3, 0, 0))
+	o.db = db
+
+	effect := func(step string, kind actionKind) StepFunc[testOrder] {
+		return func(ctx context.Context, tx pgx.Tx, data testOrder) error {
+			if step == abort && kind == actionDo {
+				return Abort(fmt.Errorf("%s unavailable", step))
+			}
+			_, err := tx.Exec(ctx, "EFFECT", data.OrderID, step+"/"+string(kind))
+			return err
+		}
+	}
+
+	for _, s := range []struct {
+		name string
+		opts []StepOption
+	}{
+		{name: "order"},
+		{name: "payment", opts: []StepOption{DependsOn("order")}},
+		{name: "reservation", opts: []StepOption{DependsOn("order")}},
+		{name: "shipment", opts: []StepOption{DependsOn("payment", "reservation")}},
+	} {
+		o.AddStep(s.name, effect(s.name, actionDo), effect(s.name, actionCompensate), s.opts...)
+	}
+
+	return o
+}
+
+// replaySource publishes a message each time the saga row changes, as a
+// changefeed would, delivering each one several times. Once the saga is
+// done, it redelivers every message it published, then closes.
+type replaySource struct {
+	db         *fakeDB
+	key        string
+	deliveries int
+
+	pending [][]byte
+	history [][]byte
+	last    changefeed.Timestamp
+	replays bool
+	handled int
+}
+
+func (s *replaySource) Fetch(ctx context.Context) (changefeed.Message, error) {
+	if len(s.pending) == 0 {
+		if ts := s.db.updated(s.key); ts != s.last && !s.replays {
+			s.last = ts
+			msg := s.db.message(s.key)
+			s.history = append(s.history, msg)
+			for i := 0; i < s.deliveries; i++ {
+				s.pending = append(s.pending, msg)
+			}
+		} else if !s.replays {
+			s.replays = true
+			for _, msg := range s.history {
+				for i := 0; i < s.deliveries; i++ {
+					s.pending = append(s.pending, msg)
+				}
+			}
+		}
+	}
+
+	if len(s.pending) == 0 {
+		return changefeed.Message{}, changefeed.ErrClosed
+	}
+
+	msg := s.pending[0]
+	s.pending = s.pending[1:]
+	s.handled++
+
+	return changefeed.Message{Value: msg}, nil
+}
+
+func (s *replaySource) Close() error {
+	return nil
+}
+
+// sliceSource delivers each of its messages once, then closes.
+type sliceSource struct {
+	messages [][]byte
+	next     int
+}
+
+func (s *sliceSource) Fetch(ctx context.Context) (changefeed.Message, error) {
+	if s.next == len(s.messages) {
+		return changefeed.Message{}, changefeed.ErrClosed
+	}
+
+	msg := s.messages[s.next]
+	s.next++
+
+	return changefeed.Message{Value: msg}, nil
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+// fakeDB is an in-memory stand-in for the tables an Orchestrator uses.
+// A transaction holds a lock from Begin until it commits or rolls back,
+// making transactions serializable, and its writes only take effect if it
+// commits. Statements are recognised by their prefix.
+type fakeDB struct {
+	lock sync.Mutex // held by the open transaction
+	mu   sync.Mutex // guards data and clock
+	data tables
+	wall int64
+}
+
+type tables struct {
+	sagas     map[string]Status
+	updated   map[string]changefeed.Timestamp
+	steps     map[string]map[string]StepStatus
+	events    map[string]int
+	processed map[string]bool
+	effects   map[string]map[string]int
+	dead      map[string]string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{data: tables{
+		sagas:     map[string]Status{},
+		updated:   map[string]changefeed.Timestamp{},
+		steps:     map[string]map[string]StepStatus{},
+		events:    map[string]int{},
+		processed: map[string]bool{},
+		effects:   map[string]map[string]int{},
+		dead:      map[string]string{},
+	}}
+}
+
+func (t tables) clone() tables {
+	c := tables{
+		sagas:     copyMap(t.sagas),
+		updated:   copyMap(t.updated),
+		steps:     map[string]map[string]StepStatus{},
+		events:    copyMap(t.events),
+		processed: copyMap(t.processed),
+		effects:   map[string]map[string]int{},
+		dead:      copyMap(t.dead),
+	}
+	for k, v := range t.steps {
+		c.steps[k] = copyMap(v)
+	}
+	for k, v := range t.effects {
+		c.effects[k] = copyMap(v)
+	}
+
+	return c
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// seed creates a saga, as the app does when an order is placed.
+func (db *fakeDB) seed(key string, o *Orchestrator[testOrder]) {
+	tx, _ := db.BeginTx(context.Background(), pgx.TxOptions{})
+	tx.(*fakeTx).data.sagas[key] = StatusInProgress
+	tx.(*fakeTx).touched[key] = true
+	if err := o.Started(context.Background(), tx, key); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// message returns the changefeed message for the saga row as committed.
+func (db *fakeDB) message(key string) []byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, _ := json.Marshal(map[string]any{
+		"order_id": key,
+		"status":   db.data.sagas[key],
+		"__crdb__": map[string]any{"updated": db.data.updated[key]},
+	})
+
+	return b
+}
+
+func (db *fakeDB) status(key string) Status {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.data.sagas[key]
+}
+
+func (db *fakeDB) updated(key string) changefeed.Timestamp {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.data.updated[key]
+}
+
+func (db *fakeDB) effects(key string) map[string]int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return copyMap(db.data.effects[key])
+}
+
+func (db *fakeDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	return db.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (db *fakeDB) BeginTx(context.Context, pgx.TxOptions) (pgx.Tx, error) {
+	db.lock.Lock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return &fakeTx{db: db, data: db.data.clone(), touched: map[string]bool{}}, nil
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows, err := query(db.data, sql, args)
+	return &fakeRows{rows: rows}, err
+}
+
+func (db *fakeDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	rows, err := db.Query(ctx, sql, args...)
+	return fakeRow{rows: rows.(*fakeRows), err: err}
+}
+
+type fakeTx struct {
+	pgx.Tx
+	db      *fakeDB
+	data    tables
+	touched map[string]bool
+	done    bool
+}
+
+func (tx *fakeTx) Commit(context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	defer tx.db.lock.Unlock()
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	// Rewriting a saga row gives it a new MVCC timestamp, and so a new
+	// changefeed message.
+	for key := range tx.touched {
+		tx.db.wall++
+		tx.data.updated[key] = changefeed.Timestamp{WallTime: tx.db.wall}
+	}
+	tx.db.data = tx.data
+
+	return nil
+}
+
+func (tx *fakeTx) Rollback(context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	tx.db.lock.Unlock()
+
+	return nil
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	n, err := exec(tx.data, tx.touched, sql, args)
+	return pgconn.NewCommandTag(fmt.Sprintf("OK %d", n)), err
+}
+
+func (tx *fakeTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := query(tx.data, sql, args)
+	return &fakeRows{rows: rows}, err
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	rows, err := query(tx.data, sql, args)
+	return fakeRow{rows: &fakeRows{rows: rows}, err: err}
+}
+
+func exec(t tables, touched map[string]bool, sql string, args []any) (int, error) {
+	str := func(i int) string { return fmt.Sprint(args[i]) }
+
+	switch {
+	case strings.Contains(sql, "SAVEPOINT"):
+		return 0, nil
+
+	case strings.HasPrefix(sql, `INSERT INTO "saga_processed_messages"`):
+		if t.processed[str(0)] {
+			return 0, nil
+		}
+		t.processed[str(0)] = true
+		return 1, nil
+
+	case strings.HasPrefix(sql, `INSERT INTO "saga_steps"`), strings.HasPrefix(sql, `UPSERT INTO "saga_steps"`):
+		if t.steps[str(0)] == nil {
+			t.steps[str(0)] = map[string]StepStatus{}
+		}
+		t.steps[str(0)][str(1)] = StepStatus(str(2))
+		return 1, nil
+
+	case strings.HasPrefix(sql, `UPDATE "sagas" SET step = $1, status = $2`):
+		if _, ok := t.sagas[str(2)]; !ok {
+			return 0, nil
+		}
+		t.sagas[str(2)] = Status(str(1))
+		touched[str(2)] = true
+		return 1, nil
+
+	case strings.HasPrefix(sql, `INSERT INTO "saga_events"`):
+		t.events[str(0)]++
+		return 1, nil
+
+	case strings.HasPrefix(sql, `UPSERT INTO "saga_dead_letters"`):
+		t.dead[str(0)] = str(1)
+		return 1, nil
+
+	case sql == "EFFECT":
+		if t.effects[str(0)] == nil {
+			t.effects[str(0)] = map[string]int{}
+		}
+		t.effects[str(0)][str(1)]++
+		return 1, nil
+	}
+
+	return 0, fmt.Errorf("fakeDB: unsupported statement %q", sql)
+}
+
+func query(t tables, sql string, args []any) ([][]any, error) {
+	key := fmt.Sprint(args[0])
+
+	switch {
+	case strings.HasPrefix(sql, `SELECT status::STRING FROM "sagas"`):
+		status, ok := t.sagas[key]
+		if !ok {
+			return nil, nil
+		}
+		return [][]any{{status}}, nil
+
+	case strings.HasPrefix(sql, `SELECT step, status FROM "saga_steps"`):
+		var rows [][]any
+		for step, status := range t.steps[key] {
+			rows = append(rows, []any{step, status})
+		}
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("fakeDB: unsupported query %q", sql)
+}
+
+type fakeRows struct {
+	pgx.Rows
+	rows [][]any
+	cur  []any
+}
+
+func (r *fakeRows) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	r.cur, r.rows = r.rows[0], r.rows[1:]
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	for i, d := range dest {
+		v := reflect.ValueOf(d).Elem()
+		v.Set(reflect.ValueOf(r.cur[i]).Convert(v.Type()))
+	}
+	return nil
+}
+
+func (r *fakeRows) Close()     {}
+func (r *fakeRows) Err() error { return nil }
+
+type fakeRow struct {
+	rows *fakeRows
+	err  error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	if !r.rows.Next() {
+		return pgx.ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
@@ -0,0 +1,263 @@
+// Package saga runs multi-step business transactions whose state lives in
+// CockroachDB and whose progress is driven by a changefeed.
+//
+// Each saga is a row holding its overall status, with a row per step in a
+// steps table. Steps form a DAG: a step runs once every step it depends on
+// is done, so independent branches run concurrently and join at any step
+// that depends on all of them. When a step finishes, the transaction that
+// ran it also rewrites the saga row, the changefeed publishes it, and the
+// Orchestrator runs whichever steps have become ready.
+package saga
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Status is the status of a saga, matching the saga_status enum.
+type Status string
+
+const (
+	StatusInProgress Status = "in_progress"
+	StatusFinished   Status = "finished"
+	StatusCancelling Status = "cancelling"
+	StatusCancelled  Status = "cancelled"
+)
+
+// StepStatus is the status of a single step of a saga.
+type StepStatus string
+
+const (
+	// StepPending steps haven't run yet.
+	StepPending StepStatus = "pending"
+	// StepDone steps have run and will need compensating if the saga is
+	// cancelled.
+	StepDone StepStatus = "done"
+	// StepFailed steps were aborted or ran out of attempts.
+	StepFailed StepStatus = "failed"
+	// StepSkipped steps were still pending when the saga was cancelled.
+	StepSkipped StepStatus = "skipped"
+	// StepCompensated steps were done and have since been undone.
+	StepCompensated StepStatus = "compensated"
+)
+
+// StepFunc performs (or undoes) a step's work using tx. Returning an error
+// rolls the transaction back and leaves the step where it was, so it's
+// retried; wrap the error with Abort to cancel the saga instead.
+type StepFunc[T any] func(ctx context.Context, tx pgx.Tx, data T) error
+
+// Step is a named unit of work and the function that undoes it. A nil
+// Compensate means there's nothing to undo.
+type Step[T any] struct {
+	Name       string
+	Do         StepFunc[T]
+	Compensate StepFunc[T]
+
+	// DependsOn names the steps that must be done before this one runs.
+	DependsOn []string
+
+	// Timeout bounds each attempt at Do or Compensate, overriding the
+	// Orchestrator's default.
+	Timeout time.Duration
+}
+
+// StepOption configures a single step.
+type StepOption func(*stepOptions)
+
+type stepOptions struct {
+	timeout   time.Duration
+	dependsOn []string
+	explicit  bool
+}
+
+// StepTimeout bounds each attempt at the step's Do or Compensate.
+func StepTimeout(d time.Duration) StepOption {
+	return func(o *stepOptions) {
+		o.timeout = d
+	}
+}
+
+// DependsOn sets the steps that must be done before this one runs,
+// replacing the default of the previously added step. With no names, the
+// step runs as soon as the saga starts.
+func DependsOn(names ...string) StepOption {
+	return func(o *stepOptions) {
+		o.dependsOn = names
+		o.explicit = true
+	}
+}
+
+// Transition describes a step changing status and the effect it had on
+// the saga. Error is set when the change was caused by a failure.
+type Transition struct {
+	Key        string
+	Step       string
+	StepStatus StepStatus
+	FromStatus Status
+	Status     Status
+	Error      string
+}
+
+// Logger receives a line for each failed attempt at a step and each
+// message that fails to process. *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures an Orchestrator.
+type Option func(*options)
+
+type options struct {
+	table           string
+	keyColumn       string
+	stepTable       string
+	deadLetterTable string
+	eventTable      string
+	processedTable  string
+	logger          Logger
+	onTransition    func(Transition)
+	partitions      int
+
+	stepTimeout    time.Duration
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// WithTable sets the table holding saga state. Defaults to "sagas".
+func WithTable(name string) Option {
+	return func(o *options) {
+		o.table = name
+	}
+}
+
+// WithKeyColumn sets the primary key column of the saga table. Defaults
+// to "order_id".
+func WithKeyColumn(name string) Option {
+	return func(o *options) {
+		o.keyColumn = name
+	}
+}
+
+// WithStepTable sets the table holding the status of each step of each
+// saga. Defaults to "saga_steps".
+func WithStepTable(name string) Option {
+	return func(o *options) {
+		o.stepTable = name
+	}
+}
+
+// WithDeadLetterTable sets the table sagas that can't be compensated are
+// recorded in. Defaults to "saga_dead_letters".
+func WithDeadLetterTable(name string) Option {
+	return func(o *options) {
+		o.deadLetterTable = name
+	}
+}
+
+// WithEventTable sets the table each saga's history of transitions is
+// recorded in. Defaults to "saga_events".
+func WithEventTable(name string) Option {
+	return func(o *options) {
+		o.eventTable = name
+	}
+}
+
+// WithProcessedTable sets the table that records which steps have been
+// run or compensated, making redelivered messages no-ops. Defaults to
+// "saga_processed_messages".
+func WithProcessedTable(name string) Option {
+	return func(o *options) {
+		o.processedTable = name
+	}
+}
+
+// WithStepTimeout sets how long each attempt at a step may take, unless
+// the step sets its own timeout. Defaults to 10s.
+func WithStepTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.stepTimeout = d
+	}
+}
+
+// WithRetries sets how many times a failing step is attempted, and the
+// delay before the first retry, which doubles up to max between subsequent
+// retries. Once the attempts are used up, a step in progress is treated
+// as aborted and a compensation is dead-lettered. Defaults to 5 attempts
+// with a backoff of 100ms up to 5s.
+func WithRetries(attempts int, initial, max time.Duration) Option {
+	return func(o *options) {
+		o.maxAttempts = attempts
+		o.initialBackoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithLogger reports failed attempts and messages to the given logger.
+// Pass nil to silence reporting.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithPartitions sets the number of partitions in the changefeed's topic,
+// so the Watermark only advances once all of them are resolved. Defaults
+// to the partitions that have been resolved so far.
+func WithPartitions(n int) Option {
+	return func(o *options) {
+		o.partitions = n
+	}
+}
+
+// OnTransition calls f after each state change has been committed.
+func OnTransition(f func(Transition)) Option {
+	return func(o *options) {
+		o.onTransition = f
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		table:           "sagas",
+		keyColumn:       "order_id",
+		stepTable:       "saga_steps",
+		deadLetterTable: "saga_dead_letters",
+		eventTable:      "saga_events",
+		processedTable:  "saga_processed_messages",
+		logger:          log.Default(),
+		stepTimeout:     time.Second * 10,
+		maxAttempts:     5,
+		initialBackoff:  time.Millisecond * 100,
+		maxBackoff:      time.Second * 5,
+	}
+}
+
+// abortError marks a step failure as permanent.
+type abortError struct {
+	err error
+}
+
+// Abort wraps err to signal that a step can't succeed and the saga should
+// be compensated rather than retried.
+func Abort(err error) error {
+	return &abortError{err: err}
+}
+
+func (e *abortError) Error() string {
+	return "saga aborted: " + e.err.Error()
+}
+
+func (e *abortError) Unwrap() error {
+	return e.err
+}
+
+// IsAbort reports whether err was created by Abort.
+func IsAbort(err error) bool {
+	var a *abortError
+	return errors.As(err, &a)
+}
@@ -0,0 +1,165 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// Error is an error response from a schema registry.
+type Error struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry error %d: %s", e.Code, e.Message)
+}
+
+// Client talks to a Confluent-compatible schema registry. Schemas never
+// change once registered, so they're cached by ID for the life of the
+// Client.
+type Client struct {
+	url  string
+	http *http.Client
+
+	mu      sync.Mutex
+	schemas map[int]*Schema
+}
+
+// NewClient returns a Client for the registry at url.
+func NewClient(url string) *Client {
+	return &Client{
+		url:     strings.TrimSuffix(url, "/"),
+		http:    http.DefaultClient,
+		schemas: map[int]*Schema{},
+	}
+}
+
+// Schema returns the schema registered under id.
+func (c *Client) Schema(ctx context.Context, id int) (*Schema, error) {
+	c.mu.Lock()
+	s, ok := c.schemas[id]
+	c.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return nil, fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+
+	s, err := NewSchema(id, resp.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.cache(s), nil
+}
+
+// Register registers a schema under subject, returning it with its ID.
+// Registering a schema that's already registered returns its existing ID.
+func (c *Client) Register(ctx context.Context, subject, schema string) (*Schema, error) {
+	req := struct {
+		Schema string `json:"schema"`
+	}{schema}
+
+	var resp struct {
+		ID int `json:"id"`
+	}
+	path := fmt.Sprintf("/subjects/%s/versions", url.PathEscape(subject))
+	if err := c.do(ctx, http.MethodPost, path, req, &resp); err != nil {
+		return nil, fmt.Errorf("registering schema for %s: %w", subject, err)
+	}
+
+	s, err := NewSchema(resp.ID, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.cache(s), nil
+}
+
+// Decode returns the native Go value of a framed message, along with the
+// schema it was written with.
+func (c *Client) Decode(ctx context.Context, b []byte) (any, *Schema, error) {
+	id, payload, err := Split(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := c.Schema(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	native, err := s.Decode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return native, s, nil
+}
+
+func (c *Client) cache(s *Schema) *Schema {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.schemas[s.ID]; ok {
+		return existing
+	}
+	c.schemas[s.ID] = s
+
+	return s
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshalling request: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, r)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e := &Error{Code: resp.StatusCode}
+		if err = json.NewDecoder(resp.Body).Decode(e); err != nil || e.Message == "" {
+			e.Message = resp.Status
+		}
+		return e
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package schemaregistry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const orderSchema = `{"type": "record", "name": "order", "fields": [{"name": "id", "type": "string"}]}`
+
+// newTestServer serves a Server, counting the schema lookups made.
+func newTestServer(t *testing.T, opts ...ServerOption) (*httptest.Server, *Server, *atomic.Int32) {
+	registry := NewServer(opts...)
+
+	var lookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			lookups.Add(1)
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, registry, &lookups
+}
+
+func TestClientSchemaIsCached(t *testing.T) {
+	server, registry, lookups := newTestServer(t)
+
+	id, err := registry.Register("orders-value", orderSchema)
+	if err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+
+	c := NewClient(server.URL + "/")
+	for i := 0; i < 3; i++ {
+		s, err := c.Schema(context.Background(), id)
+		if err != nil {
+			t.Fatalf("fetching schema: %v", err)
+		}
+		if s.ID != id {
+			t.Errorf("expected schema %d, got %d", id, s.ID)
+		}
+	}
+
+	if act := lookups.Load(); act != 1 {
+		t.Errorf("expected 1 lookup, got %d", act)
+	}
+}
+
+func TestClientRegister(t *testing.T) {
+	server, _, lookups := newTestServer(t)
+	c := NewClient(server.URL)
+
+	s, err := c.Register(context.Background(), "orders-value", orderSchema)
+	if err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+
+	again, err := c.Register(context.Background(), "orders-value", orderSchema)
+	if err != nil {
+		t.Fatalf("registering schema again: %v", err)
+	}
+	if again.ID != s.ID {
+		t.Errorf("expected re-registering to return schema %d, got %d", s.ID, again.ID)
+	}
+
+	// Registered schemas are cached too.
+	if _, err = c.Schema(context.Background(), s.ID); err != nil {
+		t.Fatalf("fetching schema: %v", err)
+	}
+	if act := lookups.Load(); act != 0 {
+		t.Errorf("expected no lookups, got %d", act)
+	}
+}
+
+func TestClientDecode(t *testing.T) {
+	server, registry, _ := newTestServer(t)
+
+	id, err := registry.Register("orders-value", orderSchema)
+	if err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+	s, err := NewSchema(id, orderSchema)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	b, err := s.Encode(map[string]any{"id": "a"})
+	if err != nil {
+		t.Fatalf("encoding datum: %v", err)
+	}
+
+	native, decodedWith, err := NewClient(server.URL).Decode(context.Background(), b)
+	if err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+	if decodedWith.ID != id {
+		t.Errorf("expected message to be decoded with schema %d, got %d", id, decodedWith.ID)
+	}
+	if act := native.(map[string]any)["id"]; act != "a" {
+		t.Errorf("expected id a, got %v", act)
+	}
+}
+
+func TestClientSchemaNotFound(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	_, err := NewClient(server.URL).Schema(context.Background(), 42)
+
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a registry error, got %v", err)
+	}
+	if e.Code != 40403 {
+		t.Errorf("expected error code 40403, got %d", e.Code)
+	}
+}
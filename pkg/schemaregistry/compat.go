@@ -0,0 +1,161 @@
+package schemaregistry
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// checkBackward reports why data written with the writer schema can't be
+// read with the reader schema, following Avro's schema resolution rules.
+func checkBackward(reader, writer string) error {
+	r, err := NewSchema(0, reader)
+	if err != nil {
+		return err
+	}
+	w, err := NewSchema(0, writer)
+	if err != nil {
+		return err
+	}
+
+	return canRead(r, r.parsed, w, w.parsed, "")
+}
+
+// promotions lists the types each writer type can be read as, besides
+// itself.
+var promotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+func canRead(r *Schema, reader any, w *Schema, writer any, path string) error {
+	reader, writer = r.resolve(reader), w.resolve(writer)
+
+	if branches, ok := writer.([]any); ok {
+		for _, b := range branches {
+			if err := canRead(r, reader, w, b, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if branches, ok := reader.([]any); ok {
+		for _, b := range branches {
+			if canRead(r, b, w, writer, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: no branch of the union can read %s", where(path), typeOf(writer))
+	}
+
+	rt, wt := typeOf(reader), typeOf(writer)
+	if rt != wt {
+		if slices.Contains(promotions[wt], rt) {
+			return nil
+		}
+		return fmt.Errorf("%s: %s can't be read as %s", where(path), wt, rt)
+	}
+
+	rm, _ := reader.(map[string]any)
+	wm, _ := writer.(map[string]any)
+
+	switch rt {
+	case "record", "error":
+		writerFields := map[string]map[string]any{}
+		for _, f := range asSlice(wm["fields"]) {
+			if m, ok := f.(map[string]any); ok {
+				name, _ := m["name"].(string)
+				writerFields[name] = m
+			}
+		}
+
+		for _, f := range asSlice(rm["fields"]) {
+			field, _ := f.(map[string]any)
+			name, _ := field["name"].(string)
+
+			wf, ok := writerFields[name]
+			if !ok {
+				if _, hasDefault := field["default"]; !hasDefault {
+					return fmt.Errorf("%s: new field has no default", where(path+"."+name))
+				}
+				continue
+			}
+
+			if err := canRead(r, field["type"], w, wf["type"], path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case "enum":
+		if _, hasDefault := rm["default"]; hasDefault {
+			return nil
+		}
+		symbols := asSlice(rm["symbols"])
+		for _, s := range asSlice(wm["symbols"]) {
+			if !slices.Contains(symbols, s) {
+				return fmt.Errorf("%s: symbol %v was removed", where(path), s)
+			}
+		}
+
+	case "array":
+		return canRead(r, rm["items"], w, wm["items"], path+"[]")
+
+	case "map":
+		return canRead(r, rm["values"], w, wm["values"], path+"{}")
+
+	case "fixed":
+		if rm["size"] != wm["size"] {
+			return fmt.Errorf("%s: fixed size changed", where(path))
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the definition of a named type, or schema itself if it
+// isn't a reference.
+func (s *Schema) resolve(schema any) any {
+	if name, ok := schema.(string); ok {
+		if def, ok := s.names[name]; ok {
+			return def
+		}
+	}
+
+	if m, ok := schema.(map[string]any); ok {
+		// {"type": "string"} and {"type": {...}} wrap another schema.
+		switch t := m["type"].(type) {
+		case map[string]any, []any:
+			return s.resolve(t)
+		case string:
+			if def, ok := s.names[t]; ok && m["name"] == nil {
+				return def
+			}
+		}
+	}
+
+	return schema
+}
+
+func typeOf(schema any) string {
+	switch t := schema.(type) {
+	case string:
+		return t
+	case map[string]any:
+		typ, _ := t["type"].(string)
+		return typ
+	}
+
+	return ""
+}
+
+func where(path string) string {
+	if path == "" {
+		return "schema"
+	}
+
+	return strings.TrimPrefix(path, ".")
+}
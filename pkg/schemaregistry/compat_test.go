@@ -0,0 +1,131 @@
+package schemaregistry
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckBackward(t *testing.T) {
+	const v1 = `{"type": "record", "name": "order", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "quantity", "type": "int"}
+	]}`
+
+	cases := []struct {
+		name   string
+		reader string
+		ok     bool
+	}{
+		{
+			name: "new nullable column with default",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"},
+				{"name": "quantity", "type": "int"},
+				{"name": "note", "type": ["null", "string"], "default": null}
+			]}`,
+			ok: true,
+		},
+		{
+			name: "dropped column",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"}
+			]}`,
+			ok: true,
+		},
+		{
+			name: "promoted type",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"},
+				{"name": "quantity", "type": "long"}
+			]}`,
+			ok: true,
+		},
+		{
+			name: "widened to a union",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"},
+				{"name": "quantity", "type": ["null", "int"]}
+			]}`,
+			ok: true,
+		},
+		{
+			name: "new column without default",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"},
+				{"name": "quantity", "type": "int"},
+				{"name": "note", "type": "string"}
+			]}`,
+		},
+		{
+			name: "narrowed type",
+			reader: `{"type": "record", "name": "order", "fields": [
+				{"name": "id", "type": "string"},
+				{"name": "quantity", "type": "string"}
+			]}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkBackward(c.reader, v1)
+			if c.ok && err != nil {
+				t.Errorf("expected schema to be compatible, got %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("expected schema to be incompatible")
+			}
+		})
+	}
+}
+
+func TestCheckBackwardEnum(t *testing.T) {
+	const writer = `{"type": "enum", "name": "status", "symbols": ["paid", "shipped"]}`
+
+	if err := checkBackward(`{"type": "enum", "name": "status", "symbols": ["paid", "shipped", "returned"]}`, writer); err != nil {
+		t.Errorf("expected added symbol to be compatible, got %v", err)
+	}
+	if err := checkBackward(`{"type": "enum", "name": "status", "symbols": ["paid"]}`, writer); err == nil {
+		t.Error("expected removed symbol to be incompatible")
+	}
+	if err := checkBackward(`{"type": "enum", "name": "status", "symbols": ["paid"], "default": "paid"}`, writer); err != nil {
+		t.Errorf("expected removed symbol with a default to be compatible, got %v", err)
+	}
+}
+
+func TestRegisterRejectsIncompatible(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	c := NewClient(server.URL)
+
+	if _, err := c.Register(context.Background(), "orders-value", orderSchema); err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+
+	incompatible := `{"type": "record", "name": "order", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "total", "type": "double"}
+	]}`
+	_, err := c.Register(context.Background(), "orders-value", incompatible)
+
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a registry error, got %v", err)
+	}
+	if e.Code != 409 {
+		t.Errorf("expected error code 409, got %d", e.Code)
+	}
+
+	// Without the check, or under another subject, it's accepted.
+	if _, err = c.Register(context.Background(), "other-value", incompatible); err != nil {
+		t.Errorf("expected schema to be registered under a new subject, got %v", err)
+	}
+
+	server, _, _ = newTestServer(t, WithCompatibility(CompatibilityNone))
+	c = NewClient(server.URL)
+	if _, err = c.Register(context.Background(), "orders-value", orderSchema); err != nil {
+		t.Fatalf("registering schema: %v", err)
+	}
+	if _, err = c.Register(context.Background(), "orders-value", incompatible); err != nil {
+		t.Errorf("expected schema to be registered without a compatibility check, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JSON returns a native Go value decoded with the schema as the JSON a
+// changefeed would have published with format = json: unions are
+// unwrapped, decimals are exact numbers and timestamps are RFC 3339
+// strings.
+func (s *Schema) JSON(native any) ([]byte, error) {
+	v, err := s.toJSON(s.parsed, native)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling datum: %w", err)
+	}
+
+	return b, nil
+}
+
+func (s *Schema) toJSON(schema any, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch t := schema.(type) {
+	case string:
+		if def, ok := s.names[t]; ok {
+			return s.toJSON(def, v)
+		}
+		return v, nil
+
+	case []any:
+		return s.unionToJSON(t, v)
+
+	case map[string]any:
+		if logical, ok := t["logicalType"].(string); ok {
+			if out, ok := logicalToJSON(logical, t, v); ok {
+				return out, nil
+			}
+		}
+
+		switch t["type"] {
+		case "record", "error":
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("expected record, got %T", v)
+			}
+
+			out := map[string]any{}
+			for _, f := range asSlice(t["fields"]) {
+				field, _ := f.(map[string]any)
+				name, _ := field["name"].(string)
+
+				fv, err := s.toJSON(field["type"], m[name])
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", name, err)
+				}
+				out[name] = fv
+			}
+			return out, nil
+
+		case "array":
+			items, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("expected array, got %T", v)
+			}
+
+			out := make([]any, len(items))
+			for i, item := range items {
+				iv, err := s.toJSON(t["items"], item)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = iv
+			}
+			return out, nil
+
+		case "map":
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("expected map, got %T", v)
+			}
+
+			out := map[string]any{}
+			for k, mv := range m {
+				cv, err := s.toJSON(t["values"], mv)
+				if err != nil {
+					return nil, err
+				}
+				out[k] = cv
+			}
+			return out, nil
+
+		case "enum", "fixed":
+			return v, nil
+
+		default:
+			return s.toJSON(t["type"], v)
+		}
+	}
+
+	return v, nil
+}
+
+// unionToJSON unwraps a union's value, which goavro holds as a map from
+// the branch's type name to the value.
+func (s *Schema) unionToJSON(branches []any, v any) (any, error) {
+	wrapped, ok := v.(map[string]any)
+	if !ok || len(wrapped) != 1 {
+		return nil, fmt.Errorf("expected union, got %T", v)
+	}
+
+	for name, inner := range wrapped {
+		for _, b := range branches {
+			if branchMatches(b, name) {
+				return s.toJSON(b, inner)
+			}
+		}
+		return nil, fmt.Errorf("union has no branch %q", name)
+	}
+
+	return nil, nil
+}
+
+// branchMatches reports whether name is the name goavro gives a union
+// branch: its full name for named types, and its type (with the logical
+// type, if goavro supports it) otherwise.
+func branchMatches(schema any, name string) bool {
+	switch t := schema.(type) {
+	case string:
+		return t == name || strings.HasSuffix(name, "."+t)
+	case map[string]any:
+		if n, ok := t["name"].(string); ok {
+			return n == name || strings.HasSuffix(name, "."+n)
+		}
+		typ, _ := t["type"].(string)
+		logical, _ := t["logicalType"].(string)
+		return typ == name || typ+"."+logical == name
+	}
+
+	return false
+}
+
+// logicalToJSON converts the values goavro produces for logical types,
+// reporting false for logical types it leaves alone.
+func logicalToJSON(logical string, schema map[string]any, v any) (any, bool) {
+	switch t := v.(type) {
+	case *big.Rat:
+		scale, _ := schema["scale"].(float64)
+		return json.Number(t.FloatString(int(scale))), true
+
+	case time.Time:
+		if logical == "date" {
+			return t.UTC().Format(time.DateOnly), true
+		}
+		return t.UTC().Format(time.RFC3339Nano), true
+
+	case time.Duration:
+		return time.Time{}.Add(t).Format("15:04:05.999999"), true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,121 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+func TestFrame(t *testing.T) {
+	payload := []byte{1, 2, 3}
+	b := Frame(258, payload)
+
+	if exp := []byte{0, 0, 0, 1, 2, 1, 2, 3}; !bytes.Equal(b, exp) {
+		t.Fatalf("expected %v, got %v", exp, b)
+	}
+
+	id, act, err := Split(b)
+	if err != nil {
+		t.Fatalf("splitting message: %v", err)
+	}
+	if id != 258 {
+		t.Errorf("expected schema 258, got %d", id)
+	}
+	if !bytes.Equal(act, payload) {
+		t.Errorf("expected payload %v, got %v", payload, act)
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "empty", b: nil},
+		{name: "too short", b: []byte{0, 0, 0, 1}},
+		{name: "wrong magic byte", b: []byte{1, 0, 0, 0, 1, 2}},
+		{name: "json", b: []byte(`{"id": 1}`)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, err := Split(c.b); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestSchemaJSON(t *testing.T) {
+	s, err := NewSchema(1, `{
+		"type": "record",
+		"name": "order_line_item",
+		"namespace": "changefeed",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "price", "type": ["null", {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}]},
+			{"name": "quantity", "type": ["null", "long"]},
+			{"name": "ts", "type": ["null", {"type": "long", "logicalType": "timestamp-micros"}]},
+			{"name": "day", "type": {"type": "int", "logicalType": "date"}},
+			{"name": "status", "type": ["null", {"type": "enum", "name": "status", "symbols": ["paid", "shipped"]}]},
+			{"name": "note", "type": ["null", "string"], "default": null}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	b, err := s.Encode(map[string]any{
+		"id":       "a",
+		"price":    goavro.Union("bytes.decimal", big.NewRat(1999, 100)),
+		"quantity": goavro.Union("long", int64(2)),
+		"ts":       goavro.Union("long.timestamp-micros", ts),
+		"day":      time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		"status":   goavro.Union("changefeed.status", "paid"),
+		"note":     nil,
+	})
+	if err != nil {
+		t.Fatalf("encoding datum: %v", err)
+	}
+
+	_, payload, err := Split(b)
+	if err != nil {
+		t.Fatalf("splitting message: %v", err)
+	}
+	native, err := s.Decode(payload)
+	if err != nil {
+		t.Fatalf("decoding datum: %v", err)
+	}
+
+	act, err := s.JSON(native)
+	if err != nil {
+		t.Fatalf("converting to json: %v", err)
+	}
+
+	exp := `{"day":"2024-01-02","id":"a","note":null,"price":19.99,"quantity":2,"status":"paid","ts":"2024-01-02T03:04:05.678Z"}`
+	if string(act) != exp {
+		t.Errorf("expected %s, got %s", exp, act)
+	}
+}
+
+func TestSchemaFields(t *testing.T) {
+	s, err := NewSchema(1, `{"type": "record", "name": "k", "fields": [{"name": "a", "type": "string"}, {"name": "b", "type": "long"}]}`)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	if act := s.Fields(); len(act) != 2 || act[0] != "a" || act[1] != "b" {
+		t.Errorf("expected fields [a b], got %v", act)
+	}
+
+	s, err = NewSchema(2, `"string"`)
+	if err != nil {
+		t.Fatalf("parsing schema: %v", err)
+	}
+	if act := s.Fields(); act != nil {
+		t.Errorf("expected no fields for a primitive schema, got %v", act)
+	}
+}
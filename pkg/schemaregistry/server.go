@@ -0,0 +1,219 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Compatibility is the check a Server makes before registering a new
+// version of a subject's schema.
+type Compatibility string
+
+const (
+	// CompatibilityNone registers any schema.
+	CompatibilityNone Compatibility = "NONE"
+	// CompatibilityBackward only registers schemas that can read data
+	// written with the subject's latest schema, so consumers can be
+	// upgraded before producers. It's the default, as it is for
+	// Confluent's registry.
+	CompatibilityBackward Compatibility = "BACKWARD"
+)
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithCompatibility sets the compatibility check made on registration.
+func WithCompatibility(c Compatibility) ServerOption {
+	return func(s *Server) {
+		s.compatibility = c
+	}
+}
+
+// Server is an in-memory schema registry implementing the parts of
+// Confluent's API that changefeeds and Client use. It stands in for a real
+// registry when running scenarios locally, and can be mounted on an
+// existing server or served with http.ListenAndServe.
+type Server struct {
+	compatibility Compatibility
+	mux           *http.ServeMux
+
+	mu       sync.Mutex
+	schemas  []string         // Indexed by ID - 1.
+	ids      map[string]int   // Schema text to ID.
+	subjects map[string][]int // Subject to the IDs of its versions.
+}
+
+// NewServer returns an empty Server.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		compatibility: CompatibilityBackward,
+		mux:           http.NewServeMux(),
+		ids:           map[string]int{},
+		subjects:      map[string][]int{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("GET /schemas/ids/{id}", s.handleSchema)
+	s.mux.HandleFunc("GET /subjects", s.handleSubjects)
+	s.mux.HandleFunc("GET /subjects/{subject}/versions", s.handleVersions)
+	s.mux.HandleFunc("GET /subjects/{subject}/versions/{version}", s.handleVersion)
+	s.mux.HandleFunc("POST /subjects/{subject}/versions", s.handleRegister)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	s.mux.ServeHTTP(w, r)
+}
+
+// Register registers a schema under subject, returning its ID.
+func (s *Server) Register(subject, schema string) (int, error) {
+	if _, err := NewSchema(0, schema); err != nil {
+		return 0, &Error{Code: 42201, Message: err.Error()}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.subjects[subject]
+	if id, ok := s.ids[schema]; ok {
+		for _, v := range versions {
+			if v == id {
+				return id, nil
+			}
+		}
+	}
+
+	if len(versions) > 0 && s.compatibility == CompatibilityBackward {
+		latest := s.schemas[versions[len(versions)-1]-1]
+		if err := checkBackward(schema, latest); err != nil {
+			return 0, &Error{Code: 409, Message: fmt.Sprintf("schema is incompatible with the latest version of %s: %v", subject, err)}
+		}
+	}
+
+	id, ok := s.ids[schema]
+	if !ok {
+		s.schemas = append(s.schemas, schema)
+		id = len(s.schemas)
+		s.ids[schema] = id
+	}
+	s.subjects[subject] = append(versions, id)
+
+	return id, nil
+}
+
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil || id < 1 || id > len(s.schemas) {
+		writeError(w, http.StatusNotFound, &Error{Code: 40403, Message: "schema not found"})
+		return
+	}
+
+	writeJSON(w, map[string]any{"schema": s.schemas[id-1]})
+}
+
+func (s *Server) handleSubjects(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subjects := []string{}
+	for subject := range s.subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	writeJSON(w, subjects)
+}
+
+func (s *Server) handleVersions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, ok := s.subjects[r.PathValue("subject")]
+	if !ok {
+		writeError(w, http.StatusNotFound, &Error{Code: 40401, Message: "subject not found"})
+		return
+	}
+
+	versions := make([]int, len(ids))
+	for i := range ids {
+		versions[i] = i + 1
+	}
+
+	writeJSON(w, versions)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subject := r.PathValue("subject")
+	ids, ok := s.subjects[subject]
+	if !ok {
+		writeError(w, http.StatusNotFound, &Error{Code: 40401, Message: "subject not found"})
+		return
+	}
+
+	version := len(ids)
+	if v := r.PathValue("version"); v != "latest" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 || version > len(ids) {
+			writeError(w, http.StatusNotFound, &Error{Code: 40402, Message: "version not found"})
+			return
+		}
+	}
+
+	id := ids[version-1]
+	writeJSON(w, map[string]any{
+		"subject": subject,
+		"version": version,
+		"id":      id,
+		"schema":  s.schemas[id-1],
+	})
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, &Error{Code: 42201, Message: fmt.Sprintf("parsing request: %v", err)})
+		return
+	}
+
+	id, err := s.Register(r.PathValue("subject"), req.Schema)
+	if err != nil {
+		e := err.(*Error)
+		status := http.StatusUnprocessableEntity
+		if e.Code == 409 {
+			status = http.StatusConflict
+		}
+		writeError(w, status, e)
+		return
+	}
+
+	writeJSON(w, map[string]any{"id": id})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, e *Error) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,41 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing count that also reports its
+// throughput. It's safe for concurrent use.
+type Counter struct {
+	n     atomic.Uint64
+	start time.Time
+}
+
+// NewCounter returns a Counter whose rate is measured from now.
+func NewCounter() *Counter {
+	return &Counter{
+		start: time.Now(),
+	}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.n.Add(1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	c.n.Add(n)
+}
+
+// Load returns the current count.
+func (c *Counter) Load() uint64 {
+	return c.n.Load()
+}
+
+// Rate returns the average number of increments per second since the
+// counter was created.
+func (c *Counter) Rate() float64 {
+	return float64(c.n.Load()) / time.Since(c.start).Seconds()
+}
@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Histogram keeps the most recent samples in a fixed-size window and
+// reports percentiles over them. It's safe for concurrent use.
+type Histogram struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	start   time.Time
+}
+
+// NewHistogram returns a Histogram that reports over the last window
+// samples recorded.
+func NewHistogram(window int) *Histogram {
+	if window <= 0 {
+		panic("stats: histogram window must be positive")
+	}
+
+	return &Histogram{
+		samples: make([]time.Duration, 0, window),
+		start:   time.Now(),
+	}
+}
+
+// Record adds a sample to the window, evicting the oldest sample once the
+// window is full.
+func (h *Histogram) Record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+
+	if len(h.samples) < cap(h.samples) {
+		h.samples = append(h.samples, d)
+		return
+	}
+
+	h.samples[h.next] = d
+	h.next = (h.next + 1) % len(h.samples)
+}
+
+// Snapshot is a point-in-time summary of a Histogram.
+type Snapshot struct {
+	// Count is the number of samples recorded since the Histogram was
+	// created; Window is the number of samples the percentiles cover.
+	Count  uint64
+	Window int
+
+	Mean time.Duration
+	P50  time.Duration
+	P95  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+
+	// Rate is the number of samples recorded per second since the
+	// Histogram was created.
+	Rate float64
+}
+
+// Snapshot summarises the samples currently in the window.
+func (h *Histogram) Snapshot() Snapshot {
+	h.mu.Lock()
+	sorted := slices.Clone(h.samples)
+	count := h.count
+	elapsed := time.Since(h.start)
+	h.mu.Unlock()
+
+	s := Snapshot{
+		Count:  count,
+		Window: len(sorted),
+		Rate:   float64(count) / elapsed.Seconds(),
+	}
+
+	if len(sorted) == 0 {
+		return s
+	}
+
+	slices.Sort(sorted)
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+
+	s.Mean = sum / time.Duration(len(sorted))
+	s.P50 = percentile(sorted, 50)
+	s.P95 = percentile(sorted, 95)
+	s.P99 = percentile(sorted, 99)
+	s.Max = sorted[len(sorted)-1]
+
+	return s
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("p50: %s, p95: %s, p99: %s, max: %s (%d samples)",
+		s.P50.Round(time.Millisecond),
+		s.P95.Round(time.Millisecond),
+		s.P99.Round(time.Millisecond),
+		s.Max.Round(time.Millisecond),
+		s.Count,
+	)
+}
+
+// percentile returns the nearest-rank percentile p of an already sorted
+// slice.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := NewHistogram(100)
+	for _, i := range rand.Perm(100) {
+		h.Record(time.Duration(i+1) * time.Millisecond)
+	}
+
+	s := h.Snapshot()
+
+	cases := []struct {
+		name string
+		got  time.Duration
+		exp  time.Duration
+	}{
+		{name: "mean", got: s.Mean, exp: 50500 * time.Microsecond},
+		{name: "p50", got: s.P50, exp: 50 * time.Millisecond},
+		{name: "p95", got: s.P95, exp: 95 * time.Millisecond},
+		{name: "p99", got: s.P99, exp: 99 * time.Millisecond},
+		{name: "max", got: s.Max, exp: 100 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.got != c.exp {
+				t.Fatalf("expected %s, got %s", c.exp, c.got)
+			}
+		})
+	}
+
+	if s.Count != 100 || s.Window != 100 {
+		t.Fatalf("expected 100 samples in a window of 100, got %d in %d", s.Count, s.Window)
+	}
+}
+
+func TestHistogramPartialWindow(t *testing.T) {
+	h := NewHistogram(100)
+	for i := 1; i <= 10; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	s := h.Snapshot()
+	if s.Count != 10 || s.Window != 10 {
+		t.Fatalf("expected 10 samples in a window of 10, got %d in %d", s.Count, s.Window)
+	}
+
+	if s.P50 != 5*time.Millisecond {
+		t.Fatalf("expected p50 of %s, got %s", 5*time.Millisecond, s.P50)
+	}
+
+	if s.P99 != 10*time.Millisecond {
+		t.Fatalf("expected p99 of %s, got %s", 10*time.Millisecond, s.P99)
+	}
+}
+
+func TestHistogramWrappedWindow(t *testing.T) {
+	h := NewHistogram(10)
+	for i := 1; i <= 25; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	// Only the last 10 samples (16..25) are still in the window.
+	s := h.Snapshot()
+	if s.Count != 25 || s.Window != 10 {
+		t.Fatalf("expected 25 samples in a window of 10, got %d in %d", s.Count, s.Window)
+	}
+
+	if s.P50 != 20*time.Millisecond {
+		t.Fatalf("expected p50 of %s, got %s", 20*time.Millisecond, s.P50)
+	}
+
+	if s.Max != 25*time.Millisecond {
+		t.Fatalf("expected max of %s, got %s", 25*time.Millisecond, s.Max)
+	}
+
+	// A sample smaller than everything in the window evicts 16.
+	h.Record(time.Millisecond)
+
+	s = h.Snapshot()
+	if s.P50 != 20*time.Millisecond {
+		t.Fatalf("expected p50 of %s, got %s", 20*time.Millisecond, s.P50)
+	}
+
+	if s.Mean != 19*time.Millisecond {
+		t.Fatalf("expected mean of %s, got %s", 19*time.Millisecond, s.Mean)
+	}
+}
+
+func TestHistogramEmpty(t *testing.T) {
+	s := NewHistogram(10).Snapshot()
+	if s.Count != 0 || s.Window != 0 || s.Max != 0 {
+		t.Fatalf("expected an empty snapshot, got %+v", s)
+	}
+}
+
+func TestHistogramRate(t *testing.T) {
+	h := NewHistogram(10)
+	h.start = time.Now().Add(-2 * time.Second)
+
+	for i := 0; i < 100; i++ {
+		h.Record(time.Millisecond)
+	}
+
+	if rate := h.Snapshot().Rate; rate < 45 || rate > 50 {
+		t.Fatalf("expected a rate of about 50/s, got %.2f", rate)
+	}
+}
+
+func TestCounterConcurrentAdds(t *testing.T) {
+	c := NewCounter()
+	c.start = time.Now().Add(-10 * time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if j%2 == 0 {
+					c.Inc()
+				} else {
+					c.Add(2)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := c.Load(); n != 15000 {
+		t.Fatalf("expected 15000, got %d", n)
+	}
+
+	if rate := c.Rate(); rate < 1400 || rate > 1500 {
+		t.Fatalf("expected a rate of about 1500/s, got %.2f", rate)
+	}
+}
@@ -0,0 +1,313 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// DecodeRow parses a JSON row, keeping numbers exact so that decimal
+// columns transform the same way they would in SQL.
+func DecodeRow(b []byte) (map[string]any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var row map[string]any
+	if err := d.Decode(&row); err != nil {
+		return nil, fmt.Errorf("parsing row: %w", err)
+	}
+
+	return row, nil
+}
+
+// Apply maps a row to an output record. ok is false if the row was
+// filtered out by the Spec's predicates.
+func (s *Spec) Apply(row map[string]any) (out map[string]any, ok bool, err error) {
+	for _, p := range s.Where {
+		match, err := p.match(row)
+		if err != nil {
+			return nil, false, fmt.Errorf("evaluating predicate on %q: %w", p.Field, err)
+		}
+		if !match {
+			return nil, false, nil
+		}
+	}
+
+	out = map[string]any{}
+	if len(s.Fields) == 0 {
+		for k, v := range row {
+			out[k] = v
+		}
+		for _, k := range s.Drop {
+			delete(out, k)
+		}
+
+		return out, true, nil
+	}
+
+	for _, f := range s.Fields {
+		v, err := f.apply(row[f.source()])
+		if err != nil {
+			return nil, false, fmt.Errorf("field %q: %w", f.Name, err)
+		}
+		out[f.Name] = v
+	}
+
+	return out, true, nil
+}
+
+// KeyOf returns the row's key column as a string, or "" if the Spec has no
+// key.
+func (s *Spec) KeyOf(row map[string]any) string {
+	if s.Key == "" || row[s.Key] == nil {
+		return ""
+	}
+
+	return fmt.Sprint(row[s.Key])
+}
+
+func (f Field) apply(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	if f.Format != "" {
+		return format(v, f.Format)
+	}
+
+	if f.Multiply != nil || f.Add != nil || f.Round != nil {
+		r, ok := toRat(v)
+		if !ok {
+			return nil, fmt.Errorf("arithmetic on non-numeric value %v", v)
+		}
+
+		if f.Multiply != nil {
+			r.Mul(r, floatRat(*f.Multiply))
+		}
+		if f.Add != nil {
+			r.Add(r, floatRat(*f.Add))
+		}
+		if f.Round != nil {
+			r = round(r, *f.Round)
+		}
+
+		v = ratNumber(r)
+	}
+
+	if f.Cast != "" {
+		return cast(v, f.Cast)
+	}
+
+	return v, nil
+}
+
+// timestampLayout is how changefeeds encode TIMESTAMP columns, which
+// have no offset and are read as UTC. TIMESTAMPTZ columns are RFC 3339.
+const timestampLayout = "2006-01-02T15:04:05.999999999"
+
+func format(v any, layout string) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("formatting non-timestamp value %v", v)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		var terr error
+		if t, terr = time.Parse(timestampLayout, s); terr != nil {
+			return nil, fmt.Errorf("parsing timestamp: %w", err)
+		}
+	}
+
+	switch layout {
+	case FormatEpoch:
+		return t.Unix(), nil
+	case FormatEpochMS:
+		return t.UnixMilli(), nil
+	case FormatRFC3339:
+		return t.UTC().Format(time.RFC3339), nil
+	default:
+		return t.UTC().Format(time.DateOnly), nil
+	}
+}
+
+func cast(v any, to string) (any, error) {
+	switch to {
+	case CastInt:
+		r, ok := toRat(v)
+		if !ok {
+			return nil, fmt.Errorf("casting %v to int", v)
+		}
+		return new(big.Int).Quo(r.Num(), r.Denom()).Int64(), nil
+
+	case CastFloat:
+		r, ok := toRat(v)
+		if !ok {
+			return nil, fmt.Errorf("casting %v to float", v)
+		}
+		f, _ := r.Float64()
+		return f, nil
+
+	case CastString:
+		return fmt.Sprint(v), nil
+
+	default:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			return strconv.ParseBool(b)
+		}
+		r, ok := toRat(v)
+		if !ok {
+			return nil, fmt.Errorf("casting %v to bool", v)
+		}
+		return r.Sign() != 0, nil
+	}
+}
+
+// toRat converts numeric values, and strings holding numbers, to exact
+// rationals.
+func toRat(v any) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case string:
+		return new(big.Rat).SetString(n)
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case int64:
+		return new(big.Rat).SetInt64(n), true
+	case float64:
+		return floatRat(n), true
+	}
+
+	return nil, false
+}
+
+// floatRat converts a float from a spec to the decimal it was written as,
+// so that 0.1 is exactly a tenth.
+func floatRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	return r
+}
+
+// round rounds r half away from zero to places decimal places.
+func round(r *big.Rat, places int) *big.Rat {
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil))
+	scaled := new(big.Rat).Mul(r, scale)
+
+	half := big.NewRat(1, 2)
+	if scaled.Sign() < 0 {
+		half.Neg(half)
+	}
+	scaled.Add(scaled, half)
+
+	whole := new(big.Int).Quo(scaled.Num(), scaled.Denom())
+	return new(big.Rat).Quo(new(big.Rat).SetInt(whole), scale)
+}
+
+// ratNumber formats r as an exact decimal number, which is always
+// possible for results of decimal arithmetic.
+func ratNumber(r *big.Rat) json.Number {
+	places := 0
+	ten := big.NewRat(10, 1)
+	for scaled := new(big.Rat).Set(r); !scaled.IsInt() && places < 30; places++ {
+		scaled.Mul(scaled, ten)
+	}
+
+	return json.Number(r.FloatString(places))
+}
+
+func (p Predicate) match(row map[string]any) (bool, error) {
+	v := row[p.Field]
+
+	switch p.Op {
+	case "is_null":
+		return v == nil, nil
+	case "not_null":
+		return v != nil, nil
+	}
+
+	// As in SQL, comparisons with NULL are never true.
+	if v == nil {
+		return false, nil
+	}
+
+	if p.Op == "in" {
+		for _, candidate := range p.Value.([]any) {
+			c, err := compare(v, candidate)
+			if err != nil {
+				return false, err
+			}
+			if c == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	c, err := compare(v, p.Value)
+	if err != nil {
+		return false, err
+	}
+
+	switch p.Op {
+	case "eq":
+		return c == 0, nil
+	case "ne":
+		return c != 0, nil
+	case "gt":
+		return c > 0, nil
+	case "gte":
+		return c >= 0, nil
+	case "lt":
+		return c < 0, nil
+	default:
+		return c <= 0, nil
+	}
+}
+
+// compare orders a row value against a spec value, numerically if both
+// are numbers.
+func compare(v, against any) (int, error) {
+	if _, isString := against.(string); !isString {
+		if b, ok := against.(bool); ok {
+			vb, ok := v.(bool)
+			if !ok {
+				return 0, fmt.Errorf("comparing %v with bool", v)
+			}
+			if vb == b {
+				return 0, nil
+			}
+			return 1, nil
+		}
+
+		vr, ok := toRat(v)
+		if !ok {
+			return 0, fmt.Errorf("comparing %v with number", v)
+		}
+		ar, ok := toRat(against)
+		if !ok {
+			return 0, fmt.Errorf("unsupported value %v", against)
+		}
+		return vr.Cmp(ar), nil
+	}
+
+	vs, ok := v.(string)
+	if !ok {
+		vs = fmt.Sprint(v)
+	}
+
+	switch s := against.(string); {
+	case vs < s:
+		return -1, nil
+	case vs > s:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
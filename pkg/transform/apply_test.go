@@ -0,0 +1,179 @@
+package transform
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	ptr := func(f float64) *float64 { return &f }
+	places := func(n int) *int { return &n }
+
+	cases := []struct {
+		name  string
+		field Field
+		row   string
+		exp   any
+	}{
+		{
+			// 19.99 * 100 is 1998.9999999999998 as a float, which the ETL
+			// service's int64 conversion truncates to 1998.
+			name:  "exact multiply then truncate",
+			field: Field{Name: "price", Multiply: ptr(100), Cast: CastInt},
+			row:   `{"price": 19.99}`,
+			exp:   int64(1999),
+		},
+		{
+			name:  "truncates towards zero",
+			field: Field{Name: "price", Multiply: ptr(100), Cast: CastInt},
+			row:   `{"price": -12.345}`,
+			exp:   int64(-1234),
+		},
+		{
+			name:  "decimal strings",
+			field: Field{Name: "price", Multiply: ptr(100), Cast: CastInt},
+			row:   `{"price": "0.29"}`,
+			exp:   int64(29),
+		},
+		{
+			name:  "round half away from zero",
+			field: Field{Name: "price", Round: places(2)},
+			row:   `{"price": 12.345}`,
+			exp:   "12.35",
+		},
+		{
+			name:  "epoch",
+			field: Field{Name: "ts", Format: FormatEpoch},
+			row:   `{"ts": "2024-01-02T03:04:05Z"}`,
+			exp:   int64(1704164645),
+		},
+		{
+			name:  "timestamp without offset as utc",
+			field: Field{Name: "ts", Format: FormatEpoch},
+			row:   `{"ts": "2024-01-02T03:04:05"}`,
+			exp:   int64(1704164645),
+		},
+		{
+			name:  "timestamp without offset with fraction",
+			field: Field{Name: "ts", Format: FormatRFC3339},
+			row:   `{"ts": "2024-01-01T00:00:00.123456"}`,
+			exp:   "2024-01-01T00:00:00Z",
+		},
+		{
+			name:  "timestamp with offset",
+			field: Field{Name: "ts", Format: FormatDate},
+			row:   `{"ts": "2024-01-01T23:00:00-02:00"}`,
+			exp:   "2024-01-02",
+		},
+		{
+			name:  "renamed",
+			field: Field{Name: "amount", From: "price"},
+			row:   `{"price": 1.5}`,
+			exp:   "1.5",
+		},
+		{
+			name:  "null",
+			field: Field{Name: "price", Multiply: ptr(100), Cast: CastInt},
+			row:   `{"price": null}`,
+			exp:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			row, err := DecodeRow([]byte(c.row))
+			if err != nil {
+				t.Fatalf("decoding row: %v", err)
+			}
+
+			s := Spec{Fields: []Field{c.field}}
+			out, ok, err := s.Apply(row)
+			if err != nil || !ok {
+				t.Fatalf("expected row to be transformed, got ok=%v err=%v", ok, err)
+			}
+
+			act := out[c.field.Name]
+			if n, isNumber := act.(interface{ String() string }); isNumber {
+				act = n.String()
+			}
+			if !reflect.DeepEqual(act, c.exp) {
+				t.Errorf("expected %v (%T), got %v (%T)", c.exp, c.exp, act, act)
+			}
+		})
+	}
+}
+
+func TestApplyWhere(t *testing.T) {
+	s := Spec{
+		Where: []Predicate{
+			{Field: "quantity", Op: "gte", Value: 2},
+			{Field: "status", Op: "in", Value: []any{"paid", "shipped"}},
+		},
+		Drop: []string{"status"},
+	}
+
+	cases := []struct {
+		row string
+		exp bool
+	}{
+		{row: `{"quantity": 2, "status": "paid"}`, exp: true},
+		{row: `{"quantity": 1, "status": "paid"}`, exp: false},
+		{row: `{"quantity": 3, "status": "cancelled"}`, exp: false},
+		{row: `{"quantity": null, "status": "paid"}`, exp: false},
+	}
+
+	for _, c := range cases {
+		row, err := DecodeRow([]byte(c.row))
+		if err != nil {
+			t.Fatalf("decoding row: %v", err)
+		}
+
+		out, ok, err := s.Apply(row)
+		if err != nil {
+			t.Fatalf("applying spec to %s: %v", c.row, err)
+		}
+		if ok != c.exp {
+			t.Errorf("expected %s to match %v, got %v", c.row, c.exp, ok)
+		}
+		if ok {
+			if _, found := out["status"]; found {
+				t.Errorf("expected status to be dropped, got %v", out)
+			}
+		}
+	}
+}
+
+// The ETL scenario's spec is exact where the service's float arithmetic
+// isn't, which its comment calls out.
+func TestETLSpec(t *testing.T) {
+	b, err := os.ReadFile("../../001_fragile_data_integrations/etl/transform.yaml")
+	if err != nil {
+		t.Fatalf("reading spec: %v", err)
+	}
+
+	s, err := Parse(b)
+	if err != nil {
+		t.Fatalf("parsing spec: %v", err)
+	}
+
+	row, err := DecodeRow([]byte(`{"order_id": "a", "quantity": 2, "price": 19.99, "ts": "2024-01-02T03:04:05Z"}`))
+	if err != nil {
+		t.Fatalf("decoding row: %v", err)
+	}
+
+	out, _, err := s.Apply(row)
+	if err != nil {
+		t.Fatalf("applying spec: %v", err)
+	}
+
+	if act := out["price"]; act != int64(1999) {
+		t.Errorf("expected spec to give 1999, got %v", act)
+	}
+
+	// What the ETL service computes.
+	price := 19.99
+	if act := int64(price * 100); act != 1998 {
+		t.Errorf("expected float arithmetic to give 1998, got %d", act)
+	}
+}
@@ -0,0 +1,153 @@
+// Package transform applies declarative mappings to changefeed rows, so
+// ETL pipelines can be described in YAML or JSON rather than code. The
+// same Spec generates the CDC query that performs the mapping inside
+// CockroachDB, making it easy to move a transformation out of a service
+// and into the changefeed itself.
+package transform
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Spec maps the rows of a table to output records.
+//
+// With Fields, the output has exactly those fields. Without them, it has
+// every column of the row except those in Drop. Rows that don't satisfy
+// every predicate in Where are filtered out.
+type Spec struct {
+	// Table is the source table, used when generating a CDC query.
+	Table string `yaml:"table"`
+	// Key is the source column used as each output record's key.
+	Key    string      `yaml:"key"`
+	Fields []Field     `yaml:"fields"`
+	Drop   []string    `yaml:"drop"`
+	Where  []Predicate `yaml:"where"`
+}
+
+// Field is a single output field. Its value is read from the From column
+// (or Name if From is empty) and then, in order, multiplied, added to,
+// rounded, cast and formatted.
+type Field struct {
+	Name string `yaml:"name"`
+	From string `yaml:"from"`
+
+	// Multiply and Add apply exact decimal arithmetic to numeric values,
+	// as SQL does to DECIMAL columns, rather than float arithmetic.
+	Multiply *float64 `yaml:"multiply"`
+	Add      *float64 `yaml:"add"`
+	// Round rounds numeric values half away from zero to this many
+	// decimal places.
+	Round *int `yaml:"round"`
+	// Cast converts the value to int (truncating), float, string or bool.
+	Cast string `yaml:"cast"`
+	// Format formats a timestamp as epoch, epoch_ms, rfc3339 or date.
+	// Timestamps without an offset are read as UTC.
+	Format string `yaml:"format"`
+}
+
+// Predicate compares a source column with a value. Op is one of eq, ne,
+// gt, gte, lt, lte, in (with a list of values), is_null or not_null.
+type Predicate struct {
+	Field string `yaml:"field"`
+	Op    string `yaml:"op"`
+	Value any    `yaml:"value"`
+}
+
+const (
+	CastInt    = "int"
+	CastFloat  = "float"
+	CastString = "string"
+	CastBool   = "bool"
+
+	FormatEpoch   = "epoch"
+	FormatEpochMS = "epoch_ms"
+	FormatRFC3339 = "rfc3339"
+	FormatDate    = "date"
+)
+
+// Load reads a Spec from a YAML or JSON file.
+func Load(path string) (*Spec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading spec: %w", err)
+	}
+
+	return Parse(b)
+}
+
+// Parse reads a Spec from YAML or JSON.
+func Parse(b []byte) (*Spec, error) {
+	var s Spec
+	if err := yaml.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("parsing spec: %w", err)
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// Validate checks that the Spec can be applied.
+func (s *Spec) Validate() error {
+	if len(s.Fields) > 0 && len(s.Drop) > 0 {
+		return fmt.Errorf("spec can't have both fields and drop: fields already lists every output field")
+	}
+
+	names := map[string]bool{}
+	for _, f := range s.Fields {
+		if f.Name == "" {
+			return fmt.Errorf("field has no name")
+		}
+		if names[f.Name] {
+			return fmt.Errorf("field %q is listed twice", f.Name)
+		}
+		names[f.Name] = true
+
+		switch f.Cast {
+		case "", CastInt, CastFloat, CastString, CastBool:
+		default:
+			return fmt.Errorf("field %q: unknown cast %q", f.Name, f.Cast)
+		}
+
+		switch f.Format {
+		case "", FormatEpoch, FormatEpochMS, FormatRFC3339, FormatDate:
+		default:
+			return fmt.Errorf("field %q: unknown format %q", f.Name, f.Format)
+		}
+
+		if f.Format != "" && (f.Multiply != nil || f.Add != nil || f.Round != nil || f.Cast != "") {
+			return fmt.Errorf("field %q: format can't be combined with arithmetic or casts", f.Name)
+		}
+	}
+
+	for _, p := range s.Where {
+		if p.Field == "" {
+			return fmt.Errorf("predicate has no field")
+		}
+
+		switch p.Op {
+		case "eq", "ne", "gt", "gte", "lt", "lte", "is_null", "not_null":
+		case "in":
+			if _, ok := p.Value.([]any); !ok {
+				return fmt.Errorf("predicate on %q: in needs a list of values", p.Field)
+			}
+		default:
+			return fmt.Errorf("predicate on %q: unknown op %q", p.Field, p.Op)
+		}
+	}
+
+	return nil
+}
+
+func (f Field) source() string {
+	if f.From != "" {
+		return f.From
+	}
+
+	return f.Name
+}
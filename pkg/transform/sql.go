@@ -0,0 +1,167 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query returns the CDC query that performs the Spec's mapping inside
+// CockroachDB. Numeric arithmetic must be on INT or DECIMAL columns for
+// rounding to match Apply.
+func (s *Spec) Query() (string, error) {
+	if s.Table == "" {
+		return "", fmt.Errorf("spec has no table")
+	}
+	if len(s.Fields) == 0 && len(s.Drop) > 0 {
+		return "", fmt.Errorf("generating a query that drops columns needs fields listing the columns to keep")
+	}
+
+	var b strings.Builder
+	b.WriteString("SELECT")
+
+	if len(s.Fields) == 0 {
+		b.WriteString(" *")
+	}
+	for i, f := range s.Fields {
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		expr := f.expr()
+		if expr == ident(f.Name) {
+			fmt.Fprintf(&b, "\n  %s", expr)
+		} else {
+			fmt.Fprintf(&b, "\n  %s AS %s", expr, ident(f.Name))
+		}
+	}
+
+	fmt.Fprintf(&b, "\nFROM %s", ident(s.Table))
+
+	for i, p := range s.Where {
+		cond, err := p.expr()
+		if err != nil {
+			return "", fmt.Errorf("predicate on %q: %w", p.Field, err)
+		}
+
+		if i == 0 {
+			fmt.Fprintf(&b, "\nWHERE %s", cond)
+		} else {
+			fmt.Fprintf(&b, "\n  AND %s", cond)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// CreateChangefeed returns a CREATE CHANGEFEED statement publishing the
+// Spec's mapping to sink, with the given options such as "resolved = '1s'".
+func (s *Spec) CreateChangefeed(sink string, options ...string) (string, error) {
+	q, err := s.Query()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE CHANGEFEED INTO %s", literal(sink))
+	if len(options) > 0 {
+		b.WriteString("\nWITH\n  ")
+		b.WriteString(strings.Join(options, ",\n  "))
+	}
+	fmt.Fprintf(&b, "\nAS %s;", q)
+
+	return b.String(), nil
+}
+
+func (f Field) expr() string {
+	expr := ident(f.source())
+
+	switch f.Format {
+	case FormatEpoch:
+		return expr + "::INT"
+	case FormatEpochMS:
+		return fmt.Sprintf("floor(extract(epoch FROM %s) * 1000)::INT", expr)
+	case FormatRFC3339:
+		return fmt.Sprintf("experimental_strftime(%s, '%%Y-%%m-%%dT%%H:%%M:%%SZ')", expr)
+	case FormatDate:
+		return fmt.Sprintf("experimental_strftime(%s, '%%Y-%%m-%%d')", expr)
+	}
+
+	if f.Multiply != nil {
+		expr = fmt.Sprintf("(%s * %s)", expr, strconv.FormatFloat(*f.Multiply, 'f', -1, 64))
+	}
+	if f.Add != nil {
+		expr = fmt.Sprintf("(%s + %s)", expr, strconv.FormatFloat(*f.Add, 'f', -1, 64))
+	}
+	if f.Round != nil {
+		expr = fmt.Sprintf("round(%s, %d)", expr, *f.Round)
+	}
+
+	switch f.Cast {
+	case CastInt:
+		// ::INT rounds, where Apply truncates.
+		expr = fmt.Sprintf("trunc(%s)::INT", expr)
+	case CastFloat:
+		expr += "::FLOAT"
+	case CastString:
+		expr += "::STRING"
+	case CastBool:
+		expr += "::BOOL"
+	}
+
+	return expr
+}
+
+func (p Predicate) expr() (string, error) {
+	field := ident(p.Field)
+
+	switch p.Op {
+	case "is_null":
+		return field + " IS NULL", nil
+	case "not_null":
+		return field + " IS NOT NULL", nil
+	case "in":
+		var values []string
+		for _, v := range p.Value.([]any) {
+			l, err := valueLiteral(v)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, l)
+		}
+		return fmt.Sprintf("%s IN (%s)", field, strings.Join(values, ", ")), nil
+	}
+
+	v, err := valueLiteral(p.Value)
+	if err != nil {
+		return "", err
+	}
+
+	op := map[string]string{"eq": "=", "ne": "!=", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[p.Op]
+	return fmt.Sprintf("%s %s %s", field, op, v), nil
+}
+
+func valueLiteral(v any) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return literal(t), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int:
+		return strconv.Itoa(t), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func ident(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func literal(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,56 @@
+package transform
+
+import (
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	hundred := 100.0
+
+	s := Spec{
+		Table: "order_line_item",
+		Fields: []Field{
+			{Name: "quantity"},
+			{Name: "price", Multiply: &hundred, Cast: CastInt},
+			{Name: "ts", Format: FormatEpoch},
+		},
+		Where: []Predicate{
+			{Field: "quantity", Op: "gt", Value: 0},
+		},
+	}
+
+	act, err := s.Query()
+	if err != nil {
+		t.Fatalf("generating query: %v", err)
+	}
+
+	// trunc matches Apply's truncation of the exact decimal, so a price of
+	// 19.99 gives 1999 in both.
+	exp := `SELECT
+  "quantity",
+  trunc(("price" * 100))::INT AS "price",
+  "ts"::INT AS "ts"
+FROM "order_line_item"
+WHERE "quantity" > 0`
+	if act != exp {
+		t.Errorf("expected query:\n%s\ngot:\n%s", exp, act)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		spec Spec
+	}{
+		{name: "no table", spec: Spec{Fields: []Field{{Name: "a"}}}},
+		{name: "drop without fields", spec: Spec{Table: "t", Drop: []string{"a"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.spec.Query(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
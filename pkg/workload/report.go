@@ -0,0 +1,111 @@
+package workload
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Report is the machine-readable summary of a run, combining the
+// workload's Result with whatever the scenario checked afterwards.
+type Report struct {
+	Scenario string  `json:"scenario"`
+	Products int     `json:"products"`
+	Writers  int     `json:"writers"`
+	Skew     float64 `json:"skew"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+	Writes          uint64  `json:"writes"`
+	Errors          uint64  `json:"errors"`
+	WritesPerSecond float64 `json:"writes_per_second"`
+
+	Latency     LatencyReport  `json:"latency_ms"`
+	HotProducts []ProductCount `json:"hot_products"`
+
+	// Mismatches is the number of products whose consumers disagreed with
+	// the database once the run had settled.
+	Mismatches int  `json:"mismatches"`
+	Coherent   bool `json:"coherent"`
+
+	Extra map[string]any `json:"extra,omitempty"`
+}
+
+// LatencyReport holds write latency percentiles in milliseconds.
+type LatencyReport struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// ProductCount is the number of writes made to a product.
+type ProductCount struct {
+	ProductID string `json:"product_id"`
+	Writes    uint64 `json:"writes"`
+}
+
+// NewReport returns a Report for a run of scenario, listing the five most
+// written products and how many products had mismatched by the end.
+func NewReport(scenario string, c Config, r Result, mismatches int) Report {
+	ids := ProductIDs(c.Products)
+
+	hot := make([]ProductCount, len(ids))
+	for i, id := range ids {
+		hot[i] = ProductCount{ProductID: id, Writes: r.PerProduct[i]}
+	}
+	sort.SliceStable(hot, func(i, j int) bool {
+		return hot[i].Writes > hot[j].Writes
+	})
+	if len(hot) > 5 {
+		hot = hot[:5]
+	}
+
+	return Report{
+		Scenario:        scenario,
+		Products:        c.Products,
+		Writers:         c.Writers,
+		Skew:            c.Skew,
+		DurationSeconds: r.Elapsed.Seconds(),
+		Writes:          r.Writes,
+		Errors:          r.Errors,
+		WritesPerSecond: float64(r.Writes) / r.Elapsed.Seconds(),
+		Latency: LatencyReport{
+			Mean: millis(r.Latency.Mean),
+			P50:  millis(r.Latency.P50),
+			P95:  millis(r.Latency.P95),
+			P99:  millis(r.Latency.P99),
+			Max:  millis(r.Latency.Max),
+		},
+		HotProducts: hot,
+		Mismatches:  mismatches,
+		Coherent:    mismatches == 0,
+	}
+}
+
+// Write writes the report as JSON to path, or to stdout if path is "-"
+// or empty.
+func (r Report) Write(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling report: %w", err)
+	}
+	b = append(b, '\n')
+
+	if path == "" || path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	if err = os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+
+	return nil
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,194 @@
+// Package workload drives scenario writes across many keys from many
+// concurrent writers, so scenarios can be run under contention and hot
+// keys rather than against a single row.
+package workload
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/stats"
+	"github.com/google/uuid"
+)
+
+// Config describes the shape of a workload.
+type Config struct {
+	// Products is the number of distinct keys written to.
+	Products int
+	// Writers is the number of goroutines writing concurrently.
+	Writers int
+	// Skew is the Zipf exponent used to pick keys. Values of 1 or less
+	// pick keys uniformly; higher values concentrate writes on fewer keys.
+	Skew float64
+	// Interval is the delay between each writer's writes. With 0, writers
+	// write as fast as they can.
+	Interval time.Duration
+	// Duration bounds the run. With 0, it runs until cancelled.
+	Duration time.Duration
+	// Settle is how long to wait after the last write before reporting,
+	// giving consumers time to catch up.
+	Settle time.Duration
+	// Report is the file the JSON report is written to, or "-" for stdout.
+	Report string
+}
+
+// Flags registers the workload flags on fs, returning the Config they
+// populate once fs is parsed.
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.IntVar(&c.Products, "products", 1, "number of products to write to")
+	fs.IntVar(&c.Writers, "writers", 1, "number of concurrent writers")
+	fs.Float64Var(&c.Skew, "skew", 0, "zipf exponent for picking products (uniform if 1 or less)")
+	fs.DurationVar(&c.Duration, "duration", 0, "how long to run for (forever if 0)")
+	fs.DurationVar(&c.Settle, "settle", time.Second*5, "time to let consumers catch up before reporting")
+	fs.StringVar(&c.Report, "report", "-", "file to write the JSON report to (- for stdout)")
+
+	return c
+}
+
+// Validate checks that the Config describes a runnable workload.
+func (c Config) Validate() error {
+	if c.Products < 1 {
+		return fmt.Errorf("products must be at least 1, got %d", c.Products)
+	}
+	if c.Writers < 1 {
+		return fmt.Errorf("writers must be at least 1, got %d", c.Writers)
+	}
+	if c.Skew < 0 {
+		return fmt.Errorf("skew must not be negative, got %g", c.Skew)
+	}
+
+	return nil
+}
+
+// ProductIDs returns n product ids. The same n always gives the same ids,
+// so separate binaries agree on them.
+func ProductIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("product-%d", i))).String()
+	}
+
+	return ids
+}
+
+// Picker picks product indexes, either uniformly or with a Zipf skew
+// towards the lowest indexes. It isn't safe for concurrent use.
+type Picker struct {
+	rand *rand.Rand
+	zipf *rand.Zipf
+	n    int
+}
+
+// NewPicker returns a Picker over n products.
+func NewPicker(n int, skew float64, seed int64) *Picker {
+	r := rand.New(rand.NewSource(seed))
+	p := &Picker{rand: r, n: n}
+	if skew > 1 && n > 1 {
+		p.zipf = rand.NewZipf(r, skew, 1, uint64(n-1))
+	}
+
+	return p
+}
+
+// Pick returns the index of the next product to write to.
+func (p *Picker) Pick() int {
+	if p.zipf != nil {
+		return int(p.zipf.Uint64())
+	}
+
+	return p.rand.Intn(p.n)
+}
+
+// WriteFunc performs a single write to a product.
+type WriteFunc func(ctx context.Context, productID string) error
+
+// Result summarises the writes made by Run.
+type Result struct {
+	Writes  uint64
+	Errors  uint64
+	Elapsed time.Duration
+	Latency stats.Snapshot
+
+	// PerProduct counts successful writes to each product, indexed like
+	// ProductIDs.
+	PerProduct []uint64
+}
+
+// Run calls write from c.Writers goroutines, each picking a product per
+// write, until c.Duration has passed or ctx is cancelled. Failed writes
+// are passed to onError, if set, and counted.
+//
+// Writes are given ctx rather than one that expires with c.Duration, so
+// the run ending doesn't interrupt a write halfway through.
+func Run(ctx context.Context, c Config, write WriteFunc, onError func(error)) Result {
+	run := ctx
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		run, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+
+	ids := ProductIDs(c.Products)
+	latency := stats.NewHistogram(10000)
+	perProduct := make([]atomic.Uint64, c.Products)
+	var writes, failures atomic.Uint64
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < c.Writers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			picker := NewPicker(c.Products, c.Skew, seed)
+			for {
+				if c.Interval > 0 {
+					select {
+					case <-run.Done():
+						return
+					case <-time.After(c.Interval):
+					}
+				} else if run.Err() != nil {
+					return
+				}
+
+				i := picker.Pick()
+				writeStart := time.Now()
+				if err := write(ctx, ids[i]); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					failures.Add(1)
+					if onError != nil {
+						onError(err)
+					}
+					continue
+				}
+
+				latency.Record(time.Since(writeStart))
+				writes.Add(1)
+				perProduct[i].Add(1)
+			}
+		}(start.UnixNano() + int64(w))
+	}
+	wg.Wait()
+
+	r := Result{
+		Writes:     writes.Load(),
+		Errors:     failures.Load(),
+		Elapsed:    time.Since(start),
+		Latency:    latency.Snapshot(),
+		PerProduct: make([]uint64, c.Products),
+	}
+	for i := range perProduct {
+		r.PerProduct[i] = perProduct[i].Load()
+	}
+
+	return r
+}
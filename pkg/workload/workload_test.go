@@ -0,0 +1,137 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPickerUniform(t *testing.T) {
+	const products, picks = 10, 100000
+
+	for _, skew := range []float64{0, 1} {
+		counts := pickCounts(NewPicker(products, skew, 1), products, picks)
+
+		for i, n := range counts {
+			// Each product should get roughly a tenth of the picks.
+			if n < picks/products*8/10 || n > picks/products*12/10 {
+				t.Errorf("skew %g: expected product %d to be picked about %d times, got %d", skew, i, picks/products, n)
+			}
+		}
+	}
+}
+
+func TestPickerZipf(t *testing.T) {
+	const products, picks = 100, 100000
+
+	counts := pickCounts(NewPicker(products, 2, 1), products, picks)
+
+	// With an exponent of 2 and v of 1, index 0 has 1/(1+0)^2 of the
+	// weight and index 1 has 1/(1+1)^2, a quarter as much.
+	if counts[0] < picks/2 {
+		t.Errorf("expected the first product to get most picks, got %d of %d", counts[0], picks)
+	}
+	if ratio := float64(counts[0]) / float64(counts[1]); ratio < 3 || ratio > 5 {
+		t.Errorf("expected the first product to be picked about 4 times as often as the second, got %.2f", ratio)
+	}
+	for i := 1; i < 10; i++ {
+		if counts[i] > counts[i-1] {
+			t.Errorf("expected picks to fall off with index, product %d got %d and product %d got %d", i-1, counts[i-1], i, counts[i])
+		}
+	}
+}
+
+func TestPickerSingleProduct(t *testing.T) {
+	p := NewPicker(1, 2, 1)
+	for i := 0; i < 100; i++ {
+		if act := p.Pick(); act != 0 {
+			t.Fatalf("expected the only product, got %d", act)
+		}
+	}
+}
+
+func TestPickerIsDeterministic(t *testing.T) {
+	a, b := NewPicker(50, 1.5, 42), NewPicker(50, 1.5, 42)
+	for i := 0; i < 1000; i++ {
+		if x, y := a.Pick(), b.Pick(); x != y {
+			t.Fatalf("expected pickers with the same seed to agree, pick %d was %d and %d", i, x, y)
+		}
+	}
+}
+
+func TestProductIDs(t *testing.T) {
+	a, b := ProductIDs(5), ProductIDs(10)
+
+	seen := map[string]bool{}
+	for i, id := range a {
+		if b[i] != id {
+			t.Errorf("expected product %d to have the same id, got %s and %s", i, id, b[i])
+		}
+		if seen[id] {
+			t.Errorf("duplicate product id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		c    Config
+		ok   bool
+	}{
+		{name: "valid", c: Config{Products: 1, Writers: 1, Skew: 1.2}, ok: true},
+		{name: "no products", c: Config{Products: 0, Writers: 1}},
+		{name: "no writers", c: Config{Products: 1, Writers: 0}},
+		{name: "negative skew", c: Config{Products: 1, Writers: 1, Skew: -1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.c.Validate(); (err == nil) != c.ok {
+				t.Errorf("expected ok %v, got %v", c.ok, err)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := Config{Products: 3, Writers: 4, Interval: time.Millisecond, Duration: 50 * time.Millisecond}
+
+	var errs atomic.Uint64
+	r := Run(context.Background(), c, func(ctx context.Context, productID string) error {
+		if productID == ProductIDs(3)[2] {
+			return errors.New("simulated failure")
+		}
+		return nil
+	}, func(error) { errs.Add(1) })
+
+	if r.Writes == 0 {
+		t.Fatal("expected some writes")
+	}
+
+	var total uint64
+	for _, n := range r.PerProduct {
+		total += n
+	}
+	if total != r.Writes {
+		t.Errorf("expected per-product writes to add up to %d, got %d", r.Writes, total)
+	}
+	if r.PerProduct[2] != 0 {
+		t.Errorf("expected no successful writes to the failing product, got %d", r.PerProduct[2])
+	}
+	if r.Errors == 0 || r.Errors != errs.Load() {
+		t.Errorf("expected every error to be counted and reported, got %d counted and %d reported", r.Errors, errs.Load())
+	}
+}
+
+func pickCounts(p *Picker, products, picks int) []int {
+	counts := make([]int, products)
+	for i := 0; i < picks; i++ {
+		counts[p.Pick()]++
+	}
+
+	return counts
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/schemaregistry"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	addr := flag.String("addr", ":8081", "address to serve the registry on")
+	compatibility := flag.String("compatibility", string(schemaregistry.CompatibilityBackward), "compatibility check on registration: BACKWARD or NONE")
+	flag.Parse()
+
+	server := schemaregistry.NewServer(schemaregistry.WithCompatibility(schemaregistry.Compatibility(*compatibility)))
+
+	log.Printf("serving in-memory schema registry on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
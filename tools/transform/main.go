@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/architectural-simplification/pkg/transform"
+)
+
+type options []string
+
+func (o *options) String() string {
+	return strings.Join(*o, ", ")
+}
+
+func (o *options) Set(v string) error {
+	*o = append(*o, v)
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var with options
+	specPath := flag.String("spec", "", "path to the transform spec")
+	sink := flag.String("sink", "kafka://localhost:9092?topic_name=transformed", "changefeed sink uri")
+	apply := flag.Bool("apply", false, "transform JSON rows from stdin (one per line) instead of printing a changefeed")
+	flag.Var(&with, "with", "changefeed option, e.g. \"resolved = '1s'\" (repeatable)")
+	flag.Parse()
+
+	if *specPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	spec, err := transform.Load(*specPath)
+	if err != nil {
+		log.Fatalf("error loading spec: %v", err)
+	}
+
+	if *apply {
+		if err = applyRows(spec); err != nil {
+			log.Fatalf("error applying spec: %v", err)
+		}
+		return
+	}
+
+	stmt, err := spec.CreateChangefeed(*sink, with...)
+	if err != nil {
+		log.Fatalf("error generating changefeed: %v", err)
+	}
+	fmt.Println(stmt)
+}
+
+func applyRows(spec *transform.Spec) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		row, err := transform.DecodeRow(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+
+		out, ok, err := spec.Apply(row)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err = encoder.Encode(out); err != nil {
+			return fmt.Errorf("writing row: %w", err)
+		}
+	}
+
+	return scanner.Err()
+}